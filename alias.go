@@ -0,0 +1,71 @@
+package qbin
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+)
+
+// NumericAliases defines if documents get a short numeric alias in addition to their name.
+// Note that numeric aliases are easy to enumerate, so every document with an alias can be found by anyone.
+// Enabling it for an existing database adds the alias column on the next start, which rebuilds the documents table.
+var NumericAliases = false
+
+// ErrNoAlias is returned by ResolveAlias if no document has the given alias.
+var ErrNoAlias = errors.New("the alias doesn't exist")
+
+// storeAlias saves the document ID for the numeric alias the database assigned to a freshly inserted document, in the
+// transaction of the insert, so no document is left without its alias if this fails.
+// The ID is encrypted with a key derived from the alias, so it can only be read by someone who knows the alias.
+func storeAlias(ctx context.Context, tx *sql.Tx, document *Document, databaseID string, result sql.Result) error {
+	alias, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	key, err := documentKey(document.Encryption, document.KeyVersion, strconv.FormatInt(alias, 10), document.Upload)
+	if err != nil {
+		return err
+	}
+	target, err := encrypt([]byte(document.ID), key)
+	if err != nil {
+		Log.Errorf("AES error: %s", err)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE documents SET alias_target = ? WHERE id = ?", string(target), databaseID)
+	if err != nil {
+		return timeoutError(err)
+	}
+	document.Alias = alias
+	return nil
+}
+
+// ResolveAlias returns the ID of the document with the given numeric alias.
+func ResolveAlias(alias int64) (string, error) {
+	var target, upload sql.NullString
+	var encryption, version int
+	err := readRow("SELECT alias_target, upload, encryption, key_version FROM documents WHERE alias = ?", []interface{}{alias}, &target, &upload, &encryption, &version)
+	if err == sql.ErrNoRows || (err == nil && !target.Valid) {
+		return "", ErrNoAlias
+	} else if err != nil {
+		return "", err
+	}
+
+	uploadTime, err := parseUpload(upload)
+	if err != nil {
+		return "", err
+	}
+	key, err := documentKey(encryption, version, strconv.FormatInt(alias, 10), uploadTime)
+	if err != nil {
+		return "", err
+	}
+	id, err := decrypt([]byte(target.String), key)
+	if err != nil {
+		Log.Errorf("AES error: %s", err)
+		countDecryptionFailure()
+		return "", err
+	}
+	return string(id), nil
+}
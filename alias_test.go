@@ -0,0 +1,76 @@
+package qbin
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNumericAlias(t *testing.T) {
+	var upload, target driver.Value
+	f := useFakeDB("alias", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		if strings.HasPrefix(query, "INSERT INTO documents") {
+			upload = args[4].Value
+			return &fakeRows{affected: 1, insertID: 42}, nil
+		} else if strings.HasPrefix(query, "UPDATE documents SET alias_target") {
+			target = args[0].Value
+			return &fakeRows{affected: 1}, nil
+		} else if strings.HasPrefix(query, "SELECT alias_target, upload, encryption, key_version FROM documents WHERE alias = ?") && args[0].Value == int64(42) {
+			return &fakeRows{columns: []string{"alias_target", "upload", "encryption", "key_version"}, values: [][]driver.Value{{target, upload, int64(EncryptionScrypt), int64(0)}}}, nil
+		} else if strings.HasPrefix(query, "SELECT alias_target") {
+			return &fakeRows{columns: []string{"alias_target", "upload", "encryption", "key_version"}}, nil
+		}
+		return nil, nil
+	})
+	NumericAliases = true
+	defer func() { NumericAliases = false }()
+
+	doc := Document{Content: "Hello World"}
+	err := Store(&doc)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if doc.Alias != 42 {
+		t.Errorf("Alias mismatch, received: %d (expected: 42)", doc.Alias)
+	}
+	if transactions := f.Transactions(); len(transactions) != 1 || transactions[0] != "commit" {
+		t.Errorf("Document and alias weren't stored in a transaction: %v", transactions)
+	}
+
+	id, err := ResolveAlias(42)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if id != doc.ID {
+		t.Errorf("Alias resolves to %s (expected: %s)", id, doc.ID)
+	}
+
+	if _, err := ResolveAlias(43); err != ErrNoAlias {
+		t.Errorf("Unknown alias should return ErrNoAlias, got: %v", err)
+	}
+}
+
+func TestNumericAliasFailure(t *testing.T) {
+	f := useFakeDB("alias-failure", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		if strings.HasPrefix(query, "INSERT INTO documents") {
+			return &fakeRows{affected: 1, insertID: 42}, nil
+		} else if strings.HasPrefix(query, "UPDATE documents SET alias_target") {
+			return nil, errors.New("connection lost")
+		}
+		return nil, nil
+	})
+	NumericAliases = true
+	defer func() { NumericAliases = false }()
+
+	doc := Document{Content: "Hello World"}
+	if err := Store(&doc); err == nil || doc.Alias != 0 {
+		t.Fatalf("Document without alias was stored (alias: %d, error: %v)", doc.Alias, err)
+	}
+	// The inserted document must not stay without its alias
+	if transactions := f.Transactions(); len(transactions) != 1 || transactions[0] != "rollback" {
+		t.Errorf("The insert wasn't rolled back: %v", transactions)
+	}
+}
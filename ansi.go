@@ -0,0 +1,107 @@
+package qbin
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// StripANSI removes ANSI escape sequences (e.g. colors in logs copied from a terminal) from new documents, unless their
+// syntax is "ansi".
+var StripANSI = false
+
+// ansiEscapes matches CSI sequences (colors, cursor movement), OSC sequences (titles, hyperlinks) and other escapes
+// (e.g. character set selection).
+var ansiEscapes = regexp.MustCompile("\x1b(?:\\[[0-?]*[ -/]*[@-~]|\\][^\x07\x1b]*(?:\x07|\x1b\\\\)|[ -/]*[0-~])")
+
+// stripANSI removes all ANSI escape sequences from the content.
+func stripANSI(content string) string {
+	if !strings.Contains(content, "\x1b") {
+		return content
+	}
+	return ansiEscapes.ReplaceAllString(content, "")
+}
+
+// ansiColors maps Prism.js token types to ANSI SGR color codes.
+var ansiColors = map[string]string{
+	"comment": "90", "prolog": "90", "doctype": "90", "cdata": "90",
+	"keyword": "35", "atrule": "35", "important": "35",
+	"string": "32", "char": "32", "attr-value": "32", "regex": "32", "template-string": "32", "inserted": "32",
+	"number": "33", "boolean": "33", "constant": "33", "symbol": "33",
+	"function": "34", "class-name": "34",
+	"builtin": "36", "tag": "36", "selector": "36", "namespace": "36",
+	"property": "31", "attr-name": "31", "variable": "31", "deleted": "31",
+}
+
+// ANSI converts a document highlighted by Highlight() to text with ANSI color codes for terminals.
+// Markup that isn't a Prism.js token (e.g. rendered Markdown) is stripped like by StripHTML.
+func ANSI(highlighted string) string {
+	result := strings.Builder{}
+	colors := []string{} // One entry per open span, "" if it doesn't change the color
+	current := func() string {
+		for i := len(colors) - 1; i >= 0; i-- {
+			if colors[i] != "" {
+				return colors[i]
+			}
+		}
+		return ""
+	}
+
+	for len(highlighted) > 0 {
+		start := strings.IndexByte(highlighted, '<')
+		if start < 0 {
+			result.WriteString(html.UnescapeString(highlighted))
+			break
+		}
+		end := strings.IndexByte(highlighted[start:], '>')
+		if end < 0 {
+			result.WriteString(html.UnescapeString(highlighted))
+			break
+		}
+		result.WriteString(html.UnescapeString(highlighted[:start]))
+		tag := highlighted[start+1 : start+end]
+		highlighted = highlighted[start+end+1:]
+
+		if strings.HasPrefix(tag, "/span") {
+			if len(colors) == 0 {
+				continue
+			}
+			previous := current()
+			colors = colors[:len(colors)-1]
+			if color := current(); color != previous {
+				result.WriteString("\x1b[0m")
+				if color != "" {
+					result.WriteString("\x1b[" + color + "m")
+				}
+			}
+		} else if strings.HasPrefix(tag, "span") {
+			color := tokenColor(tag)
+			if color != "" && color != current() {
+				result.WriteString("\x1b[" + color + "m")
+			}
+			colors = append(colors, color)
+		}
+	}
+	if current() != "" {
+		result.WriteString("\x1b[0m")
+	}
+	return result.String()
+}
+
+// tokenColor returns the ANSI color of a span tag like `span class="token keyword"`.
+func tokenColor(tag string) string {
+	start := strings.Index(tag, `class="`)
+	if start < 0 {
+		return ""
+	}
+	classes := strings.Fields(strings.SplitN(tag[start+7:], `"`, 2)[0])
+	if len(classes) < 2 || classes[0] != "token" {
+		return ""
+	}
+	for _, class := range classes[1:] {
+		if color, ok := ansiColors[class]; ok {
+			return color
+		}
+	}
+	return ""
+}
@@ -0,0 +1,53 @@
+package qbin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestANSI(t *testing.T) {
+	// Output of prism-server for a Go snippet, with the line numbers added by Highlight()
+	ln := `<span class="line-number"></span>`
+	highlighted := ln + `<span class="token keyword">package</span> main` + "\n" + ln + "\n" +
+		ln + `<span class="token keyword">func</span> <span class="token function">main</span><span class="token punctuation">(</span><span class="token punctuation">)</span> <span class="token punctuation">{</span>` + "\n" +
+		ln + "\tfmt<span class=\"token punctuation\">.</span><span class=\"token function\">Println</span><span class=\"token punctuation\">(</span><span class=\"token string\">\"Hello, &lt;World&gt; &amp; <span class=\"token unknown\">you</span>\"</span><span class=\"token punctuation\">)</span> <span class=\"token comment\">// greet</span>\n" +
+		ln + `<span class="token punctuation">}</span>`
+
+	result := ANSI(highlighted)
+	expected := "\x1b[35mpackage\x1b[0m main\n\n" +
+		"\x1b[35mfunc\x1b[0m \x1b[34mmain\x1b[0m() {\n" +
+		"\tfmt.\x1b[34mPrintln\x1b[0m(\x1b[32m\"Hello, <World> & you\"\x1b[0m) \x1b[90m// greet\x1b[0m\n" +
+		"}"
+	if result != expected {
+		t.Errorf("Wrong ANSI output:\n%q\nexpected:\n%q", result, expected)
+	}
+	if StripHTML(highlighted) != strings.NewReplacer("\x1b[0m", "", "\x1b[32m", "", "\x1b[34m", "", "\x1b[35m", "", "\x1b[90m", "").Replace(result) {
+		t.Errorf("Text differs from the stripped document: %q", result)
+	}
+
+	// Nested tokens restore the outer color
+	if result := ANSI(`<span class="token string">"a<span class="token keyword">b</span>c"</span>`); result != "\x1b[32m\"a\x1b[35mb\x1b[0m\x1b[32mc\"\x1b[0m" {
+		t.Errorf("Wrong output for nested tokens: %q", result)
+	}
+}
+
+func TestStripANSI(t *testing.T) {
+	defer func() { StripANSI = false }()
+	StripANSI = true
+	storedDocumentsDB("strip-ansi")
+
+	log := "\x1b[1;31mERROR\x1b[0m build failed\n\x1b]0;make\x07\x1b[2K\x1b[32m  ok\x1b[39m tests passed\x1b(B\n"
+	for _, test := range []struct{ content, syntax, expected string }{
+		{log, "", "ERROR build failed\n  ok tests passed\n"},
+		{log, "ansi", log},
+		{"func main() {\n\tfmt.Println(\"[0m\")\n}\n", "go", "func main() {\n\tfmt.Println(\"[0m\")\n}\n"},
+	} {
+		doc := Document{Content: test.content, Syntax: test.syntax}
+		if err := Store(&doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc.Content != test.expected {
+			t.Errorf("Wrong content for syntax %q: %q, expected: %q", test.syntax, doc.Content, test.expected)
+		}
+	}
+}
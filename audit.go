@@ -0,0 +1,64 @@
+package qbin
+
+import (
+	"time"
+)
+
+// AuditLog defines if actions using the admin API are recorded in the audit table, for accountability on shared instances.
+var AuditLog = false
+
+// maxAuditEntries limits how many entries are returned by AuditEntries().
+const maxAuditEntries = 1000
+
+// AuditEntry describes an action using the admin API.
+type AuditEntry struct {
+	ID int64 `json:"id"`
+	// Admin identifies the admin token used for the action
+	Admin string `json:"admin"`
+	// Action describes what was done, e.g. "delete-fingerprint"
+	Action string `json:"action"`
+	// Target is the document (by its database ID), fingerprint or other object affected by the action, or empty
+	Target string    `json:"target"`
+	Time   time.Time `json:"time"`
+}
+
+// Audit records an admin action in the audit table. It does nothing if AuditLog is disabled.
+func Audit(admin string, action string, target string) error {
+	if !AuditLog {
+		return nil
+	}
+	ctx, cancel := queryContext()
+	defer cancel()
+	_, err := db.ExecContext(ctx, "INSERT INTO audit (admin, action, target) VALUES (?, ?, ?)", admin, action, target)
+	return timeoutError(err)
+}
+
+// AuditEntries returns the most recent entries of the audit log, newest first. If admin isn't empty, only the actions
+// of that admin are returned.
+func AuditEntries(admin string) ([]AuditEntry, error) {
+	ctx, cancel := queryContext()
+	defer cancel()
+	query := "SELECT id, admin, action, target, time FROM audit ORDER BY id DESC LIMIT ?"
+	args := []interface{}{maxAuditEntries}
+	if admin != "" {
+		query = "SELECT id, admin, action, target, time FROM audit WHERE admin = ? ORDER BY id DESC LIMIT ?"
+		args = []interface{}{admin, maxAuditEntries}
+	}
+	rows, err := readDB().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, timeoutError(err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var created string
+		if err := rows.Scan(&entry.ID, &entry.Admin, &entry.Action, &entry.Target, &created); err != nil {
+			return nil, err
+		}
+		entry.Time, _ = time.Parse("2006-01-02 15:04:05", created)
+		entries = append(entries, entry)
+	}
+	return entries, timeoutError(rows.Err())
+}
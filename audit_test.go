@@ -0,0 +1,62 @@
+package qbin
+
+import (
+	"database/sql/driver"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAudit(t *testing.T) {
+	defer func() { AuditLog = false }()
+	var mutex sync.Mutex
+	entries := [][]driver.Value{}
+	f := useFakeDB("audit", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if strings.HasPrefix(query, "INSERT INTO audit (admin, action, target)") {
+			entries = append([][]driver.Value{{int64(len(entries) + 1), args[0].Value, args[1].Value, args[2].Value, "2026-10-17 12:30:00"}}, entries...)
+			return &fakeRows{affected: 1}, nil
+		} else if strings.HasPrefix(query, "SELECT id, admin, action, target, time FROM audit") {
+			rows := &fakeRows{columns: []string{"id", "admin", "action", "target", "time"}}
+			for _, entry := range entries {
+				if len(args) == 1 || entry[1] == args[0].Value {
+					rows.values = append(rows.values, entry)
+				}
+			}
+			return rows, nil
+		}
+		return nil, nil
+	})
+
+	// Nothing is recorded without AuditLog
+	if err := Audit("token:a", "metrics", ""); err != nil || len(f.Queries()) != 0 {
+		t.Fatalf("Admin action was recorded without AuditLog: %v, %v", f.Queries(), err)
+	}
+
+	AuditLog = true
+	fingerprint := strings.Repeat("ab", 32)
+	for _, entry := range [][3]string{{"token:a", "delete-fingerprint", fingerprint}, {"token:b", "metrics", ""}} {
+		if err := Audit(entry[0], entry[1], entry[2]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := AuditEntries("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result[0].Action != "metrics" || result[1].Action != "delete-fingerprint" {
+		t.Fatalf("Audit log isn't ordered newest first: %+v", result)
+	}
+	expected := AuditEntry{ID: 1, Admin: "token:a", Action: "delete-fingerprint", Target: fingerprint, Time: time.Date(2026, 10, 17, 12, 30, 0, 0, time.UTC)}
+	if result[1] != expected {
+		t.Errorf("Unexpected audit entry: %+v", result[1])
+	}
+
+	result, err = AuditEntries("token:a")
+	if err != nil || len(result) != 1 || result[0].Admin != "token:a" {
+		t.Errorf("Audit log wasn't filtered by admin: %+v, %v", result, err)
+	}
+}
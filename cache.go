@@ -0,0 +1,96 @@
+package qbin
+
+import (
+	"sync"
+	"time"
+)
+
+// DecryptedCacheTTL is the maximum time decrypted content (highlighted HTML and snippets) is kept in memory.
+// Documents expiring earlier than that are never cached. 0 disables the caches.
+var DecryptedCacheTTL = 10 * time.Minute
+
+// documentCache keeps decrypted data of documents in memory, limited by size and age. It's keyed by the hashed document ID.
+type documentCache struct {
+	mutex   sync.Mutex
+	entries map[string]cacheEntry
+	bytes   int
+}
+
+type cacheEntry struct {
+	value   string
+	expires time.Time
+}
+
+// get returns a cached value, if it hasn't expired yet.
+func (c *documentCache) get(key string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expires) {
+		c.removeLocked(key)
+		return "", false
+	}
+	return entry.value, true
+}
+
+// put caches a value for DecryptedCacheTTL. Values of volatile documents and documents that expire within DecryptedCacheTTL
+// aren't cached at all. If the cache would exceed maxBytes, expired entries are removed, or the whole cache if that's not enough.
+func (c *documentCache) put(key string, value string, expiration time.Time, maxBytes int) {
+	if DecryptedCacheTTL <= 0 || maxBytes <= 0 || len(value) > maxBytes {
+		return
+	}
+	if DocumentState(expiration) != StateLive || ((expiration != time.Time{}) && time.Until(expiration) < DecryptedCacheTTL) {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.removeLocked(key)
+	if c.bytes+len(value) > maxBytes {
+		// Expired entries go first, and everything else if that's not enough
+		now := time.Now()
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				c.removeLocked(k)
+			}
+		}
+	}
+	if c.entries == nil || c.bytes+len(value) > maxBytes {
+		c.entries = map[string]cacheEntry{}
+		c.bytes = 0
+	}
+	c.entries[key] = cacheEntry{value, time.Now().Add(DecryptedCacheTTL)}
+	c.bytes += len(value)
+}
+
+// remove drops a cached value, e.g. because the document was changed.
+func (c *documentCache) remove(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *documentCache) removeLocked(key string) {
+	if entry, ok := c.entries[key]; ok {
+		c.bytes -= len(entry.value)
+		delete(c.entries, key)
+	}
+}
+
+// clear drops all cached values.
+func (c *documentCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = nil
+	c.bytes = 0
+}
+
+// invalidateCaches drops all cached data of a document after it was changed.
+func invalidateCaches(databaseID string) {
+	highlightCache.remove(databaseID)
+	snippetCache.remove(databaseID)
+	pdfCache.remove(databaseID)
+}
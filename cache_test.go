@@ -0,0 +1,76 @@
+package qbin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestDocumentCacheTTL(t *testing.T) {
+	defer func() { DecryptedCacheTTL = 10 * time.Minute }()
+	DecryptedCacheTTL = 50 * time.Millisecond
+	c := &documentCache{}
+
+	c.put("forever", "content", time.Time{}, 1024)
+	if value, ok := c.get("forever"); !ok || value != "content" {
+		t.Fatalf("Value wasn't cached: %q", value)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := c.get("forever"); ok {
+		t.Errorf("Value is still cached after the TTL")
+	}
+	if c.bytes != 0 {
+		t.Errorf("Evicted value is still counted: %d bytes", c.bytes)
+	}
+
+	// Documents expiring before the TTL ends, and volatile documents, are never cached
+	c.put("short", "content", time.Now().Add(10*time.Millisecond), 1024)
+	c.put("volatile", "content", time.Unix(0, 0), 1024)
+	c.put("long", "content", time.Now().Add(time.Hour), 1024)
+	if _, ok := c.get("short"); ok {
+		t.Errorf("Document expiring within the TTL was cached")
+	}
+	if _, ok := c.get("volatile"); ok {
+		t.Errorf("Volatile document was cached")
+	}
+	if _, ok := c.get("long"); !ok {
+		t.Errorf("Document expiring after the TTL wasn't cached")
+	}
+
+	// The size limit clears the cache
+	c.put("large", "0123456789", time.Time{}, 12)
+	if _, ok := c.get("long"); ok || c.bytes != 10 {
+		t.Errorf("Cache exceeds its size limit: %d bytes", c.bytes)
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	defer func() { OriginalOnly = false }()
+	OriginalOnly = true
+	storedDocumentsDB("cache-invalidation")
+
+	doc := Document{Content: "# Title\n\nSome text\n", Syntax: "markdown!"}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Metadata(doc.ID); err != nil {
+		t.Fatal(err)
+	}
+	databaseID := sha256.Sum256([]byte(doc.ID))
+	key := hex.EncodeToString(databaseID[:])
+	_, highlighted := highlightCache.get(key)
+	_, snippet := snippetCache.get(key)
+	if !highlighted || !snippet {
+		t.Fatalf("Document wasn't cached (highlighted: %t, snippet: %t)", highlighted, snippet)
+	}
+
+	if err := Rehighlight(doc.ID); err != nil {
+		t.Fatal(err)
+	}
+	_, highlighted = highlightCache.get(key)
+	_, snippet = snippetCache.get(key)
+	if highlighted || snippet {
+		t.Errorf("Cache wasn't invalidated after changing the document (highlighted: %t, snippet: %t)", highlighted, snippet)
+	}
+}
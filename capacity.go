@@ -0,0 +1,61 @@
+package qbin
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+// MaxDatabaseSize is the size in bytes (data and indexes of all qbin tables) at which Store() rejects new documents with
+// ErrInsufficientStorage, so a full disk results in a clean error instead of failing inserts. 0 disables the limit.
+var MaxDatabaseSize int64
+
+// ErrInsufficientStorage is returned by Store() if the database has reached MaxDatabaseSize.
+var ErrInsufficientStorage = errors.New("the database has reached its maximum size")
+
+// databaseSizeInterval is the time after which the database size is queried again.
+var databaseSizeInterval = time.Minute
+
+var databaseSize struct {
+	mutex   sync.Mutex
+	bytes   int64
+	checked time.Time
+}
+
+// checkCapacity returns ErrInsufficientStorage if the database has reached MaxDatabaseSize. The size is only queried once per
+// databaseSizeInterval; if that fails, the last known size is used.
+func checkCapacity() error {
+	if MaxDatabaseSize <= 0 {
+		return nil
+	}
+	databaseSize.mutex.Lock()
+	defer databaseSize.mutex.Unlock()
+	if time.Since(databaseSize.checked) >= databaseSizeInterval {
+		ctx, cancel := queryContext()
+		defer cancel()
+		var size int64
+		err := eachShard(func(handle *sql.DB) error {
+			var n int64
+			err := handle.QueryRowContext(ctx, "SELECT COALESCE(SUM(data_length + index_length), 0) FROM information_schema.tables WHERE table_schema = DATABASE()").Scan(&n)
+			if n > size {
+				// Shards are usually on separate servers, so the fullest one counts
+				size = n
+			}
+			return err
+		})
+		if err != nil {
+			Log.Warningf("Couldn't query the database size: %s", timeoutError(err))
+		} else {
+			databaseSize.bytes = size
+			if size >= MaxDatabaseSize {
+				Log.Warningf("The database size of %d bytes has reached the maximum of %d bytes, new documents are rejected", size, MaxDatabaseSize)
+			}
+		}
+		databaseSize.checked = time.Now()
+	}
+	if databaseSize.bytes >= MaxDatabaseSize {
+		return ErrInsufficientStorage
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package qbin
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckCapacity(t *testing.T) {
+	defer func() {
+		MaxDatabaseSize = 0
+		databaseSize.checked = time.Time{}
+	}()
+	size := int64(900)
+	sizeQueries := 0
+	useFakeDB("capacity", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		if strings.Contains(query, "information_schema.tables") {
+			sizeQueries++
+			return &fakeRows{columns: []string{"size"}, values: [][]driver.Value{{size}}}, nil
+		}
+		if strings.HasPrefix(query, "SELECT COUNT(") {
+			return &fakeRows{columns: []string{"count"}, values: [][]driver.Value{{int64(0)}}}, nil
+		}
+		return &fakeRows{affected: 1}, nil
+	})
+	MaxDatabaseSize = 1000
+	databaseSize.checked = time.Time{}
+
+	if err := Store(&Document{Content: "Hello World", Syntax: "none"}); err != nil {
+		t.Fatalf("Document was rejected below the maximum size: %s", err)
+	}
+
+	// The size is cached, so it only applies after databaseSizeInterval
+	size = 1000
+	if err := checkCapacity(); err != nil || sizeQueries != 1 {
+		t.Errorf("Database size wasn't cached (%d queries, error: %v)", sizeQueries, err)
+	}
+	databaseSize.checked = time.Now().Add(-databaseSizeInterval)
+	if err := Store(&Document{Content: "Hello World", Syntax: "none"}); err != ErrInsufficientStorage {
+		t.Errorf("Document was stored above the maximum size: %v", err)
+	}
+}
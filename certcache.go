@@ -0,0 +1,198 @@
+package qbin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// CertCacheCompression defines if certificates are compressed before they are written to the database.
+// Both compressed and uncompressed certificates can always be read.
+var CertCacheCompression = true
+
+// CertLockTimeout is how long an instance waits for another instance that is requesting the same certificate, before requesting it itself.
+var CertLockTimeout = 2 * time.Minute
+
+// certEncryptionPrefix marks certificate data encrypted with the MasterKey in the database.
+const certEncryptionPrefix = "qbin-encrypted:"
+
+// CertCache is an autocert.Cache that stores certificates in the database, so multiple instances behind a load balancer can share them.
+// If a certificate is missing, a database lock makes sure that only one instance requests it from Let's Encrypt, while the others
+// wait for it to be stored. If MasterKey is set, the data (which contains the private keys) is encrypted with it.
+type CertCache struct {
+	mutex sync.Mutex
+	// pending contains the connections holding the lock for keys this instance is requesting a certificate for.
+	pending map[string]*sql.Conn
+}
+
+// NewCertCache creates a certificate cache using the database, which must be connected already.
+func NewCertCache() *CertCache {
+	if MasterKey == nil {
+		Log.Warning("No master key is configured, the private keys of certificates are stored unencrypted in the database.")
+	}
+	return &CertCache{pending: map[string]*sql.Conn{}}
+}
+
+// isCertificateKey checks if a cache key belongs to a certificate ("<domain>" or "<domain>+rsa"). autocert also uses the
+// cache for the account key ("acme_account+key" and the legacy "acme_account.key"), TLS-ALPN challenge certificates
+// ("<domain>+token", looked up before the host policy is checked) and http-01 tokens ("<token>+http-01").
+func isCertificateKey(key string) bool {
+	if strings.HasPrefix(key, "acme_account") {
+		return false
+	}
+	return !strings.Contains(key, "+") || strings.HasSuffix(key, "+rsa")
+}
+
+// Get returns the certificate data for a key, or autocert.ErrCacheMiss if it's missing.
+// autocert only looks up certificates after the host policy allowed the domain, and requests a certificate right after a miss.
+// So on a miss of a certificate key, the lock for it is held until Put() is called or CertLockTimeout passes, and other
+// instances wait for this one. Misses of other keys are returned immediately, as they're not followed by a Put().
+func (c *CertCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := c.load(ctx, key)
+	if err != autocert.ErrCacheMiss || !isCertificateKey(key) {
+		return data, err
+	}
+
+	// Wait for other instances requesting the certificate right now
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", certLockName(key), int(CertLockTimeout.Seconds())).Scan(&locked)
+	if err != nil || locked.Int64 != 1 {
+		conn.Close()
+		if err != nil {
+			return nil, err
+		}
+		Log.Warningf("Timed out waiting for another instance to request the certificate '%s', requesting it now.", key)
+		return nil, autocert.ErrCacheMiss
+	}
+
+	data, err = c.load(ctx, key)
+	if err != autocert.ErrCacheMiss {
+		// Another instance stored the certificate in the meantime
+		releaseCertLock(conn, key)
+		return data, err
+	}
+
+	// This instance requests the certificate, so the lock is kept until it's stored
+	c.mutex.Lock()
+	if previous := c.pending[key]; previous != nil {
+		releaseCertLock(previous, key)
+	}
+	c.pending[key] = conn
+	c.mutex.Unlock()
+	time.AfterFunc(CertLockTimeout, func() { c.unlock(key, conn) })
+	return nil, autocert.ErrCacheMiss
+}
+
+// Put stores the certificate data for a key, and releases the lock taken by Get().
+func (c *CertCache) Put(ctx context.Context, key string, data []byte) error {
+	defer c.unlock(key, nil)
+
+	stored := data
+	if CertCacheCompression {
+		var buffer bytes.Buffer
+		w := gzip.NewWriter(&buffer)
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			return err
+		}
+		stored = buffer.Bytes()
+	}
+	if MasterKey != nil {
+		encrypted, err := encrypt(stored, certKey(key))
+		if err != nil {
+			return err
+		}
+		stored = append([]byte(certEncryptionPrefix), encrypted...)
+	}
+	_, err := db.ExecContext(ctx, "INSERT INTO certificates (name, data) VALUES (?, ?) ON DUPLICATE KEY UPDATE data = VALUES(data)", key, stored)
+	return err
+}
+
+// Delete removes the certificate data for a key.
+func (c *CertCache) Delete(ctx context.Context, key string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM certificates WHERE name = ?", key)
+	return err
+}
+
+// load reads, decrypts and decompresses the certificate data for a key.
+func (c *CertCache) load(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+	err := db.QueryRowContext(ctx, "SELECT data FROM certificates WHERE name = ?", key).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, autocert.ErrCacheMiss
+	} else if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(data, []byte(certEncryptionPrefix)) {
+		if MasterKey == nil {
+			return nil, ErrNoMasterKey
+		}
+		data, err = decrypt(data[len(certEncryptionPrefix):], certKey(key))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Certificates are PEM encoded, so they can't start with the gzip header if they're not compressed
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+	return data, nil
+}
+
+// unlock releases the lock for a key if this instance holds it. If conn is set, only that connection's lock is released.
+func (c *CertCache) unlock(key string, conn *sql.Conn) {
+	c.mutex.Lock()
+	pending := c.pending[key]
+	if pending == nil || (conn != nil && pending != conn) {
+		c.mutex.Unlock()
+		return
+	}
+	delete(c.pending, key)
+	c.mutex.Unlock()
+	releaseCertLock(pending, key)
+}
+
+// releaseCertLock releases the database lock for a key and returns the connection to the pool.
+func releaseCertLock(conn *sql.Conn, key string) {
+	ctx, cancel := queryContext()
+	defer cancel()
+	var released sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)", certLockName(key)).Scan(&released); err != nil {
+		Log.Warningf("Couldn't release the certificate lock for '%s': %s", key, err)
+	}
+	conn.Close()
+}
+
+// certKey derives the AES key for the certificate data of a cache key from the MasterKey. The key is bound to the cache key,
+// so the data of one domain can't be swapped with another one in the database.
+func certKey(key string) []byte {
+	mac := hmac.New(sha256.New, MasterKey)
+	mac.Write([]byte("certificate:" + key))
+	return mac.Sum(nil)
+}
+
+// certLockName returns the name of the database lock for a key, which is limited to 64 characters.
+func certLockName(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return "qbin-cert-" + hex.EncodeToString(hash[:16])
+}
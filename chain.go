@@ -0,0 +1,237 @@
+package qbin
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// HashChain records every stored document in the `chain` table, with a hash covering the previous entry, so altered
+// document metadata, altered or removed entries and documents removed before their expiration can be detected using
+// VerifyChain(). The content is covered by its integrity hash, so HashChain should be combined with IntegrityCheck.
+// Changes made by qbin itself (highlighting or re-encrypting a document, removing it) append a new entry.
+var HashChain = false
+
+// ChainBreak is a problem found by VerifyChain().
+type ChainBreak struct {
+	Seq      int64  `json:"seq"`
+	Document string `json:"document"` // The database ID (SHA256 of the document ID)
+	Reason   string `json:"reason"`
+}
+
+// chainFields hashes a list of fields for a chain record.
+func chainFields(fields ...string) string {
+	hash := sha256.New()
+	for _, field := range fields {
+		// The lengths keep fields from being moved between each other
+		fmt.Fprintf(hash, "%d:%s", len(field), field)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// chainRecord hashes the fields of a document which are covered by the hash chain.
+func chainRecord(databaseID string, custom string, syntax string, upload string, expiration sql.NullString, collection sql.NullString, integrity sql.NullString) string {
+	return chainFields(databaseID, custom, syntax, upload, expiration.String, collection.String, integrity.String)
+}
+
+// chainDeletion is the record of the entry appended when qbin removes a document.
+func chainDeletion(databaseID string, deleted string) string {
+	return chainFields("deleted", databaseID, deleted)
+}
+
+// chainHash links a record to the hash of the previous chain entry.
+func chainHash(previous string, record string) string {
+	hash := sha256.Sum256([]byte(previous + record))
+	return hex.EncodeToString(hash[:])
+}
+
+// seedChain inserts the genesis entry, which is locked while appending to the chain. It has no document and an empty
+// hash, and is ignored if the chain already has a first entry.
+func seedChain(handle *sql.DB) error {
+	_, err := handle.Exec("INSERT IGNORE INTO chain (seq, document, record, hash) VALUES (1, '', '', '')")
+	return err
+}
+
+// appendChain adds a record to the hash chain. The first (genesis) entry is locked until the transaction ends, so
+// concurrent uploads (also from other instances) can't fork the chain. Locking the last entry instead wouldn't be enough,
+// as a waiting transaction would still get the entry that was the last one when it started waiting.
+func appendChain(ctx context.Context, tx *sql.Tx, databaseID string, record string, expiration sql.NullString) error {
+	var genesis int64
+	err := tx.QueryRowContext(ctx, "SELECT seq FROM chain ORDER BY seq LIMIT 1 FOR UPDATE").Scan(&genesis)
+	if err != nil {
+		return err
+	}
+	var previous string
+	err = tx.QueryRowContext(ctx, "SELECT hash FROM chain ORDER BY seq DESC LIMIT 1 FOR UPDATE").Scan(&previous)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO chain (document, record, hash, expiration) VALUES (?, ?, ?, ?)", databaseID, record, chainHash(previous, record), expiration)
+	return err
+}
+
+// appendDocumentChain adds the current state of a stored document to the hash chain.
+func appendDocumentChain(ctx context.Context, tx *sql.Tx, databaseID string) error {
+	var custom, syntax, upload string
+	var expiration, collection, integrity sql.NullString
+	err := tx.QueryRowContext(ctx, "SELECT custom, syntax, upload, expiration, collection, integrity FROM documents WHERE id = ?", databaseID).
+		Scan(&custom, &syntax, &upload, &expiration, &collection, &integrity)
+	if err != nil {
+		return err
+	}
+	return appendChain(ctx, tx, databaseID, chainRecord(databaseID, custom, syntax, upload, expiration, collection, integrity), expiration)
+}
+
+// updateDocument runs an update of a single document, which is recorded in the hash chain in the same transaction.
+func updateDocument(ctx context.Context, handle *sql.DB, databaseID string, query string, args ...interface{}) (sql.Result, error) {
+	if !HashChain {
+		return handle.ExecContext(ctx, query, args...)
+	}
+	tx, err := handle.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return result, err
+	}
+	if err := appendDocumentChain(ctx, tx, databaseID); err != nil {
+		return nil, err
+	}
+	return result, tx.Commit()
+}
+
+// deleteDocuments removes the documents matching a condition (which may end with a LIMIT) and returns their number.
+// With HashChain, every removed document gets an entry in the same transaction, so VerifyChain() can tell it apart from
+// documents removed directly in the database.
+func deleteDocuments(ctx context.Context, handle *sql.DB, condition string, args ...interface{}) (int64, error) {
+	if !HashChain {
+		result, err := handle.ExecContext(ctx, "DELETE FROM documents WHERE "+condition, args...)
+		if err != nil {
+			return 0, err
+		}
+		return result.RowsAffected()
+	}
+
+	tx, err := handle.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM documents WHERE "+condition+" FOR UPDATE", args...)
+	if err != nil {
+		return 0, err
+	}
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	deleted := time.Now().UTC().Format("2006-01-02 15:04:05")
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM documents WHERE id = ?", id); err != nil {
+			return 0, err
+		}
+		if err := appendChain(ctx, tx, id, chainDeletion(id, deleted), sql.NullString{String: deleted, Valid: true}); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(ids)), tx.Commit()
+}
+
+// chainEntry is the last entry of a document in the hash chain, and the current state of the document.
+type chainEntry struct {
+	seq        int64
+	record     string
+	expiration sql.NullString
+	exists     bool
+	current    string
+}
+
+// VerifyChain walks the hash chain and returns all entries which don't match the previous entry, and all documents which
+// don't match their last entry or were removed before the expiration recorded in it. The chain is read in batches of
+// CleanupBatchSize together with the documents, each with the QueryTimeout.
+func VerifyChain() ([]ChainBreak, error) {
+	breaks := []ChainBreak{}
+	documents := map[string]*chainEntry{}
+	previous := ""
+	var seq int64
+	for {
+		n, err := verifyChainBatch(&seq, &previous, documents, &breaks)
+		if err != nil {
+			return nil, timeoutError(err)
+		}
+		if n < CleanupBatchSize {
+			break
+		}
+	}
+
+	now := time.Now().UTC().Format("2006-01-02 15:04:05")
+	documentBreaks := []ChainBreak{}
+	for document, entry := range documents {
+		if entry.exists && entry.current != entry.record {
+			documentBreaks = append(documentBreaks, ChainBreak{entry.seq, document, "the document doesn't match the entry"})
+		} else if !entry.exists && (!entry.expiration.Valid || entry.expiration.String > now) {
+			documentBreaks = append(documentBreaks, ChainBreak{entry.seq, document, "the document was removed before its expiration"})
+		}
+	}
+	// Breaks of the same entry keep their order, the chain comes first
+	breaks = append(breaks, documentBreaks...)
+	sort.SliceStable(breaks, func(i, j int) bool { return breaks[i].Seq < breaks[j].Seq })
+	return breaks, nil
+}
+
+// verifyChainBatch verifies the chain entries after seq, and updates seq and previous to the last one.
+func verifyChainBatch(seq *int64, previous *string, documents map[string]*chainEntry, breaks *[]ChainBreak) (int, error) {
+	ctx, cancel := queryContext()
+	defer cancel()
+	rows, err := db.QueryContext(ctx, "SELECT chain.seq, chain.document, chain.record, chain.hash, chain.expiration, documents.id, documents.custom, documents.syntax, documents.upload, documents.expiration, documents.collection, documents.integrity FROM chain LEFT JOIN documents ON documents.id = chain.document WHERE chain.seq > ? ORDER BY chain.seq LIMIT ?", *seq, CleanupBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		n++
+		var document, record, hash string
+		var chainExpiration, id, custom, syntax, upload, expiration, collection, integrity sql.NullString
+		if err := rows.Scan(seq, &document, &record, &hash, &chainExpiration, &id, &custom, &syntax, &upload, &expiration, &collection, &integrity); err != nil {
+			return n, err
+		}
+		if document == "" && *previous == "" && hash == "" {
+			// Genesis entry
+			continue
+		}
+		if hash != chainHash(*previous, record) {
+			*breaks = append(*breaks, ChainBreak{*seq, document, "the entry doesn't match the previous entry"})
+		}
+		*previous = hash
+
+		documents[document] = &chainEntry{
+			seq:        *seq,
+			record:     record,
+			expiration: chainExpiration,
+			exists:     id.Valid,
+			current:    chainRecord(document, custom.String, syntax.String, upload.String, expiration, collection, integrity),
+		}
+	}
+	return n, rows.Err()
+}
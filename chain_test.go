@@ -0,0 +1,147 @@
+package qbin
+
+import (
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chainDB extends storedDocumentsDB with the chain table, which is returned as rows of seq, document, record, hash and
+// expiration.
+func chainDB(name string) (map[string][]driver.Value, *[][]driver.Value) {
+	documents := storedDocumentsDB(name)
+	f := fakeDrivers[name]
+	documentsHandler := f.handler
+	var mutex sync.Mutex
+	chain := [][]driver.Value{}
+	f.handler = func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if strings.HasPrefix(query, "INSERT IGNORE INTO chain (seq, document, record, hash) VALUES (1, '', '', '')") {
+			if len(chain) == 0 {
+				chain = append(chain, []driver.Value{int64(1), "", "", "", nil})
+			}
+			return &fakeRows{affected: 1}, nil
+		} else if strings.HasPrefix(query, "SELECT seq FROM chain ORDER BY seq LIMIT 1 FOR UPDATE") {
+			result := &fakeRows{columns: []string{"seq"}}
+			if len(chain) > 0 {
+				result.values = [][]driver.Value{{chain[0][0]}}
+			}
+			return result, nil
+		} else if strings.HasPrefix(query, "SELECT hash FROM chain ORDER BY seq DESC LIMIT 1") {
+			result := &fakeRows{columns: []string{"hash"}}
+			if len(chain) > 0 {
+				result.values = [][]driver.Value{{chain[len(chain)-1][3]}}
+			}
+			return result, nil
+		} else if strings.HasPrefix(query, "INSERT INTO chain (document, record, hash, expiration)") {
+			chain = append(chain, []driver.Value{int64(len(chain) + 1), args[0].Value, args[1].Value, args[2].Value, args[3].Value})
+			return &fakeRows{affected: 1}, nil
+		} else if strings.HasPrefix(query, "SELECT chain.seq, chain.document, chain.record, chain.hash, chain.expiration, documents.id, documents.custom, documents.syntax, documents.upload, documents.expiration, documents.collection, documents.integrity FROM chain LEFT JOIN documents") {
+			result := &fakeRows{columns: []string{"seq", "document", "record", "hash", "expiration", "id", "custom", "syntax", "upload", "expiration", "collection", "integrity"}}
+			for _, entry := range chain {
+				if entry[0].(int64) <= args[0].Value.(int64) || int64(len(result.values)) >= args[1].Value.(int64) {
+					continue
+				}
+				row := append([]driver.Value{}, entry...)
+				if document, ok := documents[entry[1].(string)]; ok {
+					row = append(row, entry[1], document[1], document[2], document[3], document[4], document[14], document[10])
+				} else {
+					row = append(row, nil, nil, nil, nil, nil, nil, nil)
+				}
+				result.values = append(result.values, row)
+			}
+			return result, nil
+		} else if strings.HasPrefix(query, "SELECT custom, syntax, upload, expiration, collection, integrity FROM documents WHERE id = ?") {
+			result := &fakeRows{columns: []string{"custom", "syntax", "upload", "expiration", "collection", "integrity"}}
+			if row, ok := documents[args[0].Value.(string)]; ok {
+				result.values = [][]driver.Value{{row[1], row[2], row[3], row[4], row[14], row[10]}}
+			}
+			return result, nil
+		} else if strings.HasPrefix(query, "SELECT id FROM documents WHERE id = ? FOR UPDATE") {
+			result := &fakeRows{columns: []string{"id"}}
+			if _, ok := documents[args[0].Value.(string)]; ok {
+				result.values = [][]driver.Value{{args[0].Value}}
+			}
+			return result, nil
+		}
+		return documentsHandler(query, args)
+	}
+	seedChain(db)
+	return documents, &chain
+}
+
+func TestHashChain(t *testing.T) {
+	defer func(batch int) { HashChain, IntegrityCheck, CleanupBatchSize = false, false, batch }(CleanupBatchSize)
+	HashChain = true
+	IntegrityCheck = true
+	CleanupBatchSize = 2
+	documents, chain := chainDB("hash-chain")
+	databaseID := func(id string) string {
+		hash := sha256.Sum256([]byte(id))
+		return hex.EncodeToString(hash[:])
+	}
+
+	ids := []string{}
+	for _, doc := range []Document{{Content: "first"}, {Content: "second", Syntax: "go", Expiration: time.Now().Add(time.Hour)}, {Content: "third", Custom: "encrypted"}, {Content: "expired", Expiration: time.Now().Add(-time.Minute)}} {
+		if err := Store(&doc); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, doc.ID)
+	}
+	if len(*chain) != 5 || (*chain)[0][1] != "" {
+		t.Fatalf("Chain has %d entries, expected the genesis entry and 4 documents", len(*chain))
+	}
+	if breaks, err := VerifyChain(); err != nil || len(breaks) != 0 {
+		t.Fatalf("Chain doesn't verify after storing documents: %v, %v", breaks, err)
+	}
+
+	// Expired documents don't break the chain, but documents removed before their expiration do
+	first, second, expired := databaseID(ids[0]), databaseID(ids[1]), databaseID(ids[3])
+	delete(documents, expired)
+	if breaks, err := VerifyChain(); err != nil || len(breaks) != 0 {
+		t.Errorf("Chain doesn't verify after removing an expired document: %v, %v", breaks, err)
+	}
+	for seq, id := range map[int64]string{2: first, 3: second} {
+		row := documents[id]
+		delete(documents, id)
+		breaks, err := VerifyChain()
+		if err != nil || len(breaks) != 1 || breaks[0].Seq != seq || breaks[0].Document != id {
+			t.Errorf("Removed document wasn't detected: %v, %v", breaks, err)
+		}
+		documents[id] = row
+	}
+
+	// Documents removed by qbin are recorded
+	if err := Delete(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if breaks, err := VerifyChain(); err != nil || len(breaks) != 0 || len(*chain) != 6 {
+		t.Errorf("Chain doesn't verify after deleting a document: %v, %v", breaks, err)
+	}
+
+	// Tampered document and content
+	documents[second][2] = "html"
+	breaks, err := VerifyChain()
+	if err != nil || len(breaks) != 1 || breaks[0].Seq != 3 || breaks[0].Document != second {
+		t.Errorf("Tampered document wasn't detected: %v, %v", breaks, err)
+	}
+	documents[second][2] = "go"
+	integrity := documents[second][10]
+	documents[second][10] = strings.Repeat("0", 64)
+	if breaks, err := VerifyChain(); err != nil || len(breaks) != 1 || breaks[0].Document != second {
+		t.Errorf("Tampered integrity hash wasn't detected: %v, %v", breaks, err)
+	}
+	documents[second][10] = integrity
+
+	// Tampered chain entry
+	(*chain)[2][2] = strings.Repeat("0", 64)
+	breaks, err = VerifyChain()
+	if err != nil || len(breaks) != 2 || breaks[0].Seq != 3 || breaks[1].Seq != 3 {
+		t.Errorf("Tampered chain entry wasn't detected: %v, %v", breaks, err)
+	}
+}
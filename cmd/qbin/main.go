@@ -1,11 +1,17 @@
 package main
 
 import (
+	"encoding/hex"
+	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/op/go-logging"
 	"github.com/qbin-io/backend"
+	"github.com/qbin-io/backend/grpc"
 	"github.com/qbin-io/backend/http"
 	"github.com/qbin-io/backend/tcp"
 	"github.com/urfave/cli"
@@ -21,27 +27,333 @@ var flags = []cli.Flag{
 	cli.BoolFlag{
 		Name: "force-root", EnvVar: "FORCE_ROOT",
 		Usage: "If this is set, requests that are not on the root URI will be redirected."},
+	cli.StringFlag{
+		Name: "replica-database", EnvVar: "REPLICA_DATABASE",
+		Usage: "MySQL/MariaDB connection string of a read-only replica used for viewing documents. Works best with --count-views=false."},
+	cli.BoolTFlag{
+		Name: "replica-fallback", EnvVar: "REPLICA_FALLBACK",
+		Usage: "Request documents that can't be found on the replica from the primary database, to handle replication lag."},
+	cli.StringSliceFlag{
+		Name: "shard", EnvVar: "SHARDS",
+		Usage: "MySQL/MariaDB connection string of an additional database to distribute documents across by their hashed ID (can be repeated). The list must not change once documents are stored. Can't be used with numeric aliases, collections, the hash chain or a replica."},
+	cli.StringFlag{
+		Name: "master-key", EnvVar: "MASTER_KEY",
+		Usage: "Hex-encoded 32 byte key to encrypt new documents with instead of using scrypt, which is a lot faster but makes it easier to brute-force document names if the key leaks. Only use this for trusted single-tenant deployments."},
+	cli.BoolFlag{
+		Name: "content-etags", EnvVar: "CONTENT_ETAGS",
+		Usage: "Store a hash of the content with new documents, which is used as ETag for raw documents and allows conditional uploads (If-None-Match). The hash is keyed with --content-hash-key, but stored unencrypted, so anyone with database access can see which documents have the same content."},
+	cli.StringFlag{
+		Name: "content-hash-key", EnvVar: "CONTENT_HASH_KEY",
+		Usage: "Hex-encoded 32 byte secret key of the content hashes, required for --content-etags. Without it, anyone could check if a document with a guessed content exists. Changing it invalidates the stored hashes."},
+	cli.Int64Flag{
+		Name: "max-database-size", EnvVar: "MAX_DATABASE_SIZE",
+		Usage: "Reject new documents with 507 Insufficient Storage once the database reaches this size in bytes (data and indexes). 0 disables the limit."},
+	cli.Int64Flag{
+		Name: "fingerprint-quota", EnvVar: "FINGERPRINT_QUOTA",
+		Usage: "Maximum total size in bytes of the live documents of a single creator (IP address and user agent, requires --fingerprint-salt). 0 disables the limit."},
+	cli.BoolFlag{
+		Name: "allow-unencrypted", EnvVar: "ALLOW_UNENCRYPTED",
+		Usage: "Allow clients to store documents without server-side encryption (U header or form field), which skips the key derivation. Anyone with access to the database can read those documents."},
+	cli.BoolFlag{
+		Name: "collections", EnvVar: "COLLECTIONS",
+		Usage: "Allow grouping documents by a secret token of at least 16 characters (G header or form field), which can be listed at /api/v1/collection."},
+	cli.IntFlag{
+		Name: "scrypt-concurrency", EnvVar: "SCRYPT_CONCURRENCY", Value: qbin.ScryptConcurrency,
+		Usage: "Maximum number of concurrent key derivations, each requiring 16 MB of memory. 0 disables the limit."},
+	cli.DurationFlag{
+		Name: "scrypt-queue-timeout", EnvVar: "SCRYPT_QUEUE_TIMEOUT", Value: qbin.ScryptQueueTimeout,
+		Usage: "How long requests wait for a key derivation slot before they are rejected with 503. 0 waits forever."},
+	cli.DurationFlag{
+		Name: "query-timeout", EnvVar: "QUERY_TIMEOUT", Value: 0,
+		Usage: "Maximum duration of a single database query, e.g. 5s. Set to 0 to disable."},
+	cli.IntFlag{
+		Name: "cleanup-batch-size", EnvVar: "CLEANUP_BATCH_SIZE", Value: 1000,
+		Usage: "Maximum number of expired documents removed by a single cleanup query."},
+	cli.DurationFlag{
+		Name: "cleanup-batch-pause", EnvVar: "CLEANUP_BATCH_PAUSE", Value: time.Second,
+		Usage: "Pause between two cleanup queries, to avoid load spikes on the database."},
 	cli.StringFlag{
 		Name: "wordlist", EnvVar: "WORD_LIST", Value: "eff_large_wordlist.txt",
 		Usage: "Word list used for random slug generation."},
+	cli.BoolFlag{
+		Name: "require-wordlist", EnvVar: "REQUIRE_WORD_LIST",
+		Usage: "Report the instance as not ready on /readyz if the word list is empty."},
+	cli.BoolFlag{
+		Name: "adaptive-names", EnvVar: "ADAPTIVE_NAMES",
+		Usage: "Grow the number of random characters in document names with the number of stored documents."},
+	cli.BoolFlag{
+		Name: "timestamp-names", EnvVar: "TIMESTAMP_NAMES",
+		Usage: "Prefix document names with their creation time in base 36, so they sort chronologically (e.g. 0sg9k2a-cornflake-peddling-bp0q)."},
+	cli.IntFlag{
+		Name: "min-name-suffix", EnvVar: "MIN_NAME_SUFFIX", Value: 4,
+		Usage: "Minimum number of random characters in document names. Requires --adaptive-names."},
+	cli.IntFlag{
+		Name: "max-name-suffix", EnvVar: "MAX_NAME_SUFFIX", Value: 12,
+		Usage: "Maximum number of random characters in document names. Requires --adaptive-names."},
 	cli.StringFlag{
 		Name: "blacklist", EnvVar: "BLACKLIST", Value: "blacklist.regex",
 		Usage: "Blacklist file containing one regular expression per line."},
 	cli.StringSliceFlag{
 		Name: "filters", EnvVar: "FILTERS", Value: &cli.StringSlice{"blacklist", "linkcount"},
 		Usage: "Set the spam filters in use. Available filters: blacklist, linkcount"},
+	cli.DurationFlag{
+		Name: "spam-repeat-window", EnvVar: "SPAM_REPEAT_WINDOW", Value: 10 * time.Minute,
+		Usage: "Time for which the content of rejected spam is remembered, so sending it again is rejected with 429 without running the filters. 0 disables it."},
+	cli.BoolFlag{
+		Name: "dedup-ignore-whitespace", EnvVar: "DEDUP_IGNORE_WHITESPACE",
+		Usage: "Recognize repeated spam regardless of indentation, trailing whitespace and empty lines."},
 	cli.StringFlag{
 		Name: "prism-server", EnvVar: "PRISM_SERVER", Value: "/tmp/prism-server.sock",
 		Usage: "TCP address or unix socket path (when containing a /) to prism-server."},
+	cli.DurationFlag{
+		Name: "notify-before", EnvVar: "NOTIFY_BEFORE", Value: 0,
+		Usage: "Send a webhook to a document's notification URL (N parameter) this long before it expires, e.g. 24h. Set to 0 to disable."},
+	cli.BoolFlag{
+		Name: "store-original", EnvVar: "STORE_ORIGINAL",
+		Usage: "Always store the original content next to the highlighted one. Makes raw output exact, but requires about twice the storage. Documents stored with it can be highlighted again using POST /api/v1/admin/rehighlight."},
+	cli.BoolFlag{
+		Name: "visualize-trailing-whitespace", EnvVar: "VISUALIZE_TRAILING_WHITESPACE",
+		Usage: "Show trailing spaces and tabs as visible markers in highlighted documents. The raw output keeps the exact whitespace."},
+	cli.BoolFlag{
+		Name: "original-only", EnvVar: "ORIGINAL_ONLY",
+		Usage: "Only store the original content and highlight documents when they are requested. Makes raw output exact with about half the storage of --store-original, but costs CPU on every request that misses the highlight cache."},
+	cli.IntFlag{
+		Name: "highlight-cache-size", EnvVar: "HIGHLIGHT_CACHE_SIZE", Value: 64 * 1024 * 1024,
+		Usage: "Memory in bytes used to cache highlighted documents stored with --original-only. 0 disables the cache."},
+	cli.DurationFlag{
+		Name: "decrypted-cache-ttl", EnvVar: "DECRYPTED_CACHE_TTL", Value: 10 * time.Minute,
+		Usage: "Maximum time decrypted content (highlighted documents and snippets) is kept in memory. Documents expiring earlier aren't cached. 0 disables the caches."},
+	cli.BoolFlag{
+		Name: "require-confirmation", EnvVar: "REQUIRE_CONFIRMATION",
+		Usage: "Keep new documents hidden until they are confirmed with the token returned on upload."},
+	cli.DurationFlag{
+		Name: "confirmation-ttl", EnvVar: "CONFIRMATION_TTL", Value: time.Hour,
+		Usage: "Remove documents that haven't been confirmed within this duration. Requires --require-confirmation."},
+	cli.BoolFlag{
+		Name: "numeric-aliases", EnvVar: "NUMERIC_ALIASES",
+		Usage: "Give new documents a short numeric alias, reachable under /n/<number>. Makes documents enumerable!"},
+	cli.BoolFlag{
+		Name: "short-links", EnvVar: "SHORT_LINKS",
+		Usage: "Return the /n/<number> URL of new documents in the upload response (Link header and JSON). Requires --numeric-aliases."},
+	cli.BoolFlag{
+		Name: "validation-errors", EnvVar: "VALIDATION_ERRORS",
+		Usage: "Report all problems of a rejected upload at once (including the spam filter), as a list for JSON clients, instead of only the first one."},
+	cli.BoolFlag{
+		Name: "url-syntax", EnvVar: "URL_SYNTAX",
+		Usage: "Use the extension of the upload URL as the syntax of documents uploaded without one, e.g. POST /raw.py for Python."},
+	cli.BoolFlag{
+		Name: "limits", EnvVar: "LIMITS",
+		Usage: "Describe the current limits of the instance (maximum size and expiration, syntaxes, rate limits) at /api/v1/limits, so clients can adjust their uploads."},
+	cli.BoolFlag{
+		Name: "inline-view", EnvVar: "INLINE_VIEW",
+		Usage: "Serve the raw content at /<document>/view.<ext> inline with a filename and the MIME type of the extension (e.g. to display SVGs). Scripts are blocked."},
+	cli.BoolFlag{
+		Name: "base64-content", EnvVar: "BASE64_CONTENT",
+		Usage: "Return the raw content base64-encoded in JSON at /<document>/raw?encoding=base64, so clients can retrieve content that isn't valid UTF-8 without losing bytes."},
+	cli.BoolFlag{
+		Name: "content-urls", EnvVar: "CONTENT_URLS",
+		Usage: "Serve documents stored with --content-etags and without encryption at /c/<content hash>, with headers allowing CDNs to cache them forever."},
+	cli.BoolFlag{
+		Name: "embeds", EnvVar: "EMBEDS",
+		Usage: "Add Open Graph meta tags to documents and describe them as oEmbed JSON at /oembed?url=<document URL>, for rich embeds in chat apps and CMSs."},
+	cli.StringSliceFlag{
+		Name: "early-hint", EnvVar: "EARLY_HINTS",
+		Usage: "Preload this frontend asset (e.g. /style.css) with a 103 Early Hints response before serving pages to browsers. Can be specified multiple times; make sure your proxy supports Early Hints."},
+	cli.StringSliceFlag{
+		Name: "theme", EnvVar: "THEMES",
+		Usage: "Name of a color theme offered by the frontend, listed at /api/v1/themes. Can be specified multiple times."},
+	cli.BoolFlag{
+		Name: "grep", EnvVar: "GREP",
+		Usage: "Serve only the lines of a document matching a regular expression at /<document>?grep=<pattern>, e.g. to link to the errors in a log."},
+	cli.DurationFlag{
+		Name: "grep-timeout", EnvVar: "GREP_TIMEOUT", Value: time.Second,
+		Usage: "Maximum time spent matching the lines of a document for --grep."},
+	cli.BoolFlag{
+		Name: "pdf", EnvVar: "PDF",
+		Usage: "Serve documents rendered as PDF with syntax highlighting at /<document>/pdf."},
+	cli.IntFlag{
+		Name: "max-pdf-size", EnvVar: "MAX_PDF_SIZE", Value: 256 * 1024,
+		Usage: "Maximum size in bytes of highlighted content that is rendered as PDF."},
+	cli.IntFlag{
+		Name: "pdf-cache-size", EnvVar: "PDF_CACHE_SIZE", Value: 32 * 1024 * 1024,
+		Usage: "Memory in bytes used to cache rendered PDFs. 0 disables the cache."},
+	cli.BoolFlag{
+		Name: "live-views", EnvVar: "LIVE_VIEWS",
+		Usage: "Provide a WebSocket at /<document>/live that pushes the view count of a document whenever it changes."},
+	cli.IntFlag{
+		Name: "max-live-viewers", EnvVar: "MAX_LIVE_VIEWERS", Value: qbin.MaxLiveViewers,
+		Usage: "Maximum number of concurrent live view connections per document."},
+	cli.IntFlag{
+		Name: "max-live-connections", EnvVar: "MAX_LIVE_CONNECTIONS", Value: qbin.MaxLiveConnections,
+		Usage: "Maximum number of concurrent live view connections of all documents together. 0 disables the limit."},
+	cli.BoolFlag{
+		Name: "files-array", EnvVar: "FILES_ARRAY",
+		Usage: "Return the content in JSON responses as a \"files\" array, like for multi-file documents, instead of flat \"syntax\", \"highlighted\", \"encoding\" and \"content\" fields (in the upload, base64 and metadata responses)."},
+	cli.BoolFlag{
+		Name: "strict-content", EnvVar: "STRICT_CONTENT",
+		Usage: "Don't trim leading and trailing new lines, so documents keep their exact content. Use with --store-original for byte-exact raw output."},
+	cli.BoolTFlag{
+		Name: "normalize-line-endings", EnvVar: "NORMALIZE_LINE_ENDINGS",
+		Usage: "Convert CRLF and CR line endings to LF. Set to false to disable."},
+	cli.BoolFlag{
+		Name: "syntax-marker", EnvVar: "SYNTAX_MARKER",
+		Usage: "Use a first line like \"#!go\" as the syntax of documents uploaded without one, and remove it from the content. Shebangs are kept."},
+	cli.BoolFlag{
+		Name: "normalize-unicode", EnvVar: "NORMALIZE_UNICODE",
+		Usage: "Convert new documents to Unicode normalization form C, so canonically equivalent content is stored and hashed the same way."},
+	cli.BoolFlag{
+		Name: "strip-ansi", EnvVar: "STRIP_ANSI",
+		Usage: "Remove ANSI escape sequences (e.g. terminal colors) from new documents, unless their syntax is \"ansi\"."},
+	cli.StringSliceFlag{
+		Name: "scrypt-params", EnvVar: "SCRYPT_PARAMS",
+		Usage: "Additional scrypt parameters in the format 'N:r:p' (e.g. 32768:8:1), the last one is used for new documents. Never remove or reorder them, documents encrypted with them couldn't be decrypted anymore."},
+	cli.BoolFlag{
+		Name: "lazy-reencryption", EnvVar: "LAZY_REENCRYPTION",
+		Usage: "Re-encrypt documents with outdated scrypt parameters or without the master key when they are requested."},
+	cli.StringSliceFlag{
+		Name: "custom-value", EnvVar: "CUSTOM_VALUES",
+		Usage: "Additional allowed value for the custom field (C) of uploads, besides 'encrypted'. Can be specified multiple times."},
+	cli.IntFlag{
+		Name: "snippet-lines", EnvVar: "SNIPPET_LINES", Value: 5,
+		Usage: "Number of non-empty lines in the snippet returned by /api/v1/documents/{document}. 0 disables snippets."},
+	cli.IntFlag{
+		Name: "snippet-length", EnvVar: "SNIPPET_LENGTH", Value: 300,
+		Usage: "Maximum number of characters in a snippet."},
+	cli.BoolFlag{
+		Name: "integrity-check", EnvVar: "INTEGRITY_CHECK",
+		Usage: "Store a hash of new documents and verify it when they are requested, to detect corrupted documents."},
+	cli.BoolFlag{
+		Name: "hash-chain", EnvVar: "HASH_CHAIN",
+		Usage: "Link new documents in a hash chain, which can be verified at /api/v1/admin/chain to detect tampering with the database, including documents removed before their expiration. Use it with --integrity-check, as the content is covered by the integrity hash."},
+	cli.IntFlag{
+		Name: "decryption-alert-threshold", EnvVar: "DECRYPTION_ALERT_THRESHOLD",
+		Usage: "Log a critical alert if this many documents couldn't be decrypted within --decryption-alert-window. 0 disables the alert."},
+	cli.DurationFlag{
+		Name: "decryption-alert-window", EnvVar: "DECRYPTION_ALERT_WINDOW", Value: 5 * time.Minute,
+		Usage: "Time window for --decryption-alert-threshold."},
+	cli.Float64Flag{
+		Name: "max-non-printable-ratio", EnvVar: "MAX_NON_PRINTABLE_RATIO",
+		Usage: "Reject documents where the share of non-printable characters exceeds this ratio (e.g. 0.3). 0 disables the check."},
+	cli.DurationFlag{
+		Name: "max-expiration", EnvVar: "MAX_EXPIRATION",
+		Usage: "Maximum time documents can be stored. Uploads without an explicit expiration get this one if it's shorter than the default of 14 days. 0 allows storing documents forever."},
+	cli.StringSliceFlag{
+		Name: "syntax-max-expiration", EnvVar: "SYNTAX_MAX_EXPIRATION",
+		Usage: "Maximum time documents of a syntax can be stored, in the format 'syntax=duration' (e.g. 'log=24h', 'none=72h' for plain text). Longer expirations are shortened. Can be specified multiple times."},
+	cli.BoolFlag{
+		Name: "detect-syntax", EnvVar: "DETECT_SYNTAX",
+		Usage: "Guess the syntax of documents uploaded without a syntax from their content."},
+	cli.StringSliceFlag{
+		Name: "content-type-syntax", EnvVar: "CONTENT_TYPE_SYNTAX",
+		Usage: "Additional mapping from the content type of an upload to a syntax, in the format 'text/x-rust=rust'. Can be specified multiple times."},
+	cli.BoolTFlag{
+		Name: "persist-detected-syntax", EnvVar: "PERSIST_DETECTED_SYNTAX",
+		Usage: "Store the detected syntax with the document instead of only using it for highlighting. Set to false to disable."},
+	cli.IntFlag{
+		Name: "syntax-candidates", EnvVar: "SYNTAX_CANDIDATES",
+		Usage: "Return this many detected syntaxes with their scores in the JSON response to an upload, so clients can offer the alternatives. 0 disables the candidates."},
+	cli.StringSliceFlag{
+		Name: "blocked-detected-syntax", EnvVar: "BLOCKED_DETECTED_SYNTAX",
+		Usage: "Reject documents whose content is detected as this syntax, even if the uploader specified another one (e.g. php). Can be specified multiple times."},
+	cli.IntFlag{
+		Name: "blocked-detection-score", EnvVar: "BLOCKED_DETECTION_SCORE", Value: 10,
+		Usage: "Minimum detection score for --blocked-detected-syntax, so content that only looks a bit like a blocked syntax isn't rejected."},
+	cli.BoolFlag{
+		Name: "stats-include-expired", EnvVar: "STATS_INCLUDE_EXPIRED",
+		Usage: "Include expired documents that haven't been removed yet in the syntax statistics."},
+	cli.IntFlag{
+		Name: "highlight-max-lines", EnvVar: "HIGHLIGHT_MAX_LINES",
+		Usage: "Store documents with more lines without highlighting, which can then be loaded on demand. 0 disables the limit."},
+	cli.DurationFlag{
+		Name: "highlight-budget", EnvVar: "HIGHLIGHT_BUDGET",
+		Usage: "Maximum time spent highlighting new documents per --highlight-budget-interval. Documents stored while it's exhausted aren't highlighted, which can then be loaded on demand. 0 disables the limit."},
+	cli.DurationFlag{
+		Name: "highlight-budget-interval", EnvVar: "HIGHLIGHT_BUDGET_INTERVAL", Value: time.Minute,
+		Usage: "Interval in which the --highlight-budget is refilled."},
+	cli.StringFlag{
+		Name: "default-syntax", EnvVar: "DEFAULT_SYNTAX",
+		Usage: "Syntax used for documents uploaded without a syntax. Empty means no highlighting."},
+	cli.StringSliceFlag{
+		Name: "popular-syntaxes", EnvVar: "POPULAR_SYNTAXES",
+		Usage: "Syntaxes advertised by /api/v1/syntaxes, all other syntaxes can still be used. Empty advertises all syntaxes."},
+	cli.BoolTFlag{
+		Name: "count-views", EnvVar: "COUNT_VIEWS",
+		Usage: "Count document views in the database. Set to false to make viewing documents read-only (except for volatile documents)."},
+	cli.DurationFlag{
+		Name: "view-flush-interval", EnvVar: "VIEW_FLUSH_INTERVAL",
+		Usage: "Collect document views in memory and write them to the database in this interval. View counts will be slightly delayed. 0 writes every view immediately."},
+	cli.IntFlag{
+		Name: "view-flush-threshold", EnvVar: "VIEW_FLUSH_THRESHOLD", Value: 1000,
+		Usage: "Write collected views to the database as soon as this many views have been collected."},
+	cli.IntFlag{
+		Name: "max-tracked-views", EnvVar: "MAX_TRACKED_VIEWS",
+		Usage: "Stop counting the views of a document once it has this many, and show them as e.g. \"10000+\". 0 counts all views."},
+	cli.StringFlag{
+		Name: "maintenance-banner", EnvVar: "MAINTENANCE_BANNER",
+		Usage: "Show a message at the top of all pages, e.g. to announce downtime. Can be changed at runtime using PUT /api/v1/admin/banner."},
+	cli.BoolFlag{
+		Name: "maintenance-banner-api", EnvVar: "MAINTENANCE_BANNER_API",
+		Usage: "Include the --maintenance-banner in the \"warnings\" of JSON API responses."},
+	cli.StringFlag{
+		Name: "admin-token", EnvVar: "ADMIN_TOKEN",
+		Usage: "Token required for the admin API (as \"Authorization: Bearer <token>\"). Empty disables the admin API."},
+	cli.StringSliceFlag{
+		Name: "admin-tokens", EnvVar: "ADMIN_TOKENS",
+		Usage: "Additional admin API tokens limited to some scopes, as \"<name>:<SHA256 of the token>:<scopes>\" (e.g. \"moderator:9f86...:reports,delete\"). The scopes are read-stats, reports, delete, purge and banner (can be repeated)."},
+	cli.BoolFlag{
+		Name: "audit-log", EnvVar: "AUDIT_LOG",
+		Usage: "Record all actions using the admin API in the database, which can be read at /api/v1/admin/audit."},
+	cli.StringFlag{
+		Name: "fingerprint-salt", EnvVar: "FINGERPRINT_SALT",
+		Usage: "Secret salt for storing a creator fingerprint (derived from IP address and user agent) with every document, for abuse investigations. Empty disables fingerprints."},
 	cli.StringFlag{
 		Name: "tcp", EnvVar: "TCP_LISTEN", Value: ":9000",
 		Usage: "TCP (netcat API) listen address. Set to 'none' to disable."},
+	cli.StringFlag{
+		Name: "grpc", EnvVar: "GRPC_LISTEN", Value: "none",
+		Usage: "gRPC listen address for other services (create, get and delete documents). Set to 'none' to disable."},
+	cli.StringFlag{
+		Name: "grpc-token", EnvVar: "GRPC_TOKEN",
+		Usage: "Token gRPC clients must send as \"authorization: Bearer <token>\" metadata. Without it, clients can only get documents, creating and deleting them is denied."},
 	cli.StringFlag{
 		Name: "http", EnvVar: "HTTP_LISTEN", Value: ":8000",
 		Usage: "HTTP listen address. Set to 'none' to disable."},
 	cli.StringFlag{
 		Name: "https", EnvVar: "HTTPS_LISTEN", Value: "none",
 		Usage: "HTTPS listen address, qbin will automatically get a Let's Encrypt certificate. Set to 'none' to disable."},
+	cli.StringFlag{
+		Name: "cert-dir", EnvVar: "CERT_DIR", Value: qbinHTTP.DefaultCertDir,
+		Usage: "Directory to store certificates from Let's Encrypt in. It will be created if it doesn't exist."},
+	cli.StringFlag{
+		Name: "cert-file", EnvVar: "CERT_FILE",
+		Usage: "Certificate file (PEM, including intermediate certificates) to use instead of requesting certificates from Let's Encrypt. Reloaded on SIGHUP."},
+	cli.StringFlag{
+		Name: "key-file", EnvVar: "KEY_FILE",
+		Usage: "Private key file for --cert-file."},
+	cli.StringFlag{
+		Name: "geoip-database", EnvVar: "GEOIP_DATABASE",
+		Usage: "CSV file with the lines 'first IP,last IP,country code' (e.g. from DB-IP) to look up the country of uploaders for --block-country."},
+	cli.StringSliceFlag{
+		Name: "block-country", EnvVar: "BLOCK_COUNTRIES",
+		Usage: "Reject uploads from this country (ISO 3166-1 alpha-2 code, e.g. 'XY') with 451. Requires --geoip-database. Can be specified multiple times."},
+	cli.BoolFlag{
+		Name: "cert-cache-db", EnvVar: "CERT_CACHE_DB",
+		Usage: "Store certificates from Let's Encrypt in the database instead of the certificate directory, to share them between multiple instances. Their private keys are encrypted with --master-key if it's set."},
+	cli.BoolTFlag{
+		Name: "cert-cache-compression", EnvVar: "CERT_CACHE_COMPRESSION",
+		Usage: "Compress certificates stored in the database. Set to false to disable."},
+	cli.StringFlag{
+		Name: "document-domain", EnvVar: "DOCUMENT_DOMAIN",
+		Usage: "Serve every document on its own subdomain of this domain (e.g. paste.example.org) to isolate HTML content. Requires a wildcard DNS record."},
+	cli.StringFlag{
+		Name: "document-cert", EnvVar: "DOCUMENT_CERT",
+		Usage: "Wildcard certificate file for the document domain, required for HTTPS as Let's Encrypt can't issue wildcard certificates automatically."},
+	cli.StringFlag{
+		Name: "document-key", EnvVar: "DOCUMENT_KEY",
+		Usage: "Private key file of the wildcard certificate for the document domain."},
+	cli.StringFlag{
+		Name: "no-sni-domain", EnvVar: "NO_SNI_DOMAIN",
+		Usage: "Domain whose certificate is served to HTTPS clients that don't send a server name (SNI). If empty, those clients are rejected."},
 	cli.BoolFlag{
 		Name: "hsts", EnvVar: "HSTS",
 		Usage: "Send HSTS header with max-age=31536000 (1 year)."},
@@ -51,9 +363,54 @@ var flags = []cli.Flag{
 	cli.BoolFlag{
 		Name: "hsts-subdomains", EnvVar: "HSTS_SUBDOMAINS",
 		Usage: "Send includeSubDomains directive with the HSTS header. Requires --hsts."},
+	cli.BoolFlag{
+		Name: "secure-writes", EnvVar: "SECURE_WRITES",
+		Usage: "Reject uploads and other changes with 403 if they aren't sent over HTTPS, while documents can still be read over HTTP."},
+	cli.StringSliceFlag{
+		Name: "trusted-proxy", EnvVar: "TRUSTED_PROXIES",
+		Usage: "IP address or CIDR range of a reverse proxy whose X-Forwarded-Proto header is trusted by --secure-writes, and whose X-Forwarded-For header is used by --access-log. Can be specified multiple times."},
+	cli.BoolTFlag{
+		Name: "terminal-raw", EnvVar: "TERMINAL_RAW",
+		Usage: "Serve raw documents to command line clients (like curl or wget) without requiring /raw. Set to false to disable."},
+	cli.BoolFlag{
+		Name: "terminal-help", EnvVar: "TERMINAL_HELP",
+		Usage: "Serve plain text usage instructions with the limits of this instance to command line clients (like curl) requesting the root."},
+	cli.BoolFlag{
+		Name: "expires-header", EnvVar: "EXPIRES_HEADER",
+		Usage: "Send the expiration of documents as X-Expires header, and allow caching them until they expire (Cache-Control: max-age)."},
+	cli.IntFlag{
+		Name: "availability-rate-limit", EnvVar: "AVAILABILITY_RATE_LIMIT", Value: 30,
+		Usage: "Number of name availability checks (/api/v1/documents/<id>/available) allowed per client and minute."},
+	cli.IntFlag{
+		Name: "highlight-rate-limit", EnvVar: "HIGHLIGHT_RATE_LIMIT", Value: 10,
+		Usage: "Number of documents whose skipped highlighting (see --highlight-max-lines) can be loaded per client and minute."},
+	cli.IntFlag{
+		Name: "ipv6-rate-limit-prefix", EnvVar: "IPV6_RATE_LIMIT_PREFIX", Value: 64,
+		Usage: "Prefix length by which IPv6 clients are grouped for rate limits (e.g. 64 to treat a /64 as one client, 128 for single addresses)."},
+	cli.IntFlag{
+		Name: "token-failures", EnvVar: "TOKEN_FAILURES", Value: 5,
+		Usage: "Number of wrong confirmation or collection tokens allowed per client and document before further attempts are delayed exponentially (up to an hour). 0 disables the delay."},
+	cli.StringFlag{
+		Name: "access-log", EnvVar: "ACCESS_LOG",
+		Usage: "Write a line for every request to Stdout in this format: human, json, common or combined (NCSA formats, e.g. for GoAccess). Uses X-Forwarded-For of a --trusted-proxy as client address."},
+	cli.DurationFlag{
+		Name: "slow-request-threshold", EnvVar: "SLOW_REQUEST_THRESHOLD", Value: 0,
+		Usage: "Log HTTP requests taking longer than this duration, e.g. 2s. Set to 0 to disable."},
+	cli.IntFlag{
+		Name: "max-url-length", EnvVar: "MAX_URL_LENGTH", Value: 1024,
+		Usage: "Maximum length of request URLs, longer ones are rejected with 414. Set to 0 to disable."},
+	cli.IntFlag{
+		Name: "max-header-bytes", EnvVar: "MAX_HEADER_BYTES", Value: 16 * 1024,
+		Usage: "Maximum size of HTTP request headers in bytes."},
 	cli.StringFlag{
 		Name: "frontend-path, p", EnvVar: "FRONTEND_PATH", Value: "./frontend",
 		Usage: "Location of the frontend files."},
+	cli.StringFlag{
+		Name: "not-found-page", EnvVar: "NOT_FOUND_PAGE", Value: "/404.html",
+		Usage: "HTML page in the frontend path that is shown, if it exists, to browsers for missing documents. Empty uses a plain text response."},
+	cli.StringFlag{
+		Name: "gone-page", EnvVar: "GONE_PAGE", Value: "/410.html",
+		Usage: "HTML page in the frontend path that is shown, if it exists, to browsers for expired documents. Empty uses a plain text response."},
 	cli.BoolFlag{
 		Name: "debug", EnvVar: "DEBUG",
 		Usage: "Show (a lot) more output."},
@@ -93,9 +450,17 @@ func run(c *cli.Context) error {
 	if err != nil {
 		qbin.Log.Errorf("Error loading word list from '%s': %s", c.String("wordlist"), err)
 	}
+	qbin.RequireWords = c.Bool("require-wordlist")
+
+	qbin.AdaptiveNames = c.Bool("adaptive-names")
+	qbin.MinSuffixLength = c.Int("min-name-suffix")
+	qbin.MaxSuffixLength = c.Int("max-name-suffix")
+	qbin.TimestampNames = c.Bool("timestamp-names")
 
 	// Switch filters
 	qbin.FilterEnable = qbin.Slice2map(c.StringSlice("filters"))
+	qbin.SpamRepeatWindow = c.Duration("spam-repeat-window")
+	qbin.DedupIgnoreWhitespace = c.Bool("dedup-ignore-whitespace")
 
 	// Load blacklist
 	err = qbin.LoadBlacklistFile(c.String("blacklist"))
@@ -105,13 +470,152 @@ func run(c *cli.Context) error {
 
 	// Setup prism-server
 	qbin.PrismServer = c.String("prism-server")
+	qbin.DefaultSyntax = qbin.ParseSyntax(c.String("default-syntax"))
+	for _, syntax := range c.StringSlice("popular-syntaxes") {
+		qbin.PopularSyntaxes = append(qbin.PopularSyntaxes, qbin.ParseSyntax(syntax))
+	}
+	qbin.StatsIncludeExpired = c.Bool("stats-include-expired")
+	qbin.HighlightMaxLines = c.Int("highlight-max-lines")
+	qbin.HighlightBudget = c.Duration("highlight-budget")
+	qbin.HighlightBudgetInterval = c.Duration("highlight-budget-interval")
+	qbin.SyntaxDetection = c.Bool("detect-syntax")
+	qbin.PersistDetectedSyntax = c.BoolT("persist-detected-syntax")
+	qbin.SyntaxCandidates = c.Int("syntax-candidates")
+	for _, syntax := range c.StringSlice("blocked-detected-syntax") {
+		qbin.BlockedDetectedSyntaxes = append(qbin.BlockedDetectedSyntaxes, qbin.ParseSyntax(syntax))
+	}
+	qbin.BlockedDetectionScore = c.Int("blocked-detection-score")
+	for _, mapping := range c.StringSlice("content-type-syntax") {
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 {
+			qbin.Log.Errorf("Invalid content type mapping '%s', expected the format 'type=syntax'.", mapping)
+			continue
+		}
+		qbin.ContentTypeSyntaxes[strings.ToLower(strings.TrimSpace(parts[0]))] = qbin.ParseSyntax(parts[1])
+	}
+
+	qbin.MaxExpiration = c.Duration("max-expiration")
+	for _, mapping := range c.StringSlice("syntax-max-expiration") {
+		parts := strings.SplitN(mapping, "=", 2)
+		if len(parts) != 2 {
+			qbin.Log.Errorf("Invalid syntax expiration '%s', expected the format 'syntax=duration'.", mapping)
+			continue
+		}
+		limit, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			qbin.Log.Errorf("Invalid syntax expiration '%s': %s", mapping, err)
+			continue
+		}
+		qbin.SyntaxMaxExpiration[qbin.ParseSyntax(parts[0])] = limit
+	}
+	if c.String("master-key") != "" {
+		qbin.MasterKey, err = hex.DecodeString(c.String("master-key"))
+		if err != nil || len(qbin.MasterKey) != 32 {
+			qbin.Log.Errorf("The master key must be 32 bytes in hex (64 characters).")
+			panic("invalid master key")
+		}
+	}
+	qbin.AllowUnencrypted = c.Bool("allow-unencrypted")
+	qbin.MaxDatabaseSize = c.Int64("max-database-size")
+	qbin.FingerprintQuota = c.Int64("fingerprint-quota")
+	qbin.Collections = c.Bool("collections")
+	qbin.MaxLiveViewers = c.Int("max-live-viewers")
+	qbin.MaxLiveConnections = c.Int("max-live-connections")
+	qbin.ContentETags = c.Bool("content-etags")
+	if c.String("content-hash-key") != "" {
+		qbin.ContentHashKey, err = hex.DecodeString(c.String("content-hash-key"))
+		if err != nil || len(qbin.ContentHashKey) != 32 {
+			qbin.Log.Errorf("The content hash key must be 32 bytes in hex (64 characters).")
+			panic("invalid content hash key")
+		}
+	} else if qbin.ContentETags {
+		qbin.Log.Errorf("--content-etags requires --content-hash-key, as the content hashes would reveal if a document with a guessed content exists.")
+		panic("missing content hash key")
+	}
+	qbin.ScryptConcurrency = c.Int("scrypt-concurrency")
+	qbin.ScryptQueueTimeout = c.Duration("scrypt-queue-timeout")
+	qbin.StoreOriginal = c.Bool("store-original")
+	qbin.OriginalOnly = c.Bool("original-only")
+	qbin.VisualizeTrailingWhitespace = c.Bool("visualize-trailing-whitespace")
+	qbin.HighlightCacheSize = c.Int("highlight-cache-size")
+	qbin.DecryptedCacheTTL = c.Duration("decrypted-cache-ttl")
+	qbin.MaxPDFSize = c.Int("max-pdf-size")
+	qbin.GrepTimeout = c.Duration("grep-timeout")
+	qbin.PDFCacheSize = c.Int("pdf-cache-size")
+	qbin.StrictContent = c.Bool("strict-content")
+	qbin.NormalizeLineEndings = c.BoolT("normalize-line-endings")
+	qbin.StripANSI = c.Bool("strip-ansi")
+	qbin.NormalizeUnicode = c.Bool("normalize-unicode")
+	qbin.SyntaxMarker = c.Bool("syntax-marker")
+	qbin.MaxNonPrintableRatio = c.Float64("max-non-printable-ratio")
+	qbin.IntegrityCheck = c.Bool("integrity-check")
+	qbin.HashChain = c.Bool("hash-chain")
+	qbin.AuditLog = c.Bool("audit-log")
+	qbin.DecryptionAlertThreshold = c.Int("decryption-alert-threshold")
+	qbin.DecryptionAlertWindow = c.Duration("decryption-alert-window")
+	qbin.CustomValues = append(qbin.CustomValues, c.StringSlice("custom-value")...)
+	qbin.CertCacheCompression = c.BoolT("cert-cache-compression")
+	qbin.SnippetLines = c.Int("snippet-lines")
+	qbin.SnippetLength = c.Int("snippet-length")
+	for _, params := range c.StringSlice("scrypt-params") {
+		var p qbin.ScryptParams
+		if _, err := fmt.Sscanf(params, "%d:%d:%d", &p.N, &p.R, &p.P); err != nil {
+			qbin.Log.Errorf("Invalid scrypt parameters '%s', expected the format 'N:r:p'.", params)
+			panic(err)
+		}
+		qbin.ScryptVersions = append(qbin.ScryptVersions, p)
+	}
+	qbin.LazyReencryption = c.Bool("lazy-reencryption")
+
+	// Geoblocking
+	if c.String("geoip-database") != "" {
+		ranges, err := qbin.LoadCountryRanges(c.String("geoip-database"))
+		if err != nil {
+			qbin.Log.Errorf("Couldn't load the GeoIP database: %s", err)
+			panic(err)
+		}
+		qbin.GeoIP = ranges
+		qbin.BlockedCountries = c.StringSlice("block-country")
+	}
+
+	// Confirmation
+	qbin.RequireConfirmation = c.Bool("require-confirmation")
+	qbin.ConfirmationTTL = c.Duration("confirmation-ttl")
+
+	qbin.NumericAliases = c.Bool("numeric-aliases")
+	qbin.CountViews = c.BoolT("count-views")
+	qbin.FingerprintSalt = c.String("fingerprint-salt")
+	qbin.ViewFlushInterval = c.Duration("view-flush-interval")
+	qbin.ViewFlushThreshold = c.Int("view-flush-threshold")
+	qbin.MaxTrackedViews = c.Int("max-tracked-views")
+
+	// Expiration notifications
+	qbin.NotifyBefore = c.Duration("notify-before")
 
 	// Connect to database
+	qbin.QueryTimeout = c.Duration("query-timeout")
+	qbin.CleanupBatchSize = c.Int("cleanup-batch-size")
+	qbin.CleanupBatchPause = c.Duration("cleanup-batch-pause")
+	if len(c.StringSlice("shard")) > 0 {
+		err = qbin.ConnectShards(c.StringSlice("shard"))
+		if err != nil {
+			qbin.Log.Errorf("Error connecting to database shards: %s", err)
+			panic(err)
+		}
+	}
 	err = qbin.Connect(c.String("database"))
 	if err != nil {
 		qbin.Log.Errorf("Error connecting to database: %s", err)
 		panic(err)
 	}
+	if c.String("replica-database") != "" {
+		qbin.ReplicaFallback = c.BoolT("replica-fallback")
+		err = qbin.ConnectReplica(c.String("replica-database"))
+		if err != nil {
+			qbin.Log.Errorf("Error connecting to database replica: %s", err)
+			panic(err)
+		}
+	}
 
 	// Serve HTTP
 	if c.String("http") != "none" || c.String("https") != "none" {
@@ -131,6 +635,7 @@ func run(c *cli.Context) error {
 		}
 
 		go qbinHTTP.StartHTTP(qbinHTTP.Configuration{
+			Version:       c.App.Version,
 			ListenHTTP:    c.String("http"),
 			ListenHTTPS:   c.String("https"),
 			FrontendPath:  c.String("frontend-path"),
@@ -138,6 +643,48 @@ func run(c *cli.Context) error {
 			CertWhitelist: c.Args(),
 			ForceRoot:     c.Bool("force-root"),
 			Hsts:          hsts,
+			TerminalRaw:   c.BoolT("terminal-raw"),
+			NoSNIDomain:   c.String("no-sni-domain"),
+			TerminalHelp:  c.Bool("terminal-help"),
+
+			AvailabilityRateLimit: c.Int("availability-rate-limit"),
+			HighlightRateLimit:    c.Int("highlight-rate-limit"),
+			IPv6RateLimitPrefix:   c.Int("ipv6-rate-limit-prefix"),
+			TokenFailures:         c.Int("token-failures"),
+			SlowRequestThreshold:  c.Duration("slow-request-threshold"),
+			AccessLog:             c.String("access-log"),
+			MaxURLLength:          c.Int("max-url-length"),
+			MaxHeaderBytes:        c.Int("max-header-bytes"),
+			MaintenanceBanner:     c.String("maintenance-banner"),
+			MaintenanceBannerAPI:  c.Bool("maintenance-banner-api"),
+			AdminToken:            c.String("admin-token"),
+			AdminTokens:           c.StringSlice("admin-tokens"),
+			ShortLinks:            c.Bool("short-links"),
+			FilesArray:            c.Bool("files-array"),
+			LiveViews:             c.Bool("live-views"),
+			URLSyntax:             c.Bool("url-syntax"),
+			Limits:                c.Bool("limits"),
+			InlineView:            c.Bool("inline-view"),
+			Base64Content:         c.Bool("base64-content"),
+			PDF:                   c.Bool("pdf"),
+			ContentURLs:           c.Bool("content-urls"),
+			Embeds:                c.Bool("embeds"),
+			EarlyHints:            c.StringSlice("early-hint"),
+			Themes:                c.StringSlice("theme"),
+			Grep:                  c.Bool("grep"),
+			ValidationErrors:      c.Bool("validation-errors"),
+			ExpiresHeader:         c.Bool("expires-header"),
+			SecureWrites:          c.Bool("secure-writes"),
+			TrustedProxies:        c.StringSlice("trusted-proxy"),
+			CertDir:               c.String("cert-dir"),
+			CertFile:              c.String("cert-file"),
+			KeyFile:               c.String("key-file"),
+			CertCacheDB:           c.Bool("cert-cache-db"),
+			DocumentDomain:        c.String("document-domain"),
+			DocumentCertFile:      c.String("document-cert"),
+			DocumentKeyFile:       c.String("document-key"),
+			NotFoundPage:          c.String("not-found-page"),
+			GonePage:              c.String("gone-page"),
 		})
 	}
 
@@ -146,6 +693,16 @@ func run(c *cli.Context) error {
 		go qbinTCP.StartTCP(c.String("tcp"), c.String("root"))
 	}
 
-	// Sleep
-	select {}
+	// Serve gRPC
+	if c.String("grpc") != "none" {
+		go qbinGRPC.StartGRPC(c.String("grpc"), c.String("root"), c.String("grpc-token"))
+	}
+
+	// Wait for a signal to shut down
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	qbin.Log.Noticef("Received %s, shutting down...", sig)
+	qbin.FlushViews()
+	return nil
 }
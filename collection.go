@@ -0,0 +1,111 @@
+package qbin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Collections allows grouping documents by a secret collection token chosen by the client, see Document.Collection and
+// ListCollection(). No accounts are required: everybody who knows the token can list the documents in the collection.
+var Collections = false
+
+// minCollectionTokenLength makes collection tokens hard to guess, as they are the only protection of a collection.
+const minCollectionTokenLength = 16
+
+// maxCollectionDocuments limits how many documents are returned by ListCollection().
+const maxCollectionDocuments = 1000
+
+// ErrCollectionsDisabled is returned by ValidateCollection() if Collections is disabled.
+var ErrCollectionsDisabled = errors.New("collections are not enabled")
+
+// ErrInvalidCollection is returned by ValidateCollection() if the collection token is too short.
+var ErrInvalidCollection = errors.New("collection tokens must be at least 16 characters long")
+
+// CollectionDocument is a document returned by ListCollection().
+type CollectionDocument struct {
+	ID         string     `json:"id"`
+	Syntax     string     `json:"syntax"`
+	Upload     time.Time  `json:"upload"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+}
+
+// ValidateCollection checks if a document can be added to the collection with the given token. Empty tokens are always valid.
+func ValidateCollection(token string) error {
+	if token == "" {
+		return nil
+	}
+	if !Collections {
+		return ErrCollectionsDisabled
+	}
+	if len(token) < minCollectionTokenLength {
+		return ErrInvalidCollection
+	}
+	return nil
+}
+
+// collectionKeys derives the value stored in the collection column and the key used to encrypt the document IDs from a
+// collection token. Only hashes of the token are stored, so the IDs can't be listed without knowing it.
+func collectionKeys(token string) (string, []byte) {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("collection"))
+	collection := hex.EncodeToString(mac.Sum(nil))
+	mac = hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("key"))
+	return collection, mac.Sum(nil)
+}
+
+// collectionValues returns the collection and the encrypted document ID to store with a document.
+func collectionValues(token string, id string) (sql.NullString, sql.NullString, error) {
+	if token == "" {
+		return sql.NullString{}, sql.NullString{}, nil
+	}
+	collection, key := collectionKeys(token)
+	entry, err := encrypt([]byte(id), key)
+	if err != nil {
+		return sql.NullString{}, sql.NullString{}, err
+	}
+	return sql.NullString{String: collection, Valid: true}, sql.NullString{String: string(entry), Valid: true}, nil
+}
+
+// ListCollection returns up to 1000 public documents in the collection with the given token, newest first.
+func ListCollection(token string) ([]CollectionDocument, error) {
+	if err := ValidateCollection(token); err != nil {
+		return nil, err
+	}
+	collection, key := collectionKeys(token)
+	ctx, cancel := queryContext()
+	defer cancel()
+	rows, err := readDB().QueryContext(ctx, "SELECT collection_entry, syntax, upload, expiration FROM documents WHERE collection = ? AND pending IS NULL AND (expiration IS NULL OR expiration > CURRENT_TIMESTAMP) ORDER BY upload DESC LIMIT ?", collection, maxCollectionDocuments)
+	if err != nil {
+		return nil, timeoutError(err)
+	}
+	defer rows.Close()
+
+	documents := []CollectionDocument{}
+	for rows.Next() {
+		var doc CollectionDocument
+		var entry []byte
+		var upload, expiration sql.NullString
+		if err := rows.Scan(&entry, &doc.Syntax, &upload, &expiration); err != nil {
+			return nil, err
+		}
+		id, err := decrypt(entry, key)
+		if err != nil {
+			Log.Warningf("Couldn't decrypt a document ID in a collection: %s", err)
+			continue
+		}
+		doc.ID = string(id)
+		doc.Upload, _ = time.Parse("2006-01-02 15:04:05", upload.String)
+		if expiration.Valid {
+			if t, err := time.Parse("2006-01-02 15:04:05", expiration.String); err == nil {
+				doc.Expiration = &t
+			}
+		}
+		documents = append(documents, doc)
+	}
+	return documents, rows.Err()
+}
@@ -0,0 +1,60 @@
+package qbin
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCollections(t *testing.T) {
+	defer func() { Collections = false }()
+	rows := storedDocumentsDB("collections")
+
+	token := "correct-horse-battery-staple"
+	if err := Store(&Document{Content: "first", Collection: token}); err != ErrCollectionsDisabled {
+		t.Errorf("Collection was accepted while disabled: %v", err)
+	}
+	Collections = true
+	if err := Store(&Document{Content: "first", Collection: "short"}); err != ErrInvalidCollection {
+		t.Errorf("Short collection token was accepted: %v", err)
+	}
+
+	ids := []string{}
+	for _, doc := range []Document{{Content: "first", Collection: token}, {Content: "second", Syntax: "go", Collection: token}, {Content: "other", Collection: token + "2"}, {Content: "none"}} {
+		if err := Store(&doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc.Collection == token {
+			ids = append(ids, doc.ID)
+		}
+	}
+	for _, row := range rows {
+		if entry, ok := row[15].(string); ok && (strings.Contains(entry, ids[0]) || strings.Contains(entry, ids[1])) {
+			t.Errorf("Document ID is stored unencrypted")
+		}
+		if collection, ok := row[14].(string); ok && strings.Contains(collection, token) {
+			t.Errorf("Collection token is stored in plain text")
+		}
+	}
+
+	documents, err := ListCollection(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := []string{}
+	for _, doc := range documents {
+		listed = append(listed, doc.ID)
+		if doc.Upload.IsZero() {
+			t.Errorf("Document %s has no upload time", doc.ID)
+		}
+	}
+	sort.Strings(ids)
+	sort.Strings(listed)
+	if strings.Join(listed, ",") != strings.Join(ids, ",") {
+		t.Errorf("Wrong documents in collection: %v, expected: %v", listed, ids)
+	}
+
+	if documents, err := ListCollection("wrong-horse-battery-staple"); err != nil || len(documents) != 0 {
+		t.Errorf("Documents were listed with a wrong token: %v, %v", documents, err)
+	}
+}
@@ -0,0 +1,83 @@
+package qbin
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// RequireConfirmation defines if new documents stay hidden until they are confirmed using the token returned by Store().
+var RequireConfirmation = false
+
+// ConfirmationTTL defines how long unconfirmed documents are kept before the cleanup removes them.
+var ConfirmationTTL = time.Hour
+
+// ErrInvalidConfirmation is returned by Confirm() if the document doesn't exist, is already confirmed or the token is wrong.
+var ErrInvalidConfirmation = errors.New("invalid confirmation token")
+
+// generateConfirmationToken returns a random token and the hash that is stored in the database.
+func generateConfirmationToken() (string, string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(b)
+	return token, hashConfirmationToken(token), nil
+}
+
+func hashConfirmationToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Confirm publishes a pending document if the token matches.
+func Confirm(id string, token string) error {
+	if token == "" {
+		return ErrInvalidConfirmation
+	}
+
+	databaseID := sha256.Sum256([]byte(id))
+	ctx, cancel := queryContext()
+	defer cancel()
+	result, err := shardDB(hex.EncodeToString(databaseID[:])).ExecContext(ctx, "UPDATE documents SET pending = NULL WHERE id = ? AND pending = ?", hex.EncodeToString(databaseID[:]), hashConfirmationToken(token))
+	if err != nil {
+		return timeoutError(err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return ErrInvalidConfirmation
+	}
+	return nil
+}
+
+// purgeUnconfirmed removes all documents that haven't been confirmed within ConfirmationTTL, in batches of
+// CleanupBatchSize like expired documents.
+func purgeUnconfirmed() {
+	eachShard(func(handle *sql.DB) error {
+		var total int64
+		for {
+			ctx, cancel := queryContext()
+			n, err := deleteDocuments(ctx, handle, "pending IS NOT NULL AND upload < DATE_SUB(CURRENT_TIMESTAMP, INTERVAL ? SECOND) LIMIT ?", int64(ConfirmationTTL.Seconds()), CleanupBatchSize)
+			cancel()
+			if err != nil {
+				Log.Errorf("Couldn't remove unconfirmed documents: %s", timeoutError(err))
+				break
+			}
+			total += n
+			if n < int64(CleanupBatchSize) {
+				break
+			}
+			time.Sleep(CleanupBatchPause)
+		}
+		if total > 0 {
+			Log.Debugf("Removed %d unconfirmed documents.", total)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,62 @@
+package qbin
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfirm(t *testing.T) {
+	token, hash, err := generateConfirmationToken()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	useFakeDB("confirm", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		if strings.HasPrefix(query, "UPDATE documents SET pending = NULL") && args[1].Value == hash {
+			return &fakeRows{affected: 1}, nil
+		}
+		return &fakeRows{affected: 0}, nil
+	})
+
+	if err := Confirm("cornflake-peddling-bp0q", "wrong"); err != ErrInvalidConfirmation {
+		t.Errorf("Wrong token should be rejected, got: %v", err)
+	}
+	if err := Confirm("cornflake-peddling-bp0q", ""); err != ErrInvalidConfirmation {
+		t.Errorf("Empty token should be rejected, got: %v", err)
+	}
+	if err := Confirm("cornflake-peddling-bp0q", token); err != nil {
+		t.Errorf("Correct token should be accepted, got: %v", err)
+	}
+}
+
+func TestPurgeUnconfirmed(t *testing.T) {
+	var ttl interface{}
+	remaining := int64(2500)
+	f := useFakeDB("purge-unconfirmed", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		ttl = args[0].Value
+		n := args[1].Value.(int64)
+		if n > remaining {
+			n = remaining
+		}
+		remaining -= n
+		return &fakeRows{affected: n}, nil
+	})
+	CleanupBatchSize = 1000
+	CleanupBatchPause = 0
+	defer func() { CleanupBatchPause = time.Second }()
+
+	purgeUnconfirmed()
+	queries := f.Queries()
+	if len(queries) != 3 || !strings.HasPrefix(queries[0], "DELETE FROM documents WHERE pending IS NOT NULL") {
+		t.Errorf("Unexpected queries: %v", queries)
+	}
+	if remaining != 0 {
+		t.Errorf("%d unconfirmed documents weren't removed", remaining)
+	}
+	if ttl != int64(ConfirmationTTL.Seconds()) {
+		t.Errorf("Wrong TTL used: %v", ttl)
+	}
+}
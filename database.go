@@ -1,15 +1,74 @@
 package qbin
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"sync/atomic"
 	"time"
 	// MySQL/MariaDB Database Driver
 	_ "github.com/go-sql-driver/mysql"
 )
 
 var db *sql.DB
+var replica *sql.DB
 var isConnected bool
 
+// ReplicaFallback defines if documents that can't be found on the replica are requested from the primary database, to handle replication lag.
+var ReplicaFallback = true
+
+// QueryTimeout limits how long a single database query for storing or requesting a document may take. 0 disables the limit.
+var QueryTimeout time.Duration
+
+// CleanupBatchSize limits how many expired documents are removed by a single query.
+var CleanupBatchSize = 1000
+
+// CleanupBatchPause defines how long the cleanup waits between two batches.
+var CleanupBatchPause = time.Second
+
+// Counters of the cleanup of expired documents, see Cleanup().
+var cleanupDeleted, cleanupBatches uint64
+var cleanupDuration int64
+
+// CleanupMetrics describes the progress of the cleanup of expired documents since the start.
+type CleanupMetrics struct {
+	// Deleted is the number of expired documents that have been removed
+	Deleted uint64 `json:"deleted"`
+	// Batches is the number of queries (of up to CleanupBatchSize documents) used to remove them
+	Batches uint64 `json:"batches"`
+	// LastDuration is how long the last cleanup of all databases took, in seconds
+	LastDuration float64 `json:"lastDuration"`
+}
+
+// Cleanup returns the progress of the cleanup of expired documents.
+func Cleanup() CleanupMetrics {
+	return CleanupMetrics{
+		Deleted:      atomic.LoadUint64(&cleanupDeleted),
+		Batches:      atomic.LoadUint64(&cleanupBatches),
+		LastDuration: time.Duration(atomic.LoadInt64(&cleanupDuration)).Seconds(),
+	}
+}
+
+// ErrTimeout is returned if a database query took longer than QueryTimeout.
+var ErrTimeout = errors.New("database query timed out")
+
+// queryContext returns a context for a database query, respecting QueryTimeout.
+func queryContext() (context.Context, context.CancelFunc) {
+	if QueryTimeout > 0 {
+		return context.WithTimeout(context.Background(), QueryTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// timeoutError replaces context deadline errors with ErrTimeout and logs them.
+func timeoutError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		Log.Warningf("Database query timed out after %s", QueryTimeout)
+		return ErrTimeout
+	}
+	return err
+}
+
 // Connect tries to establish a connection to a MySQL/MariaDB database under the given URI and initializes the qbin tables if they don't exist yet.
 func Connect(uri string) error {
 	Log.Noticef("Connecting to database at %s", uri)
@@ -32,23 +91,9 @@ func Connect(uri string) error {
 	Log.Noticef("Database version: %s", version)
 
 	// Create tables
-	var table string
-	db.QueryRow("SHOW TABLES LIKE 'documents'").Scan(&table)
-	if table == "" {
-		Log.Noticef("Setting up `documents` table...")
-		err = db.QueryRow(`CREATE TABLE documents (
-            id varchar(64) PRIMARY KEY,
-            content longblob NOT NULL,
-            custom text NOT NULL DEFAULT "",
-            syntax varchar(30) NOT NULL DEFAULT "",
-            upload datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
-            expiration datetime NULL DEFAULT NULL,
-            views int UNSIGNED NOT NULL DEFAULT 0,
-            raw longblob NULL DEFAULT NULL
-        ) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`).Scan()
-		if err != nil && err.Error() != "sql: no rows in result set" {
-			return err
-		}
+	err = setupDocumentsTable(db)
+	if err != nil {
+		return err
 	}
 
 	//Create Table Spam
@@ -66,38 +111,324 @@ func Connect(uri string) error {
 		}
 	}
 
+	// Create Table Certificates
+	var certificates string
+	db.QueryRow("SHOW TABLES LIKE 'certificates'").Scan(&certificates)
+	if certificates == "" {
+		Log.Noticef("Setting up `certificates` table...")
+		err = db.QueryRow(`CREATE TABLE certificates (
+            name varchar(255) PRIMARY KEY,
+            data mediumblob NOT NULL,
+            updated datetime NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+        ) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`).Scan()
+		if err != nil && err.Error() != "sql: no rows in result set" {
+			return err
+		}
+	}
+
+	// Create Table Chain
+	var chain string
+	db.QueryRow("SHOW TABLES LIKE 'chain'").Scan(&chain)
+	if chain == "" {
+		Log.Noticef("Setting up `chain` table...")
+		err = db.QueryRow(`CREATE TABLE chain (
+            seq bigint UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+            document varchar(64) NOT NULL,
+            record char(64) NOT NULL,
+            hash char(64) NOT NULL,
+            expiration datetime NULL DEFAULT NULL,
+            INDEX (document)
+        ) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`).Scan()
+		if err != nil && err.Error() != "sql: no rows in result set" {
+			return err
+		}
+	}
+
+	err = seedChain(db)
+	if err != nil {
+		return err
+	}
+
+	// Create Table Audit
+	var audit string
+	db.QueryRow("SHOW TABLES LIKE 'audit'").Scan(&audit)
+	if audit == "" {
+		Log.Noticef("Setting up `audit` table...")
+		err = db.QueryRow(`CREATE TABLE audit (
+            id bigint UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+            admin varchar(64) NOT NULL,
+            action varchar(64) NOT NULL,
+            target text NOT NULL,
+            time datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            INDEX (admin)
+        ) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`).Scan()
+		if err != nil && err.Error() != "sql: no rows in result set" {
+			return err
+		}
+	}
+
 	safeName, errSafeName = db.Prepare("SELECT COUNT(id) FROM documents WHERE id = ?")
 
 	isConnected = true
 	go cleanup()
+	if ViewFlushInterval > 0 {
+		go flushViewsPeriodically()
+	}
 	// After connecting to the database, connect to prim-server to speed up startup
 	go getLanguages()
 	return nil
 }
 
+// setupDocumentsTable creates the documents table, or adds columns that didn't exist in earlier versions.
+func setupDocumentsTable(handle *sql.DB) error {
+	var table string
+	handle.QueryRow("SHOW TABLES LIKE 'documents'").Scan(&table)
+	if table == "" {
+		Log.Noticef("Setting up `documents` table...")
+		err := handle.QueryRow(`CREATE TABLE documents (
+            id varchar(64) PRIMARY KEY,
+            content longblob NOT NULL,
+            custom text NOT NULL DEFAULT "",
+            syntax varchar(30) NOT NULL DEFAULT "",
+            upload datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            expiration datetime NULL DEFAULT NULL,
+            views int UNSIGNED NOT NULL DEFAULT 0,
+            raw longblob NULL DEFAULT NULL,
+            notify text NULL DEFAULT NULL,
+            notified tinyint(1) NOT NULL DEFAULT 0,
+            pending varchar(64) NULL DEFAULT NULL,
+            alias int UNSIGNED NOT NULL AUTO_INCREMENT UNIQUE,
+            alias_target blob NULL DEFAULT NULL,
+            fingerprint varchar(64) NULL DEFAULT NULL,
+            highlight_skipped tinyint(1) NOT NULL DEFAULT 0,
+            encryption tinyint UNSIGNED NOT NULL DEFAULT 0,
+            integrity char(64) NULL DEFAULT NULL,
+            key_version tinyint UNSIGNED NOT NULL DEFAULT 0,
+            parent blob NULL DEFAULT NULL,
+            content_hash char(32) NULL DEFAULT NULL,
+            collection char(64) NULL DEFAULT NULL,
+            collection_entry blob NULL DEFAULT NULL,
+            INDEX (fingerprint),
+            INDEX (content_hash),
+            INDEX (collection)
+        ) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`).Scan()
+		if err != nil && err.Error() != "sql: no rows in result set" {
+			return err
+		}
+	}
+
+	// Add columns that didn't exist in earlier versions
+	err := addColumn(handle, "documents", "notify", "text NULL DEFAULT NULL")
+	if err != nil {
+		return err
+	}
+	err = addColumn(handle, "documents", "notified", "tinyint(1) NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = addColumn(handle, "documents", "pending", "varchar(64) NULL DEFAULT NULL")
+	if err != nil {
+		return err
+	}
+	// Adding an AUTO_INCREMENT column rebuilds the whole table, so it's only done when the aliases are needed
+	if NumericAliases {
+		err = addColumn(handle, "documents", "alias", "int UNSIGNED NOT NULL AUTO_INCREMENT UNIQUE")
+		if err != nil {
+			return err
+		}
+	} else if !hasColumn(handle, "documents", "alias") {
+		aliasColumn = "NULL"
+	}
+	err = addColumn(handle, "documents", "alias_target", "blob NULL DEFAULT NULL")
+	if err != nil {
+		return err
+	}
+	err = addColumn(handle, "documents", "fingerprint", "varchar(64) NULL DEFAULT NULL, ADD INDEX (fingerprint)")
+	if err != nil {
+		return err
+	}
+	err = addColumn(handle, "documents", "highlight_skipped", "tinyint(1) NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = addColumn(handle, "documents", "encryption", "tinyint UNSIGNED NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = addColumn(handle, "documents", "integrity", "char(64) NULL DEFAULT NULL")
+	if err != nil {
+		return err
+	}
+	err = addColumn(handle, "documents", "key_version", "tinyint UNSIGNED NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = addColumn(handle, "documents", "parent", "blob NULL DEFAULT NULL")
+	if err != nil {
+		return err
+	}
+	err = addColumn(handle, "documents", "content_hash", "char(32) NULL DEFAULT NULL, ADD INDEX (content_hash)")
+	if err != nil {
+		return err
+	}
+	err = addColumn(handle, "documents", "collection", "char(64) NULL DEFAULT NULL, ADD INDEX (collection)")
+	if err != nil {
+		return err
+	}
+	err = addColumn(handle, "documents", "collection_entry", "blob NULL DEFAULT NULL")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// aliasColumn selects the alias of documents in queries. It's NULL if the database doesn't have the alias column, as
+// NumericAliases has never been enabled for it.
+var aliasColumn = "alias"
+
+// hasColumn checks if a table has a column.
+func hasColumn(handle *sql.DB, table string, column string) bool {
+	var name string
+	handle.QueryRow("SHOW COLUMNS FROM `" + table + "` LIKE '" + column + "'").Scan(&name)
+	return name != ""
+}
+
+// addColumn adds a column to an existing table if it doesn't exist yet, to upgrade databases created by older versions.
+func addColumn(handle *sql.DB, table string, column string, definition string) error {
+	if hasColumn(handle, table, column) {
+		return nil
+	}
+	Log.Noticef("Adding column `%s` to `%s` table...", column, table)
+	_, err := handle.Exec("ALTER TABLE `" + table + "` ADD COLUMN `" + column + "` " + definition)
+	return err
+}
+
+// ConnectReplica tries to establish a connection to a read-only MySQL/MariaDB replica, which will then be used for requesting documents.
+func ConnectReplica(uri string) error {
+	if len(shards) > 0 {
+		return ErrShardingUnsupported
+	}
+	Log.Noticef("Connecting to database replica at %s", uri)
+	result, err := try(func() (interface{}, error) {
+		r, err := sql.Open("mysql", uri)
+		if err != nil {
+			return nil, err
+		}
+		return r, r.Ping()
+	}, 10, time.Second) // Wait up to 10 seconds for the database
+	if err != nil {
+		return err
+	}
+	replica = result.(*sql.DB)
+	return nil
+}
+
+// readDB returns the replica if there is one, or the primary database otherwise.
+func readDB() *sql.DB {
+	if replica != nil {
+		return replica
+	}
+	return db
+}
+
+// readRow runs a query for a single row on the replica if there is one, or the primary database otherwise.
+// With ReplicaFallback, rows that don't exist on the replica (yet) are requested from the primary database.
+func readRow(query string, args []interface{}, dest ...interface{}) error {
+	ctx, cancel := queryContext()
+	defer cancel()
+
+	err := readDB().QueryRowContext(ctx, query, args...).Scan(dest...)
+	if err == sql.ErrNoRows && replica != nil && ReplicaFallback {
+		err = db.QueryRowContext(ctx, query, args...).Scan(dest...)
+	}
+	return timeoutError(err)
+}
+
+// execTx executes a query in the transaction if there is one, or on the given database otherwise.
+func execTx(ctx context.Context, handle *sql.DB, tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	if tx != nil {
+		return tx.ExecContext(ctx, query, args...)
+	}
+	return handle.ExecContext(ctx, query, args...)
+}
+
+// readDocumentRow runs a query for a single row with the database ID of a document as only argument, on the shard containing
+// the document if there are shards, like readRow() otherwise.
+func readDocumentRow(databaseID string, query string, dest ...interface{}) error {
+	if len(shards) == 0 {
+		return readRow(query, []interface{}{databaseID}, dest...)
+	}
+	ctx, cancel := queryContext()
+	defer cancel()
+	return timeoutError(shardDB(databaseID).QueryRowContext(ctx, query, databaseID).Scan(dest...))
+}
+
 // IsConnected returns true if the database has already been initialized.
 func IsConnected() bool {
 	return isConnected
 }
 
 func cleanup() {
-	stmt, err := db.Prepare("DELETE FROM documents WHERE expiration < CURRENT_TIMESTAMP AND expiration > FROM_UNIXTIME(0)")
-	if err != nil {
-		Log.Errorf("Couldn't initialize cleanup statement: %s", err)
-		return
+	// Statements are prepared when they are needed first, as each shard has its own
+	statements := map[*sql.DB]*sql.Stmt{}
+	for {
+		start := time.Now()
+		eachShard(func(handle *sql.DB) error {
+			stmt, ok := statements[handle]
+			if !ok {
+				var err error
+				stmt, err = handle.Prepare("DELETE FROM documents WHERE expiration < CURRENT_TIMESTAMP AND expiration > FROM_UNIXTIME(0) LIMIT ?")
+				if err != nil {
+					Log.Errorf("Couldn't initialize cleanup statement: %s", err)
+					return nil
+				}
+				statements[handle] = stmt
+			}
+			cleanupExpired(stmt)
+			return nil
+		})
+		atomic.StoreInt64(&cleanupDuration, int64(time.Since(start)))
+
+		if AdaptiveNames {
+			countDocuments()
+		}
+
+		if NotifyBefore > 0 {
+			notifyExpiring()
+		}
+		if RequireConfirmation {
+			purgeUnconfirmed()
+		}
+
+		time.Sleep(10 * time.Minute)
 	}
+}
 
+// cleanupExpired removes expired documents in batches of CleanupBatchSize, pausing for CleanupBatchPause in between to avoid locking the table for too long.
+func cleanupExpired(stmt *sql.Stmt) int64 {
+	var total int64
 	for {
-		result, err := stmt.Exec()
+		result, err := stmt.Exec(CleanupBatchSize)
 		if err != nil {
 			Log.Errorf("Couldn't execute cleanup statement: %s", err)
-		} else {
-			n, err := result.RowsAffected()
-			if err == nil && n > 0 {
-				Log.Debugf("Cleaned up %d documents.", n)
-			}
+			break
 		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			break
+		}
+		atomic.AddUint64(&cleanupBatches, 1)
+		atomic.AddUint64(&cleanupDeleted, uint64(n))
+		total += n
+		if n < int64(CleanupBatchSize) {
+			break
+		}
+		Log.Debugf("Cleaned up %d documents so far, continuing...", total)
+		time.Sleep(CleanupBatchPause)
+	}
 
-		time.Sleep(10 * time.Minute)
+	if total > 0 {
+		Log.Debugf("Cleaned up %d documents.", total)
 	}
+	return total
 }
@@ -0,0 +1,103 @@
+package qbin
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryTimeout(t *testing.T) {
+	f := useFakeDB("timeout", nil)
+	f.delay = time.Second
+	QueryTimeout = 20 * time.Millisecond
+	defer func() { QueryTimeout = 0 }()
+
+	start := time.Now()
+	_, err := Request("cornflake-peddling-bp0q", false)
+	if err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got: %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Request took %s, which is longer than the timeout", time.Since(start))
+	}
+
+	// Maintenance operations respect the timeout, too
+	if err := Rehighlight("cornflake-peddling-bp0q"); err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout from Rehighlight(), got: %v", err)
+	}
+	if _, err := Reencrypt("cornflake-peddling-bp0q"); err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout from Reencrypt(), got: %v", err)
+	}
+}
+
+func TestCleanupBatches(t *testing.T) {
+	remaining := int64(2500)
+	f := useFakeDB("cleanup", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		n := args[0].Value.(int64)
+		if n > remaining {
+			n = remaining
+		}
+		remaining -= n
+		return &fakeRows{affected: n}, nil
+	})
+	CleanupBatchSize = 1000
+	CleanupBatchPause = 0
+	defer func() { CleanupBatchPause = time.Second }()
+
+	stmt, err := db.Prepare("DELETE FROM documents WHERE expiration < CURRENT_TIMESTAMP AND expiration > FROM_UNIXTIME(0) LIMIT ?")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	before := Cleanup()
+	total := cleanupExpired(stmt)
+	if total != 2500 {
+		t.Errorf("Cleaned up %d documents (expected: 2500)", total)
+	}
+	if len(f.Queries()) != 3 {
+		t.Errorf("Cleanup used %d batches (expected: 3)", len(f.Queries()))
+	}
+	// The progress is reported in the metrics
+	if after := Cleanup(); after.Deleted-before.Deleted != 2500 || after.Batches-before.Batches != 3 {
+		t.Errorf("Cleanup metrics counted %d documents in %d batches (expected: 2500 in 3)", after.Deleted-before.Deleted, after.Batches-before.Batches)
+	}
+}
+
+func TestAliasColumn(t *testing.T) {
+	defer func() { NumericAliases, aliasColumn = false, "alias" }()
+	for _, enabled := range []bool{false, true} {
+		NumericAliases, aliasColumn = enabled, "alias"
+		f := useFakeDB("alias-column-"+strconv.FormatBool(enabled), nil)
+		if err := setupDocumentsTable(db); err != nil {
+			t.Fatal(err)
+		}
+		added := false
+		for _, query := range f.Queries() {
+			if strings.HasPrefix(query, "ALTER TABLE `documents` ADD COLUMN `alias`") {
+				added = true
+			}
+		}
+		if added != enabled {
+			t.Errorf("Alias column was added: %t (numeric aliases enabled: %t)", added, enabled)
+		}
+		// Queries mustn't use the missing column
+		if expected := map[bool]string{false: "NULL", true: "alias"}[enabled]; aliasColumn != expected {
+			t.Errorf("Alias column is selected as %s (expected: %s)", aliasColumn, expected)
+		}
+	}
+}
+
+func TestTimeoutError(t *testing.T) {
+	// The driver can return the deadline wrapped in its own errors
+	if err := timeoutError(fmt.Errorf("driver: %w", context.DeadlineExceeded)); err != ErrTimeout {
+		t.Errorf("Wrapped deadline error returned %v (expected: %s)", err, ErrTimeout)
+	}
+	if err := timeoutError(sql.ErrNoRows); err != sql.ErrNoRows {
+		t.Errorf("Other error was replaced: %v", err)
+	}
+}
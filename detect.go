@@ -0,0 +1,257 @@
+package qbin
+
+import (
+	"errors"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SyntaxDetection defines if the syntax of documents uploaded without a syntax is guessed from their content.
+var SyntaxDetection = false
+
+// PersistDetectedSyntax defines if a detected syntax is written to the database, instead of only being used for highlighting.
+// This keeps the syntax of those documents visible to later requests and the syntax statistics.
+var PersistDetectedSyntax = true
+
+// SyntaxMarker uses a first line like "#!go" as the syntax of documents uploaded without a syntax, and removes that line.
+// Shebangs like "#!/usr/bin/env python" are kept, as they contain a path.
+var SyntaxMarker = false
+
+var syntaxMarkerPattern = regexp.MustCompile(`^#!([A-Za-z0-9_+#-]+!?)[ \t]*(?:\n|$)`)
+
+// syntaxFromMarker returns the syntax of a syntax marker in the first line and the content without it. If there's no marker
+// for an existing syntax, it returns an empty syntax and the unchanged content.
+func syntaxFromMarker(content string) (string, string) {
+	match := syntaxMarkerPattern.FindStringSubmatch(content)
+	if match == nil {
+		return "", content
+	}
+	syntax := strings.ToLower(match[1])
+	if syntax != "none" && !SyntaxExists(syntax) {
+		return "", content
+	}
+	return syntax, content[len(match[0]):]
+}
+
+// detectionRule adds its weight to the score of a syntax for every line matching its pattern.
+type detectionRule struct {
+	syntax  string
+	pattern *regexp.Regexp
+	weight  int
+}
+
+var shebangPattern = regexp.MustCompile(`^#!\s*\S*?(?:/env\s+)?([a-z]+)[0-9.]*(?:\s|$)`)
+
+var shebangSyntaxes = map[string]string{
+	"sh":     "bash",
+	"bash":   "bash",
+	"zsh":    "bash",
+	"python": "python",
+	"node":   "javascript",
+	"php":    "php",
+	"ruby":   "ruby",
+	"perl":   "perl",
+}
+
+// ContentTypeSyntaxes maps the media type of an upload (without parameters) to the syntax used if the client didn't specify one.
+var ContentTypeSyntaxes = map[string]string{
+	"application/json":       "json",
+	"application/javascript": "javascript",
+	"text/javascript":        "javascript",
+	"text/html":              "markup",
+	"text/xml":               "markup",
+	"application/xml":        "markup",
+	"image/svg+xml":          "markup",
+	"text/css":               "css",
+	"text/markdown":          "markdown!",
+	"text/x-go":              "go",
+	"text/x-python":          "python",
+	"application/x-python":   "python",
+	"text/x-c":               "c",
+	"text/x-php":             "php",
+	"application/x-php":      "php",
+	"text/x-ruby":            "ruby",
+	"text/x-perl":            "perl",
+	"text/x-shellscript":     "bash",
+	"application/x-sh":       "bash",
+	"application/sql":        "sql",
+	"text/yaml":              "yaml",
+	"application/x-yaml":     "yaml",
+}
+
+// SyntaxFromContentType returns the syntax for a Content-Type header using ContentTypeSyntaxes.
+// It returns an empty string for unknown content types and syntaxes that don't exist in prism-server.
+func SyntaxFromContentType(contentType string) string {
+	mediaType := strings.TrimSpace(strings.ToLower(strings.Split(contentType, ";")[0]))
+	if syntax, ok := ContentTypeSyntaxes[mediaType]; ok && SyntaxExists(syntax) {
+		return syntax
+	}
+	return ""
+}
+
+// ExtensionSyntaxes maps file extensions (without the dot) to syntaxes for SyntaxFromExtension(), if they aren't a syntax
+// name or alias already.
+var ExtensionSyntaxes = map[string]string{
+	"py":   "python",
+	"rb":   "ruby",
+	"pl":   "perl",
+	"sh":   "bash",
+	"md":   "markdown!",
+	"yml":  "yaml",
+	"htm":  "markup",
+	"html": "markup",
+	"xml":  "markup",
+	"svg":  "markup",
+	"h":    "c",
+	"cc":   "cpp",
+	"hpp":  "cpp",
+	"ts":   "typescript",
+	"rs":   "rust",
+	"kt":   "kotlin",
+	"cs":   "csharp",
+	"ps1":  "powershell",
+}
+
+// SyntaxFromExtension returns the syntax for the extension of a file name or URL path (e.g. "/raw.py"), using
+// ExtensionSyntaxes and the aliases of ParseSyntax(). It returns an empty string for unknown extensions and syntaxes that
+// don't exist in prism-server.
+func SyntaxFromExtension(name string) string {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	if ext == "" {
+		return ""
+	}
+	syntax, ok := ExtensionSyntaxes[ext]
+	if !ok {
+		syntax = ParseSyntax(ext)
+	}
+	if SyntaxExists(syntax) {
+		return syntax
+	}
+	return ""
+}
+
+var detectionRules = []detectionRule{
+	{"go", regexp.MustCompile(`^package [a-z_]+$`), 5},
+	{"go", regexp.MustCompile(`^func (\([^)]*\) )?[A-Za-z_]+\(`), 3},
+	{"go", regexp.MustCompile(`:= `), 1},
+	{"python", regexp.MustCompile(`^\s*def [a-z_]+\(.*\):$`), 3},
+	{"python", regexp.MustCompile(`^(from [a-z_.]+ )?import [a-z_., ]+$`), 2},
+	{"python", regexp.MustCompile(`^\s*(if|elif|for|while|with|class) .*:$`), 1},
+	{"javascript", regexp.MustCompile(`^\s*(const|let|var) [A-Za-z_$]+ = `), 2},
+	{"javascript", regexp.MustCompile(`=> \{|function\s*[A-Za-z_$]*\(|console\.log\(`), 2},
+	{"php", regexp.MustCompile(`^<\?php`), 10},
+	{"markup", regexp.MustCompile(`^\s*<(!DOCTYPE|html|head|body|div|\?xml)`), 3},
+	{"json", regexp.MustCompile(`^\s*"[^"]+":\s*("|[0-9\[{]|true|false|null)`), 2},
+	{"bash", regexp.MustCompile(`^\s*(echo|export|cd|sudo|apt-get|fi|done|esac)\b`), 2},
+	{"c", regexp.MustCompile(`^#include\s*[<"]`), 4},
+	{"c", regexp.MustCompile(`^(int|void|char) [a-z_]+\(`), 2},
+	{"css", regexp.MustCompile(`^\s*[a-z-]+:\s*[^;]+;\s*$`), 1},
+	{"css", regexp.MustCompile(`^[.#]?[A-Za-z][\w-]*( [.#]?[\w-]+)*\s*\{$`), 2},
+	{"sql", regexp.MustCompile(`(?i)^\s*(SELECT .* FROM|INSERT INTO|UPDATE .* SET|CREATE TABLE|DELETE FROM)\b`), 3},
+	{"yaml", regexp.MustCompile(`^\s*(- )?[a-z_]+: [^{;]*$`), 1},
+	{"yaml", regexp.MustCompile(`^---$`), 2},
+}
+
+// detectionLines limits how many lines of a document are examined.
+const detectionLines = 200
+
+// minDetectionScore is the score a syntax needs to be detected by DetectSyntax().
+const minDetectionScore = 3
+
+// BlockedDetectedSyntaxes rejects documents whose content is detected as one of these syntaxes, regardless of the syntax
+// given by the uploader, e.g. to block phishing kits recognized as PHP. Only confident detections are blocked, see
+// BlockedDetectionScore.
+var BlockedDetectedSyntaxes []string
+
+// BlockedDetectionScore is the score the best syntax candidate needs to be blocked by BlockedDetectedSyntaxes, which keeps
+// content that only looks a bit like a blocked syntax from being rejected. A matching shebang is always confident enough.
+var BlockedDetectionScore = 10
+
+// ErrBlockedSyntax is returned by Store() if the content is detected as one of BlockedDetectedSyntaxes.
+var ErrBlockedSyntax = errors.New("the detected syntax of the document is blocked")
+
+// checkBlockedSyntax returns ErrBlockedSyntax if the content is confidently detected as one of BlockedDetectedSyntaxes.
+func checkBlockedSyntax(content string) error {
+	if len(BlockedDetectedSyntaxes) == 0 {
+		return nil
+	}
+	candidates := RankSyntaxes(content, 1)
+	if len(candidates) == 0 || (!candidates[0].Shebang && candidates[0].Score < BlockedDetectionScore) {
+		return nil
+	}
+	for _, blocked := range BlockedDetectedSyntaxes {
+		if candidates[0].Syntax == blocked {
+			return ErrBlockedSyntax
+		}
+	}
+	return nil
+}
+
+// SyntaxCandidates defines how many syntaxes Store() returns in Document.SyntaxCandidates when it detects the syntax of a
+// document, e.g. to offer the alternatives to the user. 0 disables the candidates.
+var SyntaxCandidates = 0
+
+// SyntaxCandidate is a syntax matching the content of a document, with the score it got by the detection rules.
+type SyntaxCandidate struct {
+	Syntax string `json:"syntax"`
+	Score  int    `json:"score"`
+	// Shebang is set if the syntax was recognized from the shebang line, which always makes it the best candidate.
+	Shebang bool `json:"shebang,omitempty"`
+}
+
+// DetectSyntax guesses the syntax of a document from its content. It returns an empty string if no syntax is convincing enough.
+// Only syntaxes that exist in prism-server are returned.
+func DetectSyntax(content string) string {
+	candidates := RankSyntaxes(content, 1)
+	if len(candidates) == 0 || (!candidates[0].Shebang && candidates[0].Score < minDetectionScore) {
+		return ""
+	}
+	return candidates[0].Syntax
+}
+
+// RankSyntaxes returns up to n syntaxes matching the content, best first. Unlike DetectSyntax(), it also returns syntaxes
+// that aren't convincing enough to be detected. Only syntaxes that exist in prism-server are returned.
+func RankSyntaxes(content string, n int) []SyntaxCandidate {
+	lines := strings.SplitN(content, "\n", detectionLines+1)
+	if len(lines) > detectionLines {
+		lines = lines[:detectionLines]
+	}
+
+	scores := map[string]int{}
+	for _, line := range lines {
+		for _, rule := range detectionRules {
+			if rule.pattern.MatchString(line) {
+				scores[rule.syntax] += rule.weight
+			}
+		}
+	}
+
+	shebang := ""
+	if match := shebangPattern.FindStringSubmatch(lines[0]); match != nil {
+		if syntax, ok := shebangSyntaxes[match[1]]; ok && SyntaxExists(syntax) {
+			shebang = syntax
+		}
+	}
+
+	candidates := []SyntaxCandidate{}
+	for syntax, score := range scores {
+		if syntax != shebang && SyntaxExists(syntax) {
+			candidates = append(candidates, SyntaxCandidate{Syntax: syntax, Score: score})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].Syntax < candidates[j].Syntax
+	})
+	if shebang != "" {
+		candidates = append([]SyntaxCandidate{{Syntax: shebang, Score: scores[shebang], Shebang: true}}, candidates...)
+	}
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
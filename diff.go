@@ -0,0 +1,331 @@
+package qbin
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxDiffEdits limits the number of changed lines in a diff, as the memory required grows quadratically with it: the
+// trace of the algorithm needs about 8·MaxDiffEdits² bytes (8 MB for 1000 changed lines).
+var MaxDiffEdits = 1000
+
+// MaxDiffLines limits the number of lines between the common beginning and end of two documents that are compared, as the
+// time required grows with it (multiplied by the number of changed lines).
+var MaxDiffLines = 20000
+
+// diffContext is the number of unchanged lines around every change in a hunk.
+const diffContext = 3
+
+// ErrDiffTooLarge is returned if two documents differ in more than MaxDiffEdits lines, or in a range of more than
+// MaxDiffLines lines.
+var ErrDiffTooLarge = errors.New("the documents differ too much")
+
+// ErrNoParent is returned by ForkDiff() if the document wasn't forked from another document.
+var ErrNoParent = errors.New("the document is not a fork")
+
+// ErrParentGone is returned by ForkDiff() if the parent document has been deleted or has expired.
+var ErrParentGone = errors.New("the parent document is gone")
+
+// ErrVolatile is returned by ForkDiff() for volatile documents, which can only be viewed once.
+var ErrVolatile = errors.New("the document can only be viewed once")
+
+// DiffHunk is a group of changes in a unified diff. Lines start with " " (unchanged), "-" (removed) or "+" (added).
+type DiffHunk struct {
+	OldStart int      `json:"oldStart"`
+	OldLines int      `json:"oldLines"`
+	NewStart int      `json:"newStart"`
+	NewLines int      `json:"newLines"`
+	Lines    []string `json:"lines"`
+}
+
+// ForkDiff returns the differences between a fork and its parent document. Unlike Request(), it doesn't count a view.
+// The parent's ID isn't returned, as it might not be known to everybody who knows the fork.
+func ForkDiff(id string) ([]DiffHunk, error) {
+	content, parent, err := plaintext(id)
+	if err != nil {
+		return nil, err
+	}
+	if parent == "" {
+		return nil, ErrNoParent
+	}
+	parentContent, _, err := plaintext(parent)
+	if err == sql.ErrNoRows || err == ErrExpired || err == ErrVolatile {
+		return nil, ErrParentGone
+	} else if err != nil {
+		return nil, err
+	}
+	return Diff(parentContent, content)
+}
+
+// plaintext returns the unhighlighted content of a document and the ID of its parent, without counting a view.
+func plaintext(id string) (string, string, error) {
+	var content string
+	var upload, expiration, rawString, pending, integrity, parentData sql.NullString
+	var encryption, version int
+	databaseID := sha256.Sum256([]byte(id))
+	err := readDocumentRow(hex.EncodeToString(databaseID[:]), "SELECT content, upload, expiration, raw, pending, encryption, key_version, integrity, parent FROM documents WHERE id = ?",
+		&content, &upload, &expiration, &rawString, &pending, &encryption, &version, &integrity, &parentData)
+	if err == nil && pending.Valid {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	uploadTime, err := parseUpload(upload)
+	if err != nil {
+		return "", "", err
+	}
+	if expiration.Valid {
+		t, err := time.Parse("2006-01-02 15:04:05", expiration.String)
+		if err != nil {
+			return "", "", err
+		}
+		switch DocumentState(t) {
+		case StateExpired:
+			return "", "", ErrExpired
+		case StateVolatile:
+			return "", "", ErrVolatile
+		}
+	}
+
+	key, err := documentKey(encryption, version, id, uploadTime)
+	if err != nil {
+		return "", "", err
+	}
+	text, _, err := decryptContent(hex.EncodeToString(databaseID[:]), key, storedContent{content, rawString, integrity}, true)
+	if err != nil {
+		return "", "", err
+	}
+
+	parent := ""
+	if parentData.Valid {
+		p, err := decrypt([]byte(parentData.String), key)
+		if err != nil {
+			Log.Errorf("AES error: %s", err)
+			countDecryptionFailure()
+			return "", "", err
+		}
+		parent = string(p)
+	}
+	return text, parent, nil
+}
+
+// Diff computes the line-based differences between two texts using the Myers algorithm.
+func Diff(a string, b string) ([]DiffHunk, error) {
+	ops, err := diffOps(splitLines(a), splitLines(b))
+	if err != nil {
+		return nil, err
+	}
+	return diffHunks(ops), nil
+}
+
+// UnifiedDiff formats hunks in the unified diff format, as used by diff -u and git.
+func UnifiedDiff(oldName string, newName string, hunks []DiffHunk) string {
+	if len(hunks) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("--- " + oldName + "\n+++ " + newName + "\n")
+	for _, hunk := range hunks {
+		b.WriteString("@@ -" + hunkRange(hunk.OldStart, hunk.OldLines) + " +" + hunkRange(hunk.NewStart, hunk.NewLines) + " @@\n")
+		for _, line := range hunk.Lines {
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.String()
+}
+
+func hunkRange(start int, lines int) string {
+	if lines == 1 {
+		return strconv.Itoa(start)
+	}
+	return strconv.Itoa(start) + "," + strconv.Itoa(lines)
+}
+
+// splitLines splits a text into lines, ignoring the final new line.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffOp is a single line of the edit script, with the kind " ", "-" or "+".
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffOps returns the shortest edit script to transform a into b.
+func diffOps(a []string, b []string) ([]diffOp, error) {
+	// Common prefixes and suffixes don't need the expensive part
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	middle, err := myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, middle...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops, nil
+}
+
+// myers implements "An O(ND) Difference Algorithm and Its Variations" (Eugene W. Myers, 1986).
+func myers(a []string, b []string) ([]diffOp, error) {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil, nil
+	}
+	if max > MaxDiffLines {
+		return nil, ErrDiffTooLarge
+	}
+	// The diagonals k are within -d..d, so they're bounded by MaxDiffEdits
+	limit := max
+	if limit > MaxDiffEdits {
+		limit = MaxDiffEdits
+	}
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	trace := [][]int{}
+	for d := 0; d <= max; d++ {
+		if d > limit {
+			return nil, ErrDiffTooLarge
+		}
+		trace = append(trace, append([]int{}, v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return myersBacktrack(a, b, trace, d), nil
+			}
+		}
+	}
+	return nil, ErrDiffTooLarge
+}
+
+// myersBacktrack follows the furthest reaching paths stored in trace back to the start, to build the edit script.
+// trace[d] contains v[-d-1..d+1] before step d.
+func myersBacktrack(a []string, b []string, trace [][]int, depth int) []diffOp {
+	x, y := len(a), len(b)
+	reversed := []diffOp{}
+	for d := depth; d > 0; d-- {
+		v := trace[d]
+		get := func(k int) int { return v[k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && get(k-1) < get(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := get(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			reversed = append(reversed, diffOp{' ', a[x]})
+		}
+		if x == prevX {
+			y--
+			reversed = append(reversed, diffOp{'+', b[y]})
+		} else {
+			x--
+			reversed = append(reversed, diffOp{'-', a[x]})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		reversed = append(reversed, diffOp{' ', a[x]})
+	}
+
+	ops := make([]diffOp, len(reversed))
+	for i, op := range reversed {
+		ops[len(reversed)-1-i] = op
+	}
+	return ops
+}
+
+// diffHunks groups an edit script into hunks with diffContext unchanged lines around the changes.
+func diffHunks(ops []diffOp) []DiffHunk {
+	hunks := []DiffHunk{}
+	var hunk *DiffHunk
+	oldLine, newLine := 1, 1
+	for i, op := range ops {
+		if op.kind != ' ' || nearChange(ops, i) {
+			if hunk == nil {
+				hunk = &DiffHunk{OldStart: oldLine, NewStart: newLine}
+			}
+			hunk.Lines = append(hunk.Lines, string(op.kind)+op.line)
+			if op.kind != '+' {
+				hunk.OldLines++
+			}
+			if op.kind != '-' {
+				hunk.NewLines++
+			}
+		} else if hunk != nil {
+			hunks = append(hunks, *hunk)
+			hunk = nil
+		}
+		if op.kind != '+' {
+			oldLine++
+		}
+		if op.kind != '-' {
+			newLine++
+		}
+	}
+	if hunk != nil {
+		hunks = append(hunks, *hunk)
+	}
+
+	// Like diff -u, empty ranges start at the line before them
+	for i := range hunks {
+		if hunks[i].OldLines == 0 {
+			hunks[i].OldStart--
+		}
+		if hunks[i].NewLines == 0 {
+			hunks[i].NewStart--
+		}
+	}
+	return hunks
+}
+
+// nearChange checks if there's a change within diffContext lines of an unchanged line.
+func nearChange(ops []diffOp, i int) bool {
+	for j := i - diffContext; j <= i+diffContext; j++ {
+		if j >= 0 && j < len(ops) && ops[j].kind != ' ' {
+			return true
+		}
+	}
+	return false
+}
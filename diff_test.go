@@ -0,0 +1,141 @@
+package qbin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	old := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\n"
+	changed := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+	hunks, err := Diff(old, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "--- old\n+++ new\n" +
+		"@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n" +
+		"@@ -9,3 +9,4 @@\n i\n j\n k\n+l\n"
+	if diff := UnifiedDiff("old", "new", hunks); diff != expected {
+		t.Errorf("Unexpected diff:\n%s\nExpected:\n%s", diff, expected)
+	}
+
+	// Removing everything results in an empty new range
+	hunks, err = Diff("x\ny\n", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hunks) != 1 || hunks[0].NewStart != 0 || hunks[0].NewLines != 0 || hunks[0].OldLines != 2 {
+		t.Errorf("Unexpected hunks for a removal: %+v", hunks)
+	}
+
+	if hunks, _ := Diff(old, old); len(hunks) != 0 || UnifiedDiff("old", "new", hunks) != "" {
+		t.Errorf("Identical texts have differences: %+v", hunks)
+	}
+}
+
+func TestDiffApplies(t *testing.T) {
+	// Applying the hunks to the old text must always result in the new text
+	r := rand.New(rand.NewSource(1))
+	randomText := func() []string {
+		lines := make([]string, r.Intn(30))
+		for i := range lines {
+			lines[i] = strconv.Itoa(r.Intn(5))
+		}
+		return lines
+	}
+	for i := 0; i < 200; i++ {
+		a, b := randomText(), randomText()
+		hunks, err := Diff(strings.Join(a, "\n"), strings.Join(b, "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := []string{}
+		position := 0
+		for _, hunk := range hunks {
+			start := hunk.OldStart - 1
+			if hunk.OldLines == 0 {
+				start++
+			}
+			result = append(result, a[position:start]...)
+			for _, line := range hunk.Lines {
+				if line[0] != '-' {
+					result = append(result, line[1:])
+				}
+			}
+			position = start + hunk.OldLines
+		}
+		result = append(result, a[position:]...)
+		if !reflect.DeepEqual(result, b) && !(len(result) == 0 && len(b) == 0) {
+			t.Fatalf("Applying the diff of %v and %v resulted in %v", a, b, result)
+		}
+	}
+}
+
+func TestDiffTooLarge(t *testing.T) {
+	defer func() { MaxDiffEdits, MaxDiffLines = 1000, 20000 }()
+	MaxDiffEdits = 3
+	if _, err := Diff("a\nb\nc\n", "d\ne\nf\n"); err != ErrDiffTooLarge {
+		t.Errorf("Expected ErrDiffTooLarge, got %v", err)
+	}
+	if _, err := Diff("a\nb\nc\n", "a\nx\nc\n"); err != nil {
+		t.Errorf("Diff within the limits failed: %s", err)
+	}
+
+	// Long documents are rejected before comparing them, unless they only differ in a short range
+	MaxDiffEdits, MaxDiffLines = 1000, 4
+	if _, err := Diff("a\nb\nc\n", "d\ne\nf\n"); err != ErrDiffTooLarge {
+		t.Errorf("Expected ErrDiffTooLarge for too many lines, got %v", err)
+	}
+	if _, err := Diff("a\nb\nc\nd\ne\n", "a\nb\nx\nd\ne\n"); err != nil {
+		t.Errorf("Diff with a short changed range failed: %s", err)
+	}
+}
+
+func TestForkDiff(t *testing.T) {
+	rows := storedDocumentsDB("fork-diff")
+
+	parent := Document{Content: "package main\n\nfunc main() {\n\tprintln(\"hello\")\n}\n", Syntax: "none"}
+	if err := Store(&parent); err != nil {
+		t.Fatal(err)
+	}
+	fork := Document{Content: "package main\n\nfunc main() {\n\tprintln(\"hello, world\")\n}\n", Syntax: "none", Parent: parent.ID}
+	if err := Store(&fork); err != nil {
+		t.Fatal(err)
+	}
+
+	hunks, err := ForkDiff(fork.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DiffHunk{{OldStart: 1, OldLines: 5, NewStart: 1, NewLines: 5, Lines: []string{
+		" package main", " ", " func main() {", "-\tprintln(\"hello\")", "+\tprintln(\"hello, world\")", " }",
+	}}}
+	if !reflect.DeepEqual(hunks, expected) {
+		t.Errorf("Unexpected diff: %+v", hunks)
+	}
+
+	// The parent ID must not be stored in plain text
+	databaseID := sha256.Sum256([]byte(fork.ID))
+	if stored := rows[hex.EncodeToString(databaseID[:])][12]; stored == nil || strings.Contains(stored.(string), parent.ID) {
+		t.Errorf("Parent wasn't stored encrypted: %v", stored)
+	}
+
+	if _, err := ForkDiff(parent.ID); err != ErrNoParent {
+		t.Errorf("Expected ErrNoParent for a document that isn't a fork, got %v", err)
+	}
+
+	parentID := sha256.Sum256([]byte(parent.ID))
+	delete(rows, hex.EncodeToString(parentID[:]))
+	if _, err := ForkDiff(fork.ID); err != ErrParentGone {
+		t.Errorf("Expected ErrParentGone after deleting the parent, got %v", err)
+	}
+
+	if err := Store(&Document{Content: "orphan", Syntax: "none", Parent: parent.ID}); err != ErrInvalidParent {
+		t.Errorf("Expected ErrInvalidParent for a deleted parent, got %v", err)
+	}
+}
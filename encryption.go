@@ -3,12 +3,206 @@ package qbin
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"errors"
 	"io"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ScryptConcurrency limits how many scrypt key derivations can run at the same time, as every one of them requires 16 MB of memory.
+// Further derivations wait for a free slot. 0 disables the limit.
+var ScryptConcurrency = 4 * runtime.NumCPU()
+
+// ScryptQueueTimeout defines how long a key derivation waits for a free slot before ErrBusy is returned. 0 waits forever.
+var ScryptQueueTimeout = 10 * time.Second
+
+// ErrBusy is returned if a key derivation couldn't get a slot within ScryptQueueTimeout.
+var ErrBusy = errors.New("too many concurrent key derivations")
+
+var scryptKey = scrypt.Key
+var scryptSlots chan struct{}
+var scryptSlotsMutex sync.Mutex
+
+// acquireScrypt waits for a free scrypt slot, and returns the function to release it again.
+func acquireScrypt() (func(), error) {
+	scryptSlotsMutex.Lock()
+	if ScryptConcurrency <= 0 {
+		scryptSlotsMutex.Unlock()
+		return func() {}, nil
+	}
+	if scryptSlots == nil || cap(scryptSlots) != ScryptConcurrency {
+		scryptSlots = make(chan struct{}, ScryptConcurrency)
+	}
+	slots := scryptSlots
+	scryptSlotsMutex.Unlock()
+
+	release := func() { <-slots }
+	if ScryptQueueTimeout <= 0 {
+		slots <- struct{}{}
+		return release, nil
+	}
+	timeout := time.NewTimer(ScryptQueueTimeout)
+	defer timeout.Stop()
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-timeout.C:
+		Log.Warningf("No scrypt slot available after %s, rejecting request.", ScryptQueueTimeout)
+		return nil, ErrBusy
+	}
+}
+
+// DecryptionAlertThreshold is the number of decryption failures within DecryptionAlertWindow that raise a critical alert.
+// Failures spike after configuration mistakes like a wrong master key, and when the database is corrupted. 0 disables the alert.
+var DecryptionAlertThreshold = 0
+
+// DecryptionAlertWindow is the time window for DecryptionAlertThreshold. There's at most one alert per window.
+var DecryptionAlertWindow = 5 * time.Minute
+
+var decryptionFailures uint64
+var recentDecryptionFailures []time.Time
+var lastDecryptionAlert time.Time
+var decryptionAlertMutex sync.Mutex
+
+// DecryptionFailures returns the number of documents that couldn't be decrypted since the start.
+func DecryptionFailures() uint64 {
+	return atomic.LoadUint64(&decryptionFailures)
+}
+
+// countDecryptionFailure counts a failed decryption, and raises an alert if DecryptionAlertThreshold is reached.
+func countDecryptionFailure() {
+	atomic.AddUint64(&decryptionFailures, 1)
+	if DecryptionAlertThreshold <= 0 {
+		return
+	}
+
+	now := time.Now()
+	decryptionAlertMutex.Lock()
+	defer decryptionAlertMutex.Unlock()
+	recent := append(recentDecryptionFailures, now)
+	for len(recent) > 0 && (now.Sub(recent[0]) > DecryptionAlertWindow || len(recent) > DecryptionAlertThreshold) {
+		recent = recent[1:]
+	}
+	recentDecryptionFailures = recent
+	if len(recent) >= DecryptionAlertThreshold && now.Sub(lastDecryptionAlert) > DecryptionAlertWindow {
+		lastDecryptionAlert = now
+		Log.Criticalf("%d documents couldn't be decrypted within %s! Check the encryption configuration (master key, scrypt parameters) and the database for corruption.", len(recent), DecryptionAlertWindow)
+	}
+}
+
+// Encryption strategies, stored with every document so documents from different configurations can be decrypted.
+const (
+	// EncryptionScrypt derives the key from the document ID and upload time using scrypt.
+	EncryptionScrypt = 0
+	// EncryptionMasterKey derives the key from the document ID and MasterKey using HMAC-SHA256, which is much faster than scrypt.
+	EncryptionMasterKey = 1
+	// EncryptionNone stores the document in plain text, see Document.Unencrypted.
+	EncryptionNone = 2
 )
 
+// AllowUnencrypted allows storing documents without server-side encryption (see Document.Unencrypted), e.g. public snippets
+// that don't need the scrypt overhead. Anyone with access to the database can read those documents.
+var AllowUnencrypted = false
+
+// ErrUnencryptedNotAllowed is returned by Store() for unencrypted documents if AllowUnencrypted is disabled.
+var ErrUnencryptedNotAllowed = errors.New("unencrypted documents are not allowed")
+
+// MasterKey enables EncryptionMasterKey for new documents if it's set. It must be 32 bytes long.
+// Documents are still encrypted with a different key each, so the document ID is required for decryption, but anyone with the
+// master key can try to brute-force IDs a lot faster than with scrypt. Only use this for trusted single-tenant deployments.
+var MasterKey []byte
+
+// ErrNoMasterKey is returned if a document was encrypted with EncryptionMasterKey, but no master key is configured.
+var ErrNoMasterKey = errors.New("the document requires the master key")
+
+// ScryptParams are the cost parameters of a scrypt key derivation.
+type ScryptParams struct {
+	N, R, P int
+}
+
+// ScryptVersions contains all scrypt parameters that have been used for documents, indexed by the key version stored with every document.
+// New documents use the last entry, so stronger parameters can be appended at any time. Entries must never be removed or changed,
+// as the documents encrypted with them couldn't be decrypted anymore.
+var ScryptVersions = []ScryptParams{{N: 16384, R: 8, P: 1}}
+
+// encryptionStrategy returns the strategy and key version used for new documents.
+func encryptionStrategy() (int, int) {
+	if MasterKey != nil {
+		return EncryptionMasterKey, 0
+	}
+	return EncryptionScrypt, len(ScryptVersions) - 1
+}
+
+// documentKey generates the AES key for a document using the given strategy and key version.
+// EncryptionNone has no key, which makes encrypt() and decrypt() return the data unchanged.
+func documentKey(strategy int, version int, id string, upload time.Time) ([]byte, error) {
+	switch strategy {
+	case EncryptionNone:
+		return nil, nil
+	case EncryptionScrypt:
+		return deriveKey(id, upload, version)
+	case EncryptionMasterKey:
+		if MasterKey == nil {
+			return nil, ErrNoMasterKey
+		}
+		mac := hmac.New(sha256.New, MasterKey)
+		mac.Write([]byte(id))
+		return mac.Sum(nil), nil
+	}
+	return nil, errors.New("unknown encryption strategy " + strconv.Itoa(strategy))
+}
+
+// integrityHash returns a hash of the plaintext content for IntegrityCheck. It's keyed with the document key, so it doesn't reveal anything about the content.
+func integrityHash(content []byte, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(content)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// integrityValue returns the integrity hash to store for the content, or NULL if IntegrityCheck is disabled.
+func integrityValue(content []byte, key []byte) sql.NullString {
+	if !IntegrityCheck {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: integrityHash(content, key), Valid: true}
+}
+
+// deriveKey generates the AES key for a document from its ID and upload time, using the scrypt parameters of the given key version.
+func deriveKey(id string, upload time.Time, version int) ([]byte, error) {
+	if version < 0 || version >= len(ScryptVersions) {
+		return nil, errors.New("unknown scrypt parameter version " + strconv.Itoa(version))
+	}
+	params := ScryptVersions[version]
+
+	release, err := acquireScrypt()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	key, err := scryptKey([]byte(id), []byte(upload.UTC().Format("2006-01-02 15:04:05")), params.N, params.R, params.P, 24)
+	if err != nil {
+		Log.Errorf("Invalid scrypt parameters: %s", err)
+		return nil, err
+	}
+	return key, nil
+}
+
 func encrypt(plaintext []byte, key []byte) ([]byte, error) {
+	if key == nil {
+		// EncryptionNone
+		return plaintext, nil
+	}
 	c, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -28,6 +222,10 @@ func encrypt(plaintext []byte, key []byte) ([]byte, error) {
 }
 
 func decrypt(ciphertext []byte, key []byte) ([]byte, error) {
+	if key == nil {
+		// EncryptionNone
+		return ciphertext, nil
+	}
 	c, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,506 @@
+package qbin
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+	"golang.org/x/crypto/scrypt"
+)
+
+func TestScryptConcurrency(t *testing.T) {
+	defer func(concurrency int, timeout time.Duration, key func([]byte, []byte, int, int, int, int) ([]byte, error)) {
+		ScryptConcurrency = concurrency
+		ScryptQueueTimeout = timeout
+		scryptKey = key
+	}(ScryptConcurrency, ScryptQueueTimeout, scryptKey)
+	ScryptConcurrency = 3
+
+	var mutex sync.Mutex
+	running, maximum := 0, 0
+	scryptKey = func(password, salt []byte, N, r, p, keyLen int) ([]byte, error) {
+		mutex.Lock()
+		running++
+		if running > maximum {
+			maximum = running
+		}
+		mutex.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		return make([]byte, keyLen), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := deriveKey("cornflake-peddling-bp0q", time.Now(), 0); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if maximum != 3 {
+		t.Errorf("%d key derivations ran at the same time (expected: 3)", maximum)
+	}
+
+	// Requests are shed if no slot becomes available in time
+	ScryptConcurrency = 1
+	ScryptQueueTimeout = 5 * time.Millisecond
+	done := make(chan error)
+	go func() {
+		_, err := deriveKey("cornflake-peddling-bp0q", time.Now(), 0)
+		done <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	if _, err := deriveKey("cornflake-peddling-bp0q", time.Now(), 0); err != ErrBusy {
+		t.Errorf("Key derivation without a free slot returned %v (expected: %s)", err, ErrBusy)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+// storedDocumentsDB replaces the database with a fake that keeps inserted documents in memory and returns them to Request().
+// The returned rows are indexed by the database ID and contain the columns content, custom, syntax, upload, expiration, views,
+// raw, pending, highlight_skipped, encryption, integrity, key_version, parent and content_hash.
+func storedDocumentsDB(name string) map[string][]driver.Value {
+	var mutex sync.Mutex
+	rows := map[string][]driver.Value{}
+	useFakeDB(name, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if strings.HasPrefix(query, "INSERT INTO documents") {
+			// id, content, custom, syntax, upload, expiration, views, raw, notify, pending, fingerprint, highlight_skipped, encryption, integrity, key_version, parent, content_hash, collection, collection_entry
+			v := make([]driver.Value, len(args))
+			for i, arg := range args {
+				v[i] = arg.Value
+			}
+			rows[v[0].(string)] = []driver.Value{v[1], v[2], v[3], v[4], v[5], v[6], v[7], v[9], v[11], v[12], v[13], v[14], v[15], v[16], v[17], v[18]}
+			return &fakeRows{affected: 1}, nil
+		} else if strings.HasPrefix(query, "SELECT collection_entry, syntax, upload, expiration FROM documents WHERE collection = ?") {
+			result := &fakeRows{columns: []string{"collection_entry", "syntax", "upload", "expiration"}}
+			for _, row := range rows {
+				if collection, ok := row[14].(string); ok && collection == args[0].Value {
+					result.values = append(result.values, []driver.Value{row[15], row[2], row[3], row[4]})
+				}
+			}
+			return result, nil
+		} else if strings.HasPrefix(query, "DELETE FROM documents WHERE id = ?") {
+			if _, ok := rows[args[0].Value.(string)]; !ok {
+				return &fakeRows{}, nil
+			}
+			delete(rows, args[0].Value.(string))
+			return &fakeRows{affected: 1}, nil
+		} else if strings.HasPrefix(query, "SELECT COUNT(id) FROM documents WHERE id = ?") {
+			count := int64(0)
+			if _, ok := rows[args[0].Value.(string)]; ok {
+				count = 1
+			}
+			return &fakeRows{columns: []string{"count"}, values: [][]driver.Value{{count}}}, nil
+		} else if strings.HasPrefix(query, "SELECT COUNT(id) FROM documents WHERE content_hash = ?") {
+			count := int64(0)
+			for _, row := range rows {
+				if hash, ok := row[13].(string); ok && hash == args[0].Value {
+					count++
+				}
+			}
+			return &fakeRows{columns: []string{"count"}, values: [][]driver.Value{{count}}}, nil
+		} else if strings.HasPrefix(query, "SELECT content, custom, syntax, upload, expiration, views, raw, pending, highlight_skipped, encryption, integrity, key_version, content_hash FROM documents WHERE id = ?") {
+			result := &fakeRows{columns: documentColumns}
+			if row, ok := rows[args[0].Value.(string)]; ok {
+				result.values = [][]driver.Value{append(append([]driver.Value{}, row[:12]...), row[13])}
+			}
+			return result, nil
+		} else if strings.HasPrefix(query, "SELECT content, custom, syntax, upload, expiration, views, raw, pending, encryption, key_version, integrity FROM documents WHERE id = ?") {
+			result := &fakeRows{columns: []string{"content", "custom", "syntax", "upload", "expiration", "views", "raw", "pending", "encryption", "key_version", "integrity"}}
+			if row, ok := rows[args[0].Value.(string)]; ok {
+				result.values = [][]driver.Value{append(append([]driver.Value{}, row[:8]...), row[9], row[11], row[10])}
+			}
+			return result, nil
+		} else if strings.HasPrefix(query, "SELECT content, upload, expiration, raw, pending, encryption, key_version, integrity, parent FROM documents WHERE id = ?") {
+			result := &fakeRows{columns: []string{"content", "upload", "expiration", "raw", "pending", "encryption", "key_version", "integrity", "parent"}}
+			if row, ok := rows[args[0].Value.(string)]; ok {
+				result.values = [][]driver.Value{{row[0], row[3], row[4], row[6], row[7], row[9], row[11], row[10], row[12]}}
+			}
+			return result, nil
+		} else if strings.HasPrefix(query, "SELECT content, raw, upload, encryption, key_version, integrity, alias, alias_target, parent FROM documents WHERE id = ?") {
+			result := &fakeRows{columns: []string{"content", "raw", "upload", "encryption", "key_version", "integrity", "alias", "alias_target", "parent"}}
+			if row, ok := rows[args[0].Value.(string)]; ok {
+				result.values = [][]driver.Value{{row[0], row[6], row[3], row[9], row[11], row[10], nil, nil, row[12]}}
+			}
+			return result, nil
+		} else if strings.HasPrefix(query, "SELECT highlight_skipped FROM documents WHERE id = ? AND pending IS NULL") {
+			result := &fakeRows{columns: []string{"highlight_skipped"}}
+			if row, ok := rows[args[0].Value.(string)]; ok && row[7] == nil {
+				result.values = [][]driver.Value{{row[8]}}
+			}
+			return result, nil
+		} else if strings.HasPrefix(query, "SELECT custom, syntax, upload, raw, encryption, key_version FROM documents WHERE id = ?") {
+			result := &fakeRows{columns: []string{"custom", "syntax", "upload", "raw", "encryption", "key_version"}}
+			if row, ok := rows[args[0].Value.(string)]; ok {
+				result.values = [][]driver.Value{{row[1], row[2], row[3], row[6], row[9], row[11]}}
+			}
+			return result, nil
+		} else if strings.HasPrefix(query, "UPDATE documents SET content = ?, highlight_skipped = 0, integrity = ? WHERE id = ?") {
+			if row, ok := rows[args[2].Value.(string)]; ok {
+				row[0], row[8], row[10] = args[0].Value, false, args[1].Value
+			}
+			return &fakeRows{affected: 1}, nil
+		} else if strings.HasPrefix(query, "UPDATE documents SET content = ?, raw = ?, alias_target = ?, parent = ?, integrity = ?, encryption = ?, key_version = ? WHERE id = ? AND encryption = ? AND key_version = ?") {
+			row, ok := rows[args[7].Value.(string)]
+			if !ok || row[9] != args[8].Value || row[11] != args[9].Value {
+				return &fakeRows{}, nil
+			}
+			row[0], row[6], row[12], row[10], row[9], row[11] = args[0].Value, args[1].Value, args[3].Value, args[4].Value, args[5].Value, args[6].Value
+			return &fakeRows{affected: 1}, nil
+		}
+		return nil, nil
+	})
+	return rows
+}
+
+func TestMasterKeyEncryption(t *testing.T) {
+	defer func(key func([]byte, []byte, int, int, int, int) ([]byte, error)) {
+		MasterKey = nil
+		scryptKey = key
+	}(scryptKey)
+	var mutex sync.Mutex
+	scryptCalls := 0
+	scryptKey = func(password, salt []byte, N, r, p, keyLen int) ([]byte, error) {
+		mutex.Lock()
+		scryptCalls++
+		mutex.Unlock()
+		return scrypt.Key(password, salt, N, r, p, keyLen)
+	}
+	storedDocumentsDB("master-key")
+
+	// Scrypt document from before the master key was configured
+	scryptDoc := Document{Content: "scrypt", Syntax: "none"}
+	if err := Store(&scryptDoc); err != nil {
+		t.Fatal(err)
+	}
+
+	MasterKey = make([]byte, 32)
+	rand.Read(MasterKey)
+	calls := scryptCalls
+	masterDoc := Document{Content: "master key", Syntax: "none"}
+	if err := Store(&masterDoc); err != nil {
+		t.Fatal(err)
+	}
+	if masterDoc.Encryption != EncryptionMasterKey || scryptCalls != calls {
+		t.Errorf("Document wasn't encrypted with the master key (strategy: %d, scrypt calls: %d)", masterDoc.Encryption, scryptCalls-calls)
+	}
+
+	// Both documents must be readable with the master key configured
+	for _, expected := range []Document{scryptDoc, masterDoc} {
+		doc, err := Request(expected.ID, false)
+		if err != nil {
+			t.Errorf("Couldn't request %s document: %s", expected.Content, err)
+		} else if doc.Content != expected.Content || doc.Encryption != expected.Encryption {
+			t.Errorf("Decrypted %q with strategy %d (expected: %q with strategy %d)", doc.Content, doc.Encryption, expected.Content, expected.Encryption)
+		}
+	}
+
+	// A different master key must not decrypt the document
+	MasterKey = make([]byte, 32)
+	if doc, _ := Request(masterDoc.ID, false); doc.Content == masterDoc.Content {
+		t.Errorf("Document was decrypted with the wrong master key")
+	}
+
+	// Without the master key, only the scrypt document is readable
+	MasterKey = nil
+	if _, err := Request(scryptDoc.ID, false); err != nil {
+		t.Errorf("Couldn't request scrypt document without master key: %s", err)
+	}
+	if _, err := Request(masterDoc.ID, false); err != ErrNoMasterKey {
+		t.Errorf("Requesting a master key document without master key returned %v (expected: %s)", err, ErrNoMasterKey)
+	}
+}
+
+func TestUnencryptedDocuments(t *testing.T) {
+	defer func() { AllowUnencrypted, IntegrityCheck, LazyReencryption = false, false, false }()
+	rows := storedDocumentsDB("unencrypted")
+
+	if err := Store(&Document{Content: "plain", Syntax: "none", Unencrypted: true}); err != ErrUnencryptedNotAllowed {
+		t.Errorf("Unencrypted document was stored without AllowUnencrypted: %v", err)
+	}
+
+	AllowUnencrypted, IntegrityCheck, LazyReencryption = true, true, true
+	documents := []Document{
+		{Content: "encrypted", Syntax: "none"},
+		{Content: "plain", Syntax: "none", Unencrypted: true},
+		{Content: "also encrypted", Syntax: "none"},
+		{Content: "also plain", Syntax: "none", Unencrypted: true},
+	}
+	for i := range documents {
+		if err := Store(&documents[i]); err != nil {
+			t.Fatal(err)
+		}
+		databaseID := sha256.Sum256([]byte(documents[i].ID))
+		stored := rows[hex.EncodeToString(databaseID[:])][0].(string)
+		if documents[i].Unencrypted && (documents[i].Encryption != EncryptionNone || stored != documents[i].Highlighted) {
+			t.Errorf("Document %q wasn't stored in plain text: %q (strategy %d)", documents[i].Content, stored, documents[i].Encryption)
+		} else if !documents[i].Unencrypted && (documents[i].Encryption == EncryptionNone || strings.Contains(stored, "encrypted")) {
+			t.Errorf("Document %q wasn't encrypted: %q", documents[i].Content, stored)
+		}
+	}
+
+	for _, expected := range documents {
+		doc, err := Request(expected.ID, true)
+		if err != nil {
+			t.Errorf("Couldn't request %q: %s", expected.Content, err)
+		} else if doc.Content != expected.Content || doc.Unencrypted != expected.Unencrypted {
+			t.Errorf("Requested %q (unencrypted: %t), expected %q (unencrypted: %t)", doc.Content, doc.Unencrypted, expected.Content, expected.Unencrypted)
+		}
+		// Unencrypted documents must not be encrypted by the re-encryption
+		if reencrypted, err := Reencrypt(expected.ID); err != nil || reencrypted {
+			t.Errorf("Document %q was re-encrypted: %t, %v", expected.Content, reencrypted, err)
+		}
+	}
+}
+
+func TestIntegrityCheck(t *testing.T) {
+	IntegrityCheck = true
+	defer func() { IntegrityCheck = false }()
+	rows := storedDocumentsDB("integrity")
+
+	doc := Document{Content: "Hello World", Syntax: "none"}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	databaseID := sha256.Sum256([]byte(doc.ID))
+	row := rows[hex.EncodeToString(databaseID[:])]
+	if row[10] == nil {
+		t.Fatalf("No integrity hash was stored")
+	}
+	if requested, err := Request(doc.ID, false); err != nil || requested.Content != doc.Highlighted {
+		t.Fatalf("Intact document failed the integrity check: %v", err)
+	}
+
+	// Bit rot in the stored blob
+	stored := row[0].(string)
+	corrupted := []byte(stored)
+	corrupted[len(corrupted)/2] ^= 0x01
+	row[0] = string(corrupted)
+	if requested, err := Request(doc.ID, false); err != ErrCorrupted {
+		t.Errorf("Corrupted document was served (error: %v): %q", err, requested.Content)
+	}
+
+	// Content that decrypts fine, but isn't what was stored
+	key, _ := documentKey(doc.Encryption, doc.KeyVersion, doc.ID, doc.Upload)
+	other, _ := encrypt([]byte("Hello Garbage"), key)
+	row[0] = string(other)
+	if requested, err := Request(doc.ID, false); err != ErrCorrupted {
+		t.Errorf("Document with wrong content was served (error: %v): %q", err, requested.Content)
+	}
+}
+
+func TestDecryptContent(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	seal := func(content string) string {
+		data, err := encrypt([]byte(content), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	highlighted, original := "<span>a &lt; b</span>", "a < b"
+	stored := storedContent{seal(highlighted), sql.NullString{String: seal(original), Valid: true}, sql.NullString{String: integrityHash([]byte(highlighted), key), Valid: true}}
+	originalOnly := storedContent{"", stored.raw, sql.NullString{String: integrityHash([]byte(original), key), Valid: true}}
+	withoutOriginal := storedContent{stored.content, sql.NullString{}, stored.integrity}
+
+	tests := []struct {
+		name     string
+		stored   storedContent
+		plain    bool
+		expected string
+	}{
+		{"highlighted", stored, false, highlighted},
+		{"original", stored, true, original},
+		{"original only", originalOnly, false, original},
+		{"plain original only", originalOnly, true, original},
+		{"stripped", withoutOriginal, true, "a < b"},
+	}
+	for _, test := range tests {
+		if content, legacy, err := decryptContent("test", key, test.stored, test.plain); err != nil || legacy || content != test.expected {
+			t.Errorf("%s content returned %q (legacy: %t, error: %v)", test.name, content, legacy, err)
+		}
+	}
+
+	// The integrity hash is checked for every way of reading the content that it covers
+	originalOnly.raw.String = seal("a > b")
+	for _, plain := range []bool{false, true} {
+		if _, _, err := decryptContent("test", key, originalOnly, plain); err != ErrCorrupted {
+			t.Errorf("Changed original content wasn't detected (plain: %t): %v", plain, err)
+		}
+	}
+}
+
+func TestScryptVersions(t *testing.T) {
+	defer func(versions []ScryptParams) {
+		ScryptVersions = versions
+		LazyReencryption = false
+	}(ScryptVersions)
+	storedDocumentsDB("scrypt-versions")
+
+	oldDoc := Document{Content: "old parameters", Syntax: "none"}
+	lazyDoc := Document{Content: "lazy re-encryption", Syntax: "none"}
+	for _, doc := range []*Document{&oldDoc, &lazyDoc} {
+		if err := Store(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The operator changes the parameters
+	ScryptVersions = append(ScryptVersions, ScryptParams{N: 1024, R: 8, P: 2})
+	newDoc := Document{Content: "new parameters", Syntax: "none"}
+	if err := Store(&newDoc); err != nil {
+		t.Fatal(err)
+	}
+	if oldDoc.KeyVersion != 0 || newDoc.KeyVersion != 1 {
+		t.Errorf("Wrong key versions: %d, %d (expected: 0, 1)", oldDoc.KeyVersion, newDoc.KeyVersion)
+	}
+	for _, expected := range []Document{oldDoc, newDoc} {
+		doc, err := Request(expected.ID, false)
+		if err != nil || doc.Content != expected.Highlighted || doc.KeyVersion != expected.KeyVersion {
+			t.Errorf("Document with key version %d couldn't be decrypted (error: %v): %q", expected.KeyVersion, err, doc.Content)
+		}
+	}
+
+	// Bulk re-encryption only changes outdated documents
+	if n := ReencryptAll([]string{oldDoc.ID, newDoc.ID, "cornflake-peddling-nope"}); n != 1 {
+		t.Errorf("%d documents were re-encrypted (expected: 1)", n)
+	}
+	doc, err := Request(oldDoc.ID, false)
+	if err != nil || doc.Content != oldDoc.Highlighted || doc.KeyVersion != 1 {
+		t.Errorf("Re-encrypted document couldn't be decrypted with version %d (error: %v): %q", doc.KeyVersion, err, doc.Content)
+	}
+
+	// Lazy re-encryption when an old document is requested
+	LazyReencryption = true
+	if doc, err := Request(lazyDoc.ID, false); err != nil || doc.KeyVersion != 0 {
+		t.Fatalf("Old document couldn't be requested with version %d: %v", doc.KeyVersion, err)
+	}
+	for i := 0; i < 100; i++ {
+		if doc, err := Request(lazyDoc.ID, false); err == nil && doc.KeyVersion == 1 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("Document wasn't re-encrypted lazily")
+}
+
+func TestDecryptionAlert(t *testing.T) {
+	defer func(recent []time.Time, last time.Time) {
+		DecryptionAlertThreshold, DecryptionAlertWindow = 0, 5*time.Minute
+		recentDecryptionFailures, lastDecryptionAlert = recent, last
+	}(recentDecryptionFailures, lastDecryptionAlert)
+	DecryptionAlertThreshold, DecryptionAlertWindow = 3, time.Minute
+	recentDecryptionFailures, lastDecryptionAlert = nil, time.Time{}
+	memory := logging.NewMemoryBackend(100)
+	Log.SetBackend(logging.AddModuleLevel(memory))
+	defer Log.SetBackend(leveled)
+	alerts := func() int {
+		n := 0
+		for node := memory.Head(); node != nil; node = node.Next() {
+			if node.Record.Level == logging.CRITICAL {
+				n++
+			}
+		}
+		return n
+	}
+
+	rows := storedDocumentsDB("decryption-alert")
+	doc := Document{Content: "to be corrupted", Syntax: "none"}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	// Content encrypted with a different key, like after changing the master key
+	databaseID := sha256.Sum256([]byte(doc.ID))
+	wrongKey := make([]byte, 32)
+	rand.Read(wrongKey)
+	ciphertext, err := encrypt([]byte(doc.Highlighted), wrongKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows[hex.EncodeToString(databaseID[:])][0] = string(ciphertext)
+
+	before := DecryptionFailures()
+	for i := 1; i <= 4; i++ {
+		if _, err := Request(doc.ID, false); err == nil {
+			t.Fatal("Corrupted document could be decrypted")
+		}
+		expected := 0
+		if i >= 3 {
+			// Only one alert per window
+			expected = 1
+		}
+		if alerts() != expected {
+			t.Errorf("Expected %d alerts after %d failures, got %d", expected, i, alerts())
+		}
+	}
+	if DecryptionFailures()-before != 4 {
+		t.Errorf("Expected 4 decryption failures, got %d", DecryptionFailures()-before)
+	}
+}
+
+func TestDecryptionFailures(t *testing.T) {
+	defer func() { IntegrityCheck = false }()
+	rows := storedDocumentsDB("decryption-failures")
+	failures := func(f func()) uint64 {
+		before := DecryptionFailures()
+		f()
+		return DecryptionFailures() - before
+	}
+
+	// Documents from before the encryption are served, but counted
+	legacy := Document{Content: "legacy", Syntax: "none"}
+	if err := Store(&legacy); err != nil {
+		t.Fatal(err)
+	}
+	databaseID := sha256.Sum256([]byte(legacy.ID))
+	rows[hex.EncodeToString(databaseID[:])][0] = "legacy plain text"
+	if n := failures(func() {
+		if doc, err := Request(legacy.ID, false); err != nil || doc.Content != "legacy plain text" {
+			t.Errorf("Legacy document wasn't served: %q, %v", doc.Content, err)
+		}
+	}); n != 1 {
+		t.Errorf("Legacy fallback counted %d failures (expected: 1)", n)
+	}
+
+	// Valid ciphertext of other content fails the integrity check
+	IntegrityCheck = true
+	doc := Document{Content: "original", Syntax: "none"}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	databaseID = sha256.Sum256([]byte(doc.ID))
+	key, err := documentKey(doc.Encryption, doc.KeyVersion, doc.ID, doc.Upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := encrypt([]byte("replaced"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows[hex.EncodeToString(databaseID[:])][0] = string(ciphertext)
+	if n := failures(func() {
+		if _, err := Request(doc.ID, false); err != ErrCorrupted {
+			t.Errorf("Replaced content wasn't detected: %v", err)
+		}
+	}); n != 1 {
+		t.Errorf("Integrity hash mismatch counted %d failures (expected: 1)", n)
+	}
+}
@@ -0,0 +1,202 @@
+package qbin
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeDB is a minimal database/sql driver for tests that don't have a MySQL server available.
+// Every query is passed to the handler, which decides about the result.
+type fakeDB struct {
+	mutex        sync.Mutex
+	queries      []string
+	transactions []string
+	delay        time.Duration
+	handler      func(query string, args []driver.NamedValue) (*fakeRows, error)
+}
+
+// fakeRows is the result of a query; affected and insertID are used for Exec() calls.
+type fakeRows struct {
+	columns  []string
+	values   [][]driver.Value
+	affected int64
+	insertID int64
+}
+
+var fakeDrivers = map[string]*fakeDB{}
+var fakeDriversMutex sync.Mutex
+
+func init() {
+	sql.Register("qbin-fake", fakeDriver{})
+}
+
+// openFakeDB opens a new database connection to a fakeDB.
+func openFakeDB(name string, handler func(query string, args []driver.NamedValue) (*fakeRows, error)) (*sql.DB, *fakeDB) {
+	f := &fakeDB{handler: handler}
+	fakeDriversMutex.Lock()
+	fakeDrivers[name] = f
+	fakeDriversMutex.Unlock()
+	handle, _ := sql.Open("qbin-fake", name)
+	return handle, f
+}
+
+// useFakeDB replaces the database connection with a new fakeDB and returns it.
+func useFakeDB(name string, handler func(query string, args []driver.NamedValue) (*fakeRows, error)) *fakeDB {
+	var f *fakeDB
+	db, f = openFakeDB(name, handler)
+	replica = nil
+	shards = nil
+	safeName, errSafeName = db.Prepare("SELECT COUNT(id) FROM documents WHERE id = ?")
+	return f
+}
+
+// Queries returns all queries executed so far.
+func (f *fakeDB) Queries() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.queries...)
+}
+
+// Transactions returns how the transactions so far ended ("commit" or "rollback").
+func (f *fakeDB) Transactions() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.transactions...)
+}
+
+func (f *fakeDB) end(transaction string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.transactions = append(f.transactions, transaction)
+	return nil
+}
+
+func (f *fakeDB) run(ctx context.Context, query string, args []driver.NamedValue) (*fakeRows, error) {
+	f.mutex.Lock()
+	f.queries = append(f.queries, query)
+	delay := f.delay
+	f.mutex.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	var rows *fakeRows
+	var err error
+	if f.handler != nil {
+		rows, err = f.handler(query, args)
+	}
+	if rows == nil && err == nil {
+		rows = &fakeRows{}
+		if strings.HasPrefix(query, "SELECT COUNT(") {
+			// Names are always available by default
+			rows = &fakeRows{columns: []string{"count"}, values: [][]driver.Value{{int64(0)}}}
+		}
+	}
+	return rows, err
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDriversMutex.Lock()
+	defer fakeDriversMutex.Unlock()
+	f, ok := fakeDrivers[name]
+	if !ok {
+		return nil, errors.New("unknown fake database")
+	}
+	return &fakeConn{f}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c.db, query}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{c.db}, nil }
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	result, err := c.db.run(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRowsIterator{rows: result}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	result, err := c.db.run(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return fakeResult{result}, nil
+}
+
+type fakeResult struct {
+	rows *fakeRows
+}
+
+func (r fakeResult) LastInsertId() (int64, error) { return r.rows.insertID, nil }
+func (r fakeResult) RowsAffected() (int64, error) { return r.rows.affected, nil }
+
+type fakeTx struct {
+	db *fakeDB
+}
+
+func (t fakeTx) Commit() error   { return t.db.end("commit") }
+func (t fakeTx) Rollback() error { return t.db.end("rollback") }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return (&fakeConn{s.db}).ExecContext(context.Background(), s.query, namedValues(args))
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return (&fakeConn{s.db}).QueryContext(context.Background(), s.query, namedValues(args))
+}
+func (s *fakeStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return (&fakeConn{s.db}).ExecContext(ctx, s.query, args)
+}
+func (s *fakeStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return (&fakeConn{s.db}).QueryContext(ctx, s.query, args)
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+type fakeRowsIterator struct {
+	rows *fakeRows
+	i    int
+}
+
+func (r *fakeRowsIterator) Columns() []string { return r.rows.columns }
+func (r *fakeRowsIterator) Close() error      { return nil }
+func (r *fakeRowsIterator) Next(dest []driver.Value) error {
+	if r.i >= len(r.rows.values) {
+		return io.EOF
+	}
+	copy(dest, r.rows.values[r.i])
+	r.i++
+	return nil
+}
@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 var FilterEnable = map[string]bool{}
@@ -38,14 +40,14 @@ func LoadBlacklistFile(filename string) error {
 	return err
 }
 
-func spamcheckBlacklist(doc *Document, highlighted *string) error {
+func spamcheckBlacklist(doc *Document) error {
 	for i := 0; i < len(contentBlacklist); i++ {
 		if contentBlacklist[i].MatchString(doc.Content) {
 			return errors.New("document matches blacklist")
 		}
 	}
 
-	links := linkExpression.FindAllStringSubmatch(*highlighted, -1)
+	links := linkExpression.FindAllStringSubmatch(doc.Content, -1)
 	for i := 0; i < len(links); i++ {
 		for j := 0; j < len(urlBlacklist); j++ {
 			if urlBlacklist[j].MatchString(links[i][1]) {
@@ -63,14 +65,16 @@ func spamcheckBlacklist(doc *Document, highlighted *string) error {
 }
 
 var spacesExpression = regexp.MustCompile(`\s+`)
-var linkExpression = regexp.MustCompile(`url-link" href="([^"]+)"`)
+
+// linkExpression matches links like the autolinker of the highlighter, but works on the original content, so the spam filter can run before highlighting.
+var linkExpression = regexp.MustCompile(`\b((?:https?|ftp)://[^\s"'<>]+)`)
 var domainExpression = regexp.MustCompile(`^[^:]+://([^/]+)`)
 
-func spamcheckLinkCount(doc *Document, highlighted *string) error {
+func spamcheckLinkCount(doc *Document) error {
 	//Count word and determin, how many links are allowed in the document
 	documentLength := len(spacesExpression.ReplaceAllString(doc.Content, ""))
 
-	links := linkExpression.FindAllStringSubmatch(*highlighted, -1)
+	links := linkExpression.FindAllStringSubmatch(doc.Content, -1)
 	linkCount := len(links)
 	linkLength := 0
 	for i := 0; i < linkCount; i++ {
@@ -102,32 +106,69 @@ func spamcheckLinkCount(doc *Document, highlighted *string) error {
 	return nil
 }
 
+// spamWrites tracks the spam that is being saved in the background, so it can be waited for.
+var spamWrites sync.WaitGroup
+
 //FilterSpam ->Filter content with different Filters to categories spam
-func FilterSpam(doc *Document, highlighted *string) error {
+func FilterSpam(doc *Document) error {
+	err := checkSpam(doc)
+	if err != nil {
+		spamWrites.Add(1)
+		go func() {
+			defer spamWrites.Done()
+			saveToSpam(doc)
+		}()
+	}
+	return err
+}
+
+// spamCheck rejects repeated spam (see SpamRepeatWindow) and runs the spam filters for a normalized document with its
+// content hash, saving and remembering new spam. The filters are skipped if the content already passed them in Validate().
+func spamCheck(document *Document) error {
+	if document.spamChecked != "" && document.spamChecked == document.ContentHash {
+		return nil
+	}
+	dedup := dedupHash(document)
+	if isRepeatedSpam(dedup) {
+		return ErrRepeatedSpam
+	}
+	if err := FilterSpam(document); err != nil {
+		Log.Warningf("Spam filter hit for document: %s", err)
+		rememberSpam(dedup)
+		return errors.New("spam: " + err.Error())
+	}
+	document.spamChecked = document.ContentHash
+	return nil
+}
 
+// checkSpam runs the enabled spam filters without saving the document as spam.
+func checkSpam(doc *Document) error {
 	if FilterEnable["blacklist"] {
-		err := spamcheckBlacklist(doc, highlighted)
-		if err != nil {
-			go saveToSpam(doc)
+		if err := spamcheckBlacklist(doc); err != nil {
 			return err
 		}
 	}
-
 	if FilterEnable["linkcount"] {
-		err := spamcheckLinkCount(doc, highlighted)
-		if err != nil {
-			go saveToSpam(doc)
+		if err := spamcheckLinkCount(doc); err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
 func saveToSpam(doc *Document) {
+	if db == nil {
+		Log.Warning("Spam wasn't saved, the database isn't connected.")
+		return
+	}
+	// Spam is rejected before the document gets its name
+	id := doc.ID
+	if id == "" {
+		id = GenerateName()
+	}
 	_, err := db.Exec(
 		"INSERT INTO spam (id, content, upload) VALUES (?, ?, ?)",
-		doc.ID,
+		id,
 		doc.Content,
 		doc.Upload.UTC().Format("2006-01-02 15:04:05"))
 	if err != nil {
@@ -135,3 +176,65 @@ func saveToSpam(doc *Document) {
 	}
 	Log.Debug("Spam was saved to DB.")
 }
+
+// SpamRepeatWindow is how long the content of rejected spam is remembered. Submitting the same content again within that
+// time fails with ErrRepeatedSpam without running the filters or storing it as spam again. 0 disables it.
+var SpamRepeatWindow = 10 * time.Minute
+
+// ErrRepeatedSpam is returned by Store() if the same content was rejected as spam within SpamRepeatWindow.
+var ErrRepeatedSpam = errors.New("the same spam was submitted recently")
+
+// DedupIgnoreWhitespace recognizes repeated spam (see SpamRepeatWindow) by a hash of the content with normalized whitespace,
+// so content differing only in indentation, trailing whitespace or empty lines is treated as the same. The stored content
+// and its hash (see Document.ContentHash) stay exact.
+var DedupIgnoreWhitespace = false
+
+// dedupHash returns the hash by which repeated content is recognized, which is the content hash unless DedupIgnoreWhitespace is set.
+func dedupHash(doc *Document) string {
+	if !DedupIgnoreWhitespace {
+		return doc.ContentHash
+	}
+	lines := []string{}
+	for _, line := range strings.Split(doc.Content, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			lines = append(lines, strings.Join(fields, " "))
+		}
+	}
+	return contentHash(strings.Join(lines, "\n"))
+}
+
+// maxRecentSpam limits the number of remembered content hashes, so a spam wave can't fill the memory.
+const maxRecentSpam = 10000
+
+var recentSpam = struct {
+	sync.Mutex
+	hashes map[string]time.Time
+}{hashes: map[string]time.Time{}}
+
+// rememberSpam stores the content hash of rejected spam for isRepeatedSpam().
+func rememberSpam(hash string) {
+	if SpamRepeatWindow <= 0 {
+		return
+	}
+	recentSpam.Lock()
+	defer recentSpam.Unlock()
+	if len(recentSpam.hashes) >= maxRecentSpam {
+		for h, rejected := range recentSpam.hashes {
+			if time.Since(rejected) > SpamRepeatWindow {
+				delete(recentSpam.hashes, h)
+			}
+		}
+		if len(recentSpam.hashes) >= maxRecentSpam {
+			recentSpam.hashes = map[string]time.Time{}
+		}
+	}
+	recentSpam.hashes[hash] = time.Now()
+}
+
+// isRepeatedSpam checks if content with this hash was rejected as spam within SpamRepeatWindow.
+func isRepeatedSpam(hash string) bool {
+	recentSpam.Lock()
+	defer recentSpam.Unlock()
+	rejected, ok := recentSpam.hashes[hash]
+	return ok && time.Since(rejected) <= SpamRepeatWindow
+}
@@ -0,0 +1,194 @@
+package qbin
+
+import (
+	"database/sql/driver"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// spamDB uses a fake database that counts stored documents and spam.
+func spamDB(name string) (*int, *int, *sync.Mutex) {
+	var mutex sync.Mutex
+	documents, spam := 0, 0
+	useFakeDB(name, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if strings.HasPrefix(query, "INSERT INTO documents") {
+			documents++
+		} else if strings.HasPrefix(query, "INSERT INTO spam") {
+			spam++
+		} else if strings.HasPrefix(query, "SELECT COUNT(") {
+			return &fakeRows{columns: []string{"count"}, values: [][]driver.Value{{int64(0)}}}, nil
+		}
+		return &fakeRows{affected: 1}, nil
+	})
+	return &documents, &spam, &mutex
+}
+
+func TestSpamFilteredFirst(t *testing.T) {
+	defer func(key func([]byte, []byte, int, int, int, int) ([]byte, error)) {
+		scryptKey = key
+		FilterEnable = map[string]bool{}
+		contentBlacklist = []*regexp.Regexp{}
+		recentSpam.hashes = map[string]time.Time{}
+	}(scryptKey)
+	scryptCalls := 0
+	scryptKey = func(password, salt []byte, N, r, p, keyLen int) ([]byte, error) {
+		scryptCalls++
+		return make([]byte, keyLen), nil
+	}
+	documents, spam, mutex := spamDB("spam-first")
+	FilterEnable = map[string]bool{"blacklist": true, "linkcount": true}
+	contentBlacklist = []*regexp.Regexp{regexp.MustCompile("cheap pills")}
+
+	doc := Document{Content: "Buy cheap pills now!", Syntax: "go"}
+	if err := Store(&doc); err == nil || !strings.HasPrefix(err.Error(), "spam: ") {
+		t.Fatalf("Spam wasn't rejected: %v", err)
+	}
+	if doc.Timing.Highlight != 0 || scryptCalls != 0 {
+		t.Errorf("Spam was highlighted (%s) or encrypted (%d key derivations)", doc.Timing.Highlight, scryptCalls)
+	}
+
+	// The same content is rejected again without running the filters
+	again := Document{Content: "Buy cheap pills now!\n", Syntax: "go"}
+	if err := Store(&again); err != ErrRepeatedSpam {
+		t.Errorf("Repeated spam returned %v (expected: %s)", err, ErrRepeatedSpam)
+	}
+
+	// Links are counted in the original content
+	links := Document{Content: "https://example.org/a http://example.org/b https://example.org/c", Syntax: "none"}
+	if err := Store(&links); err == nil || !strings.HasPrefix(err.Error(), "spam: ") {
+		t.Errorf("Document with too many links wasn't rejected: %v", err)
+	}
+
+	if err := Store(&Document{Content: "Hello https://example.org", Syntax: "none"}); err != nil {
+		t.Errorf("Valid document was rejected: %s", err)
+	}
+	spamWrites.Wait()
+	mutex.Lock()
+	defer mutex.Unlock()
+	if *documents != 1 || *spam != 2 {
+		t.Errorf("Stored %d documents and %d spam documents (expected: 1 and 2)", *documents, *spam)
+	}
+}
+
+func TestDedupIgnoreWhitespace(t *testing.T) {
+	defer func() {
+		FilterEnable = map[string]bool{}
+		contentBlacklist = []*regexp.Regexp{}
+		recentSpam.hashes = map[string]time.Time{}
+		DedupIgnoreWhitespace = false
+	}()
+	_, spam, mutex := spamDB("dedup-whitespace")
+	FilterEnable = map[string]bool{"blacklist": true}
+	contentBlacklist = []*regexp.Regexp{regexp.MustCompile("cheap pills")}
+
+	store := func(content string) error {
+		return Store(&Document{Content: content, Syntax: "none"})
+	}
+	first := "Buy cheap pills now!\n  Only today!  \n"
+	variant := "\tBuy  cheap pills now!\n\nOnly today!\n"
+
+	// Exact mode: the variant runs through the filters again
+	if err := store(first); err == nil || !strings.HasPrefix(err.Error(), "spam: ") {
+		t.Fatalf("Spam wasn't rejected: %v", err)
+	}
+	if err := store(variant); err == ErrRepeatedSpam {
+		t.Errorf("Whitespace variant was deduplicated in exact mode")
+	}
+
+	recentSpam.hashes = map[string]time.Time{}
+	DedupIgnoreWhitespace = true
+	if err := store(first); err == nil || !strings.HasPrefix(err.Error(), "spam: ") {
+		t.Fatalf("Spam wasn't rejected: %v", err)
+	}
+	if err := store(variant); err != ErrRepeatedSpam {
+		t.Errorf("Whitespace variant returned %v (expected: %s)", err, ErrRepeatedSpam)
+	}
+	if err := store("Buy cheap pills today!"); err == ErrRepeatedSpam {
+		t.Errorf("Different content was deduplicated")
+	}
+
+	// The stored hash stays exact
+	a, b := Document{Content: first, ContentHash: contentHash(first)}, Document{Content: variant, ContentHash: contentHash(variant)}
+	if a.ContentHash == b.ContentHash || dedupHash(&a) != dedupHash(&b) {
+		t.Errorf("Unexpected hashes: %s, %s", dedupHash(&a), dedupHash(&b))
+	}
+	spamWrites.Wait()
+	mutex.Lock()
+	defer mutex.Unlock()
+	if *spam != 4 {
+		t.Errorf("Stored %d spam documents (expected: 4)", *spam)
+	}
+}
+
+func BenchmarkStoreSpam(b *testing.B) {
+	defer func() {
+		FilterEnable = map[string]bool{}
+		contentBlacklist = []*regexp.Regexp{}
+		recentSpam.hashes = map[string]time.Time{}
+	}()
+	spamDB("spam-benchmark")
+	FilterEnable = map[string]bool{"blacklist": true}
+	contentBlacklist = []*regexp.Regexp{regexp.MustCompile("cheap pills")}
+	content := strings.Repeat("Buy cheap pills now! ", 1000)
+
+	b.Run("new", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			recentSpam.hashes = map[string]time.Time{}
+			Store(&Document{Content: content, Syntax: "go"})
+		}
+	})
+	b.Run("repeated", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			Store(&Document{Content: content, Syntax: "go"})
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	defer func() { delete(FilterEnable, "linkcount") }()
+	FilterEnable["linkcount"] = true
+
+	doc := Document{Content: strings.Repeat("https://spam.example.org/buy-now ", 20), Custom: "no-such-custom-value", Unencrypted: true}
+	errs := Validate(&doc)
+	if len(errs) != 3 || errs[0] != ErrInvalidCustom || errs[1] != ErrUnencryptedNotAllowed || !strings.HasPrefix(errs[2].Error(), "spam: ") {
+		t.Errorf("Wrong problems: %v", errs)
+	}
+	if doc.Content != strings.Repeat("https://spam.example.org/buy-now ", 20) {
+		t.Errorf("Document was changed: %q", doc.Content)
+	}
+	if errs := Validate(&Document{Content: "Hello World\n"}); len(errs) != 0 {
+		t.Errorf("Valid document has problems: %v", errs)
+	}
+
+	// Spam found by Validate() is remembered like in Store()
+	defer func() { recentSpam.hashes = map[string]time.Time{} }()
+	if errs := Validate(&doc); len(errs) != 3 || errs[2] != ErrRepeatedSpam {
+		t.Errorf("Spam wasn't remembered: %v", errs)
+	}
+
+	// Content that passed the filters isn't checked again by Store(), changed content is
+	spamWrites.Wait()
+	useFakeDB("validate", nil)
+	valid := Document{Content: "Greetings from example.org"}
+	if errs := Validate(&valid); len(errs) != 0 {
+		t.Fatalf("Valid document has problems: %v", errs)
+	}
+	FilterEnable["blacklist"] = true
+	defer delete(FilterEnable, "blacklist")
+	defer func(list []*regexp.Regexp) { contentBlacklist = list }(contentBlacklist)
+	contentBlacklist = []*regexp.Regexp{regexp.MustCompile("example")}
+	if err := Store(&valid); err != nil {
+		t.Errorf("Spam filters ran again for validated content: %s", err)
+	}
+	changed := Document{Content: "Spam from example.org"}
+	changed.spamChecked = contentHash("Hello World\n")
+	if err := Store(&changed); err == nil || !strings.HasPrefix(err.Error(), "spam: ") {
+		t.Errorf("Changed content wasn't checked: %v", err)
+	}
+	spamWrites.Wait()
+}
@@ -0,0 +1,162 @@
+package qbin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"time"
+)
+
+// FingerprintSalt is the secret used to derive creator fingerprints. If it's empty, no fingerprints are stored.
+// The fingerprint can't be reversed without the salt, but IP addresses are easy to enumerate, so the salt must stay secret.
+var FingerprintSalt = ""
+
+// ErrNoFingerprint is returned by RelatedDocuments() if the document was stored without a fingerprint.
+var ErrNoFingerprint = errors.New("the document has no creator fingerprint")
+
+// FingerprintQuota limits the total size in bytes of the live and volatile documents with the same creator fingerprint, as
+// stored in the database (including the highlighting). Store() rejects documents exceeding it with ErrQuotaExceeded.
+// 0 disables the limit; documents without a fingerprint are never limited.
+var FingerprintQuota int64
+
+// ErrQuotaExceeded is returned by Store() if the creator of a document has reached the FingerprintQuota.
+var ErrQuotaExceeded = errors.New("the storage quota for this creator is exceeded")
+
+// maxRelatedDocuments limits how many documents are returned by DocumentsByFingerprint().
+const maxRelatedDocuments = 1000
+
+// RelatedDocument describes a document for abuse investigations. As document names aren't stored, it can only be identified by its database ID or alias.
+type RelatedDocument struct {
+	DatabaseID string     `json:"databaseId"`
+	Alias      int64      `json:"alias"`
+	Syntax     string     `json:"syntax"`
+	Upload     time.Time  `json:"upload"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+	// State is one of StateLive, StateExpired and StateVolatile
+	State string `json:"state"`
+}
+
+// Fingerprint derives a creator fingerprint from the IP address and user agent of a client, to correlate documents from the same source without storing them.
+// It returns an empty string if FingerprintSalt isn't set.
+func Fingerprint(ip string, userAgent string) string {
+	if FingerprintSalt == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(FingerprintSalt))
+	mac.Write([]byte(ip + "\n" + userAgent))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkFingerprintQuota returns ErrQuotaExceeded if storing size more bytes would exceed the FingerprintQuota.
+func checkFingerprintQuota(fingerprint string, size int) error {
+	if FingerprintQuota <= 0 || fingerprint == "" {
+		return nil
+	}
+	var used int64
+	ctx, cancel := queryContext()
+	defer cancel()
+	err := eachShard(func(handle *sql.DB) error {
+		var n int64
+		err := handle.QueryRowContext(ctx, "SELECT COALESCE(SUM(LENGTH(content) + COALESCE(LENGTH(raw), 0)), 0) FROM documents WHERE fingerprint = ? AND ("+livePredicate+" OR "+volatilePredicate+")", fingerprint).Scan(&n)
+		used += n
+		return err
+	})
+	if err != nil {
+		return timeoutError(err)
+	}
+	if used+int64(size) > FingerprintQuota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// RelatedDocuments returns the fingerprint of a document and all documents with the same fingerprint, including the document itself.
+func RelatedDocuments(id string) (string, []RelatedDocument, error) {
+	var fingerprint sql.NullString
+	databaseID := sha256.Sum256([]byte(id))
+	err := readDocumentRow(hex.EncodeToString(databaseID[:]), "SELECT fingerprint FROM documents WHERE id = ?", &fingerprint)
+	if err != nil {
+		return "", nil, err
+	}
+	if !fingerprint.Valid {
+		return "", nil, ErrNoFingerprint
+	}
+	documents, err := DocumentsByFingerprint(fingerprint.String)
+	return fingerprint.String, documents, err
+}
+
+// DocumentsByFingerprint returns up to 1000 documents with the given fingerprint, newest first.
+func DocumentsByFingerprint(fingerprint string) ([]RelatedDocument, error) {
+	ctx, cancel := queryContext()
+	defer cancel()
+	documents := []RelatedDocument{}
+	err := eachReadShard(func(handle *sql.DB) error {
+		rows, err := handle.QueryContext(ctx, "SELECT id, "+aliasColumn+", syntax, upload, expiration FROM documents WHERE fingerprint = ? ORDER BY upload DESC LIMIT ?", fingerprint, maxRelatedDocuments)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var doc RelatedDocument
+			var upload, expiration sql.NullString
+			if err := rows.Scan(&doc.DatabaseID, &doc.Alias, &doc.Syntax, &upload, &expiration); err != nil {
+				return err
+			}
+			doc.Upload, _ = time.Parse("2006-01-02 15:04:05", upload.String)
+			doc.State = StateLive
+			if expiration.Valid {
+				t, err := time.Parse("2006-01-02 15:04:05", expiration.String)
+				if err == nil {
+					doc.Expiration = &t
+					doc.State = DocumentState(t)
+				}
+			}
+			documents = append(documents, doc)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, timeoutError(err)
+	}
+	if len(shards) > 0 {
+		// Merge the newest documents of all shards
+		sort.SliceStable(documents, func(i, j int) bool { return documents[i].Upload.After(documents[j].Upload) })
+		if len(documents) > maxRelatedDocuments {
+			documents = documents[:maxRelatedDocuments]
+		}
+	}
+	return documents, nil
+}
+
+// DeleteByFingerprint removes all documents with the given creator fingerprint and returns the number of removed documents.
+// Documents are removed in batches of CleanupBatchSize, like expired documents.
+func DeleteByFingerprint(fingerprint string) (int64, error) {
+	if fingerprint == "" {
+		return 0, ErrNoFingerprint
+	}
+	var total int64
+	err := eachShard(func(handle *sql.DB) error {
+		for {
+			ctx, cancel := queryContext()
+			n, err := deleteDocuments(ctx, handle, "fingerprint = ? LIMIT ?", fingerprint, CleanupBatchSize)
+			cancel()
+			if err != nil {
+				return timeoutError(err)
+			}
+			total += n
+			if n < int64(CleanupBatchSize) {
+				return nil
+			}
+			time.Sleep(CleanupBatchPause)
+		}
+	})
+	if err != nil {
+		return total, err
+	}
+	Log.Noticef("Removed %d documents with fingerprint %s", total, fingerprint)
+	return total, nil
+}
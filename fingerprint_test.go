@@ -0,0 +1,150 @@
+package qbin
+
+import (
+	"database/sql/driver"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFingerprint(t *testing.T) {
+	FingerprintSalt = "secret"
+	defer func() { FingerprintSalt = "" }()
+
+	a := Fingerprint("192.0.2.1", "curl/7.61.1")
+	if a == "" || strings.Contains(a, "192.0.2.1") {
+		t.Errorf("Invalid fingerprint: %s", a)
+	}
+	if b := Fingerprint("192.0.2.1", "curl/7.61.1"); a != b {
+		t.Errorf("Same source has different fingerprints: %s != %s", a, b)
+	}
+	if b := Fingerprint("192.0.2.2", "curl/7.61.1"); a == b {
+		t.Errorf("Different IP addresses have the same fingerprint")
+	}
+	if b := Fingerprint("192.0.2.1", "Wget/1.19.5"); a == b {
+		t.Errorf("Different user agents have the same fingerprint")
+	}
+
+	FingerprintSalt = "another secret"
+	if b := Fingerprint("192.0.2.1", "curl/7.61.1"); a == b {
+		t.Errorf("Fingerprint doesn't depend on the salt")
+	}
+
+	FingerprintSalt = ""
+	if b := Fingerprint("192.0.2.1", "curl/7.61.1"); b != "" {
+		t.Errorf("Fingerprint was created without a salt: %s", b)
+	}
+}
+
+func TestStoreFingerprint(t *testing.T) {
+	var stored driver.Value
+	useFakeDB("fingerprint", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		if strings.HasPrefix(query, "INSERT INTO documents") {
+			stored = args[10].Value
+		}
+		return nil, nil
+	})
+
+	doc := Document{Content: "Hello World", Syntax: "none", Fingerprint: "abc"}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if stored != "abc" {
+		t.Errorf("Fingerprint wasn't stored: %v", stored)
+	}
+
+	doc = Document{Content: "Hello World", Syntax: "none"}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if stored != nil {
+		t.Errorf("Empty fingerprint was stored: %v", stored)
+	}
+}
+
+func TestDeleteByFingerprint(t *testing.T) {
+	defer func(size int, pause time.Duration) { CleanupBatchSize, CleanupBatchPause = size, pause }(CleanupBatchSize, CleanupBatchPause)
+	CleanupBatchSize, CleanupBatchPause = 2, 0
+
+	var mutex sync.Mutex
+	fingerprints := map[string]string{"a": "spammer", "b": "spammer", "c": "someone", "d": "spammer", "e": "spammer", "f": "spammer", "g": ""}
+	batches := 0
+	useFakeDB("delete-fingerprint", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if strings.HasPrefix(query, "DELETE FROM documents WHERE fingerprint = ? LIMIT ?") {
+			batches++
+			n := int64(0)
+			for id, fingerprint := range fingerprints {
+				if fingerprint == args[0].Value && n < args[1].Value.(int64) {
+					delete(fingerprints, id)
+					n++
+				}
+			}
+			return &fakeRows{affected: n}, nil
+		}
+		return nil, nil
+	})
+
+	deleted, err := DeleteByFingerprint("spammer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 5 || batches != 3 {
+		t.Errorf("Deleted %d documents in %d batches (expected: 5 in 3)", deleted, batches)
+	}
+	if len(fingerprints) != 2 || fingerprints["c"] != "someone" || fingerprints["g"] != "" {
+		t.Errorf("Wrong documents remain: %v", fingerprints)
+	}
+
+	if _, err := DeleteByFingerprint(""); err != ErrNoFingerprint {
+		t.Errorf("Documents without fingerprint were deleted (error: %v)", err)
+	}
+}
+
+func TestFingerprintQuota(t *testing.T) {
+	defer func() { FingerprintQuota = 0 }()
+	FingerprintQuota = 1000
+
+	var mutex sync.Mutex
+	used := map[string]int64{}
+	useFakeDB("fingerprint-quota", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if strings.HasPrefix(query, "INSERT INTO documents") {
+			if fingerprint, ok := args[10].Value.(string); ok {
+				size := int64(len(args[1].Value.(string)))
+				if raw, ok := args[7].Value.(string); ok {
+					size += int64(len(raw))
+				}
+				used[fingerprint] += size
+			}
+			return &fakeRows{affected: 1}, nil
+		} else if strings.HasPrefix(query, "SELECT COALESCE(SUM(LENGTH(content) + COALESCE(LENGTH(raw), 0)), 0) FROM documents WHERE fingerprint = ?") {
+			return &fakeRows{columns: []string{"size"}, values: [][]driver.Value{{used[args[0].Value.(string)]}}}, nil
+		}
+		return nil, nil
+	})
+
+	content := strings.Repeat("x", 300) + "\n"
+	stored := 0
+	for ; stored < 10; stored++ {
+		err := Store(&Document{Content: content, Fingerprint: "a"})
+		if err == ErrQuotaExceeded {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stored == 0 || stored == 10 || used["a"] > FingerprintQuota {
+		t.Errorf("Quota wasn't enforced: stored %d documents with %d bytes", stored, used["a"])
+	}
+
+	if err := Store(&Document{Content: content, Fingerprint: "b"}); err != nil {
+		t.Errorf("Quota applies to other fingerprints: %v", err)
+	}
+	if err := Store(&Document{Content: content}); err != nil {
+		t.Errorf("Quota applies to documents without fingerprint: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package qbin
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CountryResolver looks up the country of an IP address, e.g. using a GeoIP database provided by the operator.
+type CountryResolver interface {
+	// Country returns the ISO 3166-1 alpha-2 code of the country (e.g. "DE"), or an empty string if it's unknown.
+	Country(ip net.IP) (string, error)
+}
+
+// GeoIP resolves the country of uploaders for BlockedCountries. nil disables geoblocking.
+var GeoIP CountryResolver
+
+// BlockedCountries contains the ISO 3166-1 alpha-2 codes of the countries from which no documents can be uploaded.
+// Requesting documents is always possible.
+var BlockedCountries []string
+
+// ErrBlockedCountry is returned by CheckCountry() if the client is located in one of the BlockedCountries.
+var ErrBlockedCountry = errors.New("uploads from this country are not allowed")
+
+// CheckCountry returns ErrBlockedCountry if the IP address is located in one of the BlockedCountries.
+// Addresses that can't be resolved are allowed, as blocking them would block everybody when the database is broken.
+func CheckCountry(ip string) error {
+	if GeoIP == nil || len(BlockedCountries) == 0 {
+		return nil
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+	country, err := GeoIP.Country(parsed)
+	if err != nil {
+		Log.Warningf("GeoIP lookup for %s failed: %s", ip, err)
+		return nil
+	}
+	for _, blocked := range BlockedCountries {
+		if strings.EqualFold(country, blocked) {
+			return ErrBlockedCountry
+		}
+	}
+	return nil
+}
+
+// countryRange is an IP address range belonging to a country. Addresses are stored in their 16 byte form.
+type countryRange struct {
+	start, end net.IP
+	country    string
+}
+
+// CountryRanges is a CountryResolver using a list of IP address ranges, see LoadCountryRanges().
+type CountryRanges []countryRange
+
+// LoadCountryRanges reads a CSV file with the lines "first IP,last IP,country code", like the free country databases of DB-IP
+// or IP2Location (with IP addresses instead of numbers). Both IPv4 and IPv6 ranges are supported.
+func LoadCountryRanges(path string) (CountryRanges, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ranges := CountryRanges{}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ",")
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		for i := range fields {
+			fields[i] = strings.Trim(strings.TrimSpace(fields[i]), `"`)
+		}
+		start, end := net.ParseIP(fields[0]).To16(), net.ParseIP(fields[1]).To16()
+		if start == nil || end == nil {
+			if line == 1 {
+				// Header
+				continue
+			}
+			return nil, errors.New("invalid IP address range in line " + strconv.Itoa(line))
+		}
+		ranges = append(ranges, countryRange{start, end, strings.ToUpper(fields[2])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(ranges, func(i, j int) bool { return bytes.Compare(ranges[i].start, ranges[j].start) < 0 })
+	return ranges, nil
+}
+
+// Country returns the country of the range containing the IP address.
+func (r CountryRanges) Country(ip net.IP) (string, error) {
+	ip = ip.To16()
+	// The first range starting after the IP address follows the one that might contain it
+	i := sort.Search(len(r), func(i int) bool { return bytes.Compare(r[i].start, ip) > 0 })
+	if i == 0 || bytes.Compare(r[i-1].end, ip) < 0 {
+		return "", nil
+	}
+	return r[i-1].country, nil
+}
@@ -0,0 +1,54 @@
+package qbin
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestLoadCountryRanges(t *testing.T) {
+	f, err := ioutil.TempFile("", "qbin-geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("ip_start,ip_end,country\n" +
+		"10.0.0.0,10.255.255.255,xy\n" +
+		"\"192.0.2.0\",\"192.0.2.255\",\"ZZ\"\n" +
+		"2001:db8::,2001:db8:ffff:ffff:ffff:ffff:ffff:ffff,XY\n")
+	f.Close()
+
+	ranges, err := LoadCountryRanges(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, expected := range map[string]string{
+		"10.1.2.3":    "XY",
+		"192.0.2.255": "ZZ",
+		"192.0.3.0":   "",
+		"9.255.255.1": "",
+		"2001:db8::1": "XY",
+		"2001:db9::1": "",
+	} {
+		if country, err := ranges.Country(net.ParseIP(ip)); err != nil || country != expected {
+			t.Errorf("Wrong country for %s: %q (expected: %q)", ip, country, expected)
+		}
+	}
+}
+
+func TestCheckCountry(t *testing.T) {
+	defer func() { GeoIP, BlockedCountries = nil, nil }()
+	GeoIP = CountryRanges{{net.ParseIP("10.0.0.0"), net.ParseIP("10.255.255.255"), "XY"}}
+
+	if err := CheckCountry("10.0.0.1"); err != nil {
+		t.Errorf("Upload blocked without blocked countries: %v", err)
+	}
+	BlockedCountries = []string{"xy"}
+	if err := CheckCountry("10.0.0.1"); err != ErrBlockedCountry {
+		t.Errorf("Upload from a blocked country wasn't blocked: %v", err)
+	}
+	if err := CheckCountry("192.0.2.1"); err != nil {
+		t.Errorf("Upload from an unknown country was blocked: %v", err)
+	}
+}
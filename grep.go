@@ -0,0 +1,59 @@
+package qbin
+
+import (
+	"errors"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"time"
+)
+
+// GrepTimeout limits the time Grep() spends matching the lines of a document.
+var GrepTimeout = time.Second
+
+// maxGrepPattern is the maximum length of a pattern accepted by CompileGrep().
+const maxGrepPattern = 256
+
+// maxGrepInstructions limits the size of compiled patterns. Go's regular expressions run in linear time, but large counted
+// repetitions (like (a{100}){100}) still make every step slow.
+const maxGrepInstructions = 2000
+
+// ErrInvalidPattern is returned by CompileGrep() if a pattern isn't a valid regular expression.
+var ErrInvalidPattern = errors.New("invalid grep pattern")
+
+// ErrPatternTooComplex is returned by CompileGrep() for patterns that would be too expensive, and by Grep() if matching
+// takes longer than GrepTimeout.
+var ErrPatternTooComplex = errors.New("the grep pattern is too complex")
+
+// CompileGrep validates and compiles a pattern for Grep(), using the syntax of Go's regexp package.
+func CompileGrep(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > maxGrepPattern {
+		return nil, ErrPatternTooComplex
+	}
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if e, ok := err.(*syntax.Error); ok && (e.Code == syntax.ErrLarge || e.Code == syntax.ErrNestingDepth || e.Code == syntax.ErrInvalidRepeatSize) {
+		return nil, ErrPatternTooComplex
+	} else if err != nil {
+		return nil, ErrInvalidPattern
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil || len(prog.Inst) > maxGrepInstructions {
+		return nil, ErrPatternTooComplex
+	}
+	return regexp.Compile(pattern)
+}
+
+// Grep returns the lines of the content that match the pattern, including their line breaks.
+func Grep(content string, pattern *regexp.Regexp) (string, error) {
+	deadline := time.Now().Add(GrepTimeout)
+	result := strings.Builder{}
+	for i, line := range strings.SplitAfter(content, "\n") {
+		if i%256 == 0 && time.Now().After(deadline) {
+			return "", ErrPatternTooComplex
+		}
+		if pattern.MatchString(strings.TrimSuffix(line, "\n")) {
+			result.WriteString(line)
+		}
+	}
+	return result.String(), nil
+}
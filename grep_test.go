@@ -0,0 +1,38 @@
+package qbin
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrep(t *testing.T) {
+	content := "INFO starting\nERROR disk full\nINFO retrying\nWARN slow disk\nERROR giving up"
+	pattern, err := CompileGrep(`^(ERROR|WARN) .*disk`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines, err := Grep(content, pattern); err != nil || lines != "ERROR disk full\nWARN slow disk\n" {
+		t.Errorf("Wrong lines matched: %q, %v", lines, err)
+	}
+
+	for _, p := range []string{`(`, `[a-`, `x**`} {
+		if _, err := CompileGrep(p); err != ErrInvalidPattern {
+			t.Errorf("Invalid pattern %q was accepted: %v", p, err)
+		}
+	}
+	for _, p := range []string{`((a{30}){30}){30}`, `((a{40}){40})`, `a{1001}`, strings.Repeat("a", 257)} {
+		if _, err := CompileGrep(p); err != ErrPatternTooComplex {
+			t.Errorf("Expensive pattern %q was accepted: %v", p, err)
+		}
+	}
+}
+
+func TestGrepTimeout(t *testing.T) {
+	defer func() { GrepTimeout = time.Second }()
+	GrepTimeout = -time.Second
+	pattern, _ := CompileGrep("x")
+	if _, err := Grep(strings.Repeat("x\n", 1000), pattern); err != ErrPatternTooComplex {
+		t.Errorf("Grep didn't time out: %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package qbinGRPC
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative qbin.proto
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"net"
+	"strings"
+
+	"github.com/qbin-io/backend"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// The model functions used by the server, replaced in tests.
+var store = qbin.Store
+var request = qbin.Request
+var remove = qbin.Delete
+
+// StartGRPC launches the gRPC server which provides the document storage to other services. If token isn't empty,
+// clients must send it as "authorization: Bearer <token>" metadata; otherwise, they can only get documents.
+func StartGRPC(listen string, root string, token string) {
+	qbin.Log.Debug("Initializing gRPC server...")
+	if token == "" {
+		qbin.Log.Warning("No gRPC token is set, gRPC clients can only get documents.")
+	}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		qbin.Log.Errorf("gRPC server error: %s", err)
+		panic(err)
+	}
+	qbin.Log.Noticef("gRPC server starting on %s", listen)
+	if err := newServer(root, token).Serve(listener); err != nil {
+		qbin.Log.Errorf("gRPC server error: %s", err)
+		panic(err)
+	}
+}
+
+// newServer creates a gRPC server with the Documents service.
+func newServer(root string, token string) *grpc.Server {
+	options := []grpc.ServerOption{
+		// Leave room for the other fields, too large documents are rejected by qbin.Store()
+		grpc.MaxRecvMsgSize(qbin.MaxFilesize + 64*1024),
+	}
+	options = append(options, grpc.UnaryInterceptor(authenticate(token)))
+	s := grpc.NewServer(options...)
+	RegisterDocumentsServer(s, &documentsServer{root: strings.TrimSuffix(root, "/")})
+	return s
+}
+
+// writeMethods are the calls that change documents, which always need a token.
+var writeMethods = map[string]bool{
+	Documents_Create_FullMethodName: true,
+	Documents_Delete_FullMethodName: true,
+}
+
+// authenticate returns an interceptor rejecting all calls without the given bearer token. Without a token, only the calls
+// reading documents are allowed, as anybody reaching the address could create and delete documents otherwise.
+func authenticate(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if token == "" && writeMethods[info.FullMethod] {
+			return nil, status.Error(codes.PermissionDenied, "creating and deleting documents requires a token")
+		} else if token == "" {
+			return handler(ctx, req)
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, authorization := range md.Get("authorization") {
+			if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, "Bearer ")), []byte(token)) == 1 {
+				return handler(ctx, req)
+			}
+		}
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+}
+
+type documentsServer struct {
+	UnimplementedDocumentsServer
+	root string
+}
+
+// Create stores a new document, validating it like an upload over HTTP.
+func (s *documentsServer) Create(ctx context.Context, req *CreateRequest) (*CreateResponse, error) {
+	if len(strings.TrimSpace(req.Content)) < 1 {
+		return nil, status.Error(codes.InvalidArgument, "the document can't be empty")
+	}
+
+	syntax, err := qbin.UploadSyntax(req.Syntax)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid syntax name")
+	}
+	if qbin.ValidateCustom(req.Custom) != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid custom value")
+	}
+	expiration, err := qbin.UploadExpiration(req.Expiration)
+	if err == qbin.ErrExpirationTooLong {
+		return nil, status.Errorf(codes.InvalidArgument, "the expiration exceeds the maximum of %s", qbin.MaxExpiration)
+	} else if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid expiration")
+	}
+
+	doc := qbin.Document{
+		Content:    req.Content,
+		Syntax:     syntax,
+		Custom:     req.Custom,
+		Expiration: expiration,
+		Views:      1,
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			doc.Fingerprint = qbin.Fingerprint(host, "")
+		}
+	}
+	if err := store(&doc); err != nil {
+		return nil, storeError(err)
+	}
+	return &CreateResponse{Id: doc.ID, Url: s.root + "/" + doc.ID, ConfirmationToken: doc.ConfirmationToken}, nil
+}
+
+// Get returns a document and counts a view.
+func (s *documentsServer) Get(ctx context.Context, req *GetRequest) (*Document, error) {
+	doc, err := request(req.Id, req.Raw)
+	if err != nil {
+		return nil, documentError(err)
+	}
+	result := &Document{
+		Id:      doc.ID,
+		Content: doc.Content,
+		Syntax:  doc.Syntax,
+		Upload:  doc.Upload.Unix(),
+		Views:   int64(doc.Views),
+	}
+	switch qbin.DocumentState(doc.Expiration) {
+	case qbin.StateVolatile:
+		result.Volatile = true
+	case qbin.StateLive:
+		if !doc.Expiration.IsZero() {
+			result.Expiration = doc.Expiration.Unix()
+		}
+	}
+	return result, nil
+}
+
+// Delete removes a document.
+func (s *documentsServer) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	if err := remove(req.Id); err != nil {
+		return nil, documentError(err)
+	}
+	return &DeleteResponse{}, nil
+}
+
+// storeError converts errors returned by qbin.Store() to gRPC status errors.
+func storeError(err error) error {
+	switch {
+	case err == qbin.ErrTooLarge:
+		return status.Error(codes.InvalidArgument, "maximum document size exceeded")
+	case err == qbin.ErrBinaryContent:
+		return status.Error(codes.InvalidArgument, "binary files are not supported")
+	case err == qbin.ErrNonPrintableContent:
+		return status.Error(codes.InvalidArgument, "the document consists mostly of non-printable characters")
+	case err == qbin.ErrInvalidCustom:
+		return status.Error(codes.InvalidArgument, "invalid custom value")
+	case err == qbin.ErrInvalidCollection:
+		return status.Error(codes.InvalidArgument, "invalid collection token, it must be at least 16 characters long")
+	case err == qbin.ErrCollectionsDisabled:
+		return status.Error(codes.FailedPrecondition, "collections aren't enabled on this server")
+	case err == qbin.ErrInvalidParent:
+		return status.Error(codes.FailedPrecondition, "the parent document doesn't exist anymore")
+	case err == qbin.ErrUnencryptedNotAllowed:
+		return status.Error(codes.PermissionDenied, "storing documents without encryption isn't allowed on this server")
+	case err == qbin.ErrBlockedSyntax:
+		return status.Error(codes.PermissionDenied, "this kind of content isn't allowed on this server")
+	case err == qbin.ErrInsufficientStorage:
+		return status.Error(codes.ResourceExhausted, "the server is out of storage")
+	case err == qbin.ErrQuotaExceeded:
+		return status.Error(codes.ResourceExhausted, "the storage quota is exceeded")
+	case err == qbin.ErrRepeatedSpam:
+		return status.Error(codes.ResourceExhausted, "the document already got caught in the spam filter")
+	case strings.HasPrefix(err.Error(), "spam: "):
+		return status.Error(codes.InvalidArgument, "the document got caught in the spam filter: "+strings.TrimPrefix(err.Error(), "spam: "))
+	case err == qbin.ErrTimeout || err == qbin.ErrBusy:
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	qbin.Log.Errorf("gRPC API error: %s", err)
+	return status.Error(codes.Internal, "an error occured, please try again")
+}
+
+// documentError converts errors returned when requesting or deleting a document to gRPC status errors.
+func documentError(err error) error {
+	switch err {
+	case sql.ErrNoRows:
+		return status.Error(codes.NotFound, "document not found")
+	case qbin.ErrExpired, qbin.ErrGone:
+		return status.Error(codes.NotFound, "document is gone")
+	case qbin.ErrTimeout, qbin.ErrBusy:
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	qbin.Log.Errorf("gRPC API error: %s", err)
+	return status.Error(codes.Internal, "an error occured, please try again")
+}
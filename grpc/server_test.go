@@ -0,0 +1,149 @@
+package qbinGRPC
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/qbin-io/backend"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeModel replaces the model functions with an in-memory document store.
+func fakeModel(t *testing.T) {
+	documents := map[string]qbin.Document{}
+	store, request, remove = func(doc *qbin.Document) error {
+		doc.ID = "cornflake-peddling-bp0q"
+		doc.Upload = time.Now().Round(time.Second)
+		documents[doc.ID] = *doc
+		return nil
+	}, func(id string, raw bool) (qbin.Document, error) {
+		doc, ok := documents[id]
+		if !ok {
+			return qbin.Document{}, sql.ErrNoRows
+		}
+		doc.Views++
+		documents[id] = doc
+		return doc, nil
+	}, func(id string) error {
+		if _, ok := documents[id]; !ok {
+			return sql.ErrNoRows
+		}
+		delete(documents, id)
+		return nil
+	}
+	t.Cleanup(func() { store, request, remove = qbin.Store, qbin.Request, qbin.Delete })
+}
+
+// dial starts a server on an in-memory listener and returns a client connected to it.
+func dial(t *testing.T, token string) DocumentsClient {
+	listener := bufconn.Listen(1024 * 1024)
+	server := newServer("https://qbin.example.org/", token)
+	go server.Serve(listener)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		server.Stop()
+	})
+	return NewDocumentsClient(conn)
+}
+
+func TestCreateGetDelete(t *testing.T) {
+	fakeModel(t)
+	client := dial(t, "secret")
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+
+	created, err := client.Create(ctx, &CreateRequest{Content: "package main\n", Syntax: "none", Expiration: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Id != "cornflake-peddling-bp0q" || created.Url != "https://qbin.example.org/cornflake-peddling-bp0q" {
+		t.Errorf("Wrong create response: %v", created)
+	}
+
+	doc, err := client.Get(ctx, &GetRequest{Id: created.Id, Raw: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Content != "package main\n" || doc.Syntax != "none" || doc.Views != 2 || doc.Volatile {
+		t.Errorf("Wrong document: %v", doc)
+	}
+	if expiration := time.Unix(doc.Expiration, 0); expiration.Before(time.Now().Add(59*time.Minute)) || expiration.After(time.Now().Add(time.Hour)) {
+		t.Errorf("Wrong expiration: %s", expiration)
+	}
+
+	if _, err := client.Delete(ctx, &DeleteRequest{Id: created.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(ctx, &GetRequest{Id: created.Id}); status.Code(err) != codes.NotFound {
+		t.Errorf("Deleted document returned %v", err)
+	}
+
+	if _, err := client.Create(ctx, &CreateRequest{Content: " \n"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Empty document returned %v", err)
+	}
+	if _, err := client.Create(ctx, &CreateRequest{Content: "x", Expiration: "soon"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Invalid expiration returned %v", err)
+	}
+}
+
+func TestToken(t *testing.T) {
+	fakeModel(t)
+	client := dial(t, "secret")
+
+	if _, err := client.Create(context.Background(), &CreateRequest{Content: "x"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Call without token returned %v", err)
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+	if _, err := client.Create(ctx, &CreateRequest{Content: "x"}); err != nil {
+		t.Errorf("Call with token failed: %v", err)
+	}
+}
+
+func TestWithoutToken(t *testing.T) {
+	fakeModel(t)
+	store(&qbin.Document{Content: "x", Syntax: "none"})
+	client := dial(t, "")
+	ctx := context.Background()
+
+	if _, err := client.Create(ctx, &CreateRequest{Content: "x"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Create without token returned %v", err)
+	}
+	if _, err := client.Delete(ctx, &DeleteRequest{Id: "cornflake-peddling-bp0q"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Delete without token returned %v", err)
+	}
+	if doc, err := client.Get(ctx, &GetRequest{Id: "cornflake-peddling-bp0q"}); err != nil || doc.Content != "x" {
+		t.Errorf("Get without token failed: %v", err)
+	}
+}
+
+func TestStoreError(t *testing.T) {
+	tests := map[error]codes.Code{
+		qbin.ErrTooLarge:              codes.InvalidArgument,
+		qbin.ErrInvalidCustom:         codes.InvalidArgument,
+		qbin.ErrInvalidCollection:     codes.InvalidArgument,
+		qbin.ErrCollectionsDisabled:   codes.FailedPrecondition,
+		qbin.ErrInvalidParent:         codes.FailedPrecondition,
+		qbin.ErrUnencryptedNotAllowed: codes.PermissionDenied,
+		qbin.ErrBlockedSyntax:         codes.PermissionDenied,
+		qbin.ErrQuotaExceeded:         codes.ResourceExhausted,
+		qbin.ErrTimeout:               codes.Unavailable,
+	}
+	for err, expected := range tests {
+		if code := status.Code(storeError(err)); code != expected {
+			t.Errorf("%q returned %s (expected: %s)", err, code, expected)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package qbin
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// RequireWords defines if an empty word list makes the instance unready, instead of falling back to names without words.
+var RequireWords = false
+
+// ReadinessCheck is the result of a single check performed by Readiness.
+type ReadinessCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// highlightProbe highlights a tiny document to check that the highlighter works. It can be replaced in tests.
+var highlightProbe = func() error {
+	result, _, err := Highlight("<qbin>", "markup")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(result, "qbin") {
+		return errors.New("unexpected result: " + result)
+	}
+	return nil
+}
+
+// Readiness checks if the database is reachable, the word list is loaded (with RequireWords) and highlighting works.
+// It returns the result of every check, and whether all of them succeeded.
+func Readiness() ([]ReadinessCheck, bool) {
+	checks := []ReadinessCheck{}
+	ready := true
+	add := func(name string, err error) {
+		check := ReadinessCheck{Name: name, OK: err == nil}
+		if err != nil {
+			check.Error = err.Error()
+			ready = false
+		}
+		checks = append(checks, check)
+	}
+
+	add("database", pingDatabase())
+	if RequireWords && len(words) == 0 {
+		add("words", errors.New("word list is empty"))
+	} else {
+		add("words", nil)
+	}
+	add("highlighter", highlightProbe())
+
+	return checks, ready
+}
+
+// pingDatabase checks the connection to the primary database and all shards.
+func pingDatabase() error {
+	if db == nil {
+		return errors.New("not connected")
+	}
+	ctx, cancel := queryContext()
+	defer cancel()
+	return timeoutError(eachShard(func(handle *sql.DB) error {
+		return handle.PingContext(ctx)
+	}))
+}
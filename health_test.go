@@ -0,0 +1,57 @@
+package qbin
+
+import (
+	"errors"
+	"testing"
+)
+
+// failedChecks returns the names of the checks that didn't succeed.
+func failedChecks(checks []ReadinessCheck) []string {
+	failed := []string{}
+	for _, check := range checks {
+		if !check.OK {
+			failed = append(failed, check.Name)
+		}
+	}
+	return failed
+}
+
+func TestReadinessWordsMissing(t *testing.T) {
+	useFakeDB("readiness-words", nil)
+	defer func(w []string, probe func() error) {
+		words, highlightProbe, RequireWords = w, probe, false
+	}(words, highlightProbe)
+	highlightProbe = func() error { return nil }
+	words = []string{}
+
+	if checks, ready := Readiness(); !ready {
+		t.Errorf("Empty word list made the instance unready without RequireWords: %v", failedChecks(checks))
+	}
+
+	RequireWords = true
+	checks, ready := Readiness()
+	if failed := failedChecks(checks); ready || len(failed) != 1 || failed[0] != "words" {
+		t.Errorf("Empty word list wasn't reported (ready: %t, failed: %v)", ready, failed)
+	}
+}
+
+func TestReadinessHighlighter(t *testing.T) {
+	useFakeDB("readiness-highlighter", nil)
+	defer func(probe func() error) { highlightProbe = probe }(highlightProbe)
+
+	highlightProbe = func() error { return nil }
+	if checks, ready := Readiness(); !ready {
+		t.Errorf("Instance with a working highlighter isn't ready: %v", failedChecks(checks))
+	}
+
+	highlightProbe = func() error { return errors.New("connection refused") }
+	checks, ready := Readiness()
+	if failed := failedChecks(checks); ready || len(failed) != 1 || failed[0] != "highlighter" {
+		t.Errorf("Broken highlighter wasn't reported (ready: %t, failed: %v)", ready, failed)
+	}
+	for _, check := range checks {
+		if check.Name == "highlighter" && check.Error != "connection refused" {
+			t.Errorf("Unexpected error for the highlighter: %q", check.Error)
+		}
+	}
+}
@@ -1,12 +1,88 @@
 package qbin
 
 import (
+	"errors"
+	"html"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
 )
 
+// MaxExpiration limits how long documents can be stored. 0 allows storing documents forever.
+var MaxExpiration time.Duration
+
+// ErrExpirationTooLong is returned by ValidateExpiration() if an expiration exceeds MaxExpiration.
+var ErrExpirationTooLong = errors.New("expiration exceeds the maximum")
+
+// ValidateExpiration checks an expiration returned by ParseExpiration against MaxExpiration. Volatile documents are always allowed.
+func ValidateExpiration(expiration time.Time) error {
+	if MaxExpiration <= 0 {
+		return nil
+	}
+	if (expiration == time.Time{}) {
+		// Forever
+		return ErrExpirationTooLong
+	}
+	if expiration.Before(time.Unix(0, 1)) {
+		// Volatile
+		return nil
+	}
+	if expiration.After(time.Now().Add(MaxExpiration + time.Minute)) {
+		return ErrExpirationTooLong
+	}
+	return nil
+}
+
+// DefaultExpiration is the expiration of uploaded documents that don't request one.
+const DefaultExpiration = "14d"
+
+// ErrInvalidExpiration is returned by UploadExpiration() if the expiration can't be parsed.
+var ErrInvalidExpiration = errors.New("invalid expiration")
+
+// UploadExpiration parses and validates the expiration requested for a new document, or the DefaultExpiration if it's
+// empty. Unlike requested expirations, the DefaultExpiration is shortened to MaxExpiration instead of being rejected with
+// ErrExpirationTooLong.
+func UploadExpiration(value string) (time.Time, error) {
+	if value == "" {
+		value = DefaultExpiration
+	}
+	expiration, err := ParseExpiration(value)
+	if err != nil {
+		return time.Time{}, ErrInvalidExpiration
+	}
+	if ValidateExpiration(expiration) != nil {
+		if value != DefaultExpiration {
+			return time.Time{}, ErrExpirationTooLong
+		}
+		expiration = time.Now().Add(MaxExpiration)
+	}
+	return expiration, nil
+}
+
+// SyntaxMaxExpiration limits how long documents of some syntaxes can be stored, e.g. to let logs expire quickly while
+// code persists. Store() shortens longer expirations to the limit of the document's syntax ("" for plain text). Syntaxes
+// without a limit are only limited by MaxExpiration.
+var SyntaxMaxExpiration = map[string]time.Duration{}
+
+// clampExpiration shortens the expiration of a document to the SyntaxMaxExpiration of its syntax, counted from its upload.
+// The syntax is the one used for highlighting, which may have been detected without being stored in the document.
+// Volatile documents are not changed.
+func clampExpiration(document *Document, syntax string) {
+	limit, ok := SyntaxMaxExpiration[syntax]
+	if !ok || limit <= 0 || DocumentState(document.Expiration) == StateVolatile {
+		return
+	}
+	latest := document.Upload.Add(limit)
+	if (document.Expiration == time.Time{}) || document.Expiration.After(latest) {
+		document.Expiration = latest
+	}
+}
+
 // ParseExpiration creates a time.Time object from an expiration string, taking the units m, h, d, w into account.
 func ParseExpiration(expiration string) (time.Time, error) {
 	expiration = strings.ToLower(strings.TrimSpace(expiration))
@@ -44,6 +120,53 @@ func ParseExpiration(expiration string) (time.Time, error) {
 	return expirationTime, nil
 }
 
+// normalizeContent prepares the content of a document for storage, and rejects binary content. ANSI escape sequences are
+// stripped if StripANSI is enabled, unless keepANSI is set.
+func normalizeContent(content string, keepANSI bool) (string, error) {
+	if StripANSI && !keepANSI {
+		content = stripANSI(content)
+	}
+	content = normalizeNewlines(content)
+	if NormalizeUnicode {
+		content = norm.NFC.String(content)
+	}
+	if strings.Contains(content, "\x00") {
+		return "", ErrBinaryContent
+	}
+	if MaxNonPrintableRatio > 0 && nonPrintableRatio(content) > MaxNonPrintableRatio {
+		return "", ErrNonPrintableContent
+	}
+	return content, nil
+}
+
+// nonPrintableRatio returns the share of characters in the content that are control characters other than whitespace, or invalid UTF-8.
+func nonPrintableRatio(content string) float64 {
+	total, nonPrintable := 0, 0
+	for i := 0; i < len(content); {
+		r, size := utf8.DecodeRuneInString(content[i:])
+		i += size
+		total++
+		if (r == utf8.RuneError && size == 1) || (unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' && r != '\f' && r != '\v') {
+			nonPrintable++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(nonPrintable) / float64(total)
+}
+
+// normalizeNewlines converts line endings and trims the content to end with exactly one new line, depending on NormalizeLineEndings and StrictContent.
+func normalizeNewlines(content string) string {
+	if NormalizeLineEndings {
+		content = strings.Replace(strings.Replace(content, "\r\n", "\n", -1), "\r", "\n", -1)
+	}
+	if StrictContent {
+		return content
+	}
+	return strings.Trim(content, "\n") + "\n"
+}
+
 // EscapeHTML removes all special HTML characters (namely, &<>") in a string and replaces them with their entities (e.g. &amp;).
 func EscapeHTML(content string) string {
 	content = strings.Replace(content, "&", "&amp;", -1)
@@ -56,14 +179,10 @@ func EscapeHTML(content string) string {
 // This does not match all HTML tags, but those created by Prism.js are fine for us.
 var htmlTags = regexp.MustCompile(`<[^>]+>`)
 
-// StripHTML strips all HTML tags and replaces the entities from escapeHTML backwards.
+// StripHTML strips all HTML tags and decodes all entities, which reverses EscapeHTML and the highlighting.
+// As every & in the content is escaped, all entities were created by the escaping and can be decoded in a single pass.
 func StripHTML(content string) string {
-	content = htmlTags.ReplaceAllString(content, "")
-	content = strings.Replace(content, "&quot;", "\"", -1)
-	content = strings.Replace(content, "&gt;", ">", -1)
-	content = strings.Replace(content, "&lt;", "<", -1)
-	content = strings.Replace(content, "&amp;", "&", -1)
-	return content
+	return html.UnescapeString(htmlTags.ReplaceAllString(content, ""))
 }
 
 // try runs a method up to howOften times until there's no error anymore, always waiting a second before trying again.
@@ -92,3 +211,16 @@ func Slice2map(s []string) map[string]bool {
 	}
 	return r
 }
+
+// ValidateCustom checks if a custom value is empty or one of CustomValues.
+func ValidateCustom(custom string) error {
+	if custom == "" {
+		return nil
+	}
+	for _, allowed := range CustomValues {
+		if custom == allowed {
+			return nil
+		}
+	}
+	return ErrInvalidCustom
+}
@@ -0,0 +1,234 @@
+package qbin
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeNewlines(t *testing.T) {
+	input := "\n\nfirst line\r\nsecond line\rthird line\n\n"
+	if result := normalizeNewlines(input); result != "first line\nsecond line\nthird line\n" {
+		t.Errorf("Wrong normalization: %q", result)
+	}
+
+	StrictContent = true
+	NormalizeLineEndings = false
+	defer func() {
+		StrictContent = false
+		NormalizeLineEndings = true
+	}()
+	if sha256.Sum256([]byte(normalizeNewlines(input))) != sha256.Sum256([]byte(input)) {
+		t.Errorf("Content was modified in strict mode: %q", normalizeNewlines(input))
+	}
+
+	NormalizeLineEndings = true
+	if result := normalizeNewlines(input); result != "\n\nfirst line\nsecond line\nthird line\n\n" {
+		t.Errorf("Wrong normalization in strict mode: %q", result)
+	}
+}
+
+func TestValidateExpiration(t *testing.T) {
+	MaxExpiration = 7 * 24 * time.Hour
+	defer func() { MaxExpiration = 0 }()
+
+	tests := map[string]error{
+		"1h":       nil,
+		"7d":       nil,
+		"volatile": nil,
+		"8d":       ErrExpirationTooLong,
+		"0":        ErrExpirationTooLong,
+	}
+	for value, expected := range tests {
+		expiration, _ := ParseExpiration(value)
+		if err := ValidateExpiration(expiration); err != expected {
+			t.Errorf("Expiration %s returned %v (expected: %v)", value, err, expected)
+		}
+	}
+
+	MaxExpiration = 0
+	expiration, _ := ParseExpiration("0")
+	if err := ValidateExpiration(expiration); err != nil {
+		t.Errorf("Storing forever isn't allowed without a maximum expiration: %s", err)
+	}
+}
+
+func TestUploadExpiration(t *testing.T) {
+	MaxExpiration = 7 * 24 * time.Hour
+	defer func() { MaxExpiration = 0 }()
+
+	tests := map[string]error{
+		"1h":   nil,
+		"soon": ErrInvalidExpiration,
+		"8d":   ErrExpirationTooLong,
+	}
+	for value, expected := range tests {
+		if _, err := UploadExpiration(value); err != expected {
+			t.Errorf("Expiration %s returned %v (expected: %v)", value, err, expected)
+		}
+	}
+
+	// The default expiration is shortened instead of rejected
+	MaxExpiration = time.Hour
+	expiration, err := UploadExpiration("")
+	if err != nil || expiration.After(time.Now().Add(time.Hour)) || expiration.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("Default expiration wasn't shortened to the maximum: %s, %v", expiration, err)
+	}
+}
+
+func FuzzNormalizeContent(f *testing.F) {
+	for _, seed := range []string{"", "\n", "Hello World", "\r\n\r\nfirst\r\nsecond\rthird\n\n", "\r\r\n", "a\x00b", "\n\r\n\r"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		output, err := normalizeContent(input, false)
+		if strings.Contains(input, "\x00") {
+			if err != ErrBinaryContent {
+				t.Fatalf("Binary content wasn't rejected: %q", input)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("Content was rejected: %q (%s)", input, err)
+		}
+		if strings.Contains(output, "\r") {
+			t.Errorf("Output contains \\r: %q", output)
+		}
+		if strings.Contains(output, "\x00") {
+			t.Errorf("Output contains NUL: %q", output)
+		}
+		twice, err := normalizeContent(output, false)
+		if err != nil || twice != output {
+			t.Errorf("Normalization isn't idempotent: %q -> %q -> %q", input, output, twice)
+		}
+	})
+}
+
+// highlightText returns the content like Highlight() does for a syntax without any tokens.
+func highlightText(content string) string {
+	ln := `<span class="line-number"></span>`
+	return ln + strings.Replace(EscapeHTML(content), "\n", "\n"+ln, -1)
+}
+
+func FuzzStripHTMLRoundTrip(f *testing.F) {
+	for _, seed := range []string{
+		"<!DOCTYPE html>\n<html><head><title>Test</title></head></html>",
+		`<a href="https://qbin.io/?a=1&b=2">link</a>`,
+		"if (a < b && b > c) { return \"<>\"; }",
+		"&amp; &lt; &gt; &quot; &#39; &#x27; &nbsp; &copy &unknown;",
+		"&amp;lt;&lt;&amp;amp;",
+		"<script>alert('x')</script><!-- comment -->",
+		"<<>>&&\"\"''",
+		"<span class=\"line-number\"></span>",
+		"a > b\n<c\n\n&",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		content, err := normalizeContent(input, false)
+		if err != nil {
+			return
+		}
+		if result := StripHTML(highlightText(content)); result != content {
+			t.Errorf("StripHTML didn't recover the content:\n%q\n%q", content, result)
+		}
+		if result := StripHTML(EscapeHTML(content)); result != content {
+			t.Errorf("StripHTML didn't reverse EscapeHTML:\n%q\n%q", content, result)
+		}
+	})
+}
+
+func TestSyntaxMaxExpiration(t *testing.T) {
+	defer func() { SyntaxMaxExpiration = map[string]time.Duration{} }()
+	SyntaxMaxExpiration = map[string]time.Duration{"log": 24 * time.Hour, "": 72 * time.Hour}
+	storedDocumentsDB("syntax-max-expiration")
+
+	week := time.Now().Add(7 * 24 * time.Hour)
+	tests := []struct {
+		doc      Document
+		expected time.Duration
+	}{
+		{Document{Content: "GET /index.html 200\n", Syntax: "log", Expiration: week}, 24 * time.Hour},
+		{Document{Content: "GET /index.html 200\n", Syntax: "log"}, 24 * time.Hour}, // Forever
+		{Document{Content: "Just some text.\n", Syntax: "none", Expiration: week}, 72 * time.Hour},
+		{Document{Content: "package main\n", Syntax: "go", Expiration: week}, 7 * 24 * time.Hour},
+		{Document{Content: "GET /index.html 200\n", Syntax: "log", Expiration: time.Now().Add(time.Hour)}, time.Hour},
+	}
+	for _, test := range tests {
+		doc := test.doc
+		if err := Store(&doc); err != nil {
+			t.Fatal(err)
+		}
+		if ttl := doc.Expiration.Sub(doc.Upload); ttl < test.expected-time.Minute || ttl > test.expected+time.Minute {
+			t.Errorf("Document with syntax %q expires after %s (expected: %s)", test.doc.Syntax, ttl, test.expected)
+		}
+	}
+
+	// Volatile documents are already as short as possible
+	doc := Document{Content: "GET /index.html 200\n", Syntax: "log", Expiration: time.Unix(-1, 0)}
+	if err := Store(&doc); err != nil || DocumentState(doc.Expiration) != StateVolatile {
+		t.Errorf("Volatile document was changed to expire at %s (%v)", doc.Expiration, err)
+	}
+
+	// The limit of a detected syntax applies even if it isn't stored
+	defer func() {
+		languages = nil
+		SyntaxDetection, PersistDetectedSyntax = false, true
+	}()
+	languages, SyntaxDetection, PersistDetectedSyntax = detectionLanguages, true, false
+	SyntaxMaxExpiration["bash"] = time.Hour
+	doc = Document{Content: "#!/bin/bash\necho done\n", Expiration: week}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := doc.Expiration.Sub(doc.Upload); doc.Syntax != "" || ttl > time.Hour+time.Minute {
+		t.Errorf("Document with the detected syntax bash (stored: %q) expires after %s (expected: 1h)", doc.Syntax, ttl)
+	}
+}
+
+func TestMaxNonPrintableRatio(t *testing.T) {
+	MaxNonPrintableRatio = 0.3
+	defer func() { MaxNonPrintableRatio = 0 }()
+
+	if _, err := normalizeContent("\x1b\x01\x02\x03\x7f\x1b[0m\x04\x05\x06\xff\xfe", false); err != ErrNonPrintableContent {
+		t.Errorf("Mostly non-printable content wasn't rejected: %v", err)
+	}
+	code := "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(\"Hällo Wörld 👋\")\r\n}\n"
+	if _, err := normalizeContent(code, false); err != nil {
+		t.Errorf("Code was rejected: %s", err)
+	}
+	// A few escape sequences in a log are fine
+	if _, err := normalizeContent("\x1b[31mERROR\x1b[0m something failed\n", false); err != nil {
+		t.Errorf("Log with escape sequences was rejected: %s", err)
+	}
+
+	MaxNonPrintableRatio = 0
+	if _, err := normalizeContent("\x01\x02\x03", false); err != nil {
+		t.Errorf("Non-printable content was rejected with the check disabled: %s", err)
+	}
+}
+
+func TestNormalizeUnicode(t *testing.T) {
+	defer func() { NormalizeUnicode = false }()
+	nfd, nfc := "Cafe\u0301 nai\u0308ve\n", "Caf\u00e9 na\u00efve\n"
+
+	if content, err := normalizeContent(nfd, false); err != nil || content != nfd {
+		t.Errorf("Content was changed with normalization disabled: %q, %v", content, err)
+	}
+	a, _ := ContentHash(nfd, "")
+	b, _ := ContentHash(nfc, "")
+	if a == b {
+		t.Errorf("Different forms have the same hash with normalization disabled")
+	}
+
+	NormalizeUnicode = true
+	if content, err := normalizeContent(nfd, false); err != nil || content != nfc {
+		t.Errorf("NFD content wasn't converted to NFC: %q, %v", content, err)
+	}
+	a, _ = ContentHash(nfd, "")
+	b, _ = ContentHash(nfc, "")
+	if a != b {
+		t.Errorf("Canonically equivalent content has different hashes: %s != %s", a, b)
+	}
+}
@@ -1,6 +1,7 @@
 package qbin
 
 import (
+	"errors"
 	"io/ioutil"
 	"net"
 	"sort"
@@ -15,6 +16,9 @@ import (
 var PrismServer = "/tmp/prism-server.sock"
 var languages map[string]bool
 
+// DefaultSyntax is used for documents that are stored without a syntax. It is reset if prism-server doesn't know it.
+var DefaultSyntax = ""
+
 // Highlight performs syntax highlighting on a string using Prism.js running under node.js.
 func Highlight(content string, language string) (string, bool, error) {
 	if language == "markdown!" {
@@ -57,7 +61,13 @@ func Highlight(content string, language string) (string, bool, error) {
 	// Don't ask where that 0x00 byte is coming from.
 	// They are following me, and my code is haunted by them.
 	// I guess it's just the closing character from the transmission though.
-	return ln + strings.Replace(strings.TrimSuffix(string(result), "\x00"), "\n", "\n"+ln, -1), false, nil
+	highlighted := ln + strings.Replace(strings.TrimSuffix(string(result), "\x00"), "\n", "\n"+ln, -1)
+	if VisualizeTrailingWhitespace {
+		// The markers can't be stripped from the highlighted content, so the original content is required for raw output
+		visualized := visualizeTrailingWhitespace(highlighted)
+		return visualized, visualized != highlighted, nil
+	}
+	return highlighted, false, nil
 }
 
 // SyntaxExists checks if a given syntax definition exists in Prism.js.
@@ -73,6 +83,62 @@ func SyntaxExists(language string) bool {
 	return language == "" || languages[language]
 }
 
+// Syntaxes returns a sorted list of all syntaxes that can be used for highlighting, or nil if prism-server isn't available yet.
+func Syntaxes() []string {
+	if languages == nil {
+		go getLanguages()
+		return nil
+	}
+	list := []string{"markdown!"}
+	for language := range languages {
+		if language != "" {
+			list = append(list, language)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// PopularSyntaxes limits the syntaxes returned by AdvertisedSyntaxes, to keep the list in frontends short.
+// All other syntaxes can still be used. Empty advertises all syntaxes.
+var PopularSyntaxes []string
+
+// AdvertisedSyntaxes returns the sorted list of syntaxes that should be offered to users: PopularSyntaxes if set, otherwise all of them.
+// Popular syntaxes that don't exist are left out. Like Syntaxes(), it returns nil if prism-server isn't available yet.
+func AdvertisedSyntaxes() []string {
+	all := Syntaxes()
+	if all == nil || len(PopularSyntaxes) == 0 {
+		return all
+	}
+	list := []string{}
+	for _, language := range all {
+		for _, popular := range PopularSyntaxes {
+			if language == popular {
+				list = append(list, language)
+				break
+			}
+		}
+	}
+	return list
+}
+
+// ErrInvalidSyntax is returned by UploadSyntax() if the syntax doesn't exist.
+var ErrInvalidSyntax = errors.New("invalid syntax name")
+
+// UploadSyntax parses and validates the syntax requested for a new document. It returns "" if no syntax was requested, so
+// the default or detected syntax can be used, and "none" if highlighting was explicitly disabled.
+func UploadSyntax(value string) (string, error) {
+	syntax := ParseSyntax(value)
+	if !SyntaxExists(syntax) {
+		return "", ErrInvalidSyntax
+	}
+	if syntax == "" && value != "" {
+		// Explicitly no syntax, which must not be replaced by the default syntax
+		return "none", nil
+	}
+	return syntax, nil
+}
+
 // ParseSyntax applies aliases and some other transformations to a syntax name supplied by the user to make it more intuitive.
 func ParseSyntax(language string) string {
 	language = strings.TrimSpace(strings.ToLower(language))
@@ -128,4 +194,9 @@ func getLanguages() {
 	Log.Debugf("Prism.js initialization succeeded. Available languages: %s", strings.Trim(strings.Replace(strings.Join(list, ", "), ", ,", ",", -1), ","))
 	languages = result.(map[string]bool)
 	gettingLanguages = false
+
+	if DefaultSyntax != "" && !languages[DefaultSyntax] {
+		Log.Errorf("The default syntax '%s' doesn't exist, documents without a syntax won't be highlighted.", DefaultSyntax)
+		DefaultSyntax = ""
+	}
 }
@@ -0,0 +1,82 @@
+package qbin
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// HighlightBudget limits the time spent highlighting new documents to this much per HighlightBudgetInterval, so a burst of
+// large documents can't monopolize the CPU. Documents stored while the budget is exhausted aren't highlighted, like with
+// HighlightMaxLines. 0 disables the limit.
+var HighlightBudget time.Duration
+
+// HighlightBudgetInterval is the interval in which the HighlightBudget is refilled.
+var HighlightBudgetInterval = time.Minute
+
+// ErrHighlightBudget is returned by HighlightSkipped() if the HighlightBudget is exhausted.
+var ErrHighlightBudget = errors.New("the highlighting budget is exhausted")
+
+// highlightBudget is a token bucket of highlighting time, which is refilled continuously.
+var highlightBudget = struct {
+	sync.Mutex
+	available time.Duration
+	refilled  time.Time
+	// skipped counts the documents stored without highlighting since noticed, when this was last logged
+	skipped int
+	noticed time.Time
+	// now returns the current time, and can be replaced in tests
+	now func() time.Time
+}{now: time.Now}
+
+// highlightBudgetNotice reports documents stored without highlighting because of the HighlightBudget.
+var highlightBudgetNotice = Log.Noticef
+
+// refillHighlightBudget adds the budget for the time since the last refill. It must be called with the lock held.
+func refillHighlightBudget() {
+	now := highlightBudget.now()
+	if highlightBudget.refilled.IsZero() {
+		highlightBudget.available = HighlightBudget
+	} else if HighlightBudgetInterval > 0 {
+		highlightBudget.available += time.Duration(float64(HighlightBudget) * float64(now.Sub(highlightBudget.refilled)) / float64(HighlightBudgetInterval))
+	}
+	if highlightBudget.available > HighlightBudget {
+		highlightBudget.available = HighlightBudget
+	}
+	highlightBudget.refilled = now
+}
+
+// highlightBudgetAvailable checks if there's HighlightBudget left for highlighting a document.
+func highlightBudgetAvailable() bool {
+	if HighlightBudget <= 0 {
+		return true
+	}
+	highlightBudget.Lock()
+	defer highlightBudget.Unlock()
+	refillHighlightBudget()
+	return highlightBudget.available > 0
+}
+
+// spendHighlightBudget subtracts the time spent highlighting a document from the HighlightBudget. The budget can become
+// negative, which delays further highlighting until the overspent time has been refilled.
+func spendHighlightBudget(spent time.Duration) {
+	if HighlightBudget <= 0 {
+		return
+	}
+	highlightBudget.Lock()
+	defer highlightBudget.Unlock()
+	refillHighlightBudget()
+	highlightBudget.available -= spent
+}
+
+// skipHighlightBudget records a document stored without highlighting because the HighlightBudget is exhausted. It's logged
+// at most once per HighlightBudgetInterval, so a burst of uploads doesn't flood the log.
+func skipHighlightBudget() {
+	highlightBudget.Lock()
+	defer highlightBudget.Unlock()
+	highlightBudget.skipped++
+	if now := highlightBudget.now(); now.Sub(highlightBudget.noticed) >= HighlightBudgetInterval {
+		highlightBudgetNotice("The highlighting budget is exhausted, %d documents were stored without highlighting", highlightBudget.skipped)
+		highlightBudget.skipped, highlightBudget.noticed = 0, now
+	}
+}
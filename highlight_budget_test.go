@@ -0,0 +1,66 @@
+package qbin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHighlightBudget(t *testing.T) {
+	defer fakePrism(t)()
+	defer func() {
+		HighlightBudget, HighlightBudgetInterval = 0, time.Minute
+		highlightBudget.available, highlightBudget.refilled = 0, time.Time{}
+		highlightBudget.skipped, highlightBudget.noticed = 0, time.Time{}
+		highlightBudget.now = time.Now
+		highlightBudgetNotice = Log.Noticef
+	}()
+	notices := 0
+	highlightBudgetNotice = func(format string, args ...interface{}) { notices++ }
+	// The clock only advances explicitly, so the real time spent highlighting is negligible compared to the budget
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	highlightBudget.now = func() time.Time { return now }
+	HighlightBudget, HighlightBudgetInterval = time.Minute, time.Hour
+	storedDocumentsDB("highlight-budget")
+
+	store := func() (string, bool, string) {
+		doc := Document{Content: "package main", Syntax: "go"}
+		if err := Store(&doc); err != nil {
+			t.Fatal(err)
+		}
+		requested, err := Request(doc.ID, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return doc.ID, requested.HighlightSkipped, requested.Content
+	}
+
+	if _, skipped, _ := store(); skipped {
+		t.Fatalf("Document was stored without highlighting within the budget")
+	}
+
+	// A large document exhausted the budget
+	spendHighlightBudget(2 * time.Minute)
+	id, skipped, content := store()
+	if !skipped || content != "package main\n" {
+		t.Errorf("Document was highlighted although the budget is exhausted: %q", content)
+	}
+	// A burst of documents is only logged once
+	store()
+	store()
+	if notices != 1 {
+		t.Errorf("The exhausted budget was logged %d times (expected: once)", notices)
+	}
+	// Loading the highlighting on demand waits for the budget too
+	if err := HighlightSkipped(id); err != ErrHighlightBudget {
+		t.Errorf("Highlighting was loaded although the budget is exhausted: %v", err)
+	}
+
+	// The overspent time (a budget of two intervals) has been refilled
+	now = now.Add(2 * HighlightBudgetInterval)
+	if _, skipped, _ := store(); skipped {
+		t.Errorf("Document was stored without highlighting after the budget was refilled")
+	}
+	if err := HighlightSkipped(id); err != nil {
+		t.Errorf("Highlighting couldn't be loaded after the budget was refilled: %s", err)
+	}
+}
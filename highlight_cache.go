@@ -0,0 +1,25 @@
+package qbin
+
+import "time"
+
+// HighlightCacheSize limits the memory (in bytes of HTML) used to cache the highlighted content of documents stored with OriginalOnly.
+// The cache contains decrypted content, but is only accessible using the document ID. 0 disables the cache.
+var HighlightCacheSize = 64 * 1024 * 1024
+
+var highlightCache = &documentCache{}
+
+// highlightOnRead returns the highlighted HTML for the original content of a document stored with OriginalOnly.
+func highlightOnRead(databaseID string, content string, syntax string, expiration time.Time) string {
+	if cached, ok := highlightCache.get(databaseID); ok {
+		return cached
+	}
+
+	highlighted, _, err := Highlight(content, syntax)
+	if err != nil {
+		// Not cached, so it's highlighted properly as soon as prism-server is available again
+		Log.Warningf("Skipped syntax highlighting for the following reason: %s", err)
+		return EscapeHTML(content)
+	}
+	highlightCache.put(databaseID, highlighted, expiration, HighlightCacheSize)
+	return highlighted
+}
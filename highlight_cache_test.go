@@ -0,0 +1,58 @@
+package qbin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestOriginalOnly(t *testing.T) {
+	defer func() { OriginalOnly, IntegrityCheck = false, false }()
+	OriginalOnly, IntegrityCheck = true, true
+	rows := storedDocumentsDB("original-only")
+
+	doc := Document{Content: "# Title\n\n<b>*bold*</b>\n", Syntax: "markdown!"}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	databaseID := sha256.Sum256([]byte(doc.ID))
+	row := rows[hex.EncodeToString(databaseID[:])]
+	if row[0] != "" || row[6] == nil {
+		t.Fatalf("Document wasn't stored with only the original content (content: %q, original stored: %t)", row[0], row[6] != nil)
+	}
+
+	// Once from the cache filled by Store(), once highlighted on read
+	for _, clear := range []bool{false, true} {
+		if clear {
+			highlightCache.clear()
+		}
+		requested, err := Request(doc.ID, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if requested.Content != doc.Highlighted {
+			t.Errorf("Wrong highlighted content (cache cleared: %t): %q, expected: %q", clear, requested.Content, doc.Highlighted)
+		}
+	}
+	if cached, _ := highlightCache.get(hex.EncodeToString(databaseID[:])); cached != doc.Highlighted {
+		t.Errorf("Highlighted content wasn't cached on read: %q", cached)
+	}
+
+	requested, err := Request(doc.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requested.Content != doc.Content {
+		t.Errorf("Wrong raw content: %q", requested.Content)
+	}
+
+	// Re-encryption must keep the content empty
+	ScryptVersions = append(ScryptVersions, ScryptParams{N: 1024, R: 8, P: 1})
+	defer func() { ScryptVersions = ScryptVersions[:1] }()
+	if reencrypted, err := Reencrypt(doc.ID); err != nil || !reencrypted {
+		t.Fatalf("Couldn't re-encrypt the document: %t, %v", reencrypted, err)
+	}
+	if requested, err := Request(doc.ID, true); err != nil || requested.Content != doc.Content || row[0] != "" {
+		t.Errorf("Wrong raw content after re-encryption: %q, %v", requested.Content, err)
+	}
+}
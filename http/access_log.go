@@ -0,0 +1,142 @@
+package qbinHTTP
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// accessLogOutput receives the access log lines, and can be replaced in tests.
+var accessLogOutput io.Writer = os.Stdout
+
+// accessLogEntry describes a single request for the access log.
+type accessLogEntry struct {
+	Time      time.Time     `json:"time"`
+	IP        string        `json:"ip"`
+	Method    string        `json:"method"`
+	URI       string        `json:"uri"`
+	Protocol  string        `json:"protocol"`
+	Status    int           `json:"status"`
+	Size      int           `json:"size"`
+	Duration  time.Duration `json:"duration"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"userAgent,omitempty"`
+}
+
+// accessLogFormats are the formats of config.AccessLog. "common" and "combined" are the NCSA formats used by Apache and
+// nginx, which log analyzers like GoAccess and AWStats understand.
+var accessLogFormats = map[string]func(entry accessLogEntry) string{
+	"human": func(entry accessLogEntry) string {
+		return fmt.Sprintf("%s %s %s %s %d (%d bytes, %s)", entry.Time.Format("15:04:05.000"), entry.IP, entry.Method,
+			entry.URI, entry.Status, entry.Size, entry.Duration)
+	},
+	"json": func(entry accessLogEntry) string {
+		line, _ := json.Marshal(entry)
+		return string(line)
+	},
+	"common": commonLogLine,
+	"combined": func(entry accessLogEntry) string {
+		return commonLogLine(entry) + " " + logQuote(entry.Referer) + " " + logQuote(entry.UserAgent)
+	},
+}
+
+// commonLogLine formats an entry in the NCSA Common Log Format: host ident user [time] "request" status size
+func commonLogLine(entry accessLogEntry) string {
+	size := "-"
+	if entry.Size > 0 {
+		size = strconv.Itoa(entry.Size)
+	}
+	return fmt.Sprintf("%s - - [%s] %s %d %s", entry.IP, entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		logQuote(entry.Method+" "+entry.URI+" "+entry.Protocol), entry.Status, size)
+}
+
+// logQuote quotes a value for the NCSA formats, escaping quotes and control characters so a client can't forge log lines.
+// Empty values are logged as "-".
+func logQuote(value string) string {
+	if value == "" {
+		return `"-"`
+	}
+	return strconv.Quote(value)
+}
+
+// logAccess is a middleware that writes a line in the config.AccessLog format to accessLogOutput for every request.
+func logAccess(res http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	format, ok := accessLogFormats[config.AccessLog]
+	if !ok {
+		next(res, req)
+		return
+	}
+	start := time.Now()
+	recorder := &accessLogWriter{ResponseWriter: res}
+	next(recorder, req)
+
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+	status := recorder.status
+	if status == 0 {
+		status = 200
+	}
+	fmt.Fprintln(accessLogOutput, format(accessLogEntry{
+		Time:      start,
+		IP:        remoteClientIP(req),
+		Method:    req.Method,
+		URI:       uri,
+		Protocol:  req.Proto,
+		Status:    status,
+		Size:      recorder.size,
+		Duration:  time.Since(start),
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	}))
+}
+
+// accessLogWriter records the status and size of a response for the access log.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	// Informational responses like 103 Early Hints are followed by the actual status
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.size += n
+	return n, err
+}
+
+// Flush and Hijack keep streaming responses and live views working behind the access log.
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer doesn't support hijacking")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
@@ -0,0 +1,73 @@
+package qbinHTTP
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	output := &bytes.Buffer{}
+	defer func() {
+		accessLogOutput = os.Stdout
+		config.AccessLog, config.TrustedProxies = "", nil
+	}()
+	accessLogOutput = output
+	config.AccessLog = "common"
+	config.TrustedProxies = []string{"127.0.0.1", "10.0.0.0/8"}
+
+	handler := func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/empty" {
+			return
+		}
+		res.Header().Add("Link", "</style.css>; rel=preload; as=style")
+		res.WriteHeader(103)
+		res.WriteHeader(404)
+		res.Write([]byte("not found\n"))
+	}
+	// The line is written after the response, so the test waits until it's done
+	logged := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		logAccess(res, req, handler)
+		logged <- struct{}{}
+	}))
+	defer server.Close()
+	get := func(path string, forwardedFor string) string {
+		output.Reset()
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		req.Header.Set("Referer", "https://example.com/")
+		req.Header.Set("User-Agent", `Mozilla/5.0 "quoted"`)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		<-logged
+		return output.String()
+	}
+
+	line := get("/cornflake-peddling-bp0q?grep=a+b", "203.0.113.7, 10.0.0.1")
+	common := regexp.MustCompile(`^203\.0\.113\.7 - - \[\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /cornflake-peddling-bp0q\?grep=a\+b HTTP/1\.1" 404 10\n$`)
+	if !common.MatchString(line) {
+		t.Errorf("Unexpected Common Log Format line: %q", line)
+	}
+
+	config.AccessLog = "combined"
+	line = get("/cornflake-peddling-bp0q", "203.0.113.7")
+	if !strings.HasSuffix(line, `404 10 "https://example.com/" "Mozilla/5.0 \"quoted\""`+"\n") {
+		t.Errorf("Unexpected Combined Log Format line: %q", line)
+	}
+
+	// Only trusted proxies can choose the logged address
+	config.AccessLog = "common"
+	config.TrustedProxies = nil
+	line = get("/empty", "203.0.113.7")
+	if !strings.HasPrefix(line, "127.0.0.1 - - [") || !strings.HasSuffix(line, `" 200 -`+"\n") {
+		t.Errorf("Unexpected log line for an untrusted client: %q", line)
+	}
+}
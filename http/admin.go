@@ -0,0 +1,271 @@
+package qbinHTTP
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/qbin-io/backend"
+)
+
+// Scopes of the tokens in config.AdminTokens. config.AdminToken has all scopes, and is the only token allowed to use routes without a scope.
+const (
+	// scopeReadStats allows reading metrics and verifying the hash chain
+	scopeReadStats = "read-stats"
+	// scopeReports allows investigating abuse reports by looking up the documents of a creator
+	scopeReports = "reports"
+	// scopeDelete allows removing documents
+	scopeDelete = "delete"
+	// scopePurge allows operations rewriting many documents at once
+	scopePurge = "purge"
+	// scopeBanner allows changing the maintenance banner
+	scopeBanner = "banner"
+)
+
+// setupAdminRoutes will set up the routes for moderation under /api/v1/admin, which require config.AdminToken or one of config.AdminTokens.
+func setupAdminRoutes(api *mux.Router) {
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.HandleFunc("/documents/{document}/related", requireAdmin(scopeReports, relatedDocumentsRoute)).Methods("GET")
+	admin.HandleFunc("/fingerprints/{fingerprint:[0-9a-f]{64}}", requireAdmin(scopeReports, fingerprintRoute)).Methods("GET")
+	admin.HandleFunc("/fingerprints/{fingerprint:[0-9a-f]{64}}", requireAdmin(scopeDelete, deleteFingerprintRoute)).Methods("DELETE")
+	admin.HandleFunc("/reencrypt", requireAdmin(scopePurge, reencryptRoute)).Methods("POST")
+	admin.HandleFunc("/rehighlight", requireAdmin(scopePurge, rehighlightRoute)).Methods("POST")
+	admin.HandleFunc("/metrics", requireAdmin(scopeReadStats, metricsRoute)).Methods("GET")
+	admin.HandleFunc("/chain", requireAdmin(scopeReadStats, chainRoute)).Methods("GET")
+	admin.HandleFunc("/banner", requireAdmin(scopeBanner, bannerRoute)).Methods("GET")
+	admin.HandleFunc("/banner", requireAdmin(scopeBanner, setBannerRoute)).Methods("PUT")
+	if qbin.AuditLog {
+		admin.HandleFunc("/audit", requireAdmin("", auditRoute)).Methods("GET")
+	}
+}
+
+// recordAudit, deleteByFingerprint, rehighlightAll and cleanupMetrics can be replaced in tests.
+var recordAudit = qbin.Audit
+var deleteByFingerprint = qbin.DeleteByFingerprint
+var rehighlightAll = qbin.RehighlightAll
+var cleanupMetrics = qbin.Cleanup
+
+// adminIdentity identifies the admin token of a request authorized by requireAdmin() in the audit log, without storing
+// the token itself. Tokens from config.AdminTokens are identified by their name.
+func adminIdentity(req *http.Request) string {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if name, _, ok := scopedAdminToken(token); ok {
+		return name
+	}
+	hash := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(hash[:8])
+}
+
+// auditAdmin records an admin action before it's executed, and returns false (after responding) if that failed, so no
+// action happens without being recorded.
+func auditAdmin(res http.ResponseWriter, req *http.Request, action string, target string) bool {
+	return !adminError("qbin.Audit()", recordAudit(adminIdentity(req), action, target), res, req)
+}
+
+// auditDocuments identifies documents in the audit log by their database IDs, as the document IDs are the keys to decrypt them.
+func auditDocuments(ids ...string) string {
+	databaseIDs := make([]string, len(ids))
+	for i, id := range ids {
+		hash := sha256.Sum256([]byte(id))
+		databaseIDs[i] = hex.EncodeToString(hash[:])
+	}
+	return strings.Join(databaseIDs, ",")
+}
+
+// requireAdmin only calls the route if the request is authorized with "Authorization: Bearer <token>", using
+// config.AdminToken or one of config.AdminTokens with the given scope. Without admin tokens, the admin routes don't exist.
+func requireAdmin(scope string, route http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if config.AdminToken == "" && len(config.AdminTokens) == 0 {
+			notFoundRoute(res, req)
+			return
+		}
+		authorization := req.Header.Get("Authorization")
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		if token != authorization && config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1 {
+			route(res, req)
+			return
+		}
+		_, scopes, ok := scopedAdminToken(token)
+		if token == authorization || !ok {
+			res.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(res, 401, struct {
+				Error string `json:"error"`
+			}{"invalid admin token"})
+			return
+		}
+		// Routes without a scope are only available with config.AdminToken
+		for _, s := range scopes {
+			if s == scope && scope != "" {
+				route(res, req)
+				return
+			}
+		}
+		writeJSON(res, 403, struct {
+			Error string `json:"error"`
+		}{"the admin token isn't allowed to do this"})
+	}
+}
+
+// scopedAdminToken looks up a token in config.AdminTokens, which are formatted as "<name>:<hex-encoded SHA256 of the
+// token>:<comma-separated scopes>", and returns its name and scopes.
+func scopedAdminToken(token string) (string, []string, bool) {
+	hash := sha256.Sum256([]byte(token))
+	encoded := []byte(hex.EncodeToString(hash[:]))
+	for _, entry := range config.AdminTokens {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) == 3 && subtle.ConstantTimeCompare([]byte(strings.ToLower(parts[1])), encoded) == 1 {
+			return parts[0], strings.Split(parts[2], ","), true
+		}
+	}
+	return "", nil, false
+}
+
+// relatedDocumentsRoute returns all documents with the same creator fingerprint as the given document.
+func relatedDocumentsRoute(res http.ResponseWriter, req *http.Request) {
+	if !auditAdmin(res, req, "related-documents", auditDocuments(mux.Vars(req)["document"])) {
+		return
+	}
+	fingerprint, documents, err := qbin.RelatedDocuments(mux.Vars(req)["document"])
+	if err == sql.ErrNoRows || err == qbin.ErrNoFingerprint {
+		writeJSON(res, 404, struct {
+			Error string `json:"error"`
+		}{"no fingerprint found for this document"})
+		return
+	} else if adminError("qbin.RelatedDocuments()", err, res, req) {
+		return
+	}
+	writeJSON(res, 200, struct {
+		Fingerprint string                 `json:"fingerprint"`
+		Documents   []qbin.RelatedDocument `json:"documents"`
+	}{fingerprint, documents})
+}
+
+// fingerprintRoute returns all documents with the given creator fingerprint.
+func fingerprintRoute(res http.ResponseWriter, req *http.Request) {
+	if !auditAdmin(res, req, "list-fingerprint", mux.Vars(req)["fingerprint"]) {
+		return
+	}
+	documents, err := qbin.DocumentsByFingerprint(mux.Vars(req)["fingerprint"])
+	if adminError("qbin.DocumentsByFingerprint()", err, res, req) {
+		return
+	}
+	writeJSON(res, 200, struct {
+		Fingerprint string                 `json:"fingerprint"`
+		Documents   []qbin.RelatedDocument `json:"documents"`
+	}{mux.Vars(req)["fingerprint"], documents})
+}
+
+// deleteFingerprintRoute removes all documents with the given creator fingerprint, e.g. to clean up after a spammer.
+func deleteFingerprintRoute(res http.ResponseWriter, req *http.Request) {
+	if !auditAdmin(res, req, "delete-fingerprint", mux.Vars(req)["fingerprint"]) {
+		return
+	}
+	deleted, err := deleteByFingerprint(mux.Vars(req)["fingerprint"])
+	if adminError("qbin.DeleteByFingerprint()", err, res, req) {
+		return
+	}
+	writeJSON(res, 200, struct {
+		Fingerprint string `json:"fingerprint"`
+		Deleted     int64  `json:"deleted"`
+	}{mux.Vars(req)["fingerprint"], deleted})
+}
+
+// reencryptRoute re-encrypts the documents with the IDs in the request body ({"ids": [...]}) using the current encryption settings.
+func reencryptRoute(res http.ResponseWriter, req *http.Request) {
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(res, req.Body, qbin.MaxFilesize)).Decode(&body)
+	if err != nil {
+		writeJSON(res, 400, struct {
+			Error string `json:"error"`
+		}{"invalid request body, expected {\"ids\": [...]}"})
+		return
+	}
+	if !auditAdmin(res, req, "reencrypt", auditDocuments(body.IDs...)) {
+		return
+	}
+	writeJSON(res, 200, struct {
+		Reencrypted int `json:"reencrypted"`
+	}{qbin.ReencryptAll(body.IDs)})
+}
+
+// rehighlightRoute runs the syntax highlighting again for the documents with the IDs in the request body ({"ids": [...]}),
+// e.g. after updating the highlighter. Only documents with a stored original content can be updated.
+func rehighlightRoute(res http.ResponseWriter, req *http.Request) {
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(res, req.Body, qbin.MaxFilesize)).Decode(&body)
+	if err != nil {
+		writeJSON(res, 400, struct {
+			Error string `json:"error"`
+		}{"invalid request body, expected {\"ids\": [...]}"})
+		return
+	}
+	if !auditAdmin(res, req, "rehighlight", auditDocuments(body.IDs...)) {
+		return
+	}
+	writeJSON(res, 200, struct {
+		Rehighlighted int `json:"rehighlighted"`
+	}{rehighlightAll(body.IDs)})
+}
+
+// metricsRoute returns internal counters for monitoring.
+func metricsRoute(res http.ResponseWriter, req *http.Request) {
+	if !auditAdmin(res, req, "metrics", "") {
+		return
+	}
+	writeJSON(res, 200, struct {
+		DecryptionFailures uint64              `json:"decryptionFailures"`
+		Cleanup            qbin.CleanupMetrics `json:"cleanup"`
+	}{qbin.DecryptionFailures(), cleanupMetrics()})
+}
+
+// chainRoute verifies the hash chain of stored documents and returns all breaks.
+func chainRoute(res http.ResponseWriter, req *http.Request) {
+	if !auditAdmin(res, req, "verify-chain", "") {
+		return
+	}
+	breaks, err := qbin.VerifyChain()
+	if adminError("qbin.VerifyChain()", err, res, req) {
+		return
+	}
+	writeJSON(res, 200, struct {
+		Valid  bool              `json:"valid"`
+		Breaks []qbin.ChainBreak `json:"breaks"`
+	}{len(breaks) == 0, breaks})
+}
+
+// auditRoute returns the most recent entries of the audit log, optionally only of one admin (?admin=<identity>).
+func auditRoute(res http.ResponseWriter, req *http.Request) {
+	if !auditAdmin(res, req, "audit", req.URL.Query().Get("admin")) {
+		return
+	}
+	entries, err := qbin.AuditEntries(req.URL.Query().Get("admin"))
+	if adminError("qbin.AuditEntries()", err, res, req) {
+		return
+	}
+	writeJSON(res, 200, struct {
+		Entries []qbin.AuditEntry `json:"entries"`
+	}{entries})
+}
+
+func adminError(during string, err error, res http.ResponseWriter, req *http.Request) bool {
+	if err == nil {
+		return false
+	}
+	qbin.Log.Errorf("Admin error during %s: %s", during, err)
+	if err == qbin.ErrTimeout {
+		serviceUnavailableRoute(res, req)
+		return true
+	}
+	internalErrorRoute(res, req)
+	return true
+}
@@ -0,0 +1,204 @@
+package qbinHTTP
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/qbin-io/backend"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	route := requireAdmin(scopeReadStats, func(res http.ResponseWriter, req *http.Request) {})
+	defer func() { config.AdminToken = "" }()
+
+	config.AdminToken = ""
+	res := httptest.NewRecorder()
+	route(res, httptest.NewRequest("GET", "/api/v1/admin/fingerprints/x", nil))
+	if res.Code != 404 {
+		t.Errorf("Admin route without admin token returned %d (expected: 404)", res.Code)
+	}
+
+	config.AdminToken = "secret"
+	for token, status := range map[string]int{"": 401, "Bearer wrong": 401, "secret": 401, "Bearer secret": 200} {
+		req := httptest.NewRequest("GET", "/api/v1/admin/fingerprints/x", nil)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		res := httptest.NewRecorder()
+		route(res, req)
+		if res.Code != status {
+			t.Errorf("Admin route with Authorization %q returned %d (expected: %d)", token, res.Code, status)
+		}
+	}
+}
+
+func TestAuditAdmin(t *testing.T) {
+	defer func() { recordAudit, deleteByFingerprint = qbin.Audit, qbin.DeleteByFingerprint }()
+	entries := []qbin.AuditEntry{}
+	recordAudit = func(admin string, action string, target string) error {
+		entries = append(entries, qbin.AuditEntry{Admin: admin, Action: action, Target: target})
+		return nil
+	}
+	deleted := []string{}
+	deleteByFingerprint = func(fingerprint string) (int64, error) {
+		deleted = append(deleted, fingerprint)
+		return 3, nil
+	}
+
+	fingerprint := strings.Repeat("ab", 32)
+	deleteRequest := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", "/api/v1/admin/fingerprints/"+fingerprint, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		req = mux.SetURLVars(req, map[string]string{"fingerprint": fingerprint})
+		res := httptest.NewRecorder()
+		deleteFingerprintRoute(res, req)
+		return res
+	}
+
+	res := deleteRequest()
+	if res.Code != 200 || len(deleted) != 1 {
+		t.Fatalf("Admin delete failed: %d %s", res.Code, res.Body.String())
+	}
+	hash := sha256.Sum256([]byte("secret"))
+	expected := qbin.AuditEntry{Admin: "token:" + hex.EncodeToString(hash[:8]), Action: "delete-fingerprint", Target: fingerprint}
+	if len(entries) != 1 || entries[0] != expected {
+		t.Errorf("Admin delete wasn't recorded as expected: %+v", entries)
+	}
+
+	// Nothing is deleted if the action can't be recorded
+	recordAudit = func(admin string, action string, target string) error { return errors.New("database is gone") }
+	res = deleteRequest()
+	if res.Code != 500 || len(deleted) != 1 {
+		t.Errorf("Admin delete without audit record returned %d and deleted %d times", res.Code, len(deleted))
+	}
+}
+
+func TestScopedAdminTokens(t *testing.T) {
+	defer func() {
+		config.AdminToken, config.AdminTokens = "", nil
+		recordAudit, deleteByFingerprint = qbin.Audit, qbin.DeleteByFingerprint
+	}()
+	identities := []string{}
+	recordAudit = func(admin string, action string, target string) error {
+		identities = append(identities, admin)
+		return nil
+	}
+	deleteByFingerprint = func(fingerprint string) (int64, error) { return 1, nil }
+
+	hash := func(token string) string {
+		sum := sha256.Sum256([]byte(token))
+		return hex.EncodeToString(sum[:])
+	}
+	config.AdminTokens = []string{"dashboard:" + hash("read-only") + ":read-stats", "moderator:" + strings.ToUpper(hash("moderator")) + ":reports,delete"}
+	r := mux.NewRouter()
+	setupAdminRoutes(r.PathPrefix("/api/v1").Subrouter())
+
+	fingerprint := "/api/v1/admin/fingerprints/" + strings.Repeat("ab", 32)
+	tests := []struct {
+		token, method, path string
+		status              int
+	}{
+		{"read-only", "GET", "/api/v1/admin/metrics", 200},
+		{"read-only", "DELETE", fingerprint, 403},
+		{"read-only", "GET", fingerprint, 403},
+		{"moderator", "DELETE", fingerprint, 200},
+		{"moderator", "GET", "/api/v1/admin/metrics", 403},
+		{"moderator", "POST", "/api/v1/admin/reencrypt", 403},
+		{"moderator", "POST", "/api/v1/admin/rehighlight", 403},
+		{hash("read-only"), "GET", "/api/v1/admin/metrics", 401},
+		{"wrong", "GET", "/api/v1/admin/metrics", 401},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, req)
+		if res.Code != test.status {
+			t.Errorf("%s %s with token %q returned %d (expected: %d)", test.method, test.path, test.token, res.Code, test.status)
+		}
+	}
+	if strings.Join(identities, ",") != "dashboard,moderator" {
+		t.Errorf("Actions weren't recorded with the token names: %v", identities)
+	}
+
+	// The full admin token can still do everything
+	config.AdminToken = "secret"
+	req := httptest.NewRequest("DELETE", fingerprint, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, req)
+	if res.Code != 200 {
+		t.Errorf("Delete with the full admin token returned %d", res.Code)
+	}
+}
+
+func TestRehighlightRoute(t *testing.T) {
+	defer func() {
+		config.AdminTokens = nil
+		recordAudit, rehighlightAll = qbin.Audit, qbin.RehighlightAll
+	}()
+	entries := []qbin.AuditEntry{}
+	recordAudit = func(admin string, action string, target string) error {
+		entries = append(entries, qbin.AuditEntry{Admin: admin, Action: action, Target: target})
+		return nil
+	}
+	rehighlighted := []string{}
+	rehighlightAll = func(ids []string) int {
+		rehighlighted = append(rehighlighted, ids...)
+		return len(ids) - 1
+	}
+	sum := sha256.Sum256([]byte("maintenance"))
+	config.AdminTokens = []string{"maintenance:" + hex.EncodeToString(sum[:]) + ":purge"}
+	r := mux.NewRouter()
+	setupAdminRoutes(r.PathPrefix("/api/v1").Subrouter())
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/admin/rehighlight", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer maintenance")
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, req)
+		return res
+	}
+
+	res := post(`{"ids": ["cornflake-peddling-bp0q", "missing"]}`)
+	if res.Code != 200 || res.Body.String() != `{"rehighlighted":1}`+"\n" {
+		t.Errorf("Rehighlighting returned %d %s", res.Code, res.Body.String())
+	}
+	// Document IDs are the keys of the documents, so only their database IDs are recorded
+	first, second := sha256.Sum256([]byte("cornflake-peddling-bp0q")), sha256.Sum256([]byte("missing"))
+	expected := qbin.AuditEntry{Admin: "maintenance", Action: "rehighlight", Target: hex.EncodeToString(first[:]) + "," + hex.EncodeToString(second[:])}
+	if len(entries) != 1 || entries[0] != expected {
+		t.Errorf("Rehighlighting wasn't recorded as expected: %+v", entries)
+	}
+
+	if res := post("not json"); res.Code != 400 || len(rehighlighted) != 2 || len(entries) != 1 {
+		t.Errorf("Invalid request returned %d and rehighlighted %v", res.Code, rehighlighted)
+	}
+}
+
+func TestMetricsRoute(t *testing.T) {
+	defer func() { recordAudit, cleanupMetrics = qbin.Audit, qbin.Cleanup }()
+	recordAudit = func(admin string, action string, target string) error { return nil }
+	cleanupMetrics = func() qbin.CleanupMetrics {
+		return qbin.CleanupMetrics{Deleted: 2500, Batches: 3, LastDuration: 1.5}
+	}
+
+	res := httptest.NewRecorder()
+	metricsRoute(res, httptest.NewRequest("GET", "/api/v1/admin/metrics", nil))
+	response := struct {
+		Cleanup qbin.CleanupMetrics `json:"cleanup"`
+	}{}
+	if err := json.Unmarshal(res.Body.Bytes(), &response); err != nil || res.Code != 200 {
+		t.Fatalf("Metrics returned %d: %s", res.Code, res.Body.String())
+	}
+	if response.Cleanup != cleanupMetrics() {
+		t.Errorf("Cleanup progress isn't in the metrics: %s", res.Body.String())
+	}
+}
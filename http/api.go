@@ -0,0 +1,334 @@
+package qbinHTTP
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/qbin-io/backend"
+)
+
+// setupAPIRoutes will set up the routes of the JSON API under /api/v1.
+func setupAPIRoutes(r *mux.Router) {
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("", apiRootRoute).Methods("GET")
+
+	availabilityLimiter := newRateLimiter(config.AvailabilityRateLimit, time.Minute)
+	api.HandleFunc("/documents/{document}/available", rateLimited(availabilityLimiter, availableRoute)).Methods("GET")
+	api.HandleFunc("/documents/{document}", metadataRoute).Methods("GET")
+	api.HandleFunc("/documents/{document}/diff", diffRoute).Methods("GET")
+	api.HandleFunc("/stats/syntaxes", syntaxStatsRoute).Methods("GET")
+	api.HandleFunc("/stats/documents", documentStatsRoute).Methods("GET")
+	api.HandleFunc("/syntaxes", syntaxesRoute).Methods("GET")
+	api.HandleFunc("/themes", themesRoute).Methods("GET")
+	if qbin.Collections {
+		api.HandleFunc("/collection", collectionRoute).Methods("GET")
+	}
+	if config.Limits {
+		api.HandleFunc("/limits", limitsRoute).Methods("GET")
+	}
+
+	setupAdminRoutes(api)
+}
+
+// staticJSON is a JSON response that doesn't change during the lifetime of the process, and can therefore be cached by clients.
+type staticJSON struct {
+	mutex sync.Mutex
+	body  []byte
+	etag  string
+}
+
+// get returns the cached body and ETag, encoding the value returned by load on the first call.
+// If load returns nil, nothing is cached and nil is returned, so the next call tries again.
+func (s *staticJSON) get(load func() interface{}) ([]byte, string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.body != nil {
+		return s.body, s.etag, nil
+	}
+
+	value := load()
+	if value == nil {
+		return nil, "", nil
+	}
+	body, err := json.Marshal(value)
+	if err != nil {
+		return nil, "", err
+	}
+	hash := sha256.Sum256(body)
+	s.body = append(body, '\n')
+	s.etag = `"` + hex.EncodeToString(hash[:16]) + `"`
+	return s.body, s.etag, nil
+}
+
+// serve sends the cached response with caching headers, or 304 if the client already has it.
+func (s *staticJSON) serve(res http.ResponseWriter, req *http.Request, load func() interface{}) {
+	body, etag, err := s.get(load)
+	if err != nil {
+		qbin.Log.Errorf("Couldn't encode JSON response: %s", err)
+		internalErrorRoute(res, req)
+		return
+	} else if body == nil {
+		serviceUnavailableRoute(res, req)
+		return
+	}
+
+	res.Header().Set("ETag", etag)
+	res.Header().Set("Cache-Control", "public, max-age=86400")
+	if matchesETag(req.Header.Get("If-None-Match"), etag) {
+		res.WriteHeader(304)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	res.WriteHeader(200)
+	res.Write(body)
+}
+
+var syntaxesResponse = &staticJSON{}
+var allSyntaxesResponse = &staticJSON{}
+var syntaxList = qbin.Syntaxes
+var advertisedSyntaxList = qbin.AdvertisedSyntaxes
+
+// syntaxesRoute returns the list of syntaxes offered for highlighting, or all available ones with ?all=true.
+func syntaxesRoute(res http.ResponseWriter, req *http.Request) {
+	response, list := syntaxesResponse, advertisedSyntaxList
+	if all, _ := strconv.ParseBool(req.URL.Query().Get("all")); all {
+		response, list = allSyntaxesResponse, syntaxList
+	}
+	response.serve(res, req, func() interface{} {
+		if syntaxes := list(); syntaxes != nil {
+			return syntaxes
+		}
+		return nil
+	})
+}
+
+var themesResponse = &staticJSON{}
+
+// themesRoute returns the list of color themes offered by the frontend.
+func themesRoute(res http.ResponseWriter, req *http.Request) {
+	themesResponse.serve(res, req, func() interface{} {
+		if config.Themes == nil {
+			return []string{}
+		}
+		return config.Themes
+	})
+}
+
+// writeJSON sends a value as a JSON response. Objects get the maintenance banner as "warnings" (see withBannerWarnings()).
+func writeJSON(res http.ResponseWriter, status int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		qbin.Log.Errorf("Couldn't encode JSON response: %s", err)
+		internalErrorRoute(res, nil)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	res.WriteHeader(status)
+	res.Write(append(withBannerWarnings(body), '\n'))
+}
+
+// apiRoot describes the instance for API clients, so they can configure themselves.
+type apiRoot struct {
+	Version string `json:"version"`
+	// MaxFilesize is in bytes
+	MaxFilesize int `json:"maxFilesize"`
+	// MaxExpiration is in seconds, 0 means documents can be stored forever
+	MaxExpiration int64             `json:"maxExpiration"`
+	Syntaxes      int               `json:"syntaxes"`
+	Links         map[string]string `json:"links"`
+}
+
+// apiRootRoute returns information about the instance and links to the other API routes.
+func apiRootRoute(res http.ResponseWriter, req *http.Request) {
+	api := config.Root + "/api/v1"
+	root := apiRoot{
+		Version:       config.Version,
+		MaxFilesize:   qbin.MaxFilesize,
+		MaxExpiration: int64(qbin.MaxExpiration.Seconds()),
+		Syntaxes:      len(syntaxList()),
+		Links: map[string]string{
+			"self":          api,
+			"upload":        config.Root + "/",
+			"syntaxes":      api + "/syntaxes",
+			"themes":        api + "/themes",
+			"syntaxStats":   api + "/stats/syntaxes",
+			"documentStats": api + "/stats/documents",
+			"metadata":      api + "/documents/{document}",
+			"diff":          api + "/documents/{document}/diff",
+			"available":     api + "/documents/{document}/available",
+		},
+	}
+	if qbin.Collections {
+		root.Links["collection"] = api + "/collection"
+	}
+	if config.Limits {
+		root.Links["limits"] = api + "/limits"
+	}
+	writeJSON(res, 200, root)
+}
+
+// availableRoute checks if a document name is still available, without disclosing anything else about an existing document.
+func availableRoute(res http.ResponseWriter, req *http.Request) {
+	exists, err := qbin.Exists(mux.Vars(req)["document"])
+	if err == qbin.ErrTimeout {
+		serviceUnavailableRoute(res, req)
+		return
+	} else if err != nil {
+		qbin.Log.Errorf("Couldn't check document availability: %s", err)
+		internalErrorRoute(res, req)
+		return
+	}
+	writeJSON(res, 200, struct {
+		Available bool `json:"available"`
+	}{!exists})
+}
+
+var apiMetadata = qbin.Metadata
+
+// metadataRoute returns the metadata and a snippet of a document, without counting a view.
+func metadataRoute(res http.ResponseWriter, req *http.Request) {
+	meta, err := apiMetadata(mux.Vars(req)["document"])
+	if err != nil {
+		documentErrorRoute(res, req, err)
+		return
+	}
+	if config.FilesArray {
+		writeJSON(res, 200, filesMetadata{DocumentMetadata: meta, Files: []jsonFile{{Syntax: meta.Syntax}}})
+		return
+	}
+	writeJSON(res, 200, meta)
+}
+
+// filesMetadata is the metadata of a document with the syntax in a "files" array, if config.FilesArray is set.
+type filesMetadata struct {
+	qbin.DocumentMetadata
+	// Syntax hides the syntax of the embedded metadata, as it's only in Files
+	Syntax *string    `json:"syntax,omitempty"`
+	Files  []jsonFile `json:"files"`
+}
+
+// diffRoute returns the differences between a fork and its parent, as a unified diff or as JSON hunks.
+func diffRoute(res http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["document"]
+	hunks, err := qbin.ForkDiff(id)
+	switch err {
+	case nil:
+	case qbin.ErrNoParent:
+		customErrorRoute(res, req, 404, "document is not a fork")
+		return
+	case qbin.ErrParentGone:
+		customErrorRoute(res, req, 410, "parent document is gone")
+		return
+	case qbin.ErrVolatile:
+		customErrorRoute(res, req, 403, "document can only be viewed once")
+		return
+	case qbin.ErrDiffTooLarge:
+		customErrorRoute(res, req, 422, "documents differ too much")
+		return
+	default:
+		documentErrorRoute(res, req, err)
+		return
+	}
+
+	if wantsJSON(req) {
+		writeJSON(res, 200, struct {
+			ID    string          `json:"id"`
+			Hunks []qbin.DiffHunk `json:"hunks"`
+		}{id, hunks})
+		return
+	}
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	res.WriteHeader(200)
+	fmt.Fprint(res, qbin.UnifiedDiff("parent", id, hunks))
+}
+
+// syntaxStatsRoute returns the number of documents per syntax.
+func syntaxStatsRoute(res http.ResponseWriter, req *http.Request) {
+	stats, err := qbin.SyntaxStats()
+	if err == qbin.ErrTimeout {
+		serviceUnavailableRoute(res, req)
+		return
+	} else if err != nil {
+		qbin.Log.Errorf("Couldn't get syntax statistics: %s", err)
+		internalErrorRoute(res, req)
+		return
+	}
+	writeJSON(res, 200, stats)
+}
+
+var listCollection = qbin.ListCollection
+
+// collectionRoute lists the documents in the collection whose token is sent as "Authorization: Bearer <token>".
+func collectionRoute(res http.ResponseWriter, req *http.Request) {
+	// Collections are only identified by their token, so malformed tokens can only be counted per client. Well-formed
+	// tokens of collections without documents aren't failures, as they can't be told apart from valid collections whose
+	// documents expired.
+	key := "ip:" + clientBucket(req)
+	if tokenThrottled(res, req, key) {
+		return
+	}
+	authorization := req.Header.Get("Authorization")
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if token == authorization || qbin.ValidateCollection(token) != nil {
+		tokenAttempts.fail(key)
+		res.Header().Set("WWW-Authenticate", "Bearer")
+		customErrorRoute(res, req, 401, "invalid collection token")
+		return
+	}
+	documents, err := listCollection(token)
+	if err == qbin.ErrTimeout {
+		serviceUnavailableRoute(res, req)
+		return
+	} else if err != nil {
+		qbin.Log.Errorf("Couldn't list a collection: %s", err)
+		internalErrorRoute(res, req)
+		return
+	}
+	writeJSON(res, 200, struct {
+		Documents []qbin.CollectionDocument `json:"documents"`
+	}{documents})
+}
+
+// documentStatsRoute returns the number of live, expired and volatile documents.
+func documentStatsRoute(res http.ResponseWriter, req *http.Request) {
+	stats, err := qbin.DocumentStats()
+	if err == qbin.ErrTimeout {
+		serviceUnavailableRoute(res, req)
+		return
+	} else if err != nil {
+		qbin.Log.Errorf("Couldn't get document statistics: %s", err)
+		internalErrorRoute(res, req)
+		return
+	}
+	writeJSON(res, 200, stats)
+}
+
+// readinessResponse is the result of the readiness check.
+type readinessResponse struct {
+	Ready  bool                  `json:"ready"`
+	Checks []qbin.ReadinessCheck `json:"checks"`
+}
+
+// readyRoute responds with 200 if the instance can serve documents, and with 503 and the failed checks otherwise.
+func readyRoute(res http.ResponseWriter, req *http.Request) {
+	checks, ready := qbin.Readiness()
+	status := 200
+	if !ready {
+		status = 503
+		for _, check := range checks {
+			if !check.OK {
+				qbin.Log.Warningf("Readiness check '%s' failed: %s", check.Name, check.Error)
+			}
+		}
+	}
+	res.Header().Set("Cache-Control", "no-store")
+	writeJSON(res, status, readinessResponse{Ready: ready, Checks: checks})
+}
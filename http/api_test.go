@@ -0,0 +1,216 @@
+package qbinHTTP
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/qbin-io/backend"
+)
+
+func TestSyntaxesCaching(t *testing.T) {
+	syntaxesResponse = &staticJSON{}
+	defer func(list, advertised func() []string) {
+		syntaxesResponse = &staticJSON{}
+		syntaxList, advertisedSyntaxList = list, advertised
+	}(syntaxList, advertisedSyntaxList)
+	advertisedSyntaxList = func() []string { return syntaxList() }
+	syntaxList = func() []string { return nil }
+
+	// Without prism-server, nothing must be cached
+	res := httptest.NewRecorder()
+	syntaxesRoute(res, httptest.NewRequest("GET", "/api/v1/syntaxes", nil))
+	if res.Code != 503 {
+		t.Errorf("Syntaxes without prism-server returned %d (expected: 503)", res.Code)
+	}
+
+	syntaxList = func() []string { return []string{"go", "markdown!", "python"} }
+	res = httptest.NewRecorder()
+	syntaxesRoute(res, httptest.NewRequest("GET", "/api/v1/syntaxes", nil))
+	etag := res.Header().Get("ETag")
+	if res.Code != 200 || etag == "" || res.Header().Get("Cache-Control") == "" {
+		t.Fatalf("Syntaxes returned %d with ETag %q and Cache-Control %q", res.Code, etag, res.Header().Get("Cache-Control"))
+	}
+	if res.Body.String() != `["go","markdown!","python"]`+"\n" {
+		t.Errorf("Unexpected syntaxes body: %s", res.Body.String())
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/syntaxes", nil)
+	req.Header.Set("If-None-Match", etag)
+	res = httptest.NewRecorder()
+	syntaxesRoute(res, req)
+	if res.Code != 304 || res.Body.Len() != 0 {
+		t.Errorf("Syntaxes with matching ETag returned %d with %d bytes (expected: 304 without body)", res.Code, res.Body.Len())
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/syntaxes", nil)
+	req.Header.Set("If-None-Match", `"outdated"`)
+	res = httptest.NewRecorder()
+	syntaxesRoute(res, req)
+	if res.Code != 200 {
+		t.Errorf("Syntaxes with outdated ETag returned %d (expected: 200)", res.Code)
+	}
+}
+
+func TestThemes(t *testing.T) {
+	defer func() {
+		themesResponse = &staticJSON{}
+		config.Themes = nil
+	}()
+	config.Themes = []string{"light", "dark", "solarized"}
+
+	res := httptest.NewRecorder()
+	themesRoute(res, httptest.NewRequest("GET", "/api/v1/themes", nil))
+	etag := res.Header().Get("ETag")
+	if res.Code != 200 || etag == "" || res.Body.String() != `["light","dark","solarized"]`+"\n" {
+		t.Fatalf("Themes returned %d with ETag %q: %s", res.Code, etag, res.Body.String())
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/themes", nil)
+	req.Header.Set("If-None-Match", etag)
+	res = httptest.NewRecorder()
+	themesRoute(res, req)
+	if res.Code != 304 || res.Body.Len() != 0 {
+		t.Errorf("Themes with matching ETag returned %d with %d bytes (expected: 304 without body)", res.Code, res.Body.Len())
+	}
+}
+
+func TestAPIRoot(t *testing.T) {
+	config.Root = "https://qbin.example.org"
+	config.Version = "2.0.0"
+	qbin.MaxExpiration = 30 * 24 * time.Hour
+	defer func(list func() []string) {
+		qbin.MaxExpiration = 0
+		syntaxList = list
+	}(syntaxList)
+	syntaxList = func() []string { return []string{"go", "markdown!", "python"} }
+
+	res := httptest.NewRecorder()
+	apiRootRoute(res, httptest.NewRequest("GET", "/api/v1", nil))
+	root := apiRoot{}
+	if err := json.Unmarshal(res.Body.Bytes(), &root); err != nil {
+		t.Fatal(err)
+	}
+	if root.Version != "2.0.0" || root.MaxFilesize != qbin.MaxFilesize || root.MaxExpiration != 30*24*60*60 || root.Syntaxes != 3 {
+		t.Errorf("API root doesn't match the configuration: %+v", root)
+	}
+	if root.Links["syntaxes"] != "https://qbin.example.org/api/v1/syntaxes" {
+		t.Errorf("Wrong link to the syntaxes: %s", root.Links["syntaxes"])
+	}
+}
+
+func TestMetadataFilesArray(t *testing.T) {
+	defer func() {
+		apiMetadata = qbin.Metadata
+		config.FilesArray = false
+	}()
+	apiMetadata = func(id string) (qbin.DocumentMetadata, error) {
+		return qbin.DocumentMetadata{ID: "cornflake-peddling-bp0q", Syntax: "go", State: qbin.StateLive}, nil
+	}
+
+	for _, filesArray := range []bool{false, true} {
+		config.FilesArray = filesArray
+		res := httptest.NewRecorder()
+		metadataRoute(res, httptest.NewRequest("GET", "/api/v1/documents/cornflake-peddling-bp0q", nil))
+		response := map[string]interface{}{}
+		if err := json.Unmarshal(res.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Response isn't valid JSON: %s", err)
+		}
+		files, _ := response["files"].([]interface{})
+		if filesArray && (response["syntax"] != nil || len(files) != 1 || files[0].(map[string]interface{})["syntax"] != "go" || response["id"] != "cornflake-peddling-bp0q") {
+			t.Errorf("Wrong metadata with files array: %s", res.Body.String())
+		} else if !filesArray && (response["syntax"] != "go" || response["files"] != nil) {
+			t.Errorf("Wrong flat metadata: %s", res.Body.String())
+		}
+	}
+}
+
+func TestAllSyntaxes(t *testing.T) {
+	defer func(list, advertised func() []string) {
+		syntaxesResponse, allSyntaxesResponse = &staticJSON{}, &staticJSON{}
+		syntaxList, advertisedSyntaxList = list, advertised
+	}(syntaxList, advertisedSyntaxList)
+	syntaxList = func() []string { return []string{"go", "markdown!", "python"} }
+	advertisedSyntaxList = func() []string { return []string{"go"} }
+
+	for path, expected := range map[string]string{
+		"/api/v1/syntaxes":          `["go"]`,
+		"/api/v1/syntaxes?all=true": `["go","markdown!","python"]`,
+		"/api/v1/syntaxes?all=1":    `["go","markdown!","python"]`,
+	} {
+		res := httptest.NewRecorder()
+		syntaxesRoute(res, httptest.NewRequest("GET", path, nil))
+		if res.Body.String() != expected+"\n" {
+			t.Errorf("%s returned %s (expected: %s)", path, res.Body.String(), expected)
+		}
+	}
+}
+
+func TestCollectionToken(t *testing.T) {
+	defer func() { qbin.Collections = false }()
+	qbin.Collections = true
+	for header, status := range map[string]int{"": 401, "correct-horse-battery-staple": 401, "Bearer short": 401} {
+		req := httptest.NewRequest("GET", "/api/v1/collection", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		res := httptest.NewRecorder()
+		collectionRoute(res, req)
+		if res.Code != status || res.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("Collection with authorization %q returned %d (expected: %d)", header, res.Code, status)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	defer func(advertised func() []string) {
+		advertisedSyntaxList = advertised
+		qbin.MaxExpiration, qbin.SyntaxMaxExpiration = 0, map[string]time.Duration{}
+		config.AvailabilityRateLimit, config.TokenFailures = 0, 0
+	}(advertisedSyntaxList)
+	advertisedSyntaxList = func() []string { return []string{"go", "python"} }
+	qbin.MaxExpiration = 7 * 24 * time.Hour
+	qbin.SyntaxMaxExpiration = map[string]time.Duration{"log": 24 * time.Hour, "": 72 * time.Hour}
+	config.AvailabilityRateLimit = 30
+	config.TokenFailures = 5
+
+	get := func(etag string) (*httptest.ResponseRecorder, apiLimits) {
+		req := httptest.NewRequest("GET", "/api/v1/limits", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		res := httptest.NewRecorder()
+		limitsRoute(res, req)
+		limits := apiLimits{}
+		json.Unmarshal(res.Body.Bytes(), &limits)
+		return res, limits
+	}
+
+	res, limits := get("")
+	etag := res.Header().Get("ETag")
+	if res.Code != 200 || etag == "" || res.Header().Get("Cache-Control") == "" {
+		t.Fatalf("Limits returned %d with ETag %q and Cache-Control %q", res.Code, etag, res.Header().Get("Cache-Control"))
+	}
+	if limits.MaxFilesize != qbin.MaxFilesize || limits.MaxExpiration != 7*24*60*60 || len(limits.Syntaxes) != 2 ||
+		limits.RateLimits.AvailabilityPerMinute != 30 || limits.RateLimits.TokenFailures != 5 || limits.VanityIDs {
+		t.Errorf("Limits don't match the configuration: %+v", limits)
+	}
+	if len(limits.SyntaxMaxExpiration) != 2 || limits.SyntaxMaxExpiration["log"] != 24*60*60 || limits.SyntaxMaxExpiration["none"] != 72*60*60 {
+		t.Errorf("Limits don't contain the maximum expirations of the syntaxes: %v", limits.SyntaxMaxExpiration)
+	}
+	if res, _ := get(etag); res.Code != 304 {
+		t.Errorf("Limits with matching ETag returned %d (expected: 304)", res.Code)
+	}
+
+	// Changes to the configuration must be visible immediately
+	qbin.MaxExpiration = time.Hour
+	config.AvailabilityRateLimit = 10
+	res, limits = get(etag)
+	if res.Code != 200 || res.Header().Get("ETag") == etag {
+		t.Errorf("Limits weren't updated after a configuration change: %d", res.Code)
+	}
+	if limits.MaxExpiration != 60*60 || limits.RateLimits.AvailabilityPerMinute != 10 {
+		t.Errorf("Limits don't match the changed configuration: %+v", limits)
+	}
+}
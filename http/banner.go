@@ -0,0 +1,101 @@
+package qbinHTTP
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/qbin-io/backend"
+)
+
+// maintenanceBanner is the current banner message, which starts as config.MaintenanceBanner and can be changed at runtime
+// using the admin API. Empty means no banner.
+var maintenanceBanner = struct {
+	sync.RWMutex
+	message string
+}{}
+
+// currentBanner returns the current banner message, or an empty string if there is none.
+func currentBanner() string {
+	maintenanceBanner.RLock()
+	defer maintenanceBanner.RUnlock()
+	return maintenanceBanner.message
+}
+
+// setBanner replaces the current banner message.
+func setBanner(message string) {
+	maintenanceBanner.Lock()
+	defer maintenanceBanner.Unlock()
+	maintenanceBanner.message = strings.TrimSpace(message)
+}
+
+// bannerWarnings returns the current banner as warnings for API responses, if config.MaintenanceBannerAPI is enabled.
+func bannerWarnings() []string {
+	if message := currentBanner(); message != "" && config.MaintenanceBannerAPI {
+		return []string{message}
+	}
+	return nil
+}
+
+// withBannerWarnings adds bannerWarnings() as "warnings" field to an encoded JSON object, so API clients get the banner
+// with every response. Other values (e.g. arrays) can't have fields, and are returned unchanged.
+func withBannerWarnings(body []byte) []byte {
+	warnings := bannerWarnings()
+	if warnings == nil || len(body) < 2 || body[0] != '{' {
+		return body
+	}
+	field, err := json.Marshal(struct {
+		Warnings []string `json:"warnings"`
+	}{warnings})
+	if err != nil || string(body) == "{}" {
+		return field
+	}
+	// Replace the closing brace of the object with the field, without modifying the original body
+	return append(append(body[:len(body)-1:len(body)-1], ','), field[1:]...)
+}
+
+// injectBanner inserts the current banner at the beginning of the <body> of an HTML page.
+func injectBanner(body *string) {
+	message := currentBanner()
+	if message == "" {
+		return
+	}
+	start := strings.Index(*body, "<body")
+	if start < 0 {
+		return
+	}
+	end := strings.Index((*body)[start:], ">")
+	if end < 0 {
+		return
+	}
+	end += start + 1
+	*body = (*body)[:end] + "\n" + `<div class="maintenance-banner" role="alert">` + qbin.EscapeHTML(message) + "</div>" + (*body)[end:]
+}
+
+// bannerRoute returns the current banner message.
+func bannerRoute(res http.ResponseWriter, req *http.Request) {
+	writeJSON(res, 200, struct {
+		Message string `json:"message"`
+	}{currentBanner()})
+}
+
+// setBannerRoute replaces the banner message with the one in the request body ({"message": "..."}). An empty message
+// removes the banner.
+func setBannerRoute(res http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Message *string `json:"message"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(res, req.Body, 64*1024)).Decode(&body)
+	if err != nil || body.Message == nil {
+		writeJSON(res, 400, struct {
+			Error string `json:"error"`
+		}{"invalid request body, expected {\"message\": \"...\"}"})
+		return
+	}
+	if !auditAdmin(res, req, "banner", *body.Message) {
+		return
+	}
+	setBanner(*body.Message)
+	bannerRoute(res, req)
+}
@@ -0,0 +1,89 @@
+package qbinHTTP
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/qbin-io/backend"
+)
+
+func TestMaintenanceBanner(t *testing.T) {
+	defer func() {
+		recordAudit = qbin.Audit
+		config.AdminToken, config.MaintenanceBannerAPI = "", false
+		setBanner("")
+	}()
+	recordAudit = func(admin string, action string, target string) error { return nil }
+	config.AdminToken = "secret"
+	config.MaintenanceBannerAPI = true
+
+	page := "<html><head></head><body class=\"dark\">\n<main></main></body></html>"
+	body := page
+	injectBanner(&body)
+	apiRes := httptest.NewRecorder()
+	apiRootRoute(apiRes, httptest.NewRequest("GET", "/api/v1", nil))
+	if body != page || strings.Contains(apiRes.Body.String(), "warnings") {
+		t.Errorf("Empty banner was shown: %s %s", body, apiRes.Body.String())
+	}
+
+	req := httptest.NewRequest("PUT", "/api/v1/admin/banner", strings.NewReader(`{"message": "Downtime at <b>22:00</b>"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	res := httptest.NewRecorder()
+	requireAdmin(scopeBanner, setBannerRoute)(res, req)
+	if res.Code != 200 || currentBanner() != "Downtime at <b>22:00</b>" {
+		t.Fatalf("Setting the banner returned %d %s", res.Code, res.Body.String())
+	}
+
+	body = page
+	injectBanner(&body)
+	if !strings.Contains(body, `<body class="dark">`+"\n"+`<div class="maintenance-banner" role="alert">Downtime at &lt;b&gt;22:00&lt;/b&gt;</div>`) {
+		t.Errorf("Banner wasn't injected into the page: %s", body)
+	}
+
+	// All JSON objects get the banner, other values stay unchanged
+	advertisedSyntaxList = func() []string { return []string{"go"} }
+	defer func() { advertisedSyntaxList = qbin.AdvertisedSyntaxes }()
+	for name, route := range map[string]func(*httptest.ResponseRecorder){
+		"root": func(res *httptest.ResponseRecorder) { apiRootRoute(res, httptest.NewRequest("GET", "/api/v1", nil)) },
+		"limits": func(res *httptest.ResponseRecorder) {
+			limitsRoute(res, httptest.NewRequest("GET", "/api/v1/limits", nil))
+		},
+		"stats": func(res *httptest.ResponseRecorder) { writeJSON(res, 200, qbin.DocumentCounts{}) },
+		"empty": func(res *httptest.ResponseRecorder) { writeJSON(res, 200, struct{}{}) },
+	} {
+		apiRes = httptest.NewRecorder()
+		route(apiRes)
+		response := struct {
+			Warnings []string `json:"warnings"`
+		}{}
+		json.Unmarshal(apiRes.Body.Bytes(), &response)
+		if len(response.Warnings) != 1 || response.Warnings[0] != "Downtime at <b>22:00</b>" {
+			t.Errorf("Banner isn't in the warnings of the %s response: %s", name, apiRes.Body.String())
+		}
+	}
+	apiRes = httptest.NewRecorder()
+	writeJSON(apiRes, 200, []string{"go"})
+	if apiRes.Body.String() != `["go"]`+"\n" {
+		t.Errorf("Banner was added to an array: %s", apiRes.Body.String())
+	}
+	config.MaintenanceBannerAPI = false
+	if bannerWarnings() != nil {
+		t.Errorf("Banner is in the API warnings without config.MaintenanceBannerAPI")
+	}
+
+	// An empty message removes the banner, a missing one is invalid
+	for body, status := range map[string]int{`{}`: 400, `{"message": ""}`: 200} {
+		req := httptest.NewRequest("PUT", "/api/v1/admin/banner", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		res := httptest.NewRecorder()
+		requireAdmin(scopeBanner, setBannerRoute)(res, req)
+		if res.Code != status {
+			t.Errorf("Setting the banner to %s returned %d (expected: %d)", body, res.Code, status)
+		}
+	}
+	if currentBanner() != "" {
+		t.Errorf("Banner wasn't removed: %q", currentBanner())
+	}
+}
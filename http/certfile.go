@@ -0,0 +1,61 @@
+package qbinHTTP
+
+import (
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/qbin-io/backend"
+)
+
+// certificateFile is a certificate loaded from a certificate and key file, which can be reloaded when the files are rotated.
+type certificateFile struct {
+	certFile    string
+	keyFile     string
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+}
+
+// loadCertificateFile loads a PEM encoded certificate (including intermediate certificates) and its private key.
+func loadCertificateFile(certFile string, keyFile string) (*certificateFile, error) {
+	c := &certificateFile{certFile: certFile, keyFile: keyFile}
+	return c, c.reload()
+}
+
+// reload loads the files again. If that fails, the previous certificate is kept.
+func (c *certificateFile) reload() error {
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.certificate = &certificate
+	c.mutex.Unlock()
+	return nil
+}
+
+// GetCertificate returns the current certificate, for use in tls.Config.
+func (c *certificateFile) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.certificate, nil
+}
+
+// reloadOnSIGHUP reloads the certificates whenever the process receives SIGHUP, e.g. after a renewal: kill -HUP $(pidof qbin)
+func reloadOnSIGHUP(certificates ...*certificateFile) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			for _, c := range certificates {
+				if err := c.reload(); err != nil {
+					qbin.Log.Errorf("Couldn't reload the certificate %s, keeping the previous one: %s", c.certFile, err)
+					continue
+				}
+				qbin.Log.Noticef("Reloaded the certificate %s", c.certFile)
+			}
+		}
+	}()
+}
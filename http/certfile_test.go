@@ -0,0 +1,111 @@
+package qbinHTTP
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCertificate creates a self-signed certificate for qbin.test and writes it to cert.pem and key.pem in dir.
+func writeSelfSignedCertificate(t *testing.T, dir string, serial int64) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "qbin test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"qbin.test"},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+func TestCertificateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qbin-cert-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := writeSelfSignedCertificate(t, dir, 1)
+	certificate, err := loadCertificateFile(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("Hello World"))
+	}))
+	server.TLS = &tls.Config{GetCertificate: certificate.GetCertificate}
+	server.StartTLS()
+	defer server.Close()
+
+	// Every request uses a new connection, so the current certificate is used. The server name is required, as httptest
+	// serves its own certificate to clients without SNI.
+	get := func(trusted *x509.Certificate) error {
+		pool := x509.NewCertPool()
+		pool.AddCert(trusted)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "qbin.test"}, DisableKeepAlives: true}}
+		res, err := client.Get(server.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+	if err := get(first); err != nil {
+		t.Fatalf("HTTPS request with the certificate from the file failed: %s", err)
+	}
+
+	// Rotate the certificate
+	second := writeSelfSignedCertificate(t, dir, 2)
+	if err := certificate.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(second); err != nil {
+		t.Errorf("HTTPS request with the reloaded certificate failed: %s", err)
+	}
+	if err := get(first); err == nil {
+		t.Errorf("The previous certificate is still used after reloading")
+	}
+
+	// Broken files keep the previous certificate
+	ioutil.WriteFile(filepath.Join(dir, "key.pem"), []byte("broken"), 0600)
+	if err := certificate.reload(); err == nil {
+		t.Errorf("Broken key file was loaded")
+	}
+	if err := get(second); err != nil {
+		t.Errorf("Certificate was replaced by a broken one: %s", err)
+	}
+}
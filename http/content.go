@@ -0,0 +1,43 @@
+package qbinHTTP
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/qbin-io/backend"
+)
+
+var requestByContentHash = qbin.RequestByContentHash
+
+// contentRoute serves the raw content of a document by its content hash (/c/<hash>). The content of a hash can never change,
+// so the response can be cached forever, e.g. by a CDN, unless all documents with that content expire. Then it can only be
+// cached until the last one expires, so expired content isn't served from caches.
+func contentRoute(res http.ResponseWriter, req *http.Request) {
+	hash := mux.Vars(req)["hash"]
+	content, expiration, err := requestByContentHash(hash)
+	if err == sql.ErrNoRows {
+		notFoundRoute(res, req)
+		return
+	} else if err != nil {
+		documentErrorRoute(res, req, err)
+		return
+	}
+
+	if expiration.IsZero() {
+		res.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		res.Header().Set("Cache-Control", "public, max-age="+strconv.FormatInt(int64(time.Until(expiration).Seconds()), 10))
+	}
+	etag := `"` + hash + `"`
+	res.Header().Set("ETag", etag)
+	if matchesETag(req.Header.Get("If-None-Match"), etag) {
+		res.WriteHeader(304)
+		return
+	}
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(res, "%s", content)
+}
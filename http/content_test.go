@@ -0,0 +1,57 @@
+package qbinHTTP
+
+import (
+	"database/sql"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/qbin-io/backend"
+)
+
+func TestContentRoute(t *testing.T) {
+	defer func() { requestByContentHash = qbin.RequestByContentHash }()
+	hash := "0123456789abcdef0123456789abcdef"
+	expiring := "fedcba9876543210fedcba9876543210"
+	requestByContentHash = func(h string) (string, time.Time, error) {
+		if h == hash {
+			return "Hello World\n", time.Time{}, nil
+		} else if h == expiring {
+			return "Goodbye\n", time.Now().Add(time.Hour), nil
+		}
+		return "", time.Time{}, sql.ErrNoRows
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/c/{hash:[0-9a-f]{32}}", contentRoute).Methods("GET")
+
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("GET", "/c/"+hash, nil))
+	if res.Code != 200 || res.Body.String() != "Hello World\n" {
+		t.Fatalf("Content URL didn't resolve: %d %q", res.Code, res.Body.String())
+	}
+	if res.Header().Get("Cache-Control") != "public, max-age=31536000, immutable" || res.Header().Get("ETag") != `"`+hash+`"` {
+		t.Errorf("Content URL isn't cacheable: %v", res.Header())
+	}
+
+	req := httptest.NewRequest("GET", "/c/"+hash, nil)
+	req.Header.Set("If-None-Match", `"`+hash+`"`)
+	res = httptest.NewRecorder()
+	r.ServeHTTP(res, req)
+	if res.Code != 304 {
+		t.Errorf("Conditional request returned %d (expected: 304)", res.Code)
+	}
+
+	// Expiring content must not be served from caches after it expired
+	res = httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("GET", "/c/"+expiring, nil))
+	if cache := res.Header().Get("Cache-Control"); res.Code != 200 || (cache != "public, max-age=3600" && cache != "public, max-age=3599") {
+		t.Errorf("Expiring content returned %d with Cache-Control %q", res.Code, cache)
+	}
+
+	res = httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("GET", "/c/ffffffffffffffffffffffffffffffff", nil))
+	if res.Code != 404 || res.Header().Get("Cache-Control") != "" {
+		t.Errorf("Unknown content hash returned %d with Cache-Control %q", res.Code, res.Header().Get("Cache-Control"))
+	}
+}
@@ -0,0 +1,45 @@
+package qbinHTTP
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// preloadTypes maps the extension of an asset to the "as" attribute of its preload link.
+var preloadTypes = map[string]string{
+	".css":   "style",
+	".js":    "script",
+	".mjs":   "script",
+	".woff":  "font",
+	".woff2": "font",
+	".svg":   "image",
+	".png":   "image",
+}
+
+// preloadLink returns the value of a Link header preloading an asset of the frontend, e.g. "/style.css".
+func preloadLink(asset string) string {
+	link := "<" + config.Root + "/" + strings.TrimPrefix(asset, "/") + ">; rel=preload"
+	if as, ok := preloadTypes[strings.ToLower(path.Ext(asset))]; ok {
+		link += "; as=" + as
+		if as == "font" {
+			// Fonts are always fetched in CORS mode, the preload would be wasted without it
+			link += "; crossorigin"
+		}
+	}
+	return link
+}
+
+// earlyHints sends a 103 Early Hints response preloading the assets in config.EarlyHints to browsers before calling the
+// route, so they can load the critical CSS and JavaScript of the frontend while the page is still being rendered.
+func earlyHints(route func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if len(config.EarlyHints) > 0 && strings.Contains(req.Header.Get("Accept"), "text/html") {
+			for _, asset := range config.EarlyHints {
+				res.Header().Add("Link", preloadLink(asset))
+			}
+			res.WriteHeader(103)
+		}
+		route(res, req)
+	}
+}
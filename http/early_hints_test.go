@@ -0,0 +1,65 @@
+package qbinHTTP
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestEarlyHints(t *testing.T) {
+	defer func() { config.Root, config.EarlyHints = "", nil }()
+	config.Root = "https://qbin.example.org"
+	config.EarlyHints = []string{"/style.css", "app.js", "/fonts/mono.woff2"}
+
+	server := httptest.NewServer(http.HandlerFunc(earlyHints(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/html; charset=utf-8")
+		res.WriteHeader(200)
+		res.Write([]byte("<h1>qbin</h1>"))
+	})))
+	defer server.Close()
+
+	get := func(accept string) (*http.Response, []int, []http.Header) {
+		statuses, headers := []int{}, []http.Header{}
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				statuses = append(statuses, code)
+				headers = append(headers, http.Header(header))
+				return nil
+			},
+		}
+		req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), "GET", server.URL, nil)
+		req.Header.Set("Accept", accept)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res, statuses, headers
+	}
+
+	res, statuses, headers := get("text/html,application/xhtml+xml,*/*;q=0.8")
+	if len(statuses) != 1 || statuses[0] != 103 || res.StatusCode != 200 {
+		t.Fatalf("Expected 103 before 200, got %v and %d", statuses, res.StatusCode)
+	}
+	expected := []string{
+		"<https://qbin.example.org/style.css>; rel=preload; as=style",
+		"<https://qbin.example.org/app.js>; rel=preload; as=script",
+		"<https://qbin.example.org/fonts/mono.woff2>; rel=preload; as=font; crossorigin",
+	}
+	if links := headers[0]["Link"]; strings.Join(links, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected preload links in the Early Hints: %q", links)
+	}
+
+	// API and command line clients don't need the assets
+	if _, statuses, _ := get("*/*"); len(statuses) != 0 {
+		t.Errorf("Early Hints were sent to a non-browser client: %v", statuses)
+	}
+	config.EarlyHints = nil
+	if _, statuses, _ := get("text/html"); len(statuses) != 0 {
+		t.Errorf("Early Hints were sent without configured assets: %v", statuses)
+	}
+}
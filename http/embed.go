@@ -0,0 +1,141 @@
+package qbinHTTP
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/qbin-io/backend"
+)
+
+var embedMetadata = qbin.Metadata
+
+// Default size of the iframe returned by oembedRoute, which can be reduced with the maxwidth and maxheight parameters.
+const embedWidth = 800
+const embedHeight = 400
+
+// maxEmbedDescription limits the length of the og:description of a document.
+const maxEmbedDescription = 200
+
+// oembedResponse is a response of oembedRoute, as defined by https://oembed.com/.
+type oembedResponse struct {
+	Version      string `json:"version"`
+	Type         string `json:"type"`
+	Title        string `json:"title"`
+	ProviderName string `json:"provider_name"`
+	ProviderURL  string `json:"provider_url"`
+	HTML         string `json:"html"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	CacheAge     int64  `json:"cache_age,omitempty"`
+}
+
+// oembedRoute describes the document at ?url=<document URL> as oEmbed JSON, with an iframe of the document as HTML snippet.
+func oembedRoute(res http.ResponseWriter, req *http.Request) {
+	embedError := func(status int, message string) {
+		writeJSON(res, status, struct {
+			Error string `json:"error"`
+		}{message})
+	}
+	if format := req.URL.Query().Get("format"); format != "" && format != "json" {
+		embedError(501, "only the json format is supported")
+		return
+	}
+	id := embedDocument(req.URL.Query().Get("url"))
+	if id == "" {
+		embedError(404, "the url doesn't belong to a document")
+		return
+	}
+	meta, err := embedMetadata(id)
+	if err == qbin.ErrExpired || err == qbin.ErrGone {
+		embedError(410, "document is gone")
+		return
+	} else if err == qbin.ErrTimeout || err == qbin.ErrBusy {
+		serviceUnavailableRoute(res, req)
+		return
+	} else if err != nil {
+		embedError(404, "document not found")
+		return
+	} else if meta.State == qbin.StateVolatile {
+		// Loading the embed would consume the document
+		embedError(404, "volatile documents can't be embedded")
+		return
+	}
+
+	width, height := embedWidth, embedHeight
+	if w, err := strconv.Atoi(req.URL.Query().Get("maxwidth")); err == nil && w > 0 && w < width {
+		width = w
+	}
+	if h, err := strconv.Atoi(req.URL.Query().Get("maxheight")); err == nil && h > 0 && h < height {
+		height = h
+	}
+	response := oembedResponse{
+		Version:      "1.0",
+		Type:         "rich",
+		Title:        embedTitle(meta.ID, meta.Syntax),
+		ProviderName: "qbin",
+		ProviderURL:  config.Root,
+		HTML:         fmt.Sprintf(`<iframe src="%s" width="%d" height="%d" frameborder="0"></iframe>`, qbin.EscapeHTML(config.Root+"/"+meta.ID), width, height),
+		Width:        width,
+		Height:       height,
+	}
+	if meta.Expiration != nil {
+		response.CacheAge = int64(time.Until(*meta.Expiration).Seconds())
+	}
+	writeJSON(res, 200, response)
+}
+
+// embedDocument returns the ID of the document a URL points to, or an empty string if it's not a document URL of this server.
+func embedDocument(documentURL string) string {
+	u, err := url.Parse(documentURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	if id := documentFromHost(u.Host); id != "" {
+		return id
+	}
+	root, err := url.Parse(config.Root)
+	if err != nil || !strings.EqualFold(u.Host, root.Host) || !strings.HasPrefix(u.Path, config.path+"/") {
+		return ""
+	}
+	// The document itself or one of its sub-routes, like /<document>/raw
+	id := strings.Split(strings.TrimPrefix(u.Path, config.path+"/"), "/")[0]
+	if id == "" || strings.Contains(id, ".") {
+		return ""
+	}
+	return id
+}
+
+// embedTitle returns the title of a document in embeds.
+func embedTitle(id string, syntax string) string {
+	if syntax == "" {
+		return id
+	}
+	return id + " (" + syntax + ")"
+}
+
+// openGraphTags returns the Open Graph meta tags describing a document, and a link to its oEmbed description.
+func openGraphTags(doc *qbin.Document) string {
+	documentURL := config.Root + "/" + doc.ID
+	tags := []string{
+		`<meta property="og:type" content="website">`,
+		`<meta property="og:site_name" content="qbin">`,
+		`<meta property="og:title" content="` + qbin.EscapeHTML(embedTitle(doc.ID, doc.Syntax)) + `">`,
+		`<meta property="og:url" content="` + qbin.EscapeHTML(documentURL) + `">`,
+	}
+	// Client-side encrypted content would only be noise
+	if doc.Custom != "encrypted" {
+		description := strings.TrimSpace(qbin.StripHTML(doc.Content))
+		if utf8.RuneCountInString(description) > maxEmbedDescription {
+			description = string([]rune(description)[:maxEmbedDescription-1]) + "…"
+		}
+		tags = append(tags, `<meta property="og:description" content="`+qbin.EscapeHTML(description)+`">`)
+	}
+	tags = append(tags, `<link rel="alternate" type="application/json+oembed" href="`+
+		qbin.EscapeHTML(config.Root+"/oembed?url="+url.QueryEscape(documentURL))+`" title="`+qbin.EscapeHTML(doc.ID)+`">`)
+	return strings.Join(tags, "\n")
+}
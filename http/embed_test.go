@@ -0,0 +1,100 @@
+package qbinHTTP
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qbin-io/backend"
+)
+
+func TestOembed(t *testing.T) {
+	defer func() {
+		embedMetadata = qbin.Metadata
+		config.Root, config.DocumentDomain = "", ""
+	}()
+	config.Root = "https://qbin.example.org"
+	config.DocumentDomain = "qbin-usercontent.example.org"
+	expiration := time.Now().Add(time.Hour)
+	embedMetadata = func(id string) (qbin.DocumentMetadata, error) {
+		switch id {
+		case "cornflake-peddling-bp0q":
+			return qbin.DocumentMetadata{ID: id, Syntax: "go", State: qbin.StateLive, Expiration: &expiration}, nil
+		case "expired-document-aaaa":
+			return qbin.DocumentMetadata{}, qbin.ErrExpired
+		case "volatile-document-aaaa":
+			return qbin.DocumentMetadata{ID: id, State: qbin.StateVolatile}, nil
+		}
+		return qbin.DocumentMetadata{}, sql.ErrNoRows
+	}
+
+	oembed := func(documentURL string, query string) (*httptest.ResponseRecorder, oembedResponse) {
+		req := httptest.NewRequest("GET", "/oembed?url="+url.QueryEscape(documentURL)+query, nil)
+		res := httptest.NewRecorder()
+		oembedRoute(res, req)
+		response := oembedResponse{}
+		json.Unmarshal(res.Body.Bytes(), &response)
+		return res, response
+	}
+
+	for _, documentURL := range []string{"https://qbin.example.org/cornflake-peddling-bp0q", "https://qbin.example.org/cornflake-peddling-bp0q/raw", "https://cornflake-peddling-bp0q.qbin-usercontent.example.org/"} {
+		res, response := oembed(documentURL, "")
+		if res.Code != 200 || response.Version != "1.0" || response.Type != "rich" || response.Title != "cornflake-peddling-bp0q (go)" || response.ProviderName != "qbin" {
+			t.Errorf("Unexpected oEmbed response for %s: %d %s", documentURL, res.Code, res.Body.String())
+		}
+		if !strings.Contains(response.HTML, `src="https://qbin.example.org/cornflake-peddling-bp0q"`) || response.Width != embedWidth {
+			t.Errorf("The embed doesn't reference the document: %s", response.HTML)
+		}
+		if response.CacheAge <= 0 || response.CacheAge > 3600 {
+			t.Errorf("The cache age doesn't respect the expiration: %d", response.CacheAge)
+		}
+	}
+
+	if res, response := oembed("https://qbin.example.org/cornflake-peddling-bp0q", "&maxwidth=300&maxheight=1000"); res.Code != 200 || response.Width != 300 || response.Height != embedHeight {
+		t.Errorf("Maximum size wasn't respected: %d %s", res.Code, res.Body.String())
+	}
+
+	tests := map[string]int{
+		"https://qbin.example.org/expired-document-aaaa":  410,
+		"https://qbin.example.org/volatile-document-aaaa": 404,
+		"https://qbin.example.org/missing-document-aaaa":  404,
+		"https://example.com/cornflake-peddling-bp0q":     404,
+		"https://qbin.example.org/":                       404,
+		"https://qbin.example.org/style.css":              404,
+		"not a url":                                       404,
+	}
+	for documentURL, status := range tests {
+		if res, _ := oembed(documentURL, ""); res.Code != status || !strings.Contains(res.Body.String(), `"error"`) {
+			t.Errorf("oEmbed for %s returned %d %s (expected: %d)", documentURL, res.Code, res.Body.String(), status)
+		}
+	}
+	if res, _ := oembed("https://qbin.example.org/cornflake-peddling-bp0q", "&format=xml"); res.Code != 501 {
+		t.Errorf("XML format returned %d (expected: 501)", res.Code)
+	}
+}
+
+func TestOpenGraphTags(t *testing.T) {
+	defer func() { config.Root = "" }()
+	config.Root = "https://qbin.example.org"
+	doc := qbin.Document{ID: "cornflake-peddling-bp0q", Syntax: "go", Content: `<span class="token keyword">package</span> main &lt;"quoted"&gt;`}
+	tags := openGraphTags(&doc)
+	for _, expected := range []string{
+		`<meta property="og:title" content="cornflake-peddling-bp0q (go)">`,
+		`<meta property="og:url" content="https://qbin.example.org/cornflake-peddling-bp0q">`,
+		`<meta property="og:description" content="package main &lt;&quot;quoted&quot;&gt;">`,
+		`href="https://qbin.example.org/oembed?url=https%3A%2F%2Fqbin.example.org%2Fcornflake-peddling-bp0q"`,
+	} {
+		if !strings.Contains(tags, expected) {
+			t.Errorf("Open Graph tags don't contain %s:\n%s", expected, tags)
+		}
+	}
+
+	doc.Custom = "encrypted"
+	if strings.Contains(openGraphTags(&doc), "og:description") {
+		t.Errorf("Encrypted document has a description")
+	}
+}
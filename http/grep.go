@@ -0,0 +1,46 @@
+package qbinHTTP
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/qbin-io/backend"
+)
+
+// grepRoute serves the lines of a document matching the regular expression in the grep parameter as plain text
+// (/<document>?grep=<pattern>). The pattern is checked first, so invalid patterns don't count a view.
+func grepRoute(res http.ResponseWriter, req *http.Request) {
+	pattern, err := qbin.CompileGrep(req.URL.Query().Get("grep"))
+	if err != nil {
+		if customErrorRoute(res, req, 400, err.Error()) {
+			return
+		}
+		res.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		res.WriteHeader(400)
+		fmt.Fprintf(res, "The grep pattern is invalid or too complex, please use a simpler one.\n")
+		return
+	}
+
+	path := strings.Split(req.URL.Path, "/")
+	doc, err := qbin.Request(path[len(path)-1], true)
+	recordTiming(req, doc.Timing)
+	if err != nil {
+		documentErrorRoute(res, req, err)
+		return
+	}
+
+	lines, err := qbin.Grep(doc.Content, pattern)
+	if err != nil {
+		if customErrorRoute(res, req, 422, err.Error()) {
+			return
+		}
+		res.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		res.WriteHeader(422)
+		fmt.Fprintf(res, "The grep pattern is too complex for this document, please use a simpler one.\n")
+		return
+	}
+	setExpirationHeaders(res, &doc)
+	res.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(res, lines)
+}
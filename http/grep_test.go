@@ -0,0 +1,18 @@
+package qbinHTTP
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestGrepInvalidPattern(t *testing.T) {
+	for _, pattern := range []string{"(", "((a{30}){30}){30}"} {
+		res := httptest.NewRecorder()
+		// The pattern is rejected before the document is requested, so no database is needed
+		grepRoute(res, httptest.NewRequest("GET", "/cornflake-peddling-bp0q?grep="+url.QueryEscape(pattern), nil))
+		if res.Code != 400 {
+			t.Errorf("Pattern %q returned %d (expected: 400)", pattern, res.Code)
+		}
+	}
+}
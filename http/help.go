@@ -0,0 +1,72 @@
+package qbinHTTP
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/qbin-io/backend"
+)
+
+// terminalHelp returns the usage instructions for command line clients, reflecting the limits of this instance.
+func terminalHelp() string {
+	size := fmt.Sprintf("%d KB", qbin.MaxFilesize/1024)
+	if qbin.MaxFilesize%(1024*1024) == 0 {
+		size = fmt.Sprintf("%d MB", qbin.MaxFilesize/1024/1024)
+	}
+	// Documents without a syntax are detected if possible, and use the default syntax otherwise
+	syntax := " By default, documents\n         aren't highlighted."
+	if qbin.SyntaxDetection {
+		syntax = " By default, it's\n         detected from the content."
+	} else if qbin.DefaultSyntax != "" {
+		syntax = "\n         Default: " + qbin.DefaultSyntax
+	}
+	forever := ",\n         or 0 to never expire."
+	maxExpiration := "none"
+	if qbin.MaxExpiration > 0 {
+		forever = "."
+		maxExpiration = formatExpiration(qbin.MaxExpiration)
+	}
+
+	return `qbin - a pastebin for the command line
+
+Upload a file:
+    curl -T file.txt ` + config.Root + `
+    curl -F 'Q=@file.txt' ` + config.Root + `
+Upload the output of a command:
+    command | curl -T - ` + config.Root + `
+Read a document:
+    curl ` + config.Root + `/<id>
+    curl '` + config.Root + `/<id>?format=ansi'    (with syntax highlighting)
+
+Options, sent as headers (-H 'E: 1h') or form fields (-F 'E=1h'):
+    E    Expiration: a number with the unit m, h, d or w (e.g. 30m, 2d),
+         or "volatile" to delete the document after the first view` + forever + `
+         Default: ` + qbin.DefaultExpiration + `
+    S    Syntax for highlighting, e.g. go or python.` + syntax + `
+
+Limits:
+    Maximum size:        ` + size + `
+    Maximum expiration:  ` + maxExpiration + `
+`
+}
+
+// formatExpiration formats a duration like the expirations accepted by qbin.ParseExpiration(), using the largest fitting unit.
+func formatExpiration(d time.Duration) string {
+	for _, unit := range []struct {
+		suffix   string
+		duration time.Duration
+	}{{"w", 7 * 24 * time.Hour}, {"d", 24 * time.Hour}, {"h", time.Hour}} {
+		if d%unit.duration == 0 {
+			return strconv.FormatInt(int64(d/unit.duration), 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(d/time.Minute), 10) + "m"
+}
+
+// helpRoute serves terminalHelp() as plain text.
+func helpRoute(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(res, terminalHelp())
+}
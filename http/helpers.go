@@ -2,6 +2,7 @@ package qbinHTTP
 
 import (
 	"math"
+	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
@@ -67,7 +68,7 @@ func replaceDocumentVariables(content *string, doc *qbin.Document) {
 	replaceVariable(content, "expiration", formatTime(doc.Expiration, false))
 	replaceVariable(content, "expiration-remaining", formatTime(doc.Expiration, true))
 
-	replaceVariable(content, "views", strconv.Itoa(doc.Views))
+	replaceVariable(content, "views", qbin.FormatViews(doc.Views))
 
 	if (doc.Expiration != time.Time{}) { // Don't store forever?
 		replaceBlockVariable(content, "if_volatile", doc.Expiration.Before(time.Unix(0, 1)))
@@ -75,7 +76,63 @@ func replaceDocumentVariables(content *string, doc *qbin.Document) {
 		replaceBlockVariable(content, "if_volatile", false)
 	}
 
+	replaceVariable(content, "custom", qbin.EscapeHTML(doc.Custom))
 	replaceBlockVariable(content, "if_encrypted", doc.Custom == "encrypted")
+	replaceBlockVariable(content, "if_highlight_skipped", doc.HighlightSkipped)
+}
+
+// setExpirationHeaders tells clients and caching proxies how long a document may be cached, if config.ExpiresHeader is enabled.
+// Documents that are stored forever don't get any headers, and volatile documents must never be cached.
+func setExpirationHeaders(res http.ResponseWriter, doc *qbin.Document) {
+	if !config.ExpiresHeader {
+		return
+	}
+	switch qbin.DocumentState(doc.Expiration) {
+	case qbin.StateVolatile:
+		res.Header().Set("Cache-Control", "no-store")
+	case qbin.StateLive:
+		if (doc.Expiration == time.Time{}) {
+			return
+		}
+		remaining := int64(time.Until(doc.Expiration).Seconds())
+		res.Header().Set("X-Expires", doc.Expiration.UTC().Format(http.TimeFormat))
+		res.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(remaining, 10))
+	}
+}
+
+// contentETag sends the stored content hash of a document as ETag, and responds with 304 if the client already has that
+// content. It returns true if the response has been sent. Volatile documents and documents without a stored hash get no ETag.
+func contentETag(res http.ResponseWriter, req *http.Request, doc *qbin.Document) bool {
+	if doc.ContentHash == "" || qbin.DocumentState(doc.Expiration) == qbin.StateVolatile {
+		return false
+	}
+	etag := `"` + doc.ContentHash + `"`
+	res.Header().Set("ETag", etag)
+	if matchesETag(req.Header.Get("If-None-Match"), etag) {
+		res.WriteHeader(304)
+		return true
+	}
+	return false
+}
+
+// containsETag checks if an If-None-Match header contains exactly the ETag, ignoring "*".
+func containsETag(header string, etag string) bool {
+	for _, match := range strings.Split(header, ",") {
+		if match = strings.TrimSpace(match); match == etag || match == "W/"+etag {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesETag checks if an If-None-Match header contains the ETag or "*".
+func matchesETag(header string, etag string) bool {
+	for _, match := range strings.Split(header, ",") {
+		if match = strings.TrimSpace(match); match == etag || match == "W/"+etag || match == "*" {
+			return true
+		}
+	}
+	return false
 }
 
 func formatTime(t time.Time, relative bool) string {
@@ -0,0 +1,92 @@
+package qbinHTTP
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"github.com/qbin-io/backend"
+)
+
+// apiLimits describes the limits of the instance, so clients can adjust their uploads before they're rejected.
+type apiLimits struct {
+	// MaxFilesize is in bytes
+	MaxFilesize int `json:"maxFilesize"`
+	// MaxExpiration is in seconds, 0 means documents can be stored forever
+	MaxExpiration int64 `json:"maxExpiration"`
+	// SyntaxMaxExpiration maps syntaxes ("none" for plain text) to their shorter maximum expiration in seconds. Longer
+	// expirations of these syntaxes are shortened instead of rejected.
+	SyntaxMaxExpiration map[string]int64 `json:"syntaxMaxExpiration"`
+	DefaultExpiration   string           `json:"defaultExpiration"`
+	Syntaxes            []string         `json:"syntaxes"`
+	CustomValues        []string         `json:"customValues"`
+	// VanityIDs is always false, as document names are generated by the server
+	VanityIDs   bool `json:"vanityIds"`
+	Unencrypted bool `json:"unencrypted"`
+	// FingerprintQuota is in bytes, 0 means there is no quota
+	FingerprintQuota int64         `json:"fingerprintQuota"`
+	RateLimits       apiRateLimits `json:"rateLimits"`
+}
+
+// apiRateLimits describes the rate limits applied to a client, 0 means the limit is disabled.
+type apiRateLimits struct {
+	// AvailabilityPerMinute is the number of name availability checks per minute
+	AvailabilityPerMinute int `json:"availabilityPerMinute"`
+	// TokenFailures is the number of wrong tokens per document before further attempts are delayed
+	TokenFailures int `json:"tokenFailures"`
+	// IPv6Prefix is the prefix length by which IPv6 clients are grouped
+	IPv6Prefix int `json:"ipv6Prefix"`
+}
+
+// limitsRoute returns the current limits of the instance. Unlike staticJSON, the response is built on every request, so it
+// always reflects the live configuration, and may only be cached for a short time.
+func limitsRoute(res http.ResponseWriter, req *http.Request) {
+	syntaxes := advertisedSyntaxList()
+	if syntaxes == nil {
+		serviceUnavailableRoute(res, req)
+		return
+	}
+	syntaxMaxExpiration := map[string]int64{}
+	for syntax, limit := range qbin.SyntaxMaxExpiration {
+		if syntax == "" {
+			syntax = "none"
+		}
+		syntaxMaxExpiration[syntax] = int64(limit.Seconds())
+	}
+	limits := apiLimits{
+		MaxFilesize:         qbin.MaxFilesize,
+		MaxExpiration:       int64(qbin.MaxExpiration.Seconds()),
+		SyntaxMaxExpiration: syntaxMaxExpiration,
+		DefaultExpiration:   qbin.DefaultExpiration,
+		Syntaxes:            syntaxes,
+		CustomValues:        qbin.CustomValues,
+		Unencrypted:         qbin.AllowUnencrypted,
+		FingerprintQuota:    qbin.FingerprintQuota,
+		RateLimits: apiRateLimits{
+			AvailabilityPerMinute: config.AvailabilityRateLimit,
+			TokenFailures:         config.TokenFailures,
+			IPv6Prefix:            config.IPv6RateLimitPrefix,
+		},
+	}
+	body, err := json.Marshal(limits)
+	if err != nil {
+		qbin.Log.Errorf("Couldn't encode JSON response: %s", err)
+		internalErrorRoute(res, req)
+		return
+	}
+	// The banner is part of the ETag, so clients see it as soon as it's changed
+	body = withBannerWarnings(body)
+	hash := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(hash[:16]) + `"`
+
+	res.Header().Set("ETag", etag)
+	res.Header().Set("Cache-Control", "public, max-age=300")
+	if matchesETag(req.Header.Get("If-None-Match"), etag) {
+		res.WriteHeader(304)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	res.WriteHeader(200)
+	res.Write(append(body, '\n'))
+}
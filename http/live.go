@@ -0,0 +1,72 @@
+package qbinHTTP
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/qbin-io/backend"
+	"golang.org/x/net/websocket"
+)
+
+// The model functions used by liveRoute, replaced in tests.
+var liveMetadata = qbin.Metadata
+var subscribeViews = qbin.SubscribeViews
+
+// liveViews is a message sent to live view clients.
+type liveViews struct {
+	Views int `json:"views"`
+}
+
+// liveRoute upgrades to a WebSocket connection that receives the current view count of a document, and an update whenever
+// the document is viewed.
+func liveRoute(res http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["document"]
+	meta, err := liveMetadata(id)
+	if err != nil {
+		documentErrorRoute(res, req, err)
+		return
+	}
+	views, cancel, err := subscribeViews(id)
+	if err == qbin.ErrTooManyLiveConnections {
+		if customErrorRoute(res, req, 503, "too many live connections") {
+			return
+		}
+		res.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		res.WriteHeader(503)
+		fmt.Fprint(res, "Too many live connections, please try again later.\n")
+		return
+	} else if err == qbin.ErrTooManyViewers {
+		if customErrorRoute(res, req, 429, "too many live viewers for this document") {
+			return
+		}
+		res.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		res.WriteHeader(429)
+		fmt.Fprint(res, "Too many live viewers for this document, please try again later.\n")
+		return
+	}
+	defer cancel()
+
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		// Nothing is expected from the client, reading only detects when the connection is closed
+		closed := make(chan struct{})
+		go func() {
+			io.Copy(ioutil.Discard, ws)
+			close(closed)
+		}()
+
+		n := meta.Views
+		for {
+			if err := websocket.JSON.Send(ws, liveViews{n}); err != nil {
+				return
+			}
+			select {
+			case n = <-views:
+			case <-closed:
+				return
+			}
+		}
+	}}.ServeHTTP(res, req)
+}
@@ -0,0 +1,82 @@
+package qbinHTTP
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/qbin-io/backend"
+	"golang.org/x/net/websocket"
+)
+
+func TestLiveRoute(t *testing.T) {
+	defer func(metadata func(string) (qbin.DocumentMetadata, error), max int) {
+		liveMetadata, subscribeViews, qbin.MaxLiveViewers = metadata, qbin.SubscribeViews, max
+	}(liveMetadata, qbin.MaxLiveViewers)
+	liveMetadata = func(id string) (qbin.DocumentMetadata, error) {
+		return qbin.DocumentMetadata{ID: id, Views: 3}, nil
+	}
+	qbin.MaxLiveViewers = 1
+
+	// Request() publishes the view count to the subscription when a document is viewed (see qbin.TestSubscribeViews), the
+	// document route is replaced by one doing that without a database
+	published := make(chan int, 1)
+	subscribeViews = func(id string) (<-chan int, func(), error) {
+		_, cancel, err := qbin.SubscribeViews(id)
+		return published, cancel, err
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/{document}/live", liveRoute)
+	r.HandleFunc("/{document}", func(res http.ResponseWriter, req *http.Request) {
+		published <- 4
+	})
+	server := httptest.NewServer(r)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/cornflake-peddling-bp0q/live"
+
+	ws, err := websocket.Dial(url, "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	var message liveViews
+	if err := websocket.JSON.Receive(ws, &message); err != nil || message.Views != 3 {
+		t.Errorf("Wrong initial view count: %d, %v", message.Views, err)
+	}
+
+	// Viewing the document pushes the new view count
+	res, err := http.Get(server.URL + "/cornflake-peddling-bp0q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.JSON.Receive(ws, &message); err != nil || message.Views != 4 {
+		t.Errorf("Wrong view count after a view: %d, %v", message.Views, err)
+	}
+
+	// The connection above is the only one allowed
+	res, err = http.Get(server.URL + "/cornflake-peddling-bp0q/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 429 {
+		t.Errorf("Connection above the limit returned %d (expected: 429)", res.StatusCode)
+	}
+
+	// The global limit applies to all documents
+	defer func(max int) { qbin.MaxLiveConnections = max }(qbin.MaxLiveConnections)
+	qbin.MaxLiveConnections = 1
+	res, err = http.Get(server.URL + "/other-document-bp0q/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 503 {
+		t.Errorf("Connection above the global limit returned %d (expected: 503)", res.StatusCode)
+	}
+}
@@ -0,0 +1,44 @@
+package qbinHTTP
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/qbin-io/backend"
+)
+
+// pdfRoute serves the highlighted content of a document rendered as PDF (/<document>/pdf).
+func pdfRoute(res http.ResponseWriter, req *http.Request) {
+	doc, err := qbin.Request(mux.Vars(req)["document"], false)
+	recordTiming(req, doc.Timing)
+	if err != nil {
+		documentErrorRoute(res, req, err)
+		return
+	}
+
+	servePDF(res, req, &doc)
+}
+
+// servePDF renders a document for pdfRoute.
+func servePDF(res http.ResponseWriter, req *http.Request, doc *qbin.Document) {
+	data, err := qbin.PDF(doc)
+	if err == qbin.ErrPDFTooLarge {
+		if customErrorRoute(res, req, 422, err.Error()) {
+			return
+		}
+		res.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		res.WriteHeader(422)
+		fmt.Fprint(res, "The document is too large to be rendered as PDF, please use the raw version instead.\n")
+		return
+	} else if err != nil {
+		qbin.Log.Errorf("Couldn't render PDF: %s", err)
+		internalErrorRoute(res, req)
+		return
+	}
+
+	setExpirationHeaders(res, doc)
+	res.Header().Set("Content-Type", "application/pdf")
+	res.Header().Set("Content-Disposition", `inline; filename="`+sanitizeFilename(doc.ID+".pdf")+`"`)
+	res.Write(data)
+}
@@ -0,0 +1,30 @@
+package qbinHTTP
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/qbin-io/backend"
+)
+
+func TestServePDF(t *testing.T) {
+	doc := qbin.Document{ID: "cornflake-peddling-bp0q", Content: "Hello World"}
+	res := httptest.NewRecorder()
+	servePDF(res, httptest.NewRequest("GET", "/"+doc.ID+"/pdf", nil), &doc)
+	if res.Code != 200 || res.Header().Get("Content-Type") != "application/pdf" || !strings.HasPrefix(res.Body.String(), "%PDF-") {
+		t.Errorf("PDF wasn't served: %d %v", res.Code, res.Header())
+	}
+	if disposition := res.Header().Get("Content-Disposition"); disposition != `inline; filename="cornflake-peddling-bp0q.pdf"` {
+		t.Errorf("Wrong disposition: %s", disposition)
+	}
+
+	defer func() { qbin.MaxPDFSize = 256 * 1024 }()
+	qbin.MaxPDFSize = 4
+	doc.ID = "other-document-bp0q"
+	res = httptest.NewRecorder()
+	servePDF(res, httptest.NewRequest("GET", "/"+doc.ID+"/pdf", nil), &doc)
+	if res.Code != 422 {
+		t.Errorf("Too large document returned %d (expected: 422)", res.Code)
+	}
+}
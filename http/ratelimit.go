@@ -0,0 +1,216 @@
+package qbinHTTP
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter allows a limited number of requests per client within a fixed time window.
+type rateLimiter struct {
+	mutex   sync.Mutex
+	limit   int
+	window  time.Duration
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	count int
+	reset time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		buckets: map[string]*rateBucket{},
+	}
+}
+
+// allow counts a request for the given key and returns false if the limit has been exceeded, together with the time until the next request will be allowed.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if len(l.buckets) > 10000 {
+		// Forget clients whose window is over, so the map doesn't grow forever
+		for k, b := range l.buckets {
+			if now.After(b.reset) {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[key]
+	if !ok || now.After(b.reset) {
+		b = &rateBucket{reset: now.Add(l.window)}
+		l.buckets[key] = b
+	}
+	b.count++
+	return b.count <= l.limit, b.reset.Sub(now)
+}
+
+// rateLimited wraps a route so it can only be called a limited number of times per client.
+func rateLimited(l *rateLimiter, route func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if l.limit > 0 {
+			ok, wait := l.allow(clientBucket(req))
+			if !ok {
+				res.Header().Add("Content-Type", "text/plain; charset=utf-8")
+				res.Header().Add("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				res.WriteHeader(429)
+				fmt.Fprint(res, "Slow down, you're sending too many requests. Please try again later.\n")
+				return
+			}
+		}
+		route(res, req)
+	}
+}
+
+// clientIP returns the IP address of the client that sent a request.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// clientBucket returns the key used to rate-limit the client that sent a request: the full IPv4 address, or the IPv6 prefix
+// of config.IPv6RateLimitPrefix bits, as IPv6 clients usually get a whole /64 and could otherwise switch to a new address
+// for every request.
+func clientBucket(req *http.Request) string {
+	host := clientIP(req)
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() != nil {
+		return host
+	}
+	prefix := config.IPv6RateLimitPrefix
+	if prefix <= 0 || prefix > 128 {
+		// Unset or invalid
+		prefix = 64
+	}
+	mask := net.CIDRMask(prefix, 128)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// tokenBackoff delays further attempts of clients and documents after repeated wrong tokens, to prevent brute-forcing them.
+// After the number of allowed failures, every further failure doubles the delay, up to the maximum. Failures are forgotten
+// once the maximum delay has passed without another one.
+type tokenBackoff struct {
+	mutex    sync.Mutex
+	allowed  int
+	base     time.Duration
+	max      time.Duration
+	failures map[string]*tokenFailures
+}
+
+type tokenFailures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+// maxTokenFailures limits the number of keys remembered by a tokenBackoff. If there are more keys with recent failures,
+// the oldest ones are forgotten.
+const maxTokenFailures = 10000
+
+// tokenAttempts throttles routes authenticated by confirmation or collection tokens, it's set up with the routes.
+var tokenAttempts *tokenBackoff
+
+func newTokenBackoff(allowed int, base time.Duration, max time.Duration) *tokenBackoff {
+	return &tokenBackoff{
+		allowed:  allowed,
+		base:     base,
+		max:      max,
+		failures: map[string]*tokenFailures{},
+	}
+}
+
+// wait returns the time until the next attempt is allowed for all of the keys.
+func (b *tokenBackoff) wait(keys ...string) time.Duration {
+	if b == nil || b.allowed <= 0 {
+		return 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	wait := time.Duration(0)
+	for _, key := range keys {
+		if f, ok := b.failures[key]; ok && f.until.Sub(now) > wait {
+			wait = f.until.Sub(now)
+		}
+	}
+	return wait
+}
+
+// fail counts a wrong token for all of the keys.
+func (b *tokenBackoff) fail(keys ...string) {
+	if b == nil || b.allowed <= 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	if len(b.failures) >= maxTokenFailures {
+		// Forget keys without recent failures, so the map doesn't grow forever
+		for k, f := range b.failures {
+			if now.Sub(f.last) > b.max {
+				delete(b.failures, k)
+			}
+		}
+	}
+
+	for _, key := range keys {
+		f, ok := b.failures[key]
+		if !ok || now.Sub(f.last) > b.max {
+			if !ok && len(b.failures) >= maxTokenFailures {
+				b.evictLocked()
+			}
+			f = &tokenFailures{}
+			b.failures[key] = f
+		}
+		f.count++
+		f.last = now
+		if f.count > b.allowed {
+			delay := b.max
+			if shift := uint(f.count - b.allowed - 1); shift < 32 && b.base<<shift < b.max {
+				delay = b.base << shift
+			}
+			f.until = now.Add(delay)
+		}
+	}
+}
+
+// evictLocked forgets the key with the oldest failure, to make room for a new one.
+func (b *tokenBackoff) evictLocked() {
+	oldest := ""
+	for k, f := range b.failures {
+		if oldest == "" || f.last.Before(b.failures[oldest].last) {
+			oldest = k
+		}
+	}
+	delete(b.failures, oldest)
+}
+
+// tokenThrottled responds with 429 and returns true if the client or document has to wait after wrong tokens.
+func tokenThrottled(res http.ResponseWriter, req *http.Request, keys ...string) bool {
+	wait := tokenAttempts.wait(keys...)
+	if wait <= 0 {
+		return false
+	}
+	res.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	if customErrorRoute(res, req, 429, "too many wrong tokens") {
+		return true
+	}
+	res.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	res.WriteHeader(429)
+	fmt.Fprint(res, "Too many wrong tokens, please try again later.\n")
+	return true
+}
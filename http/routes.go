@@ -1,10 +1,15 @@
 package qbinHTTP
 
 import (
+	"database/sql"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/qbin-io/backend"
@@ -12,27 +17,69 @@ import (
 
 // setupRoutes will set up a mux Router to provide the routes used by the qbin frontend and API.
 func setupRoutes(r *mux.Router) {
+	// Documents on their own subdomain
+	if config.DocumentDomain != "" {
+		setupSubdomainRoutes(r, earlyHints(documentRoute()), rawDocumentRoute)
+	}
+
+	tokenAttempts = newTokenBackoff(config.TokenFailures, time.Second, time.Hour)
+	setBanner(config.MaintenanceBanner)
+
 	// Upload function
 	r.HandleFunc("/", uploadRoute).Methods("POST", "PUT")
-	r.Methods("PUT").HandlerFunc(uploadRoute)
+	// PUT works on any path (e.g. curl -T file); a custom matcher keeps other methods on unknown paths from being reported as 405
+	r.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool { return req.Method == "PUT" }).HandlerFunc(uploadRoute)
+	if config.URLSyntax {
+		// POST /raw.py or /<name>.go, with the extension as a syntax hint
+		r.HandleFunc("/{name}.{ext:[A-Za-z0-9+]{1,16}}", uploadRoute).Methods("POST")
+	}
 
 	// Static aliased HTML files
-	r.HandleFunc("/", advancedStaticRoute(config.FrontendPath, "/index.html", routeOptions{
-		ignoreExceptions: true,
-		modifySource: func(body *string) {
-			replaceBlockVariable(body, "if_fork", false)
-		},
-	})).Methods("GET")
+	r.HandleFunc("/", earlyHints(indexRoute())).Methods("GET")
 	r.HandleFunc("/guidelines", staticRoute(config.FrontendPath, "/guidelines.html", true)).Methods("GET")
 
+	// Readiness check for load balancers and deployments
+	r.HandleFunc("/readyz", readyRoute).Methods("GET")
+
+	// Content-addressed URLs, which can be cached forever
+	if config.ContentURLs {
+		r.HandleFunc("/c/{hash:[0-9a-f]{32}}", contentRoute).Methods("GET")
+	}
+
+	// Rich embeds in chat apps and CMSs
+	if config.Embeds {
+		r.HandleFunc("/oembed", oembedRoute).Methods("GET")
+	}
+
+	// Custom error pages
+	loadErrorPages()
+
+	// API
+	setupAPIRoutes(r)
+
 	// Static files
 	qbin.Log.Debugf("Including static files from: %s", config.FrontendPath)
 	addStaticDirectory(config.FrontendPath, "/", r)
 
 	// Documents
-	r.HandleFunc("/{document}", documentRoute()).Methods("GET")
+	document := subdomainRedirect(earlyHints(documentRoute()))
+	if qbin.NumericAliases {
+		r.HandleFunc("/n/{alias:[0-9]+}", aliasRoute(document)).Methods("GET")
+	}
+	r.HandleFunc("/{document}", document).Methods("GET")
 	r.HandleFunc("/{document}/raw", rawDocumentRoute).Methods("GET")
+	if config.InlineView {
+		r.HandleFunc("/{document}/view.{ext:[A-Za-z0-9]{1,16}}", viewRoute).Methods("GET")
+	}
+	if config.PDF {
+		r.HandleFunc("/{document}/pdf", pdfRoute).Methods("GET")
+	}
+	if config.LiveViews {
+		r.HandleFunc("/{document}/live", liveRoute).Methods("GET")
+	}
 	r.HandleFunc("/{document}/fork", forkDocumentRoute()).Methods("GET")
+	r.HandleFunc("/{document}/confirm", confirmRoute).Methods("POST")
+	r.HandleFunc("/{document}/highlight", rateLimited(newRateLimiter(config.HighlightRateLimit, time.Minute), highlightRoute)).Methods("POST")
 	r.HandleFunc("/{document}/report", advancedStaticRoute(config.FrontendPath, "/report.html", routeOptions{
 		ignoreExceptions: true,
 		modifyResult: func(res http.ResponseWriter, req *http.Request, body *string) error {
@@ -41,8 +88,61 @@ func setupRoutes(r *mux.Router) {
 		},
 	})).Methods("GET")
 
-	// 404 error page
-	r.PathPrefix("/").HandlerFunc(notFoundRoute)
+	// 404 and 405 error pages
+	r.NotFoundHandler = http.HandlerFunc(notFoundRoute)
+	r.MethodNotAllowedHandler = methodNotAllowedRoute(r)
+}
+
+// routeMethods are the methods that are checked for the Allow header of 405 responses.
+var routeMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// methodNotAllowedRoute responds to requests for existing paths with a method that isn't supported by any of their routes.
+func methodNotAllowedRoute(r *mux.Router) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		allowed := []string{}
+		for _, method := range routeMethods {
+			alternative := *req
+			alternative.Method = method
+			match := mux.RouteMatch{}
+			if r.Match(&alternative, &match) && match.MatchErr == nil {
+				allowed = append(allowed, method)
+			}
+		}
+		res.Header().Set("Allow", strings.Join(allowed, ", "))
+
+		if customErrorRoute(res, req, 405, "method not allowed") {
+			return
+		}
+		res.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		res.WriteHeader(405)
+		fmt.Fprint(res, "You can't "+req.Method+" that. ¯\\_(ツ)_/¯\n")
+	}
+}
+
+// isTerminalClient checks if a request comes from a command line client like curl or wget, which should receive the raw document instead of HTML.
+func isTerminalClient(req *http.Request) bool {
+	ua := strings.ToLower(req.Header.Get("User-Agent"))
+	if ua == "" || strings.HasPrefix(ua, "curl/") || strings.HasPrefix(ua, "wget/") || strings.HasPrefix(ua, "httpie/") || strings.Contains(ua, "windowspowershell/") {
+		return true
+	}
+
+	// Clients explicitly asking for plain text instead of HTML
+	accept := strings.ToLower(req.Header.Get("Accept"))
+	return strings.Contains(accept, "text/plain") && !strings.Contains(accept, "text/html")
+}
+
+// wantsANSI checks if the client requested the highlighted document with ANSI color codes instead of plain text, either using
+// ?format=ansi or the Accept header "text/x-ansi". Other terminal clients receive the raw document, as they might not support colors.
+func wantsANSI(req *http.Request) bool {
+	if req.URL.Query().Get("format") == "ansi" {
+		return true
+	}
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		if strings.TrimSpace(strings.Split(accept, ";")[0]) == "text/x-ansi" {
+			return true
+		}
+	}
+	return false
 }
 
 func rawDocumentRoute(res http.ResponseWriter, req *http.Request) {
@@ -52,30 +152,102 @@ func rawDocumentRoute(res http.ResponseWriter, req *http.Request) {
 		id = path[len(path)-2]
 	}
 
-	doc, err := qbin.Request(id, true)
+	ansi := wantsANSI(req)
+	doc, err := qbin.Request(id, !ansi)
+	recordTiming(req, doc.Timing)
 	if err != nil {
-		notFoundRoute(res, req)
+		documentErrorRoute(res, req, err)
+		return
 	}
 
+	setExpirationHeaders(res, &doc)
+	if ansi {
+		res.Header().Add("Content-Type", "text/x-ansi; charset=utf-8")
+		fmt.Fprintf(res, "%s", qbin.ANSI(doc.Content))
+		return
+	}
+	if config.Base64Content && req.URL.Query().Get("encoding") != "" {
+		base64DocumentRoute(res, req, &doc)
+		return
+	}
+	if contentETag(res, req, &doc) {
+		return
+	}
 	res.Header().Add("Content-Type", "text/plain; charset=utf-8")
 	fmt.Fprintf(res, "%s", doc.Content)
 }
 
+// base64Document is the raw content of a document in JSON, encoded so that bytes which aren't valid UTF-8 survive the transport.
+type base64Document struct {
+	ID       string `json:"id"`
+	Syntax   string `json:"syntax,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Content  string `json:"content,omitempty"`
+	// Files replaces Syntax, Encoding and Content if config.FilesArray is set
+	Files []jsonFile `json:"files,omitempty"`
+}
+
+// base64DocumentRoute sends the raw content of a document base64-encoded in JSON, for ?encoding=base64.
+func base64DocumentRoute(res http.ResponseWriter, req *http.Request, doc *qbin.Document) {
+	if req.URL.Query().Get("encoding") != "base64" {
+		writeJSON(res, 400, struct {
+			Error string `json:"error"`
+		}{"unsupported encoding, only base64 is available"})
+		return
+	}
+	content := base64.StdEncoding.EncodeToString([]byte(doc.Content))
+	if config.FilesArray {
+		writeJSON(res, 200, base64Document{
+			ID:    doc.ID,
+			Files: []jsonFile{{Syntax: doc.Syntax, Encoding: "base64", Content: &content}},
+		})
+		return
+	}
+	writeJSON(res, 200, base64Document{
+		ID:       doc.ID,
+		Syntax:   doc.Syntax,
+		Encoding: "base64",
+		Content:  content,
+	})
+}
+
+// indexRoute serves the frontend, or the usage instructions to command line clients if config.TerminalHelp is enabled.
+func indexRoute() func(http.ResponseWriter, *http.Request) {
+	return advancedStaticRoute(config.FrontendPath, "/index.html", routeOptions{
+		ignoreExceptions: true,
+		modifySource: func(body *string) {
+			replaceBlockVariable(body, "if_fork", false)
+		},
+		modifyResult: func(res http.ResponseWriter, req *http.Request, body *string) error {
+			if config.TerminalHelp && isTerminalClient(req) {
+				helpRoute(res, req)
+				return errors.New("serving for curl")
+			}
+			injectBanner(body)
+			return nil
+		},
+	})
+}
+
 func documentRoute() func(http.ResponseWriter, *http.Request) {
 	return advancedStaticRoute(config.FrontendPath, "/output.html", routeOptions{
 		ignoreExceptions: true,
 		modifyResult: func(res http.ResponseWriter, req *http.Request, body *string) error {
+			if config.Grep && req.URL.Query().Get("grep") != "" {
+				grepRoute(res, req)
+				return errors.New("serving grep")
+			}
 			// Check for curl/wget requests and return raw document
-			ua := strings.ToLower(req.Header.Get("User-Agent"))
-			if ua == "" || strings.HasPrefix(ua, "curl/") || strings.HasPrefix(ua, "wget/") || strings.HasPrefix(ua, "httpie/") || strings.Contains(ua, "windowspowershell/") {
+			if (config.TerminalRaw && isTerminalClient(req)) || wantsANSI(req) {
 				rawDocumentRoute(res, req)
 				return errors.New("serving for curl")
 			}
 
 			id := strings.Split(req.URL.Path, "/")
 			doc, err := qbin.Request(id[len(id)-1], false)
+			recordTiming(req, doc.Timing)
 			if err != nil {
-				notFoundRoute(res, req)
+				documentErrorRoute(res, req, err)
 				return errors.New("not found")
 			}
 
@@ -85,14 +257,64 @@ func documentRoute() func(http.ResponseWriter, *http.Request) {
 			} else {
 				content = `<pre class="line-numbers"><code class="language-` + doc.Syntax + `">` + doc.Content + `</code></pre>`
 			}
+			if doc.HighlightSkipped {
+				content = `<form class="highlight-skipped" method="POST" action="` + config.Root + `/` + doc.ID + `/highlight">` +
+					`This document is too long to be highlighted automatically. <button type="submit">Load highlighting anyway</button></form>` + content
+			}
 			replaceVariable(body, "content", content)
 			replaceDocumentVariables(body, &doc)
+			if config.Embeds {
+				*body = strings.Replace(*body, "</head>", openGraphTags(&doc)+"\n</head>", 1)
+			}
+			injectBanner(body)
+			setExpirationHeaders(res, &doc)
 
 			return nil
 		},
 	})
 }
 
+var highlightSkipped = qbin.HighlightSkipped
+
+// highlightRoute loads the highlighting of a document that was stored without it, and redirects back to the document.
+// While the highlighting budget is exhausted, it responds with 503.
+func highlightRoute(res http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["document"]
+	err := highlightSkipped(id)
+	if err == qbin.ErrHighlightBudget {
+		serviceUnavailableRoute(res, req)
+		return
+	} else if err != nil && err != qbin.ErrNotSkipped {
+		if err != sql.ErrNoRows {
+			qbin.Log.Errorf("Couldn't load highlighting: %s", err)
+		}
+		documentErrorRoute(res, req, err)
+		return
+	}
+	res.Header().Set("Location", config.Root+"/"+id)
+	res.WriteHeader(303)
+}
+
+// aliasRoute serves a document by its numeric alias, using the given document route.
+func aliasRoute(document func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		alias, err := strconv.ParseInt(mux.Vars(req)["alias"], 10, 64)
+		if err != nil {
+			notFoundRoute(res, req)
+			return
+		}
+
+		id, err := qbin.ResolveAlias(alias)
+		if err != nil {
+			documentErrorRoute(res, req, err)
+			return
+		}
+
+		req.URL.Path = "/" + id
+		document(res, req)
+	}
+}
+
 func forkDocumentRoute() func(http.ResponseWriter, *http.Request) {
 	return advancedStaticRoute(config.FrontendPath, "/index.html", routeOptions{
 		ignoreExceptions: true,
@@ -102,13 +324,15 @@ func forkDocumentRoute() func(http.ResponseWriter, *http.Request) {
 		modifyResult: func(res http.ResponseWriter, req *http.Request, body *string) error {
 			id := strings.Split(req.URL.Path, "/")
 			doc, err := qbin.Request(id[len(id)-2], true)
+			recordTiming(req, doc.Timing)
 			if err != nil {
-				notFoundRoute(res, req)
+				documentErrorRoute(res, req, err)
 				return errors.New("not found")
 			}
 
 			replaceVariable(body, "content", qbin.EscapeHTML(strings.TrimSuffix(doc.Content, "\n")))
 			replaceDocumentVariables(body, &doc)
+			injectBanner(body)
 
 			return nil
 		},
@@ -121,7 +345,84 @@ func internalErrorRoute(res http.ResponseWriter, req *http.Request) {
 	fmt.Fprint(res, "Oh no, the server is broken! ಠ_ಠ\nYou should try again in a few minutes, there's probably a desperate admin running around somewhere already trying to fix it.\n")
 }
 
+func serviceUnavailableRoute(res http.ResponseWriter, req *http.Request) {
+	res.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	res.Header().Add("Retry-After", "10")
+	res.WriteHeader(503)
+	fmt.Fprint(res, "The server is a bit overwhelmed right now. ¯\\_(ツ)_/¯\nPlease try again in a few seconds.\n")
+}
+
+// documentErrorRoute responds to an error returned by qbin.Request.
+func documentErrorRoute(res http.ResponseWriter, req *http.Request, err error) {
+	if err == qbin.ErrTimeout || err == qbin.ErrBusy {
+		serviceUnavailableRoute(res, req)
+		return
+	} else if err == qbin.ErrExpired || err == qbin.ErrGone {
+		goneRoute(res, req)
+		return
+	} else if err == qbin.ErrInvalidUpload || err == qbin.ErrCorrupted {
+		internalErrorRoute(res, req)
+		return
+	}
+	notFoundRoute(res, req)
+}
+
+// errorPages contains the custom HTML pages for error status codes, loaded by loadErrorPages.
+var errorPages = map[int]string{}
+
+// loadErrorPages loads the custom 404 and 410 pages from the frontend path, if they are configured.
+func loadErrorPages() {
+	errorPages = map[int]string{}
+	for status, path := range map[int]string{404: config.NotFoundPage, 410: config.GonePage} {
+		if path == "" {
+			continue
+		}
+		localPath := strings.TrimSuffix(config.FrontendPath, "/") + "/" + strings.TrimPrefix(path, "/")
+		if _, err := os.Stat(localPath); os.IsNotExist(err) {
+			qbin.Log.Debugf("No custom error page for status %d at %s", status, path)
+			continue
+		}
+		body, err := loadStaticFile(localPath, path, true)
+		if err == nil {
+			errorPages[status] = body
+		}
+	}
+}
+
+// customErrorRoute responds with JSON to API clients and with the custom error page to browsers, if there is one.
+// It returns false if neither applies and the caller should send its plain text response.
+func customErrorRoute(res http.ResponseWriter, req *http.Request, status int, message string) bool {
+	if req == nil {
+		return false
+	}
+	if strings.HasPrefix(req.URL.Path, "/api/") || wantsJSON(req) {
+		writeJSON(res, status, struct {
+			Error string `json:"error"`
+		}{message})
+		return true
+	}
+	if page, ok := errorPages[status]; ok && strings.Contains(req.Header.Get("Accept"), "text/html") {
+		res.Header().Add("Content-Type", "text/html; charset=utf-8")
+		res.WriteHeader(status)
+		fmt.Fprint(res, page)
+		return true
+	}
+	return false
+}
+
+func goneRoute(res http.ResponseWriter, req *http.Request) {
+	if customErrorRoute(res, req, 410, "document is gone") {
+		return
+	}
+	res.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	res.WriteHeader(410)
+	fmt.Fprint(res, "Too late, this document is gone! ¯\\_(ツ)_/¯\nIt has expired or was only meant to be viewed once.\n")
+}
+
 func notFoundRoute(res http.ResponseWriter, req *http.Request) {
+	if customErrorRoute(res, req, 404, "not found") {
+		return
+	}
 	res.Header().Add("Content-Type", "text/plain; charset=utf-8")
 	res.WriteHeader(404)
 	fmt.Fprint(res, "Oops, seems like there's nothing here! ¯\\_(ツ)_/¯\nMaybe the document is expired or has been removed.\n")
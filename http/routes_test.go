@@ -0,0 +1,329 @@
+package qbinHTTP
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/qbin-io/backend"
+)
+
+func TestIsTerminalClient(t *testing.T) {
+	req := httptest.NewRequest("GET", "/cornflake-peddling-bp0q", nil)
+	req.Header.Set("User-Agent", "curl/7.61.1")
+	req.Header.Set("Accept", "*/*")
+	if !isTerminalClient(req) {
+		t.Errorf("curl should receive the raw document, but doesn't.")
+	}
+
+	req = httptest.NewRequest("GET", "/cornflake-peddling-bp0q", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:63.0) Gecko/20100101 Firefox/63.0")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	if isTerminalClient(req) {
+		t.Errorf("Firefox should receive HTML, but doesn't.")
+	}
+
+	req = httptest.NewRequest("GET", "/cornflake-peddling-bp0q", nil)
+	req.Header.Set("User-Agent", "my-script/1.0")
+	req.Header.Set("Accept", "text/plain")
+	if !isTerminalClient(req) {
+		t.Errorf("Clients accepting only text/plain should receive the raw document, but don't.")
+	}
+}
+
+func TestWantsANSI(t *testing.T) {
+	req := httptest.NewRequest("GET", "/cornflake-peddling-bp0q", nil)
+	req.Header.Set("User-Agent", "curl/7.61.1")
+	if wantsANSI(req) {
+		t.Errorf("curl received ANSI colors without asking for them.")
+	}
+
+	req = httptest.NewRequest("GET", "/cornflake-peddling-bp0q?format=ansi", nil)
+	if !wantsANSI(req) {
+		t.Errorf("?format=ansi didn't enable ANSI colors.")
+	}
+
+	req = httptest.NewRequest("GET", "/cornflake-peddling-bp0q", nil)
+	req.Header.Set("Accept", "text/x-ansi, text/plain;q=0.9")
+	if !wantsANSI(req) {
+		t.Errorf("Accept: text/x-ansi didn't enable ANSI colors.")
+	}
+}
+
+func TestExpirationHeaders(t *testing.T) {
+	defer func() { config.ExpiresHeader = false }()
+	config.ExpiresHeader = true
+
+	expiration := time.Now().Add(2 * time.Hour).Round(time.Second)
+	res := httptest.NewRecorder()
+	setExpirationHeaders(res, &qbin.Document{Expiration: expiration})
+	expires, err := http.ParseTime(res.Header().Get("X-Expires"))
+	if err != nil || !expires.Equal(expiration) {
+		t.Errorf("Wrong X-Expires header: %s", res.Header().Get("X-Expires"))
+	}
+	var maxAge int
+	if _, err := fmt.Sscanf(res.Header().Get("Cache-Control"), "max-age=%d", &maxAge); err != nil || maxAge > 7200 || maxAge < 7190 {
+		t.Errorf("Cache-Control doesn't reflect the remaining lifetime: %s", res.Header().Get("Cache-Control"))
+	}
+
+	res = httptest.NewRecorder()
+	setExpirationHeaders(res, &qbin.Document{})
+	if res.Header().Get("X-Expires") != "" || res.Header().Get("Cache-Control") != "" {
+		t.Errorf("Headers set for a document that never expires: %v", res.Header())
+	}
+
+	res = httptest.NewRecorder()
+	setExpirationHeaders(res, &qbin.Document{Expiration: time.Unix(0, 0)})
+	if res.Header().Get("X-Expires") != "" || res.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Volatile documents must not be cached: %v", res.Header())
+	}
+}
+
+func TestTerminalHelp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qbin-frontend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>qbin</h1>"), 0644)
+	config.FrontendPath = dir
+	config.Root = "https://qbin.test"
+	config.TerminalHelp = true
+	defer func() { config.TerminalHelp, qbin.MaxExpiration = false, 0 }()
+	qbin.MaxExpiration = 30 * 24 * time.Hour
+	route := indexRoute()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "curl/7.61.1")
+	res := httptest.NewRecorder()
+	route(res, req)
+	help := res.Body.String()
+	if !strings.HasPrefix(res.Header().Get("Content-Type"), "text/plain") || !strings.Contains(help, "curl -T file.txt https://qbin.test\n") {
+		t.Errorf("curl didn't receive the usage instructions: %q", help)
+	}
+	if !strings.Contains(help, "Maximum size:        1 MB\n") || !strings.Contains(help, "Maximum expiration:  30d\n") || strings.Contains(help, "never expire") {
+		t.Errorf("Usage instructions don't contain the limits: %q", help)
+	}
+	if strings.Contains(help, "detected from the content") || !strings.Contains(help, "documents\n         aren't highlighted.") {
+		t.Errorf("Usage instructions promise syntax detection without SyntaxDetection: %q", help)
+	}
+	defer func() { qbin.SyntaxDetection = false }()
+	qbin.SyntaxDetection = true
+	if help := terminalHelp(); !strings.Contains(help, "By default, it's\n         detected from the content.") {
+		t.Errorf("Usage instructions don't mention the syntax detection: %q", help)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:63.0) Gecko/20100101 Firefox/63.0")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	res = httptest.NewRecorder()
+	route(res, req)
+	if res.Body.String() != "<h1>qbin</h1>" {
+		t.Errorf("Browser didn't receive the frontend: %q", res.Body.String())
+	}
+}
+
+func TestContentETag(t *testing.T) {
+	doc := &qbin.Document{ContentHash: "0123456789abcdef0123456789abcdef", Expiration: time.Now().Add(time.Hour)}
+	req := httptest.NewRequest("GET", "/cornflake-peddling-bp0q/raw", nil)
+	res := httptest.NewRecorder()
+	if contentETag(res, req, doc) || res.Header().Get("ETag") != `"0123456789abcdef0123456789abcdef"` {
+		t.Errorf("Wrong ETag: %q", res.Header().Get("ETag"))
+	}
+
+	req.Header.Set("If-None-Match", `"other", "0123456789abcdef0123456789abcdef"`)
+	res = httptest.NewRecorder()
+	if !contentETag(res, req, doc) || res.Code != 304 {
+		t.Errorf("Matching ETag returned %d (expected: 304)", res.Code)
+	}
+
+	res = httptest.NewRecorder()
+	if contentETag(res, req, &qbin.Document{ContentHash: doc.ContentHash, Expiration: time.Unix(0, 0)}) || res.Header().Get("ETag") != "" {
+		t.Errorf("Volatile document got an ETag")
+	}
+}
+
+func TestCustomErrorPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qbin-frontend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "404.html"), []byte("<h1>Nothing here</h1>"), 0644)
+	config.FrontendPath = dir
+	config.NotFoundPage = "/404.html"
+	config.GonePage = "/410.html" // doesn't exist
+	loadErrorPages()
+	defer func() { errorPages = map[int]string{} }()
+
+	req := httptest.NewRequest("GET", "/cornflake-peddling-bp0q", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	res := httptest.NewRecorder()
+	notFoundRoute(res, req)
+	if res.Code != 404 || res.Body.String() != "<h1>Nothing here</h1>" || !strings.HasPrefix(res.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("Browser didn't receive the custom 404 page: %d, %q", res.Code, res.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/cornflake-peddling-bp0q", nil)
+	req.Header.Set("Accept", "application/json")
+	res = httptest.NewRecorder()
+	notFoundRoute(res, req)
+	if res.Code != 404 || !strings.HasPrefix(res.Header().Get("Content-Type"), "application/json") || !strings.Contains(res.Body.String(), `"error"`) {
+		t.Errorf("API client didn't receive JSON: %d, %q", res.Code, res.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/cornflake-peddling-bp0q", nil)
+	req.Header.Set("User-Agent", "curl/7.61.1")
+	res = httptest.NewRecorder()
+	notFoundRoute(res, req)
+	if res.Code != 404 || !strings.HasPrefix(res.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Terminal client didn't receive plain text: %d, %q", res.Code, res.Body.String())
+	}
+
+	// Without a custom page, browsers get the plain text response
+	req = httptest.NewRequest("GET", "/cornflake-peddling-bp0q", nil)
+	req.Header.Set("Accept", "text/html")
+	res = httptest.NewRecorder()
+	goneRoute(res, req)
+	if res.Code != 410 || !strings.HasPrefix(res.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Browser didn't receive the default 410 response: %d, %q", res.Code, res.Body.String())
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qbin-frontend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, file := range []string{"index.html", "guidelines.html", "output.html", "report.html"} {
+		ioutil.WriteFile(filepath.Join(dir, file), []byte("$$content$$"), 0644)
+	}
+	config.FrontendPath = dir
+	r := mux.NewRouter()
+	setupRoutes(r)
+
+	tests := []struct {
+		method, path string
+		status       int
+		allow        string
+	}{
+		{"POST", "/cornflake-peddling-bp0q", 405, "GET, PUT"},
+		{"DELETE", "/cornflake-peddling-bp0q/raw", 405, "GET, PUT"},
+		{"GET", "/cornflake-peddling-bp0q/confirm", 405, "POST, PUT"},
+		{"POST", "/api/v1/syntaxes", 405, "GET, PUT"},
+		{"GET", "/this/does/not/exist", 404, ""},
+	}
+	for _, test := range tests {
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, httptest.NewRequest(test.method, test.path, nil))
+		if res.Code != test.status || res.Header().Get("Allow") != test.allow {
+			t.Errorf("%s %s returned %d with Allow %q (expected: %d with Allow %q)", test.method, test.path, res.Code, res.Header().Get("Allow"), test.status, test.allow)
+		}
+	}
+
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("POST", "/api/v1/syntaxes", nil))
+	if !strings.HasPrefix(res.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("API route returned %q instead of JSON", res.Header().Get("Content-Type"))
+	}
+}
+
+func TestBase64Document(t *testing.T) {
+	// Latin-1 and control characters aren't valid UTF-8, and would be replaced in a JSON string
+	content := "caf\xe9 \x01\x7f\xff\xfe\n"
+	doc := &qbin.Document{ID: "cornflake-peddling-bp0q", Syntax: "none", Content: content}
+
+	res := httptest.NewRecorder()
+	base64DocumentRoute(res, httptest.NewRequest("GET", "/cornflake-peddling-bp0q/raw?encoding=base64", nil), doc)
+	response := base64Document{}
+	if err := json.Unmarshal(res.Body.Bytes(), &response); err != nil || res.Code != 200 {
+		t.Fatalf("Base64 response returned %d: %s", res.Code, res.Body.String())
+	}
+	decoded, err := base64.StdEncoding.DecodeString(response.Content)
+	if err != nil || response.Encoding != "base64" || response.ID != doc.ID {
+		t.Fatalf("Unexpected base64 response: %+v, %v", response, err)
+	}
+	if string(decoded) != content {
+		t.Errorf("Content didn't survive the round trip: %q (expected: %q)", decoded, content)
+	}
+
+	config.FilesArray = true
+	defer func() { config.FilesArray = false }()
+	res = httptest.NewRecorder()
+	base64DocumentRoute(res, httptest.NewRequest("GET", "/cornflake-peddling-bp0q/raw?encoding=base64", nil), doc)
+	response = base64Document{}
+	json.Unmarshal(res.Body.Bytes(), &response)
+	if response.Content != "" || len(response.Files) != 1 || response.Files[0].Syntax != "none" || response.Files[0].Encoding != "base64" ||
+		response.Files[0].Content == nil || *response.Files[0].Content != base64.StdEncoding.EncodeToString([]byte(content)) {
+		t.Errorf("Wrong base64 response with files array: %s", res.Body.String())
+	}
+
+	res = httptest.NewRecorder()
+	base64DocumentRoute(res, httptest.NewRequest("GET", "/cornflake-peddling-bp0q/raw?encoding=hex", nil), doc)
+	if res.Code != 400 || !strings.Contains(res.Body.String(), `"error"`) {
+		t.Errorf("Unsupported encoding returned %d: %s", res.Code, res.Body.String())
+	}
+}
+
+func TestHighlightRoute(t *testing.T) {
+	defer func() {
+		highlightSkipped = qbin.HighlightSkipped
+		config.Root, config.HighlightRateLimit = "", 0
+	}()
+	config.Root = "https://qbin.example.org"
+	config.HighlightRateLimit = 3
+	results := map[string]error{
+		"cornflake-peddling-bp0q": nil,
+		"already-highlighted":     qbin.ErrNotSkipped,
+		"busy-highlighter":        qbin.ErrHighlightBudget,
+	}
+	highlightSkipped = func(id string) error {
+		if err, ok := results[id]; ok {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	r := mux.NewRouter()
+	setupRoutes(r)
+
+	tests := []struct {
+		document string
+		status   int
+	}{
+		{"cornflake-peddling-bp0q", 303},
+		{"already-highlighted", 303},
+		{"busy-highlighter", 503},
+		// The rate limit applies to all documents
+		{"cornflake-peddling-bp0q", 429},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/"+test.document+"/highlight", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, req)
+		if res.Code != test.status {
+			t.Errorf("Highlighting %s returned %d (expected: %d)", test.document, res.Code, test.status)
+		} else if test.status == 303 && res.Header().Get("Location") != config.Root+"/"+test.document {
+			t.Errorf("Highlighting %s redirected to %q", test.document, res.Header().Get("Location"))
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/missing/highlight", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, req)
+	if res.Code != 404 {
+		t.Errorf("Highlighting a missing document returned %d (expected: 404)", res.Code)
+	}
+}
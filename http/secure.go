@@ -0,0 +1,76 @@
+package qbinHTTP
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// isHTTPS checks if a request was sent over HTTPS, either directly or to one of the config.TrustedProxies, which must
+// report the original scheme using X-Forwarded-Proto.
+func isHTTPS(req *http.Request) bool {
+	if req.TLS != nil {
+		return true
+	}
+	if !isTrustedProxy(clientIP(req)) {
+		return false
+	}
+	proto := strings.Split(req.Header.Get("X-Forwarded-Proto"), ",")[0]
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// remoteClientIP returns the IP address of the client that sent a request. Requests from config.TrustedProxies are attributed
+// to the address they forwarded the request for, which is the last address in X-Forwarded-For that isn't a trusted proxy.
+func remoteClientIP(req *http.Request) string {
+	ip := clientIP(req)
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	forwarded := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			// Anything before an invalid entry can't be trusted
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// isTrustedProxy checks if an IP address matches one of the addresses or CIDR ranges in config.TrustedProxies.
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, proxy := range config.TrustedProxies {
+		if strings.Contains(proxy, "/") {
+			if _, network, err := net.ParseCIDR(proxy); err == nil && network.Contains(parsed) {
+				return true
+			}
+		} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireHTTPSForWrites is a middleware that rejects all requests changing data (uploads, confirmations, admin actions, ...)
+// with 403 if they weren't sent over HTTPS, while documents can still be read over plain HTTP.
+func requireHTTPSForWrites(res http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	if req.Method == "GET" || req.Method == "HEAD" || req.Method == "OPTIONS" || isHTTPS(req) {
+		next(res, req)
+		return
+	}
+	if customErrorRoute(res, req, 403, "HTTPS is required") {
+		return
+	}
+	res.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	res.WriteHeader(403)
+	fmt.Fprint(res, "Please use HTTPS to upload or change documents.\n")
+}
@@ -0,0 +1,44 @@
+package qbinHTTP
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequireHTTPSForWrites(t *testing.T) {
+	defer func() { config.TrustedProxies = nil }()
+	config.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+	request := func(method string, url string, remote string, proto string) int {
+		req := httptest.NewRequest(method, url, strings.NewReader("Hello World"))
+		req.RemoteAddr = remote + ":12345"
+		if proto != "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		res := httptest.NewRecorder()
+		requireHTTPSForWrites(res, req, func(res http.ResponseWriter, req *http.Request) {})
+		return res.Code
+	}
+
+	if code := request("POST", "http://qbin.test/", "198.51.100.1", ""); code != 403 {
+		t.Errorf("Upload over HTTP returned %d (expected: 403)", code)
+	}
+	if code := request("GET", "http://qbin.test/cornflake-peddling-bp0q", "198.51.100.1", ""); code != 200 {
+		t.Errorf("Reading a document over HTTP returned %d (expected: 200)", code)
+	}
+	if code := request("PUT", "https://qbin.test/", "198.51.100.1", ""); code != 200 {
+		t.Errorf("Upload over HTTPS returned %d (expected: 200)", code)
+	}
+
+	// X-Forwarded-Proto is only used from trusted proxies
+	if code := request("POST", "http://qbin.test/", "10.1.2.3", "https"); code != 200 {
+		t.Errorf("Upload over HTTPS through a trusted proxy returned %d (expected: 200)", code)
+	}
+	if code := request("POST", "http://qbin.test/", "192.0.2.1", "http"); code != 403 {
+		t.Errorf("Upload over HTTP through a trusted proxy returned %d (expected: 403)", code)
+	}
+	if code := request("POST", "http://qbin.test/", "198.51.100.1", "https"); code != 403 {
+		t.Errorf("X-Forwarded-Proto of an untrusted client was used (status %d)", code)
+	}
+}
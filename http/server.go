@@ -4,9 +4,12 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/qbin-io/backend"
@@ -14,7 +17,11 @@ import (
 	"golang.org/x/crypto/acme/autocert"
 )
 
+// DefaultCertDir is used to store certificates if Configuration.CertDir is empty.
+const DefaultCertDir = "/var/lib/qbin/certs"
+
 type Configuration struct {
+	Version       string
 	ListenHTTP    string
 	ListenHTTPS   string
 	FrontendPath  string
@@ -24,6 +31,97 @@ type Configuration struct {
 	CertWhitelist []string
 	ForceRoot     bool
 	Hsts          string
+	TerminalRaw   bool
+	NoSNIDomain   string
+	// TerminalHelp serves usage instructions instead of the frontend to command line clients requesting the root.
+	TerminalHelp bool
+	// AvailabilityRateLimit is the number of name availability checks allowed per client and minute.
+	AvailabilityRateLimit int
+	// HighlightRateLimit is the number of documents whose skipped highlighting can be loaded per client and minute.
+	HighlightRateLimit int
+	// IPv6RateLimitPrefix is the prefix length by which IPv6 clients are grouped for rate limits, e.g. 64 to treat a /64 as
+	// one client. IPv4 clients are always limited by their full address.
+	IPv6RateLimitPrefix int
+	// TokenFailures is the number of wrong confirmation or collection tokens allowed per client and document, before further
+	// attempts are delayed exponentially. 0 disables the delay.
+	TokenFailures int
+	// SlowRequestThreshold is the duration after which requests are logged as slow. 0 disables the log.
+	SlowRequestThreshold time.Duration
+	// MaxURLLength is the maximum length of a request URI; longer requests are rejected with 414. 0 disables the limit.
+	MaxURLLength int
+	// MaxHeaderBytes is the maximum size of the request headers. 0 uses the default of net/http.
+	MaxHeaderBytes int
+	// NotFoundPage and GonePage are HTML files in FrontendPath that are served to browsers for missing and expired documents.
+	// Empty uses the plain text responses.
+	NotFoundPage string
+	GonePage     string
+	// CertDir is the directory where certificates from Let's Encrypt are stored. Defaults to DefaultCertDir.
+	CertDir string
+	// CertFile and KeyFile contain the certificate to use instead of requesting one from Let's Encrypt, e.g. from a corporate CA.
+	// They are reloaded when the process receives SIGHUP.
+	CertFile string
+	KeyFile  string
+	// CertCacheDB stores certificates in the database instead of CertDir, so multiple instances can share them.
+	CertCacheDB bool
+	// DocumentDomain serves every document on its own subdomain (e.g. cornflake-peddling-bp0q.paste.example.org for "paste.example.org"),
+	// so HTML in documents can't affect the main domain or other documents. Empty serves documents on the main domain.
+	DocumentDomain string
+	// DocumentCertFile and DocumentKeyFile contain a wildcard certificate for DocumentDomain, which is required for HTTPS.
+	DocumentCertFile string
+	DocumentKeyFile  string
+	// ExpiresHeader sends the expiration of documents as X-Expires header, and limits caching to the remaining lifetime.
+	ExpiresHeader bool
+	// ShortLinks adds the /n/<number> URL of new documents to the upload response, if they have a numeric alias.
+	ShortLinks bool
+	// FilesArray returns the content of documents in JSON responses as a "files" array, like for multi-file documents,
+	// instead of the flat "syntax", "highlighted", "encoding" and "content" fields. This applies to uploads, base64 encoded
+	// documents and the metadata.
+	FilesArray bool
+	// ValidationErrors reports all problems of a rejected upload at once (as a list for JSON clients), instead of only the first one.
+	ValidationErrors bool
+	// URLSyntax uses the extension of the upload URL (e.g. POST /raw.py) as the syntax of documents uploaded without one.
+	URLSyntax bool
+	// Limits enables /api/v1/limits, which describes the current limits of the instance for clients.
+	Limits bool
+	// InlineView enables /<document>/view.<ext>, which serves the raw content inline with a filename and the MIME type of the extension.
+	InlineView bool
+	// Base64Content enables /<document>/raw?encoding=base64, which returns the raw content base64-encoded in JSON, so clients
+	// can retrieve content that isn't valid UTF-8 without losing bytes.
+	Base64Content bool
+	// ContentURLs serves unencrypted documents stored with a content hash at /c/<hash> with immutable cache headers, e.g. for CDNs.
+	ContentURLs bool
+	// Embeds adds Open Graph meta tags to documents, and describes them as oEmbed JSON at /oembed?url=<document URL>.
+	Embeds bool
+	// EarlyHints are the paths of frontend assets (e.g. "/style.css") that are preloaded with a 103 Early Hints response
+	// before the frontend and documents are served to browsers. Empty disables Early Hints, as some proxies don't support them.
+	EarlyHints []string
+	// Themes are the names of the color themes offered by the frontend, which are listed at /api/v1/themes so other clients
+	// can offer the same choice.
+	Themes []string
+	// Grep enables /<document>?grep=<pattern>, which serves only the lines of a document matching a regular expression.
+	Grep bool
+	// PDF enables /<document>/pdf, which serves the highlighted content rendered as PDF.
+	PDF bool
+	// LiveViews enables /<document>/live, a WebSocket pushing the view count of a document whenever it changes.
+	LiveViews bool
+	// SecureWrites rejects requests that change data with 403 if they aren't sent over HTTPS. Reading documents is still possible over HTTP.
+	SecureWrites bool
+	// TrustedProxies contains the IP addresses and CIDR ranges of reverse proxies whose X-Forwarded-Proto header is used by
+	// SecureWrites, and whose X-Forwarded-For header is used by the access log.
+	TrustedProxies []string
+	// AccessLog writes a line for every request to Stdout in this format: human, json, or the NCSA formats common and
+	// combined. Empty disables the access log.
+	AccessLog string
+	// MaintenanceBanner is a message shown at the top of all pages, e.g. to announce downtime. It can be changed at runtime
+	// using PUT /api/v1/admin/banner. Empty means no banner.
+	MaintenanceBanner string
+	// MaintenanceBannerAPI includes the maintenance banner in the warnings of JSON API responses.
+	MaintenanceBannerAPI bool
+	// AdminToken is required for the admin API. Empty disables the admin API.
+	AdminToken string
+	// AdminTokens are additional tokens for the admin API which are limited to some scopes, formatted as
+	// "<name>:<hex-encoded SHA256 of the token>:<comma-separated scopes>". The scopes are read-stats, reports, delete, purge and banner.
+	AdminTokens []string
 }
 
 var config Configuration
@@ -51,6 +149,7 @@ func initializeConfig(initialConfig Configuration) {
 
 	rootParts = strings.SplitN(strings.ToLower(config.Root), "://", 2)
 	config.domain = strings.Split(rootParts[len(rootParts)-1], "/")[0]
+	config.DocumentDomain = strings.Trim(strings.ToLower(config.DocumentDomain), ".")
 }
 
 // StartHTTP launches the HTTP server which is responsible for the frontend and the HTTP API.
@@ -66,6 +165,20 @@ func StartHTTP(initialConfig Configuration) {
 
 	// Middlewares
 	n := negroni.New(negroni.NewRecovery())
+	if _, ok := accessLogFormats[config.AccessLog]; ok {
+		n.UseFunc(logAccess)
+	} else if config.AccessLog != "" {
+		qbin.Log.Errorf("Unknown access log format '%s', the access log is disabled.", config.AccessLog)
+	}
+	if config.SlowRequestThreshold > 0 {
+		n.UseFunc(logSlowRequests)
+	}
+	if config.MaxURLLength > 0 {
+		n.UseFunc(limitURLLength)
+	}
+	if config.SecureWrites {
+		n.UseFunc(requireHTTPSForWrites)
+	}
 	// Add important headers
 	n.UseHandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		res.Header().Add("Server", "qbin")
@@ -77,7 +190,9 @@ func StartHTTP(initialConfig Configuration) {
 	// Redirect to root
 	if config.ForceRoot {
 		n.UseFunc(func(res http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
-			if req.Host != config.domain || !strings.HasPrefix(req.URL.Path, config.path+"/") {
+			if documentFromHost(req.Host) != "" {
+				next(res, req)
+			} else if req.Host != config.domain || !strings.HasPrefix(req.URL.Path, config.path+"/") {
 				if !strings.HasPrefix(req.URL.Path, config.path+"/") {
 					res.Header().Add("Location", config.Root)
 					res.WriteHeader(301)
@@ -112,21 +227,43 @@ func listenHTTPS(r http.Handler) {
 		whitelist[h] = true
 	}
 
-	certManager := autocert.Manager{
-		Prompt: autocert.AcceptTOS,
-		HostPolicy: func(_ context.Context, host string) error {
-			if host != config.domain && whitelist[host] != true {
-				return errors.New("TLS host not configured: " + host)
-			}
-			return nil
-		},
-		Cache: autocert.DirCache("certs"),
+	// Certificates from files are reloaded on SIGHUP, so they can be rotated without a restart
+	reloadable := []*certificateFile{}
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	if config.CertFile != "" {
+		certificate, err := loadCertificateFile(config.CertFile, config.KeyFile)
+		if err != nil {
+			qbin.Log.Errorf("Couldn't load the certificate: %s", err)
+			panic(err)
+		}
+		reloadable = append(reloadable, certificate)
+		getCertificate = certificate.GetCertificate
+	} else {
+		certManager, err := newCertManager(whitelist)
+		if err != nil {
+			qbin.Log.Errorf("Couldn't create certificate directory: %s", err)
+			panic(err)
+		}
+		getCertificate = certManager.GetCertificate
+	}
+	if config.DocumentDomain != "" {
+		certificate, err := loadCertificateFile(config.DocumentCertFile, config.DocumentKeyFile)
+		if err != nil {
+			qbin.Log.Errorf("Couldn't load the wildcard certificate for document subdomains: %s", err)
+			panic(err)
+		}
+		reloadable = append(reloadable, certificate)
+		getCertificate = subdomainCertificate(certificate.GetCertificate, getCertificate)
+	}
+	if len(reloadable) > 0 {
+		reloadOnSIGHUP(reloadable...)
 	}
 	server := &http.Server{
-		Addr:    config.ListenHTTPS,
-		Handler: r,
+		Addr:           config.ListenHTTPS,
+		Handler:        r,
+		MaxHeaderBytes: config.MaxHeaderBytes,
 		TLSConfig: &tls.Config{
-			GetCertificate: certManager.GetCertificate,
+			GetCertificate: handleMissingSNI(getCertificate),
 		},
 	}
 
@@ -137,14 +274,83 @@ func listenHTTPS(r http.Handler) {
 	}
 }
 
+// newCertManager creates the autocert manager for the configured domain and whitelist, storing certificates in config.CertDir or the database.
+func newCertManager(whitelist map[string]bool) (*autocert.Manager, error) {
+	var cache autocert.Cache
+	if config.CertCacheDB {
+		cache = qbin.NewCertCache()
+	} else {
+		dir := config.CertDir
+		if dir == "" {
+			dir = DefaultCertDir
+		}
+		// The directory contains private keys, so nobody else should be able to read it
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return nil, err
+		}
+		cache = autocert.DirCache(dir)
+	}
+
+	return &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		HostPolicy: func(_ context.Context, host string) error {
+			if host != config.domain && whitelist[host] != true {
+				return errors.New("TLS host not configured: " + host)
+			}
+			return nil
+		},
+		Cache: cache,
+	}, nil
+}
+
+// handleMissingSNI wraps a GetCertificate function to handle clients that don't send a server name (e.g. old clients or direct IP access).
+// Those either get the certificate of config.NoSNIDomain, or are rejected if it's not set.
+func handleMissingSNI(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName != "" {
+			return getCertificate(hello)
+		}
+
+		if config.NoSNIDomain == "" {
+			remote := "unknown address"
+			if hello.Conn != nil {
+				remote = hello.Conn.RemoteAddr().String()
+			}
+			qbin.Log.Infof("Rejected TLS connection without server name from %s", remote)
+			return nil, errors.New("TLS server name (SNI) missing")
+		}
+
+		fallback := *hello
+		fallback.ServerName = config.NoSNIDomain
+		return getCertificate(&fallback)
+	}
+}
+
 func listenHTTP(r http.Handler) {
-	err := http.ListenAndServe(config.ListenHTTP, r)
+	server := &http.Server{
+		Addr:           config.ListenHTTP,
+		Handler:        r,
+		MaxHeaderBytes: config.MaxHeaderBytes,
+	}
+	err := server.ListenAndServe()
 	if err != nil {
 		qbin.Log.Errorf("HTTP server error: %s", err)
 		panic(err)
 	}
 }
 
+// limitURLLength is a middleware that rejects requests with URLs longer than config.MaxURLLength, which can't be valid document names anyway.
+func limitURLLength(res http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	if len(req.RequestURI) > config.MaxURLLength {
+		res.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		res.WriteHeader(414)
+		fmt.Fprint(res, "That's a really long URL you have there. Too long for us, unfortunately.\n")
+		return
+	}
+	next(res, req)
+}
+
 type redirector struct{}
 
 func (redirector) ServeHTTP(res http.ResponseWriter, req *http.Request) {
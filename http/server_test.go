@@ -0,0 +1,86 @@
+package qbinHTTP
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestHandleMissingSNI(t *testing.T) {
+	requested := ""
+	getCertificate := handleMissingSNI(func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		requested = hello.ServerName
+		return &tls.Certificate{}, nil
+	})
+
+	config.NoSNIDomain = ""
+	_, err := getCertificate(&tls.ClientHelloInfo{})
+	if err == nil {
+		t.Errorf("Connection without SNI should be rejected, but isn't.")
+	}
+	if requested != "" {
+		t.Errorf("Certificate for '%s' was requested, but the connection should have been rejected.", requested)
+	}
+
+	config.NoSNIDomain = "qbin.example.org"
+	_, err = getCertificate(&tls.ClientHelloInfo{})
+	if err != nil || requested != "qbin.example.org" {
+		t.Errorf("Connection without SNI should get the fallback certificate, got '%s' (error: %v)", requested, err)
+	}
+
+	_, err = getCertificate(&tls.ClientHelloInfo{ServerName: "other.example.org"})
+	if err != nil || requested != "other.example.org" {
+		t.Errorf("Connection with SNI should get its own certificate, got '%s' (error: %v)", requested, err)
+	}
+	config.NoSNIDomain = ""
+}
+
+func TestLimitURLLength(t *testing.T) {
+	config.MaxURLLength = 64
+	defer func() { config.MaxURLLength = 0 }()
+	next := func(res http.ResponseWriter, req *http.Request) {}
+
+	res := httptest.NewRecorder()
+	limitURLLength(res, httptest.NewRequest("GET", "/"+strings.Repeat("a", 100), nil), next)
+	if res.Code != 414 {
+		t.Errorf("Long URL returned %d (expected: 414)", res.Code)
+	}
+
+	res = httptest.NewRecorder()
+	limitURLLength(res, httptest.NewRequest("GET", "/cornflake-peddling-bp0q", nil), next)
+	if res.Code != 200 {
+		t.Errorf("Short URL returned %d (expected: 200)", res.Code)
+	}
+}
+
+func TestCertDir(t *testing.T) {
+	parent, err := ioutil.TempDir("", "qbin-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	config.CertDir = filepath.Join(parent, "certs")
+	defer func() { config.CertDir = "" }()
+
+	manager, err := newCertManager(map[string]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manager.Cache != autocert.DirCache(config.CertDir) {
+		t.Errorf("Certificate manager uses %v (expected: %s)", manager.Cache, config.CertDir)
+	}
+	info, err := os.Stat(config.CertDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0700 {
+		t.Errorf("Certificate directory wasn't created with mode 0700: %s", info.Mode())
+	}
+}
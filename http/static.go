@@ -19,6 +19,8 @@ var staticFileExceptions = []string{
 	"output.html",
 	"report.html",
 	"guidelines.html",
+	"404.html",
+	"410.html",
 	"Makefile",
 	"README.md",
 	"LICENSE",
@@ -0,0 +1,86 @@
+package qbinHTTP
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// documentFromHost returns the document ID for a host like "cornflake-peddling-bp0q.paste.example.org" if config.DocumentDomain is "paste.example.org".
+// It returns an empty string if the host isn't a document subdomain.
+func documentFromHost(host string) string {
+	if config.DocumentDomain == "" {
+		return ""
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if !strings.HasSuffix(host, "."+config.DocumentDomain) {
+		return ""
+	}
+	id := strings.TrimSuffix(host, "."+config.DocumentDomain)
+	if id == "" || strings.Contains(id, ".") {
+		return ""
+	}
+	return id
+}
+
+// setupSubdomainRoutes serves documents on their own subdomain of config.DocumentDomain, so HTML in one document can't access anything on another origin.
+// Other paths on document subdomains (e.g. static files) fall through to the normal routes.
+func setupSubdomainRoutes(r *mux.Router, document http.HandlerFunc, raw http.HandlerFunc) {
+	s := r.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+		return documentFromHost(req.Host) != ""
+	}).Subrouter()
+	s.HandleFunc("/", subdomainRoute(document, "")).Methods("GET")
+	s.HandleFunc("/raw", subdomainRoute(raw, "/raw")).Methods("GET")
+}
+
+// subdomainRoute rewrites the path of a request on a document subdomain to the path the document routes expect, e.g. "/cornflake-peddling-bp0q/raw".
+func subdomainRoute(route http.HandlerFunc, suffix string) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		req.URL.Path = "/" + documentFromHost(req.Host) + suffix
+		route(res, req)
+	}
+}
+
+// subdomainRedirect redirects HTML documents on the main domain to their subdomain if config.DocumentDomain is set.
+func subdomainRedirect(route http.HandlerFunc) http.HandlerFunc {
+	if config.DocumentDomain == "" {
+		return route
+	}
+	return func(res http.ResponseWriter, req *http.Request) {
+		if (config.TerminalRaw && isTerminalClient(req)) || wantsANSI(req) {
+			route(res, req)
+			return
+		}
+		res.Header().Set("Location", documentURL(strings.TrimPrefix(req.URL.Path, "/")))
+		res.WriteHeader(301)
+	}
+}
+
+// documentURL returns the URL under which the HTML page of a document is served.
+func documentURL(id string) string {
+	if config.DocumentDomain == "" {
+		return config.Root + "/" + id
+	}
+	scheme := "https"
+	if config.ListenHTTPS == "none" {
+		scheme = "http"
+	}
+	return scheme + "://" + id + "." + config.DocumentDomain + "/"
+}
+
+// subdomainCertificate serves a wildcard certificate for config.DocumentDomain to document subdomains, and uses getCertificate for everything else.
+// Let's Encrypt only issues wildcard certificates using DNS challenges, which aren't supported by autocert.
+func subdomainCertificate(getDocumentCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if documentFromHost(hello.ServerName) != "" {
+			return getDocumentCertificate(hello)
+		}
+		return getCertificate(hello)
+	}
+}
@@ -0,0 +1,69 @@
+package qbinHTTP
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDocumentFromHost(t *testing.T) {
+	config.DocumentDomain = "paste.example.org"
+	defer func() { config.DocumentDomain = "" }()
+
+	tests := map[string]string{
+		"cornflake-peddling-bp0q.paste.example.org":      "cornflake-peddling-bp0q",
+		"Cornflake-Peddling-bp0q.Paste.Example.org:8443": "cornflake-peddling-bp0q",
+		"cornflake-peddling-bp0q.paste.example.org.":     "cornflake-peddling-bp0q",
+		"paste.example.org":                              "",
+		"a.b.paste.example.org":                          "",
+		"cornflake-peddling-bp0q.evilpaste.example.org":  "",
+		"qbin.example.org":                               "",
+	}
+	for host, expected := range tests {
+		if id := documentFromHost(host); id != expected {
+			t.Errorf("Host %s resolved to %q (expected: %q)", host, id, expected)
+		}
+	}
+}
+
+func TestSubdomainRouting(t *testing.T) {
+	config.DocumentDomain = "paste.example.org"
+	config.ListenHTTPS = ""
+	defer func() { config.DocumentDomain = "" }()
+
+	served := ""
+	handler := func(name string) http.HandlerFunc {
+		return func(res http.ResponseWriter, req *http.Request) { served = name + " " + req.URL.Path }
+	}
+	r := mux.NewRouter()
+	setupSubdomainRoutes(r, handler("document"), handler("raw"))
+	r.HandleFunc("/style.css", handler("static")).Methods("GET")
+	r.HandleFunc("/{document}", subdomainRedirect(handler("main"))).Methods("GET")
+
+	tests := []struct{ host, path, expected string }{
+		{"cornflake-peddling-bp0q.paste.example.org", "/", "document /cornflake-peddling-bp0q"},
+		{"cornflake-peddling-bp0q.paste.example.org", "/raw", "raw /cornflake-peddling-bp0q/raw"},
+		{"cornflake-peddling-bp0q.paste.example.org", "/style.css", "static /style.css"},
+		{"qbin.example.org", "/cornflake-peddling-bp0q", ""},
+	}
+	for _, test := range tests {
+		served = ""
+		req := httptest.NewRequest("GET", test.path, nil)
+		req.Host = test.host
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, req)
+		if served != test.expected {
+			t.Errorf("%s%s served %q (expected: %q)", test.host, test.path, served, test.expected)
+		}
+	}
+
+	// Documents on the main domain are redirected to their subdomain
+	req := httptest.NewRequest("GET", "/cornflake-peddling-bp0q", nil)
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, req)
+	if res.Code != 301 || res.Header().Get("Location") != "https://cornflake-peddling-bp0q.paste.example.org/" {
+		t.Errorf("Document on the main domain returned %d with Location %q", res.Code, res.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,52 @@
+package qbinHTTP
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/qbin-io/backend"
+)
+
+type contextKey int
+
+const timingKey contextKey = iota
+
+// requestTiming collects the qbin.Timing of all documents stored or requested during a single HTTP request.
+type requestTiming struct {
+	mutex  sync.Mutex
+	timing qbin.Timing
+}
+
+// slowRequestLog is used to report slow requests.
+var slowRequestLog = qbin.Log.Warningf
+
+// recordTiming adds the timing of a stored or requested document to the request, if slow requests are logged.
+func recordTiming(req *http.Request, timing qbin.Timing) {
+	t, ok := req.Context().Value(timingKey).(*requestTiming)
+	if !ok {
+		return
+	}
+	t.mutex.Lock()
+	t.timing.Scrypt += timing.Scrypt
+	t.timing.Highlight += timing.Highlight
+	t.timing.Database += timing.Database
+	t.mutex.Unlock()
+}
+
+// logSlowRequests is a middleware that logs all requests taking longer than config.SlowRequestThreshold.
+func logSlowRequests(res http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	t := &requestTiming{}
+	start := time.Now()
+	next(res, req.WithContext(context.WithValue(req.Context(), timingKey, t)))
+	duration := time.Since(start)
+
+	// Upgraded connections (live views) are expected to stay open
+	if duration >= config.SlowRequestThreshold && req.Header.Get("Upgrade") == "" {
+		t.mutex.Lock()
+		slowRequestLog("Slow request: %s %s took %s (scrypt: %s, highlighting: %s, database: %s)",
+			req.Method, req.URL.Path, duration, t.timing.Scrypt, t.timing.Highlight, t.timing.Database)
+		t.mutex.Unlock()
+	}
+}
@@ -0,0 +1,38 @@
+package qbinHTTP
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qbin-io/backend"
+)
+
+func TestLogSlowRequests(t *testing.T) {
+	logged := []string{}
+	slowRequestLog = func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	defer func() { slowRequestLog = qbin.Log.Warningf }()
+	config.SlowRequestThreshold = 20 * time.Millisecond
+	defer func() { config.SlowRequestThreshold = 0 }()
+
+	slowRoute := func(res http.ResponseWriter, req *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		recordTiming(req, qbin.Timing{Scrypt: 25 * time.Millisecond})
+	}
+	fastRoute := func(res http.ResponseWriter, req *http.Request) {}
+
+	logSlowRequests(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil), fastRoute)
+	if len(logged) != 0 {
+		t.Errorf("Fast request was logged: %v", logged)
+	}
+
+	logSlowRequests(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil), slowRoute)
+	if len(logged) != 1 || !strings.Contains(logged[0], "GET /slow") || !strings.Contains(logged[0], "scrypt: 25ms") {
+		t.Errorf("Slow request wasn't logged correctly: %v", logged)
+	}
+}
@@ -1,11 +1,16 @@
 package qbinHTTP
 
 import (
+	"compress/flate"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 
+	"github.com/gorilla/mux"
 	"github.com/qbin-io/backend"
 )
 
@@ -13,22 +18,64 @@ func uploadError(during string, err error, res http.ResponseWriter, req *http.Re
 	if err == nil {
 		return false
 	}
+	if _, corrupt := err.(flate.CorruptInputError); corrupt || err == gzip.ErrChecksum || err == gzip.ErrHeader || err == io.ErrUnexpectedEOF {
+		res.WriteHeader(400)
+		fmt.Fprintf(res, "Invalid gzip body.\n")
+		return true
+	}
 	qbin.Log.Errorf("Upload error during %s: %s", during, err)
+	if err == qbin.ErrTimeout || err == qbin.ErrBusy {
+		serviceUnavailableRoute(res, req)
+		return true
+	}
 	internalErrorRoute(res, req)
 	return true
 }
 
+// decodeBody transparently decompresses gzip request bodies. It returns false if the encoding isn't supported, after responding with an error.
+func decodeBody(res http.ResponseWriter, req *http.Request) bool {
+	switch strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return true
+	case "gzip":
+		body, err := gzip.NewReader(req.Body)
+		if err != nil {
+			res.WriteHeader(400)
+			fmt.Fprintf(res, "Invalid gzip body.\n")
+			return false
+		}
+		// Limit the decompressed size too, to not be killed by a decompression bomb
+		req.Body = http.MaxBytesReader(res, body, qbin.MaxFilesize+1024)
+		return true
+	}
+	res.WriteHeader(415)
+	fmt.Fprintf(res, "Unsupported content encoding, only gzip is supported.\n")
+	return false
+}
+
 func uploadRoute(res http.ResponseWriter, req *http.Request) {
 	var err error
 
 	doc := qbin.Document{}
-	exp := "14d"
+	exp := ""
 	redirect := false
 	sizeExceeded := false
+	problems := uploadProblems{}
+
+	if qbin.CheckCountry(clientIP(req)) == qbin.ErrBlockedCountry {
+		res.WriteHeader(451)
+		fmt.Fprintf(res, "Uploading documents isn't allowed from your country.\n")
+		return
+	}
 
 	// Parse form and get content
 	req.Body = http.MaxBytesReader(res, req.Body, qbin.MaxFilesize+1024) // MaxFilesize + 1KB metadata
+	if !decodeBody(res, req) {
+		return
+	}
 	contentType := strings.Split(strings.Replace(strings.ToLower(req.Header.Get("Content-Type")), " ", "", -1), ";")[0]
+	// The content type of the document itself, used to infer the syntax
+	documentType := ""
 
 	// Get the document, however the request is formatted
 	if req.Method == "POST" && contentType == "application/x-www-form-urlencoded" {
@@ -57,7 +104,7 @@ func uploadRoute(res http.ResponseWriter, req *http.Request) {
 			doc.Content = req.PostFormValue("Q")
 			if doc.Content == "" { // Oh no, it's a file!
 				// Get file
-				file, _, err := req.FormFile("Q")
+				file, header, err := req.FormFile("Q")
 				if err != nil && err.Error() == "http: no such file" {
 					res.WriteHeader(400)
 					fmt.Fprintf(res, "The document can't be empty.\n")
@@ -72,6 +119,7 @@ func uploadRoute(res http.ResponseWriter, req *http.Request) {
 					return
 				}
 				doc.Content = string(content)
+				documentType = header.Header.Get("Content-Type")
 			}
 
 		}
@@ -85,20 +133,20 @@ func uploadRoute(res http.ResponseWriter, req *http.Request) {
 		} else {
 
 			doc.Content = string(content)
+			documentType = contentType
 
 		}
 	}
 
 	// Check exact filesize
 	if sizeExceeded || len(doc.Content) > qbin.MaxFilesize {
-		res.WriteHeader(413)
-		fmt.Fprintf(res, "Maximum document size exceeded.\n")
-		return
-	}
-	if len(strings.TrimSpace(doc.Content)) < 1 {
-		res.WriteHeader(400)
-		fmt.Fprintf(res, "The document can't be empty.\n")
-		return
+		if problems.add(res, req, 413, "content", "Maximum document size exceeded.") {
+			return
+		}
+	} else if len(strings.TrimSpace(doc.Content)) < 1 {
+		if problems.add(res, req, 400, "content", "The document can't be empty.") {
+			return
+		}
 	}
 
 	// Read metadata
@@ -107,12 +155,32 @@ func uploadRoute(res http.ResponseWriter, req *http.Request) {
 	} else if req.FormValue("S") != "" {
 		doc.Syntax = req.FormValue("S")
 	}
-	doc.Syntax = qbin.ParseSyntax(doc.Syntax)
-	if !qbin.SyntaxExists(doc.Syntax) {
-		res.WriteHeader(400)
-		fmt.Fprintf(res, "Invalid syntax name.\n")
+	syntax, err := qbin.UploadSyntax(doc.Syntax)
+	if err != nil && problems.add(res, req, 400, "syntax", "Invalid syntax name.") {
 		return
 	}
+	if syntax == "" && err == nil {
+		// Unknown extensions and content types fall through to the syntax detection or the default syntax
+		syntax = uploadSyntaxHint(req, documentType)
+	}
+	doc.Syntax = syntax
+
+	// Conditional create: the content is only stored if it doesn't exist yet. The client must send the exact ETag, which it
+	// can only know if it has seen a document with that content, as the hash is keyed. "*" would turn this into an oracle.
+	if qbin.ContentETags && req.Header.Get("If-None-Match") != "" {
+		hash, err := qbin.ContentHash(doc.Content, doc.Syntax)
+		if err == nil && containsETag(req.Header.Get("If-None-Match"), `"`+hash+`"`) {
+			exists, err := qbin.ContentExists(hash)
+			if uploadError("qbin.ContentExists()", err, res, req) {
+				return
+			} else if exists {
+				res.Header().Set("ETag", `"`+hash+`"`)
+				res.WriteHeader(412)
+				fmt.Fprintf(res, "A document with this content already exists.\n")
+				return
+			}
+		}
+	}
 
 	if req.Header.Get("R") != "" || req.FormValue("R") != "" {
 		redirect = true
@@ -123,6 +191,39 @@ func uploadRoute(res http.ResponseWriter, req *http.Request) {
 	} else if req.FormValue("C") != "" {
 		doc.Custom = req.FormValue("C")
 	}
+	if qbin.ValidateCustom(doc.Custom) != nil && problems.add(res, req, 400, "custom", "Invalid custom value.") {
+		return
+	}
+
+	if req.Header.Get("P") != "" {
+		doc.Parent = req.Header.Get("P")
+	} else if req.FormValue("P") != "" {
+		doc.Parent = req.FormValue("P")
+	}
+
+	if req.Header.Get("U") != "" || req.FormValue("U") != "" {
+		doc.Unencrypted = true
+	}
+
+	if req.Header.Get("G") != "" {
+		doc.Collection = req.Header.Get("G")
+	} else if req.FormValue("G") != "" {
+		doc.Collection = req.FormValue("G")
+	}
+	if err := qbin.ValidateCollection(doc.Collection); err != nil {
+		if problem, _ := storeProblem(err); problems.add(res, req, problem.status, problem.Field, problem.Message) {
+			return
+		}
+	}
+
+	if req.Header.Get("N") != "" {
+		doc.Notify = req.Header.Get("N")
+	} else if req.FormValue("N") != "" {
+		doc.Notify = req.FormValue("N")
+	}
+	if doc.Notify != "" && qbin.ValidateNotifyURL(doc.Notify) != nil && problems.add(res, req, 400, "notify", "Invalid notification URL.") {
+		return
+	}
 
 	if req.Header.Get("E") != "" {
 		exp = req.Header.Get("E")
@@ -130,28 +231,198 @@ func uploadRoute(res http.ResponseWriter, req *http.Request) {
 		exp = req.FormValue("E")
 	}
 
-	doc.Expiration, err = qbin.ParseExpiration(exp)
-	if err != nil {
-		res.WriteHeader(400)
-		fmt.Fprintf(res, "Invalid expiration.\n")
+	doc.Expiration, err = qbin.UploadExpiration(exp)
+	if err == qbin.ErrInvalidExpiration && problems.add(res, req, 400, "expiration", "Invalid expiration.") {
 		return
+	} else if err == qbin.ErrExpirationTooLong && problems.add(res, req, 400, "expiration", fmt.Sprintf("The expiration exceeds the maximum of %s.", qbin.MaxExpiration)) {
+		return
+	}
+
+	// Report the problems qbin.Store() would find together with the ones found above
+	if config.ValidationErrors {
+		for _, err := range qbin.Validate(&doc) {
+			if problem, ok := storeProblem(err); ok {
+				problems.add(res, req, problem.status, problem.Field, problem.Message)
+			}
+		}
+		if problems.respond(res, req) {
+			return
+		}
 	}
 
+	doc.Fingerprint = qbin.Fingerprint(clientIP(req), req.UserAgent())
+
 	// Volatile documents grant 1 view to the uploader, but the uploaded won't view a document when not redirected
 	if !redirect {
 		doc.Views = 1
 	}
 
 	err = qbin.Store(&doc)
-	if err != nil && err.Error() == "file contains 0x00 bytes" {
-		res.WriteHeader(400)
-		fmt.Fprintf(res, "You are trying to upload a binary file, which is not supported.\n")
+	recordTiming(req, doc.Timing)
+	if storeError(err, res, req) {
 		return
-	} else if err != nil && strings.HasPrefix(err.Error(), "spam: ") {
-		res.WriteHeader(400)
-		fmt.Fprintf(res, "Your file got caught in the spam filter.\nReason: "+strings.TrimPrefix(err.Error(), "spam: ")+"\n")
+	}
+
+	uploadResponse(res, req, &doc, redirect)
+}
+
+// uploadSyntaxHint infers the syntax of an upload without an explicit syntax from the extension of the URL (if
+// config.URLSyntax is enabled) or the content type of the document.
+func uploadSyntaxHint(req *http.Request, documentType string) string {
+	if config.URLSyntax {
+		if syntax := qbin.SyntaxFromExtension(req.URL.Path); syntax != "" {
+			return syntax
+		}
+	}
+	return qbin.SyntaxFromContentType(documentType)
+}
+
+// storeError responds to errors returned by qbin.Store(), and returns false if there was no error.
+func storeError(err error, res http.ResponseWriter, req *http.Request) bool {
+	problem, ok := storeProblem(err)
+	if !ok {
+		return uploadError("qbin.Store()", err, res, req)
+	}
+	if err == qbin.ErrRepeatedSpam {
+		res.Header().Add("Retry-After", strconv.Itoa(int(qbin.SpamRepeatWindow.Seconds())))
+	}
+	res.WriteHeader(problem.status)
+	fmt.Fprint(res, problem.Message+"\n")
+	return true
+}
+
+// storeProblem describes an error returned by qbin.Store() or qbin.Validate() for the client. It returns false for
+// unexpected errors.
+func storeProblem(err error) (uploadProblem, bool) {
+	switch {
+	case err == qbin.ErrTooLarge:
+		return uploadProblem{"content", "Maximum document size exceeded.", 413}, true
+	case err == qbin.ErrBinaryContent:
+		return uploadProblem{"content", "You are trying to upload a binary file, which is not supported.", 400}, true
+	case err == qbin.ErrNonPrintableContent:
+		return uploadProblem{"content", "Your file consists mostly of non-printable characters, which is not supported.", 400}, true
+	case err == qbin.ErrInvalidCustom:
+		return uploadProblem{"custom", "Invalid custom value.", 400}, true
+	case err == qbin.ErrUnencryptedNotAllowed:
+		return uploadProblem{"unencrypted", "Storing documents without encryption isn't allowed on this server.", 400}, true
+	case err == qbin.ErrCollectionsDisabled:
+		return uploadProblem{"collection", "Collections aren't enabled on this server.", 400}, true
+	case err == qbin.ErrInvalidCollection:
+		return uploadProblem{"collection", "Invalid collection token, it must be at least 16 characters long.", 400}, true
+	case err == qbin.ErrInvalidParent:
+		return uploadProblem{"parent", "The document you forked doesn't exist anymore.", 400}, true
+	case err == qbin.ErrBlockedSyntax:
+		return uploadProblem{"content", "This kind of content isn't allowed on this server.", 403}, true
+	case err == qbin.ErrRepeatedSpam:
+		return uploadProblem{"content", "Slow down, you've already sent that document and it got caught in the spam filter.", 429}, true
+	case err != nil && strings.HasPrefix(err.Error(), "spam: "):
+		return uploadProblem{"content", "Your file got caught in the spam filter.\nReason: " + strings.TrimPrefix(err.Error(), "spam: "), 400}, true
+	case err == qbin.ErrInsufficientStorage:
+		return uploadProblem{"", "The server is out of storage, please try again later.", 507}, true
+	case err == qbin.ErrQuotaExceeded:
+		return uploadProblem{"", "You've reached your storage quota, please try again when some of your documents have expired.", 429}, true
+	}
+	return uploadProblem{}, false
+}
+
+// uploadProblem is a reason why an upload was rejected.
+type uploadProblem struct {
+	// Field is the upload parameter causing the problem, e.g. "syntax"
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+	status  int
+}
+
+// uploadProblems collects the problems of an upload. Unless config.ValidationErrors is set, only the first problem is reported.
+type uploadProblems []uploadProblem
+
+// add records a problem. If only the first problem is reported, it responds immediately and returns true.
+func (p *uploadProblems) add(res http.ResponseWriter, req *http.Request, status int, field string, message string) bool {
+	for _, problem := range *p {
+		if problem.Message == message {
+			return false
+		}
+	}
+	*p = append(*p, uploadProblem{field, message, status})
+	if config.ValidationErrors {
+		return false
+	}
+	return p.respond(res, req)
+}
+
+// respond reports all collected problems with the status of the first one, and returns false if there are none. JSON
+// clients get a list of all problems.
+func (p uploadProblems) respond(res http.ResponseWriter, req *http.Request) bool {
+	if len(p) == 0 {
+		return false
+	}
+	if config.ValidationErrors && wantsJSON(req) {
+		writeJSON(res, p[0].status, struct {
+			Error  string          `json:"error"`
+			Errors []uploadProblem `json:"errors"`
+		}{p[0].Message, p})
+		return true
+	}
+	res.WriteHeader(p[0].status)
+	for _, problem := range p {
+		fmt.Fprint(res, problem.Message+"\n")
+	}
+	return true
+}
+
+// uploadResponse tells the client where a freshly uploaded document can be found.
+func uploadResponse(res http.ResponseWriter, req *http.Request, doc *qbin.Document, redirect bool) {
+	if doc.ConfirmationToken != "" {
+		res.Header().Set("X-Confirmation-Token", doc.ConfirmationToken)
+	}
+	if doc.ContentHash != "" {
+		res.Header().Set("X-Content-Hash", doc.ContentHash)
+	}
+	shortURL := ""
+	if config.ShortLinks && doc.Alias != 0 {
+		shortURL = config.Root + "/n/" + strconv.FormatInt(doc.Alias, 10)
+		res.Header().Set("Link", "<"+shortURL+">; rel=\"shortlink\"")
+	}
+
+	// Only send the URL in the Location header if the client doesn't need anything else (RFC 7240)
+	if !redirect && prefersMinimal(req) {
+		res.Header().Set("Preference-Applied", "return=minimal")
+		res.Header().Set("Location", config.Root+"/"+doc.ID)
+		res.WriteHeader(201)
 		return
-	} else if uploadError("qbin.Store()", err, res, req) {
+	}
+
+	// JSON clients get everything they need to show the document without requesting it again
+	if !redirect && wantsJSON(req) {
+		response := uploadJSON{
+			ID:                doc.ID,
+			URL:               config.Root + "/" + doc.ID,
+			ShortURL:          shortURL,
+			ContentHash:       doc.ContentHash,
+			ConfirmationToken: doc.ConfirmationToken,
+			SyntaxCandidates:  doc.SyntaxCandidates,
+		}
+		if includes(req, "friendlyName") {
+			response.FriendlyName = doc.FriendlyName
+		}
+		if config.FilesArray {
+			file := jsonFile{Syntax: doc.Syntax}
+			if includes(req, "highlighted") {
+				file.Highlighted = &doc.Highlighted
+			}
+			response.Files = []jsonFile{file}
+		} else if includes(req, "highlighted") {
+			response.Syntax = doc.Syntax
+			response.Highlighted = &doc.Highlighted
+		}
+		writeJSON(res, 200, response)
+		return
+	}
+
+	// Pending documents can't be viewed yet, so return the confirmation token instead of redirecting
+	if doc.ConfirmationToken != "" {
+		fmt.Fprintf(res, "%s\nConfirmation token: %s\nThe document will be public after it's confirmed, e.g. using: curl -H 'T: %s' -X POST %s/confirm\n",
+			config.Root+"/"+doc.ID, doc.ConfirmationToken, doc.ConfirmationToken, config.Root+"/"+doc.ID)
 		return
 	}
 
@@ -160,5 +431,92 @@ func uploadRoute(res http.ResponseWriter, req *http.Request) {
 		res.Header().Set("Location", config.Root+"/"+doc.ID)
 		res.WriteHeader(302)
 	}
-	fmt.Fprintf(res, config.Root+"/"+doc.ID+"\n")
+	fmt.Fprint(res, config.Root+"/"+doc.ID+"\n")
+}
+
+// uploadJSON is the response to an upload for JSON clients.
+type uploadJSON struct {
+	ID                string  `json:"id"`
+	URL               string  `json:"url"`
+	ShortURL          string  `json:"shortUrl,omitempty"`
+	FriendlyName      string  `json:"friendlyName,omitempty"`
+	ContentHash       string  `json:"contentHash,omitempty"`
+	ConfirmationToken string  `json:"confirmationToken,omitempty"`
+	Syntax            string  `json:"syntax,omitempty"`
+	Highlighted       *string `json:"highlighted,omitempty"`
+	// SyntaxCandidates are the detected syntaxes of the document, best first, if qbin.SyntaxCandidates is enabled
+	SyntaxCandidates []qbin.SyntaxCandidate `json:"syntaxCandidates,omitempty"`
+	// Files replaces Syntax and Highlighted if config.FilesArray is set
+	Files []jsonFile `json:"files,omitempty"`
+}
+
+// jsonFile is a single file of a document in JSON responses.
+type jsonFile struct {
+	Syntax      string  `json:"syntax"`
+	Highlighted *string `json:"highlighted,omitempty"`
+	Encoding    string  `json:"encoding,omitempty"`
+	Content     *string `json:"content,omitempty"`
+}
+
+// wantsJSON checks if the client requested a JSON response, either explicitly using the Accept header or by using ?include=.
+func wantsJSON(req *http.Request) bool {
+	if req.URL.Query().Get("include") != "" {
+		return true
+	}
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		if strings.TrimSpace(strings.Split(accept, ";")[0]) == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// includes checks if a field was requested using ?include=, which takes a comma-separated list.
+func includes(req *http.Request, field string) bool {
+	for _, value := range req.URL.Query()["include"] {
+		for _, f := range strings.Split(value, ",") {
+			if strings.TrimSpace(f) == field {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prefersMinimal checks if the client sent "Prefer: return=minimal".
+func prefersMinimal(req *http.Request) bool {
+	for _, header := range req.Header["Prefer"] {
+		for _, preference := range strings.Split(header, ",") {
+			preference = strings.TrimSpace(strings.Split(preference, ";")[0])
+			if strings.ToLower(strings.Replace(preference, " ", "", -1)) == "return=minimal" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func confirmRoute(res http.ResponseWriter, req *http.Request) {
+	token := req.Header.Get("T")
+	if token == "" {
+		token = req.FormValue("T")
+	}
+
+	// Failures for a document are counted per client, so others can't lock the uploader out by sending wrong tokens
+	bucket := clientBucket(req)
+	keys := []string{"ip:" + bucket, "document:" + bucket + "/" + mux.Vars(req)["document"]}
+	if tokenThrottled(res, req, keys...) {
+		return
+	}
+
+	err := qbin.Confirm(mux.Vars(req)["document"], token)
+	if err == qbin.ErrInvalidConfirmation {
+		tokenAttempts.fail(keys...)
+		res.WriteHeader(403)
+		fmt.Fprintf(res, "Invalid confirmation token.\n")
+		return
+	} else if uploadError("qbin.Confirm()", err, res, req) {
+		return
+	}
+	fmt.Fprint(res, config.Root+"/"+mux.Vars(req)["document"]+"\n")
 }
@@ -0,0 +1,363 @@
+package qbinHTTP
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/qbin-io/backend"
+)
+
+func TestUploadResponse(t *testing.T) {
+	config.Root = "https://qbin.example.org"
+	doc := qbin.Document{ID: "cornflake-peddling-bp0q"}
+
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("Prefer", "respond-async, return=minimal")
+	res := httptest.NewRecorder()
+	uploadResponse(res, req, &doc, false)
+	if res.Code != 201 || res.Header().Get("Location") != "https://qbin.example.org/cornflake-peddling-bp0q" || res.Body.Len() != 0 {
+		t.Errorf("Wrong minimal response: %d, Location: %s, Body: %q", res.Code, res.Header().Get("Location"), res.Body.String())
+	}
+
+	req = httptest.NewRequest("POST", "/", nil)
+	res = httptest.NewRecorder()
+	uploadResponse(res, req, &doc, false)
+	if res.Code != 200 || res.Body.String() != "https://qbin.example.org/cornflake-peddling-bp0q\n" {
+		t.Errorf("Wrong full response: %d, Body: %q", res.Code, res.Body.String())
+	}
+}
+
+func TestUploadResponseHighlighted(t *testing.T) {
+	config.Root = "https://qbin.example.org"
+	doc := qbin.Document{ID: "cornflake-peddling-bp0q", Syntax: "go", Highlighted: `<span class="token keyword">package</span> main`}
+
+	req := httptest.NewRequest("POST", "/?include=highlighted", nil)
+	res := httptest.NewRecorder()
+	uploadResponse(res, req, &doc, false)
+	response := map[string]interface{}{}
+	if err := json.Unmarshal(res.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Response isn't valid JSON: %s", err)
+	}
+	if response["highlighted"] != doc.Highlighted || response["syntax"] != "go" || response["url"] != "https://qbin.example.org/cornflake-peddling-bp0q" {
+		t.Errorf("Wrong response with highlighted content: %v", response)
+	}
+
+	req = httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	res = httptest.NewRecorder()
+	uploadResponse(res, req, &doc, false)
+	response = map[string]interface{}{}
+	if err := json.Unmarshal(res.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Response isn't valid JSON: %s", err)
+	}
+	if _, ok := response["highlighted"]; ok || response["id"] != "cornflake-peddling-bp0q" {
+		t.Errorf("Wrong response without highlighted content: %v", response)
+	}
+}
+
+func TestUploadResponseFilesArray(t *testing.T) {
+	config.Root = "https://qbin.example.org"
+	defer func() { config.FilesArray = false }()
+	doc := qbin.Document{ID: "cornflake-peddling-bp0q", Syntax: "go", Highlighted: `<span class="token keyword">package</span> main`}
+
+	for _, filesArray := range []bool{false, true} {
+		config.FilesArray = filesArray
+		res := httptest.NewRecorder()
+		uploadResponse(res, httptest.NewRequest("POST", "/?include=highlighted", nil), &doc, false)
+		response := struct {
+			Syntax      string `json:"syntax"`
+			Highlighted string `json:"highlighted"`
+			Files       []struct {
+				Syntax      string `json:"syntax"`
+				Highlighted string `json:"highlighted"`
+			} `json:"files"`
+		}{}
+		if err := json.Unmarshal(res.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Response isn't valid JSON: %s", err)
+		}
+		if filesArray && (response.Syntax != "" || response.Highlighted != "" || len(response.Files) != 1 || response.Files[0].Syntax != "go" || response.Files[0].Highlighted != doc.Highlighted) {
+			t.Errorf("Wrong response with files array: %s", res.Body.String())
+		} else if !filesArray && (response.Syntax != "go" || response.Highlighted != doc.Highlighted || response.Files != nil) {
+			t.Errorf("Wrong flat response: %s", res.Body.String())
+		}
+	}
+}
+
+func TestUploadResponseFriendlyName(t *testing.T) {
+	config.Root = "https://qbin.example.org"
+	doc := qbin.Document{ID: "cornflake-peddling-bp0q", FriendlyName: "cornflake-peddling"}
+
+	for query, expected := range map[string]interface{}{"?include=friendlyName": "cornflake-peddling", "?include=highlighted": nil} {
+		res := httptest.NewRecorder()
+		uploadResponse(res, httptest.NewRequest("POST", "/"+query, nil), &doc, false)
+		response := map[string]interface{}{}
+		if err := json.Unmarshal(res.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Response isn't valid JSON: %s", err)
+		}
+		if response["friendlyName"] != expected {
+			t.Errorf("Wrong friendly name for %s: %v", query, response["friendlyName"])
+		}
+	}
+}
+
+func TestUploadResponseShortLinks(t *testing.T) {
+	config.Root = "https://qbin.example.org"
+	defer func() { config.ShortLinks = false }()
+	config.ShortLinks = true
+	doc := qbin.Document{ID: "cornflake-peddling-bp0q", Alias: 42}
+
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	res := httptest.NewRecorder()
+	uploadResponse(res, req, &doc, false)
+	response := map[string]interface{}{}
+	if err := json.Unmarshal(res.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Response isn't valid JSON: %s", err)
+	}
+	if response["url"] != "https://qbin.example.org/cornflake-peddling-bp0q" || response["shortUrl"] != "https://qbin.example.org/n/42" {
+		t.Errorf("Wrong URLs in response: %v", response)
+	}
+
+	req = httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("Prefer", "return=minimal")
+	res = httptest.NewRecorder()
+	uploadResponse(res, req, &doc, false)
+	if res.Header().Get("Location") != "https://qbin.example.org/cornflake-peddling-bp0q" || res.Header().Get("Link") != `<https://qbin.example.org/n/42>; rel="shortlink"` {
+		t.Errorf("Wrong headers in minimal response: Location: %s, Link: %s", res.Header().Get("Location"), res.Header().Get("Link"))
+	}
+
+	// Documents without an alias don't get a short link
+	res = httptest.NewRecorder()
+	uploadResponse(res, httptest.NewRequest("POST", "/?include=friendlyName", nil), &qbin.Document{ID: "cornflake-peddling-bp0q"}, false)
+	if res.Header().Get("Link") != "" || strings.Contains(res.Body.String(), "shortUrl") {
+		t.Errorf("Short link for a document without alias: %s", res.Body.String())
+	}
+}
+
+// stubCountries resolves the country of IP addresses from a map.
+type stubCountries map[string]string
+
+func (s stubCountries) Country(ip net.IP) (string, error) {
+	return s[ip.String()], nil
+}
+
+func TestBlockedCountry(t *testing.T) {
+	defer func() { qbin.GeoIP, qbin.BlockedCountries = nil, nil }()
+	qbin.GeoIP = stubCountries{"192.0.2.1": "XY", "192.0.2.2": "DE"}
+	qbin.BlockedCountries = []string{"XY"}
+
+	req := httptest.NewRequest("PUT", "/", bytes.NewBufferString("Hello World\n"))
+	req.RemoteAddr = "192.0.2.1:1234"
+	res := httptest.NewRecorder()
+	uploadRoute(res, req)
+	if res.Code != 451 {
+		t.Errorf("Upload from a blocked country returned %d (expected: 451)", res.Code)
+	}
+
+	// Empty documents are rejected after the country check
+	req = httptest.NewRequest("PUT", "/", bytes.NewBufferString(""))
+	req.RemoteAddr = "192.0.2.2:1234"
+	res = httptest.NewRecorder()
+	uploadRoute(res, req)
+	if res.Code != 400 {
+		t.Errorf("Upload from an allowed country returned %d (expected: 400 for the empty document)", res.Code)
+	}
+}
+
+func TestStoreError(t *testing.T) {
+	res := httptest.NewRecorder()
+	if !storeError(qbin.ErrInsufficientStorage, res, httptest.NewRequest("POST", "/", nil)) || res.Code != 507 {
+		t.Errorf("Full database returned %d (expected: 507)", res.Code)
+	}
+	res = httptest.NewRecorder()
+	if !storeError(qbin.ErrQuotaExceeded, res, httptest.NewRequest("POST", "/", nil)) || res.Code != 429 {
+		t.Errorf("Exceeded quota returned %d (expected: 429)", res.Code)
+	}
+	res = httptest.NewRecorder()
+	if storeError(nil, res, httptest.NewRequest("POST", "/", nil)) || res.Body.Len() != 0 {
+		t.Errorf("Response was written without an error: %d, %q", res.Code, res.Body.String())
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	defer func() {
+		config.ValidationErrors = false
+		delete(qbin.FilterEnable, "linkcount")
+	}()
+	qbin.FilterEnable["linkcount"] = true
+	spam := strings.Repeat("https://spam.example.org/buy-now ", 20)
+
+	upload := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/", strings.NewReader(spam))
+		req.Header.Set("S", "no-such-syntax")
+		req.Header.Set("C", "no-such-custom-value")
+		req.Header.Set("E", "soon")
+		req.Header.Set("Accept", "application/json")
+		res := httptest.NewRecorder()
+		uploadRoute(res, req)
+		return res
+	}
+
+	res := upload()
+	if res.Code != 400 || res.Body.String() != "Invalid syntax name.\n" {
+		t.Errorf("Wrong response with only the first problem: %d %q", res.Code, res.Body.String())
+	}
+
+	config.ValidationErrors = true
+	res = upload()
+	response := struct {
+		Error  string `json:"error"`
+		Errors []struct {
+			Field   string `json:"field"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}{}
+	if err := json.Unmarshal(res.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Response isn't valid JSON: %s", res.Body.String())
+	}
+	fields := []string{}
+	for _, problem := range response.Errors {
+		fields = append(fields, problem.Field)
+	}
+	if res.Code != 400 || response.Error != "Invalid syntax name." || strings.Join(fields, ",") != "syntax,custom,expiration,content" {
+		t.Errorf("Wrong response with all problems: %d %s", res.Code, res.Body.String())
+	}
+}
+
+func gzipped(content []byte) *bytes.Buffer {
+	body := &bytes.Buffer{}
+	w := gzip.NewWriter(body)
+	w.Write(content)
+	w.Close()
+	return body
+}
+
+func TestGzipBody(t *testing.T) {
+	req := httptest.NewRequest("PUT", "/", gzipped([]byte("Hello World\n")))
+	req.Header.Set("Content-Encoding", "gzip")
+	res := httptest.NewRecorder()
+	if !decodeBody(res, req) {
+		t.Fatalf("Valid gzip body was rejected: %d", res.Code)
+	}
+	content, err := ioutil.ReadAll(req.Body)
+	if err != nil || string(content) != "Hello World\n" {
+		t.Errorf("Gzip body wasn't decompressed: %q (error: %v)", content, err)
+	}
+
+	// 10 MB of zeros compress to about 10 KB
+	bomb := gzipped(make([]byte, 10*1024*1024))
+	if bomb.Len() > qbin.MaxFilesize {
+		t.Fatalf("Decompression bomb is too large for the test: %d bytes", bomb.Len())
+	}
+	req = httptest.NewRequest("PUT", "/", bomb)
+	req.Header.Set("Content-Encoding", "gzip")
+	res = httptest.NewRecorder()
+	uploadRoute(res, req)
+	if res.Code != 413 {
+		t.Errorf("Decompression bomb returned %d (expected: 413)", res.Code)
+	}
+
+	req = httptest.NewRequest("PUT", "/", bytes.NewBufferString("not gzipped"))
+	req.Header.Set("Content-Encoding", "gzip")
+	res = httptest.NewRecorder()
+	uploadRoute(res, req)
+	if res.Code != 400 {
+		t.Errorf("Invalid gzip body returned %d (expected: 400)", res.Code)
+	}
+
+	truncated := gzipped([]byte(strings.Repeat("Hello World\n", 1000)))
+	req = httptest.NewRequest("PUT", "/", bytes.NewReader(truncated.Bytes()[:truncated.Len()/2]))
+	req.Header.Set("Content-Encoding", "gzip")
+	res = httptest.NewRecorder()
+	uploadRoute(res, req)
+	if res.Code != 400 {
+		t.Errorf("Truncated gzip body returned %d (expected: 400)", res.Code)
+	}
+
+	req = httptest.NewRequest("PUT", "/", bytes.NewBufferString("Hello World\n"))
+	req.Header.Set("Content-Encoding", "br")
+	res = httptest.NewRecorder()
+	uploadRoute(res, req)
+	if res.Code != 415 {
+		t.Errorf("Unsupported encoding returned %d (expected: 415)", res.Code)
+	}
+}
+
+func TestURLSyntax(t *testing.T) {
+	defer func() { config.URLSyntax = false }()
+	dir, err := ioutil.TempDir("", "qbin-frontend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, file := range []string{"index.html", "guidelines.html", "output.html", "report.html"} {
+		ioutil.WriteFile(filepath.Join(dir, file), []byte("$$content$$"), 0644)
+	}
+	config.FrontendPath = dir
+
+	// Without the option, POST /<name>.<ext> isn't an upload
+	r := mux.NewRouter()
+	setupRoutes(r)
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("POST", "/notes.md", bytes.NewBufferString("")))
+	if res.Code != 405 {
+		t.Errorf("POST to an extension-bearing URL returned %d without the option (expected: 405)", res.Code)
+	}
+	if syntax := uploadSyntaxHint(httptest.NewRequest("PUT", "/notes.md", nil), "text/plain"); syntax != "" {
+		t.Errorf("Syntax %q was inferred from the URL without the option", syntax)
+	}
+
+	config.URLSyntax = true
+	r = mux.NewRouter()
+	setupRoutes(r)
+	res = httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("POST", "/notes.md", bytes.NewBufferString("")))
+	if res.Code != 400 || res.Body.String() != "The document can't be empty.\n" {
+		t.Errorf("POST to an extension-bearing URL wasn't handled as an upload: %d %q", res.Code, res.Body.String())
+	}
+
+	// prism-server isn't available in the tests, so markdown is the only syntax that exists
+	tests := []struct {
+		path, documentType, expected string
+	}{
+		{"/notes.md", "", "markdown!"},
+		{"/raw.MD", "text/plain", "markdown!"},
+		{"/raw.txt", "text/markdown", "markdown!"},
+		{"/raw.py", "", ""},
+		{"/", "", ""},
+	}
+	for _, test := range tests {
+		if syntax := uploadSyntaxHint(httptest.NewRequest("POST", test.path, nil), test.documentType); syntax != test.expected {
+			t.Errorf("Inferred %q instead of %q for %s (%s)", syntax, test.expected, test.path, test.documentType)
+		}
+	}
+}
+
+func TestUploadResponseSyntaxCandidates(t *testing.T) {
+	config.Root = "https://qbin.example.org"
+	doc := qbin.Document{ID: "cornflake-peddling-bp0q", Syntax: "go", SyntaxCandidates: []qbin.SyntaxCandidate{{Syntax: "go", Score: 4}, {Syntax: "python", Score: 2}}}
+
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	res := httptest.NewRecorder()
+	uploadResponse(res, req, &doc, false)
+	if !strings.Contains(res.Body.String(), `"syntaxCandidates":[{"syntax":"go","score":4},{"syntax":"python","score":2}]`) {
+		t.Errorf("Syntax candidates are missing in the response: %s", res.Body.String())
+	}
+
+	doc.SyntaxCandidates = nil
+	res = httptest.NewRecorder()
+	uploadResponse(res, req, &doc, false)
+	if strings.Contains(res.Body.String(), "syntaxCandidates") {
+		t.Errorf("Response contains syntax candidates without detection: %s", res.Body.String())
+	}
+}
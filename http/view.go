@@ -0,0 +1,76 @@
+package qbinHTTP
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/qbin-io/backend"
+)
+
+// unsafeFilenameCharacters matches everything that shouldn't end up in a Content-Disposition filename.
+var unsafeFilenameCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// sanitizeFilename replaces all characters except letters, digits, dots, underscores and dashes, and removes leading dots.
+func sanitizeFilename(name string) string {
+	name = strings.TrimLeft(unsafeFilenameCharacters.ReplaceAllString(name, "_"), ".")
+	if name == "" {
+		return "document"
+	}
+	return name
+}
+
+// viewTypes are the MIME types viewRoute serves documents with by their extension. Formats that can contain scripts or
+// styles (HTML, SVG, XML, JavaScript, CSS) are deliberately missing, like everything else they're served as plain text.
+var viewTypes = map[string]string{
+	"txt":      "text/plain; charset=utf-8",
+	"log":      "text/plain; charset=utf-8",
+	"md":       "text/markdown; charset=utf-8",
+	"markdown": "text/markdown; charset=utf-8",
+	"csv":      "text/csv; charset=utf-8",
+	"tsv":      "text/tab-separated-values; charset=utf-8",
+	"json":     "application/json; charset=utf-8",
+	"png":      "image/png",
+	"gif":      "image/gif",
+	"jpg":      "image/jpeg",
+	"jpeg":     "image/jpeg",
+	"webp":     "image/webp",
+	"avif":     "image/avif",
+}
+
+// viewType returns the MIME type a document is served with by viewRoute.
+func viewType(ext string) string {
+	if mediaType, ok := viewTypes[strings.ToLower(ext)]; ok {
+		return mediaType
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// viewRoute serves the raw content of a document inline with a filename and the MIME type of the extension in the path
+// (/<document>/view.<ext>), so browsers display it with context. Scripts are always blocked using a sandbox.
+func viewRoute(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	doc, err := qbin.Request(vars["document"], true)
+	recordTiming(req, doc.Timing)
+	if err != nil {
+		documentErrorRoute(res, req, err)
+		return
+	}
+
+	serveInline(res, req, &doc, vars["ext"])
+}
+
+// serveInline sends the raw content of a document for viewRoute.
+func serveInline(res http.ResponseWriter, req *http.Request, doc *qbin.Document, ext string) {
+	setExpirationHeaders(res, doc)
+	if contentETag(res, req, doc) {
+		return
+	}
+	res.Header().Set("Content-Type", viewType(ext))
+	res.Header().Set("Content-Disposition", `inline; filename="`+sanitizeFilename(doc.ID+"."+ext)+`"`)
+	res.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox")
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	fmt.Fprintf(res, "%s", doc.Content)
+}
@@ -0,0 +1,50 @@
+package qbinHTTP
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/qbin-io/backend"
+)
+
+func TestServeInline(t *testing.T) {
+	doc := qbin.Document{ID: "cornflake-peddling-bp0q", Content: `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`}
+	for ext, contentType := range map[string]string{
+		"svg":  "text/plain; charset=utf-8",
+		"txt":  "text/plain; charset=utf-8",
+		"html": "text/plain; charset=utf-8",
+		"js":   "text/plain; charset=utf-8",
+		"css":  "text/plain; charset=utf-8",
+		"xml":  "text/plain; charset=utf-8",
+		"xyz":  "text/plain; charset=utf-8",
+		"CSV":  "text/csv; charset=utf-8",
+		"png":  "image/png",
+	} {
+		res := httptest.NewRecorder()
+		serveInline(res, httptest.NewRequest("GET", "/"+doc.ID+"/view."+ext, nil), &doc, ext)
+		if res.Header().Get("Content-Type") != contentType {
+			t.Errorf("Wrong content type for .%s: %s", ext, res.Header().Get("Content-Type"))
+		}
+		if disposition := res.Header().Get("Content-Disposition"); disposition != `inline; filename="cornflake-peddling-bp0q.`+ext+`"` {
+			t.Errorf("Wrong disposition for .%s: %s", ext, disposition)
+		}
+		if !strings.Contains(res.Header().Get("Content-Security-Policy"), "sandbox") || res.Body.String() != doc.Content {
+			t.Errorf("Document wasn't served in a sandbox: %v", res.Header())
+		}
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	for name, expected := range map[string]string{
+		"cornflake-peddling-bp0q.svg": "cornflake-peddling-bp0q.svg",
+		`a"; filename="evil.html`:     "a_filename_evil.html",
+		"../../etc/passwd":            "_.._etc_passwd",
+		"Grüße\r\n.txt":               "Gr_e_.txt",
+		"...":                         "document",
+	} {
+		if result := sanitizeFilename(name); result != expected {
+			t.Errorf("Wrong filename for %q: %q (expected: %q)", name, result, expected)
+		}
+	}
+}
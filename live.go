@@ -0,0 +1,78 @@
+package qbin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+// MaxLiveViewers limits the number of concurrent SubscribeViews() subscriptions per document.
+var MaxLiveViewers = 10
+
+// MaxLiveConnections limits the number of concurrent SubscribeViews() subscriptions of all documents together, as every
+// subscription keeps a connection open. 0 disables the limit.
+var MaxLiveConnections = 1000
+
+// ErrTooManyViewers is returned by SubscribeViews() if a document already has MaxLiveViewers subscriptions.
+var ErrTooManyViewers = errors.New("too many live viewers for this document")
+
+// ErrTooManyLiveConnections is returned by SubscribeViews() if there are already MaxLiveConnections subscriptions.
+var ErrTooManyLiveConnections = errors.New("too many live connections")
+
+var viewSubscribers = struct {
+	sync.Mutex
+	channels map[string]map[chan int]bool
+	total    int
+}{channels: map[string]map[chan int]bool{}}
+
+// SubscribeViews returns a channel receiving the view count of a document whenever it's viewed, and a function that must
+// be called to end the subscription. Slow receivers only get the latest view count.
+func SubscribeViews(id string) (<-chan int, func(), error) {
+	hash := sha256.Sum256([]byte(id))
+	databaseID := hex.EncodeToString(hash[:])
+
+	viewSubscribers.Lock()
+	defer viewSubscribers.Unlock()
+	subscribers := viewSubscribers.channels[databaseID]
+	if MaxLiveConnections > 0 && viewSubscribers.total >= MaxLiveConnections {
+		return nil, nil, ErrTooManyLiveConnections
+	}
+	if len(subscribers) >= MaxLiveViewers {
+		return nil, nil, ErrTooManyViewers
+	}
+	if subscribers == nil {
+		subscribers = map[chan int]bool{}
+		viewSubscribers.channels[databaseID] = subscribers
+	}
+	channel := make(chan int, 1)
+	subscribers[channel] = true
+	viewSubscribers.total++
+
+	once := sync.Once{}
+	return channel, func() {
+		once.Do(func() {
+			viewSubscribers.Lock()
+			defer viewSubscribers.Unlock()
+			delete(subscribers, channel)
+			viewSubscribers.total--
+			if len(subscribers) == 0 {
+				delete(viewSubscribers.channels, databaseID)
+			}
+		})
+	}, nil
+}
+
+// publishViews sends the new view count of a document (by its database ID) to all subscribers.
+func publishViews(databaseID string, views int) {
+	viewSubscribers.Lock()
+	defer viewSubscribers.Unlock()
+	for channel := range viewSubscribers.channels[databaseID] {
+		// Replace a view count the subscriber hasn't received yet
+		select {
+		case <-channel:
+		default:
+		}
+		channel <- views
+	}
+}
@@ -0,0 +1,86 @@
+package qbin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscribeViews(t *testing.T) {
+	defer func(count bool) { CountViews = count }(CountViews)
+	CountViews = true
+	storedDocumentsDB("subscribe-views")
+
+	doc := Document{Content: "watched"}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	views, cancel, err := SubscribeViews(doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	if _, err := Request(doc.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-views:
+		if n != 1 {
+			t.Errorf("Wrong view count: %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No view count was published")
+	}
+}
+
+func TestMaxLiveViewers(t *testing.T) {
+	defer func() { MaxLiveViewers = 10 }()
+	MaxLiveViewers = 2
+
+	_, cancel1, err1 := SubscribeViews("cornflake-peddling-bp0q")
+	_, cancel2, err2 := SubscribeViews("cornflake-peddling-bp0q")
+	if err1 != nil || err2 != nil {
+		t.Fatalf("Couldn't subscribe: %v, %v", err1, err2)
+	}
+	if _, _, err := SubscribeViews("cornflake-peddling-bp0q"); err != ErrTooManyViewers {
+		t.Errorf("Subscription above the limit was accepted: %v", err)
+	}
+	if _, cancel, err := SubscribeViews("other-document-bp0q"); err != nil {
+		t.Errorf("Limit applies to other documents: %v", err)
+	} else {
+		cancel()
+	}
+
+	cancel1()
+	cancel1()
+	_, cancel3, err := SubscribeViews("cornflake-peddling-bp0q")
+	if err != nil {
+		t.Errorf("Couldn't subscribe after cancelling: %v", err)
+	}
+	cancel2()
+	cancel3()
+	if len(viewSubscribers.channels) != 0 || viewSubscribers.total != 0 {
+		t.Errorf("Subscriptions weren't cleaned up: %v (total: %d)", viewSubscribers.channels, viewSubscribers.total)
+	}
+}
+
+func TestMaxLiveConnections(t *testing.T) {
+	defer func() { MaxLiveConnections = 1000 }()
+	MaxLiveConnections = 2
+
+	_, cancel1, err1 := SubscribeViews("cornflake-peddling-bp0q")
+	_, cancel2, err2 := SubscribeViews("other-document-bp0q")
+	if err1 != nil || err2 != nil {
+		t.Fatalf("Couldn't subscribe: %v, %v", err1, err2)
+	}
+	if _, _, err := SubscribeViews("third-document-bp0q"); err != ErrTooManyLiveConnections {
+		t.Errorf("Subscription above the global limit was accepted: %v", err)
+	}
+	cancel1()
+	_, cancel3, err := SubscribeViews("third-document-bp0q")
+	if err != nil {
+		t.Errorf("Couldn't subscribe after cancelling: %v", err)
+	}
+	cancel2()
+	cancel3()
+}
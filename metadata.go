@@ -0,0 +1,114 @@
+package qbin
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// SnippetLines and SnippetLength limit the snippet returned by Metadata() to the first non-empty lines and characters of a document.
+// SnippetLines = 0 disables snippets.
+var SnippetLines = 5
+var SnippetLength = 300
+
+// snippetCacheSize limits the memory (in bytes) used by cached snippets, so the key derivation doesn't have to run for every metadata request.
+const snippetCacheSize = 1024 * 1024
+
+var snippetCache = &documentCache{}
+
+// DocumentMetadata describes a document without its content, for listings and link previews.
+type DocumentMetadata struct {
+	ID         string     `json:"id"`
+	Syntax     string     `json:"syntax"`
+	Upload     time.Time  `json:"upload"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+	Views      int        `json:"views"`
+	Custom     string     `json:"custom,omitempty"`
+	// State is one of StateLive and StateVolatile
+	State string `json:"state"`
+	// Snippet contains the first lines of the plain text content, limited by SnippetLines and SnippetLength.
+	// It's empty for volatile and client-side encrypted documents.
+	Snippet string `json:"snippet,omitempty"`
+}
+
+// Metadata returns the metadata of a document. Unlike Request(), it doesn't count a view, so volatile documents aren't consumed.
+func Metadata(id string) (DocumentMetadata, error) {
+	meta := DocumentMetadata{ID: id}
+	var content string
+	var upload, expiration, rawString, pending, integrity sql.NullString
+	var encryption, version int
+	databaseID := sha256.Sum256([]byte(id))
+	err := readDocumentRow(hex.EncodeToString(databaseID[:]), "SELECT content, custom, syntax, upload, expiration, views, raw, pending, encryption, key_version, integrity FROM documents WHERE id = ?",
+		&content, &meta.Custom, &meta.Syntax, &upload, &expiration, &meta.Views, &rawString, &pending, &encryption, &version, &integrity)
+	if err == nil && pending.Valid {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		return DocumentMetadata{}, err
+	}
+
+	meta.Upload, err = parseUpload(upload)
+	if err != nil {
+		return DocumentMetadata{}, err
+	}
+	meta.State = StateLive
+	if expiration.Valid {
+		t, err := time.Parse("2006-01-02 15:04:05", expiration.String)
+		if err != nil {
+			return DocumentMetadata{}, err
+		}
+		meta.State = DocumentState(t)
+		if meta.State == StateExpired {
+			return DocumentMetadata{}, ErrExpired
+		} else if meta.State != StateVolatile {
+			meta.Expiration = &t
+		}
+	}
+
+	// The snippet would reveal volatile documents without consuming them
+	if meta.State == StateVolatile || meta.Custom == "encrypted" || SnippetLines <= 0 {
+		return meta, nil
+	}
+
+	snippet, ok := snippetCache.get(hex.EncodeToString(databaseID[:]))
+	if !ok {
+		key, err := documentKey(encryption, version, id, meta.Upload)
+		if err != nil {
+			return DocumentMetadata{}, err
+		}
+		text, _, err := decryptContent(hex.EncodeToString(databaseID[:]), key, storedContent{content, rawString, integrity}, true)
+		if err != nil {
+			return DocumentMetadata{}, err
+		}
+		snippet = makeSnippet(text)
+
+		var expiration time.Time
+		if meta.Expiration != nil {
+			expiration = *meta.Expiration
+		}
+		snippetCache.put(hex.EncodeToString(databaseID[:]), snippet, expiration, snippetCacheSize)
+	}
+	meta.Snippet = snippet
+	return meta, nil
+}
+
+// makeSnippet returns the first SnippetLines non-empty lines of the content, cut off after SnippetLength characters.
+func makeSnippet(content string) string {
+	lines := []string{}
+	for _, line := range strings.Split(content, "\n") {
+		if len(lines) >= SnippetLines {
+			break
+		}
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, strings.TrimRight(line, " \t\r"))
+		}
+	}
+	snippet := strings.Join(lines, "\n")
+	if utf8.RuneCountInString(snippet) > SnippetLength {
+		snippet = string([]rune(snippet)[:SnippetLength])
+	}
+	return snippet
+}
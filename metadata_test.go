@@ -0,0 +1,63 @@
+package qbin
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestMakeSnippet(t *testing.T) {
+	defer func() { SnippetLines, SnippetLength = 5, 300 }()
+	SnippetLines, SnippetLength = 3, 20
+
+	tests := map[string]string{
+		"\n\nfirst\n\n  \nsecond  \nthird\nfourth\n": "first\nsecond\nthird",
+		"a very long first line that goes on":        "a very long first li",
+		"äöü\nß€\n😀😀😀😀😀😀😀😀😀😀😀😀":                      "äöü\nß€\n😀😀😀😀😀😀😀😀😀😀😀😀",
+		"": "",
+	}
+	for content, expected := range tests {
+		snippet := makeSnippet(content)
+		if snippet != expected {
+			t.Errorf("Snippet of %q is %q (expected: %q)", content, snippet, expected)
+		}
+		if utf8.RuneCountInString(snippet) > SnippetLength || strings.Count(snippet, "\n") >= SnippetLines || !utf8.ValidString(snippet) {
+			t.Errorf("Snippet %q exceeds the limits", snippet)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	storedDocumentsDB("metadata")
+	defer func() { SnippetLines = 5 }()
+	SnippetLines = 2
+
+	doc := Document{Content: "Hello\n\n  World\nand more\n", Syntax: "none", Expiration: time.Now().Add(time.Hour)}
+	volatile := Document{Content: "secret", Syntax: "none", Expiration: time.Unix(0, 0)}
+	for _, d := range []*Document{&doc, &volatile} {
+		if err := Store(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	meta, err := Metadata(doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Snippet != "Hello\n  World" || meta.State != StateLive || meta.Expiration == nil {
+		t.Errorf("Wrong metadata: %+v", meta)
+	}
+	// The snippet is cached
+	if cached, err := Metadata(doc.ID); err != nil || cached.Snippet != meta.Snippet {
+		t.Errorf("Cached snippet is %q (error: %v)", cached.Snippet, err)
+	}
+
+	meta, err = Metadata(volatile.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Snippet != "" || meta.State != StateVolatile {
+		t.Errorf("Volatile document was revealed: %+v", meta)
+	}
+}
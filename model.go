@@ -6,14 +6,94 @@ import (
 	"errors"
 	"strings"
 	"time"
+	"unicode/utf8"
 
-	"golang.org/x/crypto/scrypt"
-
+	"crypto/hmac"
 	"crypto/sha256"
 )
 
 const MaxFilesize = 1024 * 1024 // 1MB
 
+// StoreOriginal defines if the original content is always stored (encrypted) next to the highlighted content.
+// This makes raw output exact and allows highlighting again later, but roughly doubles the required storage.
+// If disabled, the original content is only stored when it can't be recovered from the highlighted content (e.g. for Markdown).
+var StoreOriginal = false
+
+// StrictContent disables trimming of leading and trailing new lines, so the stored content matches the uploaded content exactly.
+// Combine it with StoreOriginal to get byte-exact raw output.
+var StrictContent = false
+
+// NormalizeLineEndings defines if CRLF and CR line endings are converted to LF.
+var NormalizeLineEndings = true
+
+// NormalizeUnicode converts the content to Unicode normalization form C, so canonically equivalent content (e.g. "é" as one
+// code point or as "e" with a combining accent) is stored, hashed and highlighted the same way.
+var NormalizeUnicode = false
+
+// MaxNonPrintableRatio rejects documents where the share of non-printable characters (control characters other than whitespace, and invalid UTF-8) exceeds it.
+// 0 disables the check.
+var MaxNonPrintableRatio = 0.0
+
+// IntegrityCheck stores a hash of the content with new documents, which is verified after decryption to detect corrupted documents instead of serving garbage.
+// Documents stored with a hash are always verified.
+var IntegrityCheck = false
+
+// CustomValues are the allowed values for Document.Custom. Documents with a custom value aren't highlighted, but escaped and
+// left to the frontend, e.g. "encrypted" for documents that are encrypted in the browser.
+var CustomValues = []string{"encrypted"}
+
+// ContentETags stores the content hash (see Document.ContentHash) with new documents. It's served as ETag of the raw document,
+// and allows clients to skip uploading content that already exists (see ContentExists). The hash is stored unencrypted and
+// keyed with ContentHashKey, which is required, so nobody without the key can check if a document with a given content exists.
+var ContentETags = false
+
+// ContentHashKey is the secret key of the content hashes (see Document.ContentHash). The hashes can only be exposed with
+// ContentETags if it's set; without ContentETags, they're only used in memory (e.g. to recognize repeated spam).
+var ContentHashKey []byte
+
+// OriginalOnly stores only the original content of new documents instead of the highlighted HTML, and highlights them again
+// when they are requested. This roughly halves the storage compared to StoreOriginal, at the cost of running the highlighter on
+// every request that misses the cache (see HighlightCacheSize). Documents stored with and without it can be mixed.
+var OriginalOnly = false
+
+// HighlightMaxLines defines the number of lines above which documents are stored without highlighting, to keep huge logs from slowing down the highlighter.
+// The highlighting can be loaded later using HighlightSkipped(). 0 disables the limit.
+var HighlightMaxLines = 0
+
+// CountViews defines if Request() increments the view counter. If disabled, requesting a document doesn't write to the database,
+// except for volatile documents, which must still be deleted after being viewed.
+var CountViews = true
+
+// ErrExpired is returned by Request() if the document's expiration date has passed.
+var ErrExpired = errors.New("the document has expired")
+
+// ErrGone is returned by Request() if a volatile document has already been viewed by somebody else.
+var ErrGone = errors.New("the document has already been viewed")
+
+// ErrNotSkipped is returned by HighlightSkipped() if the document has already been highlighted.
+var ErrNotSkipped = errors.New("the document has already been highlighted")
+
+// ErrTooLarge is returned by Store() if the content exceeds MaxFilesize.
+var ErrTooLarge = errors.New("the document exceeds the maximum size")
+
+// ErrBinaryContent is returned by Store() if the content contains NUL bytes.
+var ErrBinaryContent = errors.New("file contains 0x00 bytes")
+
+// ErrNonPrintableContent is returned by Store() if the content consists of too many non-printable characters, see MaxNonPrintableRatio.
+var ErrNonPrintableContent = errors.New("file contains too many non-printable characters")
+
+// ErrCorrupted is returned by Request() if a document fails the integrity check, see IntegrityCheck.
+var ErrCorrupted = errors.New("the document is corrupted")
+
+// ErrInvalidCustom is returned by Store() if the custom value isn't one of CustomValues.
+var ErrInvalidCustom = errors.New("unknown custom value")
+
+// ErrInvalidParent is returned by Store() if the parent document doesn't exist.
+var ErrInvalidParent = errors.New("the parent document doesn't exist")
+
+// ErrInvalidUpload is returned if a stored document has no valid upload time, which is required to decrypt it.
+var ErrInvalidUpload = errors.New("the document has no valid upload time")
+
 // Document specifies the content and metadata of a piece of code that is hosted on qbin.
 type Document struct {
 	// ID is set on Store()
@@ -24,68 +104,204 @@ type Document struct {
 	Upload     time.Time
 	Expiration time.Time
 	Views      int
-	Custom     string
+	// Custom marks documents that are rendered by the frontend instead of being highlighted, see CustomValues.
+	Custom string
+	// Parent is the ID of the document this one was forked from, see ForkDiff(). It's only stored encrypted, as it grants access to the parent.
+	Parent string
+	// FriendlyName is set on Store() and contains the words of the generated ID, see SplitName().
+	FriendlyName string
+	// Collection is an optional secret token grouping documents, see ListCollection(). It requires Collections.
+	Collection string
+	// Notify is an optional URL that receives a webhook before the document expires, see NotifyBefore.
+	Notify string
+	// Fingerprint identifies the creator for abuse investigations, see Fingerprint().
+	Fingerprint string
+	// ConfirmationToken is set on Store() if RequireConfirmation is enabled, and must be passed to Confirm() to publish the document.
+	ConfirmationToken string
+	// Alias is set on Store() if NumericAliases is enabled.
+	Alias int64
+	// HighlightSkipped is set on Store() and Request() if the document was stored without highlighting because of HighlightMaxLines.
+	HighlightSkipped bool
+	// ContentHash is set on Store() and identifies the (normalized) content, so clients can detect if they already uploaded it.
+	// It's set on Request() if the document was stored with ContentETags.
+	ContentHash string
+	// Encryption is the encryption strategy, and is set on Store() and Request().
+	Encryption int
+	// Unencrypted stores the document without server-side encryption (EncryptionNone), which requires AllowUnencrypted.
+	// It's set on Request().
+	Unencrypted bool
+	// KeyVersion is the version of the scrypt parameters in ScryptVersions for EncryptionScrypt, and is set on Store() and Request().
+	KeyVersion int
+	// SyntaxCandidates is set on Store() if the syntax was detected and SyntaxCandidates is enabled, and contains the
+	// syntaxes matching the content, best first.
+	SyntaxCandidates []SyntaxCandidate
+	// Highlighted is set on Store() and contains the highlighted HTML as it is stored in the database.
+	Highlighted string
+	// Timing is set on Store() and Request() and tells where the time was spent.
+	Timing Timing
+	// spamChecked is the content hash of the content that passed the spam filters in Validate(), so Store() doesn't run them again.
+	spamChecked string
+}
+
+// Timing contains the time spent on the expensive parts of storing or requesting a document.
+type Timing struct {
+	Scrypt    time.Duration
+	Highlight time.Duration
+	Database  time.Duration
+}
+
+// since adds the time passed since start to a duration, for use like: defer since(&timing.Database, time.Now())
+func since(duration *time.Duration, start time.Time) {
+	*duration += time.Since(start)
 }
 
 // Store a document object in the database.
 func Store(document *Document) error {
-	// Generate a name that doesn't exist yet
-	name, err := GenerateSafeName()
-	if err != nil {
+	if err := ValidateCustom(document.Custom); err != nil {
 		return err
 	}
-	document.ID = name
+	if document.Unencrypted && !AllowUnencrypted {
+		return ErrUnencryptedNotAllowed
+	}
+	if err := ValidateCollection(document.Collection); err != nil {
+		return err
+	}
+	if len(document.Content) > MaxFilesize {
+		return ErrTooLarge
+	}
 
+	// Cheap checks come first, so rejected content never reaches the database, the highlighter or the key derivation
+	var err error
 	// Round the timestamps on the object. Won't affect the database, but we want consistency.
 	document.Upload = time.Now().Round(time.Second)
 	document.Expiration = document.Expiration.Round(time.Second)
+	document.Content, err = normalizeContent(document.Content, document.Syntax == "ansi")
+	if err != nil {
+		return err
+	}
+	if SyntaxMarker && document.Syntax == "" {
+		if syntax, content := syntaxFromMarker(document.Content); syntax != "" {
+			document.Syntax, document.Content = syntax, content
+		}
+	}
+	document.ContentHash = contentHash(document.Content)
+	if err := spamCheck(document); err != nil {
+		return err
+	}
+	if err := checkBlockedSyntax(document.Content); err != nil {
+		Log.Warningf("Blocked syntax detected for document")
+		return err
+	}
+	if err := checkCapacity(); err != nil {
+		return err
+	}
+	if err := checkFingerprintQuota(document.Fingerprint, len(document.Content)); err != nil {
+		return err
+	}
 
-	// Normalize new lines
-	document.Content = strings.Trim(strings.Replace(strings.Replace(document.Content, "\r\n", "\n", -1), "\r", "\n", -1), "\n") + "\n"
+	if document.Parent != "" {
+		exists, err := Exists(document.Parent)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrInvalidParent
+		}
+	}
 
-	// Don't accept binary files
-	if strings.Contains(document.Content, "\x00") {
-		return errors.New("file contains 0x00 bytes")
+	// Generate a name that doesn't exist yet
+	start := time.Now()
+	name, err := GenerateSafeName()
+	since(&document.Timing.Database, start)
+	if err != nil {
+		return err
 	}
+	document.ID = name
+	document.FriendlyName, _ = SplitName(name)
 
     contentHighlighted := ""
     originalRequired := false
+	highlighted := false
+	// The syntax of the document after detection and defaults, which isn't always stored (see PersistDetectedSyntax)
+	syntax := document.Syntax
 	if document.Custom == "" {
-		if document.Syntax == "none" {
+		if syntax == "" && SyntaxDetection {
+			syntax = DetectSyntax(document.Content)
+			if SyntaxCandidates > 0 {
+				document.SyntaxCandidates = RankSyntaxes(document.Content, SyntaxCandidates)
+			}
+			if PersistDetectedSyntax || OriginalOnly {
+				// OriginalOnly requires the syntax to highlight the document on read
+				document.Syntax = syntax
+			}
+		}
+		if syntax == "" {
+			syntax = DefaultSyntax
+			document.Syntax = DefaultSyntax
+		} else if syntax == "none" {
+			syntax = ""
 			document.Syntax = ""
 		}
-		contentHighlighted, originalRequired, err = Highlight(document.Content, document.Syntax)
-		if err != nil {
-			Log.Warningf("Skipped syntax highlighting for the following reason: %s", err)
+		if syntax != "" && HighlightMaxLines > 0 && strings.Count(document.Content, "\n") > HighlightMaxLines {
+			// The original content is required to highlight the document later
+			document.HighlightSkipped = true
+			contentHighlighted = EscapeHTML(document.Content)
+			originalRequired = true
+		} else if syntax != "" && !highlightBudgetAvailable() {
+			skipHighlightBudget()
+			document.HighlightSkipped = true
+			contentHighlighted = EscapeHTML(document.Content)
+			originalRequired = true
+		} else {
+			start = time.Now()
+			contentHighlighted, originalRequired, err = Highlight(document.Content, syntax)
+			since(&document.Timing.Highlight, start)
+			spendHighlightBudget(time.Since(start))
+			if err != nil {
+				Log.Warningf("Skipped syntax highlighting for the following reason: %s", err)
+			}
+			highlighted = err == nil
 		}
 	} else {
 		contentHighlighted = EscapeHTML(document.Content)
 	}
 
-	// Filter content for spam
-	err = FilterSpam(document, &contentHighlighted)
-	if err != nil {
-		Log.Warningf("Spam filter hit for document: %s", err)
-		return errors.New("spam: " + err.Error())
-	}
+	document.Highlighted = contentHighlighted
 
-	var expiration interface{}
+	clampExpiration(document, syntax)
+	expiration := sql.NullString{}
 	if (document.Expiration != time.Time{}) {
-		expiration = document.Expiration.UTC().Format("2006-01-02 15:04:05")
+		expiration = sql.NullString{String: document.Expiration.UTC().Format("2006-01-02 15:04:05"), Valid: true}
 	}
 
 	// Server-Side Encryption
-	key, err := scrypt.Key([]byte(document.ID), []byte(document.Upload.UTC().Format("2006-01-02 15:04:05")), 16384, 8, 1, 24)
-	if err != nil {
-		Log.Errorf("Invalid script parameters: %s", err)
+	document.Encryption, document.KeyVersion = encryptionStrategy()
+	if document.Unencrypted {
+		document.Encryption, document.KeyVersion = EncryptionNone, 0
 	}
-	data, err := encrypt([]byte(contentHighlighted), key)
+	start = time.Now()
+	key, err := documentKey(document.Encryption, document.KeyVersion, document.ID, document.Upload)
+	since(&document.Timing.Scrypt, start)
 	if err != nil {
-		Log.Errorf("AES error: %s", err)
 		return err
-    }
+	}
+	// Without highlighting, there's nothing that could be generated on read
+	originalOnly := OriginalOnly && document.Custom == "" && !document.HighlightSkipped
+	var data []byte
+	var integrity sql.NullString
+	if originalOnly {
+		// The content stays empty, and the integrity hash covers the original content
+		integrity = integrityValue([]byte(document.Content), key)
+	} else {
+		data, err = encrypt([]byte(contentHighlighted), key)
+		if err != nil {
+			Log.Errorf("AES error: %s", err)
+			return err
+		}
+		integrity = integrityValue([]byte(contentHighlighted), key)
+	}
     rawData := sql.NullString{}
-    if originalRequired {
+    if originalRequired || StoreOriginal || originalOnly {
         s, err := encrypt([]byte(document.Content), key)
         if err != nil {
             Log.Errorf("AES error: %s", err)
@@ -96,21 +312,102 @@ func Store(document *Document) error {
             Valid: true,
        }
     }
+	parent := sql.NullString{}
+	if document.Parent != "" {
+		s, err := encrypt([]byte(document.Parent), key)
+		if err != nil {
+			Log.Errorf("AES error: %s", err)
+			return err
+		}
+		parent = sql.NullString{
+			String: string(s),
+			Valid:  true,
+		}
+	}
+	notify := sql.NullString{}
+	if document.Notify != "" && NotifyBefore > 0 {
+		notify = sql.NullString{
+			String: document.Notify,
+			Valid:  true,
+		}
+	}
+	pending := sql.NullString{}
+	if RequireConfirmation {
+		document.ConfirmationToken, pending.String, err = generateConfirmationToken()
+		if err != nil {
+			return err
+		}
+		pending.Valid = true
+	}
+	fingerprint := sql.NullString{String: document.Fingerprint, Valid: document.Fingerprint != ""}
+	storedHash := sql.NullString{String: document.ContentHash, Valid: ContentETags}
+	collection, collectionEntry, err := collectionValues(document.Collection, document.ID)
+	if err != nil {
+		Log.Errorf("AES error: %s", err)
+		return err
+	}
 	databaseID := sha256.Sum256([]byte(document.ID))
 
 	// Write the document to the database
-	_, err = db.Exec(
-		"INSERT INTO documents (id, content, custom, syntax, upload, expiration, views, raw) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+	ctx, cancel := queryContext()
+	defer cancel()
+	defer since(&document.Timing.Database, time.Now())
+	handle := shardDB(hex.EncodeToString(databaseID[:]))
+	var tx *sql.Tx
+	if HashChain || NumericAliases {
+		// The document is only stored together with its chain entry and its alias
+		tx, err = handle.BeginTx(ctx, nil)
+		if err != nil {
+			return timeoutError(err)
+		}
+		defer tx.Rollback()
+	}
+	result, err := execTx(ctx, handle, tx,
+		"INSERT INTO documents (id, content, custom, syntax, upload, expiration, views, raw, notify, pending, fingerprint, highlight_skipped, encryption, integrity, key_version, parent, content_hash, collection, collection_entry) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		hex.EncodeToString(databaseID[:]),
 		string(data),
 		document.Custom,
 		document.Syntax,
 		document.Upload.UTC().Format("2006-01-02 15:04:05"),
 		expiration,
-        document.Views,
-        rawData)
+		document.Views,
+		rawData,
+		notify,
+		pending,
+		fingerprint,
+		document.HighlightSkipped,
+		document.Encryption,
+		integrity,
+		document.KeyVersion,
+		parent,
+		storedHash,
+		collection,
+		collectionEntry)
 	if err != nil {
-		return err
+		return timeoutError(err)
+	}
+	if HashChain {
+		upload := document.Upload.UTC().Format("2006-01-02 15:04:05")
+		record := chainRecord(hex.EncodeToString(databaseID[:]), document.Custom, document.Syntax, upload, expiration, collection, integrity)
+		if err := appendChain(ctx, tx, hex.EncodeToString(databaseID[:]), record, expiration); err != nil {
+			return timeoutError(err)
+		}
+	}
+	if NumericAliases {
+		err = storeAlias(ctx, tx, document, hex.EncodeToString(databaseID[:]), result)
+		if err != nil {
+			Log.Errorf("Couldn't store numeric alias: %s", err)
+			return err
+		}
+	}
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			document.Alias = 0
+			return timeoutError(err)
+		}
+	}
+	if originalOnly && highlighted {
+		highlightCache.put(hex.EncodeToString(databaseID[:]), contentHighlighted, document.Expiration, HighlightCacheSize)
 	}
 	return nil
 }
@@ -119,61 +416,421 @@ func Store(document *Document) error {
 func Request(id string, raw bool) (Document, error) {
 	doc := Document{ID: id}
 	var views int
-	var upload, expiration, rawString sql.NullString
+	var upload, expiration, rawString, pending, integrity, storedHash sql.NullString
 	databaseID := sha256.Sum256([]byte(id))
-	err := db.QueryRow("SELECT content, custom, syntax, upload, expiration, views, raw FROM documents WHERE id = ?", hex.EncodeToString(databaseID[:])).
-		Scan(&doc.Content, &doc.Custom, &doc.Syntax, &upload, &expiration, &views, &rawString)
+	start := time.Now()
+	err := readDocumentRow(hex.EncodeToString(databaseID[:]), "SELECT content, custom, syntax, upload, expiration, views, raw, pending, highlight_skipped, encryption, integrity, key_version, content_hash FROM documents WHERE id = ?",
+		&doc.Content, &doc.Custom, &doc.Syntax, &upload, &expiration, &views, &rawString, &pending, &doc.HighlightSkipped, &doc.Encryption, &integrity, &doc.KeyVersion, &storedHash)
+	since(&doc.Timing.Database, start)
+	if err == nil && pending.Valid {
+		// Unconfirmed documents are not public yet
+		err = sql.ErrNoRows
+	}
 	if err != nil {
-		if err.Error() != "sql: no rows in result set" {
+		if err != sql.ErrNoRows && err != ErrTimeout {
 			Log.Warningf("Error retrieving document: %s", err)
 		}
 		return Document{}, err
 	}
 
-	go db.Exec("UPDATE documents SET views = views + 1 WHERE id = ?", hex.EncodeToString(databaseID[:]))
 	doc.Views = views
+	doc.Unencrypted = doc.Encryption == EncryptionNone
+	doc.ContentHash = storedHash.String
 
-	doc.Upload, _ = time.Parse("2006-01-02 15:04:05", upload.String)
+	doc.Upload, err = parseUpload(upload)
+	if err != nil {
+		Log.Errorf("Can't decrypt document: %s", err)
+		return Document{}, err
+	}
 
-    // Server-Side Decryption
-    if raw && rawString.Valid {
-        doc.Content = rawString.String
-    }
-	key, err := scrypt.Key([]byte(id), []byte(doc.Upload.UTC().Format("2006-01-02 15:04:05")), 16384, 8, 1, 24)
+	// Server-Side Decryption
+	// Documents stored with OriginalOnly have no highlighted content, and are highlighted after decryption
+	originalOnly := doc.Content == "" && rawString.Valid
+	start = time.Now()
+	key, err := documentKey(doc.Encryption, doc.KeyVersion, id, doc.Upload)
+	since(&doc.Timing.Scrypt, start)
 	if err != nil {
-		Log.Errorf("Invalid script parameters: %s", err)
 		return Document{}, err
 	}
-	data, err := decrypt([]byte(doc.Content), key)
-	if err != nil && !(err.Error() == "cipher: message authentication failed" && !strings.Contains(doc.Content, "\000")) {
-		Log.Errorf("AES error: %s", err)
+	content, legacy, err := decryptContent(hex.EncodeToString(databaseID[:]), key, storedContent{doc.Content, rawString, integrity}, raw)
+	if err != nil {
 		return Document{}, err
-	} else if err == nil {
-		doc.Content = string(data)
 	}
+	doc.Content = content
+	reencrypt := LazyReencryption && !legacy && outdatedEncryption(doc.Encryption, doc.KeyVersion)
 
+	volatile := false
 	if expiration.Valid {
-        doc.Expiration, err = time.Parse("2006-01-02 15:04:05", expiration.String)
-        if doc.Expiration.Before(time.Unix(0, 1)) {
-			if doc.Views > 0 {
-				// Volatile document
-				_, err = db.Exec("DELETE FROM documents WHERE id = ?", hex.EncodeToString(databaseID[:]))
-				if err != nil {
-					Log.Errorf("Couldn't delete volatile document: %s", err)
-				}
-			}
-		} else {
-			if err != nil {
-				return Document{}, err
-			}
-			if doc.Expiration.Before(time.Now()) {
-				return Document{}, errors.New("the document has expired")
-			}
+		doc.Expiration, err = time.Parse("2006-01-02 15:04:05", expiration.String)
+		if err != nil {
+			return Document{}, err
+		}
+		volatile = doc.Expiration.Before(time.Unix(0, 1))
+		if !volatile && doc.Expiration.Before(time.Now()) {
+			return Document{}, ErrExpired
 		}
 	}
 
-	if raw {
-		doc.Content = StripHTML(doc.Content)
+	if volatile {
+		start = time.Now()
+		err = consumeVolatile(hex.EncodeToString(databaseID[:]), views)
+		since(&doc.Timing.Database, start)
+		if err != nil {
+			return Document{}, err
+		}
+	} else if CountViews {
+		countView(hex.EncodeToString(databaseID[:]), views)
+	}
+	if reencrypt && !volatile {
+		go func() {
+			if _, err := Reencrypt(id); err != nil {
+				Log.Warningf("Couldn't re-encrypt document: %s", err)
+			}
+		}()
+	}
+
+	if originalOnly && !raw {
+		start = time.Now()
+		doc.Content = highlightOnRead(hex.EncodeToString(databaseID[:]), doc.Content, doc.Syntax, doc.Expiration)
+		since(&doc.Timing.Highlight, start)
 	}
 	return doc, nil
 }
+
+// contentHash returns the first 128 bits of the HMAC-SHA256 of the content with ContentHashKey as hex, which is short but
+// still collision-safe. The key keeps anyone from calculating the hash of content they guess, and checking if it exists.
+func contentHash(content string) string {
+	mac := hmac.New(sha256.New, ContentHashKey)
+	mac.Write([]byte(content))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// ContentHash returns the hash Store() would calculate for the content of a document with the given syntax (see
+// Document.ContentHash), e.g. to check if it exists before uploading it.
+func ContentHash(content string, syntax string) (string, error) {
+	content, err := normalizeContent(content, syntax == "ansi")
+	if err != nil {
+		return "", err
+	}
+	if SyntaxMarker && syntax == "" {
+		if marked, stripped := syntaxFromMarker(content); marked != "" {
+			content = stripped
+		}
+	}
+	return contentHash(content), nil
+}
+
+// ContentExists checks if a public document with the given content hash exists. Only documents stored with ContentETags
+// can be found.
+func ContentExists(hash string) (bool, error) {
+	rows := 0
+	ctx, cancel := queryContext()
+	defer cancel()
+	err := eachShard(func(handle *sql.DB) error {
+		n := 0
+		err := handle.QueryRowContext(ctx, "SELECT COUNT(id) FROM documents WHERE content_hash = ? AND pending IS NULL AND (expiration IS NULL OR expiration > CURRENT_TIMESTAMP)", hash).Scan(&n)
+		rows += n
+		return err
+	})
+	if err != nil {
+		return false, timeoutError(err)
+	}
+	return rows > 0, nil
+}
+
+// RequestByContentHash returns the content of a live document with the given content hash, for content-addressed URLs, and
+// the latest expiration of the documents with that content, which is zero if one of them never expires.
+// Only documents stored with ContentETags and without server-side encryption (see Document.Unencrypted) can be found, as the
+// key of encrypted documents is derived from their ID. Volatile documents are never returned.
+func RequestByContentHash(hash string) (string, time.Time, error) {
+	var content string
+	var expiration time.Time
+	forever := false
+	ctx, cancel := queryContext()
+	defer cancel()
+	err := eachReadShard(func(handle *sql.DB) error {
+		if forever {
+			return nil
+		}
+		var highlighted string
+		var raw, expires sql.NullString
+		err := handle.QueryRowContext(ctx, "SELECT content, raw, expiration FROM documents WHERE content_hash = ? AND encryption = ? AND pending IS NULL AND "+livePredicate+" ORDER BY expiration IS NULL DESC, expiration DESC LIMIT 1", hash, EncryptionNone).
+			Scan(&highlighted, &raw, &expires)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if content == "" && raw.Valid {
+			content = raw.String
+		} else if content == "" {
+			content = StripHTML(highlighted)
+		}
+		if !expires.Valid {
+			forever, expiration = true, time.Time{}
+			return nil
+		}
+		until, err := time.Parse("2006-01-02 15:04:05", expires.String)
+		if err != nil {
+			return err
+		}
+		if until.After(expiration) {
+			expiration = until
+		}
+		return nil
+	})
+	if err != nil {
+		return "", time.Time{}, timeoutError(err)
+	}
+	// The content must never change for a hash, e.g. if the original content isn't stored exactly
+	if content == "" || contentHash(content) != hash {
+		return "", time.Time{}, sql.ErrNoRows
+	}
+	return content, expiration, nil
+}
+
+// Validate returns all problems that would make Store() reject a document before it's stored, instead of only the first
+// one. Spam is reported, saved and remembered like by Store() (an error starting with "spam: "); if the content passed the
+// filters, Store() doesn't run them again. The document isn't changed otherwise.
+func Validate(document *Document) []error {
+	errs := []error{}
+	if err := ValidateCustom(document.Custom); err != nil {
+		errs = append(errs, err)
+	}
+	if document.Unencrypted && !AllowUnencrypted {
+		errs = append(errs, ErrUnencryptedNotAllowed)
+	}
+	if err := ValidateCollection(document.Collection); err != nil {
+		errs = append(errs, err)
+	}
+	if len(document.Content) > MaxFilesize {
+		return append(errs, ErrTooLarge)
+	}
+
+	content, err := normalizeContent(document.Content, document.Syntax == "ansi")
+	if err != nil {
+		return append(errs, err)
+	}
+	normalized := *document
+	normalized.Content = content
+	if SyntaxMarker && normalized.Syntax == "" {
+		if syntax, stripped := syntaxFromMarker(content); syntax != "" {
+			normalized.Syntax, normalized.Content = syntax, stripped
+		}
+	}
+	normalized.ContentHash = contentHash(normalized.Content)
+	if err := spamCheck(&normalized); err != nil {
+		errs = append(errs, err)
+	}
+	document.spamChecked = normalized.spamChecked
+	if err := checkBlockedSyntax(normalized.Content); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// isLegacyPlaintext checks if content that couldn't be decrypted looks like a document stored before the encryption was
+// introduced. Ciphertext is binary, so it's almost never valid UTF-8 without NUL bytes.
+func isLegacyPlaintext(content string) bool {
+	return utf8.ValidString(content) && !strings.Contains(content, "\000")
+}
+
+// storedContent is the encrypted content of a document as it's stored in the database.
+type storedContent struct {
+	// content is the highlighted content, which is empty for documents stored with OriginalOnly
+	content string
+	// raw is the original content, if it's stored
+	raw sql.NullString
+	// integrity is the hash of the highlighted content, or of the original content for documents stored with OriginalOnly
+	integrity sql.NullString
+}
+
+// decryptContent decrypts the content of a document and verifies its integrity hash. With plain, the original content is
+// returned, or the highlighted content converted to plain text if the original content isn't stored. Otherwise, the
+// highlighted content is returned, or the original content for documents stored with OriginalOnly, which the caller has to
+// highlight. Documents stored before the encryption was introduced are returned as they are, with legacy set.
+func decryptContent(databaseID string, key []byte, stored storedContent, plain bool) (content string, legacy bool, err error) {
+	originalOnly := stored.content == "" && stored.raw.Valid
+	original := (plain && stored.raw.Valid) || originalOnly
+	ciphertext := stored.content
+	if original {
+		ciphertext = stored.raw.String
+	}
+	data, err := decrypt([]byte(ciphertext), key)
+	if err != nil && stored.integrity.Valid {
+		// Documents with an integrity hash are never stored unencrypted
+		Log.Errorf("Document %s is corrupted: %s", databaseID, err)
+		countDecryptionFailure()
+		return "", false, ErrCorrupted
+	} else if err != nil && !(err.Error() == "cipher: message authentication failed" && isLegacyPlaintext(ciphertext)) {
+		Log.Errorf("AES error: %s", err)
+		countDecryptionFailure()
+		return "", false, err
+	} else if err != nil {
+		// Documents from before the encryption was introduced are served as they are, but a wrong key looks the same for
+		// text, so they're still counted
+		Log.Warningf("Document %s isn't encrypted, serving it as plain text", databaseID)
+		countDecryptionFailure()
+		data, legacy = []byte(ciphertext), true
+	}
+	// The integrity hash only covers the original content of documents stored with OriginalOnly
+	if stored.integrity.Valid && (originalOnly || !original) && !hmac.Equal([]byte(integrityHash(data, key)), []byte(stored.integrity.String)) {
+		Log.Errorf("Document %s is corrupted: integrity hash mismatch", databaseID)
+		countDecryptionFailure()
+		return "", false, ErrCorrupted
+	}
+	if plain && !original {
+		return StripHTML(string(data)), legacy, nil
+	}
+	return string(data), legacy, nil
+}
+
+// Delete removes a document. It returns sql.ErrNoRows if the document doesn't exist.
+func Delete(id string) error {
+	hash := sha256.Sum256([]byte(id))
+	databaseID := hex.EncodeToString(hash[:])
+	ctx, cancel := queryContext()
+	defer cancel()
+	n, err := deleteDocuments(ctx, shardDB(databaseID), "id = ?", databaseID)
+	if err != nil {
+		return timeoutError(err)
+	}
+	invalidateCaches(databaseID)
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// parseUpload parses the upload time of a document. Without it, the key derivation would silently produce a wrong key.
+func parseUpload(upload sql.NullString) (time.Time, error) {
+	if !upload.Valid {
+		return time.Time{}, ErrInvalidUpload
+	}
+	uploadTime, err := time.Parse("2006-01-02 15:04:05", upload.String)
+	if err != nil || uploadTime.IsZero() {
+		return time.Time{}, ErrInvalidUpload
+	}
+	return uploadTime, nil
+}
+
+// consumeVolatile counts a view of a volatile document. If the document hasn't been viewed yet, the view is granted to the uploader;
+// otherwise the document is deleted. Both queries are conditional, so only one of multiple concurrent requests can succeed.
+func consumeVolatile(databaseID string, views int) error {
+	ctx, cancel := queryContext()
+	defer cancel()
+
+	if views == 0 {
+		result, err := shardDB(databaseID).ExecContext(ctx, "UPDATE documents SET views = 1 WHERE id = ? AND views = 0", databaseID)
+		if err != nil {
+			return timeoutError(err)
+		}
+		if n, err := result.RowsAffected(); err == nil && n == 1 {
+			return nil
+		}
+		// Somebody else got the first view in the meantime, so this is the last one.
+	}
+
+	result, err := shardDB(databaseID).ExecContext(ctx, "DELETE FROM documents WHERE id = ? AND views > 0", databaseID)
+	if err != nil {
+		Log.Errorf("Couldn't delete volatile document: %s", err)
+		return timeoutError(err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return ErrGone
+	}
+	return nil
+}
+
+// Rehighlight runs the syntax highlighting for an existing document again and replaces the stored highlighted content.
+// This requires the original content to be stored, which is always the case with StoreOriginal.
+func Rehighlight(id string) error {
+	var custom, syntax string
+	var upload, rawString sql.NullString
+	var encryption, version int
+	databaseID := sha256.Sum256([]byte(id))
+	ctx, cancel := queryContext()
+	err := shardDB(hex.EncodeToString(databaseID[:])).QueryRowContext(ctx, "SELECT custom, syntax, upload, raw, encryption, key_version FROM documents WHERE id = ?", hex.EncodeToString(databaseID[:])).
+		Scan(&custom, &syntax, &upload, &rawString, &encryption, &version)
+	cancel()
+	if err != nil {
+		return timeoutError(err)
+	}
+	if !rawString.Valid {
+		return errors.New("the original content isn't stored for this document")
+	}
+
+	uploadTime, err := parseUpload(upload)
+	if err != nil {
+		return err
+	}
+	key, err := documentKey(encryption, version, id, uploadTime)
+	if err != nil {
+		return err
+	}
+	content, err := decrypt([]byte(rawString.String), key)
+	if err != nil {
+		Log.Errorf("AES error: %s", err)
+		countDecryptionFailure()
+		return err
+	}
+
+	contentHighlighted := EscapeHTML(string(content))
+	if custom == "" {
+		start := time.Now()
+		contentHighlighted, _, err = Highlight(string(content), syntax)
+		spendHighlightBudget(time.Since(start))
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := encrypt([]byte(contentHighlighted), key)
+	if err != nil {
+		Log.Errorf("AES error: %s", err)
+		return err
+	}
+	ctx, cancel = queryContext()
+	defer cancel()
+	_, err = updateDocument(ctx, shardDB(hex.EncodeToString(databaseID[:])), hex.EncodeToString(databaseID[:]),
+		"UPDATE documents SET content = ?, highlight_skipped = 0, integrity = ? WHERE id = ?", string(data), integrityValue([]byte(contentHighlighted), key), hex.EncodeToString(databaseID[:]))
+	if err != nil {
+		return err
+	}
+	invalidateCaches(hex.EncodeToString(databaseID[:]))
+	return nil
+}
+
+// HighlightSkipped highlights a document that was stored without highlighting because of HighlightMaxLines.
+// The result is stored, so the highlighter only runs once per document. It counts towards the HighlightBudget, and
+// returns ErrHighlightBudget while it's exhausted.
+func HighlightSkipped(id string) error {
+	var skipped bool
+	databaseID := sha256.Sum256([]byte(id))
+	err := readDocumentRow(hex.EncodeToString(databaseID[:]), "SELECT highlight_skipped FROM documents WHERE id = ? AND pending IS NULL", &skipped)
+	if err != nil {
+		return err
+	}
+	if !skipped {
+		return ErrNotSkipped
+	}
+	if !highlightBudgetAvailable() {
+		return ErrHighlightBudget
+	}
+	return Rehighlight(id)
+}
+
+// RehighlightAll runs Rehighlight for multiple documents and returns the number of updated documents.
+// As only hashes of the IDs are stored, the IDs have to be supplied by the caller.
+func RehighlightAll(ids []string) int {
+	n := 0
+	for _, id := range ids {
+		err := Rehighlight(id)
+		if err != nil {
+			Log.Warningf("Couldn't highlight document %s again: %s", id, err)
+			continue
+		}
+		n++
+	}
+	return n
+}
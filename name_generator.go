@@ -7,8 +7,12 @@ import (
 	"encoding/hex"
 	"errors"
 	"io/ioutil"
+	"math"
 	"math/big"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 var words = []string{}
@@ -48,25 +52,100 @@ func LoadWordsFile(filename string) error {
 	return err
 }
 
-// GenerateName generates a slug in the format "cornflake-peddling-bp0q". Note that this function will return an empty string if an error occurs along the way!
+// SplitName splits a generated name like "cornflake-peddling-bp0q" into the words from the word list ("cornflake-peddling") and the random characters ("bp0q").
+// Names without words (e.g. generated without a word list) only consist of random characters, and the returned words are empty.
+// If TimestampNames is enabled, the timestamp prefix is part of neither.
+func SplitName(name string) (string, string) {
+	if TimestampNames && len(name) > timestampLength && name[timestampLength] == '-' {
+		name = name[timestampLength+1:]
+	}
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return "", name
+	}
+	return name[:i], name[i+1:]
+}
+
+// TimestampNames prefixes generated names with their creation time (like "0sg9k2a-cornflake-peddling-bp0q"), so sorting
+// the names sorts the documents chronologically, e.g. for pagination.
+var TimestampNames = false
+
+// timestampLength is the length of the timestamp prefix, which is enough for all Unix timestamps until the year 4453.
+const timestampLength = 7
+
+// nameTimestamp formats the seconds since the Unix epoch in base 36, padded to timestampLength so the names sort correctly.
+func nameTimestamp(t time.Time) string {
+	timestamp := strconv.FormatInt(t.Unix(), 36)
+	return strings.Repeat("0", timestampLength-len(timestamp)) + timestamp
+}
+
+// AdaptiveNames defines if the length of the random characters in a name grows with the number of stored documents.
+var AdaptiveNames = false
+
+// MinSuffixLength and MaxSuffixLength limit the number of random characters in a name if AdaptiveNames is enabled.
+var MinSuffixLength = 4
+var MaxSuffixLength = 12
+
+// CollisionProbability is the highest accepted probability that a new random name already exists if AdaptiveNames is enabled.
+var CollisionProbability = 0.000001
+
+// documentCount is the number of stored documents, updated regularly if AdaptiveNames is enabled.
+var documentCount int64
+
+// GenerateName generates a slug in the format "cornflake-peddling-bp0q", see also TimestampNames. Note that this function will return an empty string if an error occurs along the way!
 func GenerateName() string {
 	text := ""
-	var word string
-	for i := 0; i < 6; i++ {
-		if i < 2 && len(words) > 0 {
-			word = randomWord(words, 0, nil)
-		} else {
-			word = randomWord(characters, 0, nil)
+	if TimestampNames {
+		text = nameTimestamp(time.Now()) + "-"
+	}
+	if len(words) > 0 {
+		text += randomWord(words, 0, nil) + "-" + randomWord(words, 0, nil) + "-"
+	}
+
+	length := suffixLength(atomic.LoadInt64(&documentCount))
+	for i := 0; i < length; i++ {
+		text += randomWord(characters, 0, nil)
+	}
+
+	return text
+}
+
+// suffixLength returns the number of random characters required in a name for the given number of documents.
+// Without AdaptiveNames, names have 2 words and 4 characters, or 6 characters if no words are loaded.
+func suffixLength(count int64) int {
+	if !AdaptiveNames {
+		if len(words) > 0 {
+			return 4
 		}
+		return 6
+	}
 
-		if i < 3 && len(words) > 0 {
-			text += "-" + word
-		} else {
-			text += word
+	combinations := 1.0
+	if len(words) > 0 {
+		combinations = float64(len(words)) * float64(len(words))
+	}
+	for length := MinSuffixLength; length < MaxSuffixLength; length++ {
+		if float64(count)/(combinations*math.Pow(float64(len(characters)), float64(length))) <= CollisionProbability {
+			return length
 		}
 	}
+	return MaxSuffixLength
+}
 
-	return strings.TrimPrefix(text, "-")
+// countDocuments updates documentCount from the database.
+func countDocuments() {
+	var count int64
+	err := eachShard(func(handle *sql.DB) error {
+		var n int64
+		err := handle.QueryRow("SELECT COUNT(*) FROM documents").Scan(&n)
+		count += n
+		return err
+	})
+	if err != nil {
+		Log.Errorf("Couldn't count documents: %s", err)
+		return
+	}
+	atomic.StoreInt64(&documentCount, count)
 }
 
 var safeName *sql.Stmt
@@ -87,7 +166,8 @@ func GenerateSafeName() (string, error) {
 			return "", errors.New("name generation failed")
 		}
 		databaseID := sha256.Sum256([]byte(name))
-		err := safeName.QueryRow(hex.EncodeToString(databaseID[:])).Scan(&rows)
+		var err error
+		rows, err = countID(hex.EncodeToString(databaseID[:]))
 		if err != nil {
 			return "", err
 		}
@@ -95,3 +175,31 @@ func GenerateSafeName() (string, error) {
 
 	return name, nil
 }
+
+// Exists checks if a document with the given ID exists, without reading any of its content or metadata.
+func Exists(id string) (bool, error) {
+	if errSafeName != nil {
+		return false, errSafeName
+	}
+
+	databaseID := sha256.Sum256([]byte(id))
+	rows, err := countID(hex.EncodeToString(databaseID[:]))
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// countID returns the number of documents with the given database ID, from the shard that would contain it.
+func countID(databaseID string) (int, error) {
+	rows := 0
+	ctx, cancel := queryContext()
+	defer cancel()
+	var err error
+	if len(shards) == 0 {
+		err = safeName.QueryRowContext(ctx, databaseID).Scan(&rows)
+	} else {
+		err = shardDB(databaseID).QueryRowContext(ctx, "SELECT COUNT(id) FROM documents WHERE id = ?", databaseID).Scan(&rows)
+	}
+	return rows, timeoutError(err)
+}
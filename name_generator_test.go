@@ -0,0 +1,127 @@
+package qbin
+
+import (
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExists(t *testing.T) {
+	existing := sha256.Sum256([]byte("cornflake-peddling-bp0q"))
+	useFakeDB("exists", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		count := int64(0)
+		if args[0].Value == hex.EncodeToString(existing[:]) {
+			count = 1
+		}
+		return &fakeRows{columns: []string{"count"}, values: [][]driver.Value{{count}}}, nil
+	})
+
+	if exists, err := Exists("cornflake-peddling-bp0q"); err != nil || !exists {
+		t.Errorf("Existing document isn't reported as existing (error: %v)", err)
+	}
+	if exists, err := Exists("cornflake-peddling-bp0r"); err != nil || exists {
+		t.Errorf("Free name isn't reported as available (error: %v)", err)
+	}
+}
+
+func TestGenerateName(t *testing.T) {
+	words = []string{"cornflake", "peddling"}
+	defer func() { words = []string{} }()
+
+	name := GenerateName()
+	parts := strings.Split(name, "-")
+	if len(parts) != 3 || len(parts[2]) != 4 {
+		t.Errorf("Wrong name format: %s", name)
+	}
+
+	words = []string{}
+	if name := GenerateName(); len(name) != 6 || strings.Contains(name, "-") {
+		t.Errorf("Wrong name format without words: %s", name)
+	}
+}
+
+func TestSplitName(t *testing.T) {
+	defer func() { words = []string{} }()
+
+	words = []string{"cornflake", "peddling", "t-shirt"}
+	for i := 0; i < 20; i++ {
+		name := GenerateName()
+		friendly, random := SplitName(name)
+		if friendly == "" || len(random) != 4 || friendly+"-"+random != name {
+			t.Errorf("Wrong split of %s: %q, %q", name, friendly, random)
+		}
+	}
+	if friendly, random := SplitName("t-shirt-cornflake-bp0q"); friendly != "t-shirt-cornflake" || random != "bp0q" {
+		t.Errorf("Wrong split of a name with a dash in a word: %q, %q", friendly, random)
+	}
+
+	words = []string{}
+	name := GenerateName()
+	if friendly, random := SplitName(name); friendly != "" || random != name {
+		t.Errorf("Wrong split of %s without words: %q, %q", name, friendly, random)
+	}
+}
+
+func TestSuffixLength(t *testing.T) {
+	AdaptiveNames = true
+	defer func() { AdaptiveNames = false }()
+
+	last := 0
+	for _, count := range []int64{0, 1000, 1000000, 1000000000, 1000000000000} {
+		length := suffixLength(count)
+		if length < last {
+			t.Errorf("Suffix length shrinks from %d to %d for %d documents", last, length, count)
+		}
+		if length < MinSuffixLength || length > MaxSuffixLength {
+			t.Errorf("Suffix length %d for %d documents is out of bounds", length, count)
+		}
+		last = length
+	}
+	if suffixLength(0) != MinSuffixLength {
+		t.Errorf("Suffix length for an empty database should be %d, but is %d", MinSuffixLength, suffixLength(0))
+	}
+	if suffixLength(1000000000000) <= suffixLength(1000) {
+		t.Errorf("Suffix length doesn't grow with the number of documents")
+	}
+
+	atomic.StoreInt64(&documentCount, 1000000000000)
+	defer atomic.StoreInt64(&documentCount, 0)
+	if name := GenerateName(); len(name) != suffixLength(1000000000000) {
+		t.Errorf("Generated name %s doesn't use the adaptive length", name)
+	}
+}
+
+func TestTimestampNames(t *testing.T) {
+	TimestampNames = true
+	words = []string{"cornflake", "peddling"}
+	defer func() { TimestampNames, words = false, []string{} }()
+
+	// Names sort like their creation times, also when the number of digits changes
+	times := []time.Time{time.Unix(0, 0), time.Unix(35, 0), time.Unix(36, 0), time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2019, 1, 1, 0, 0, 1, 0, time.UTC), time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)}
+	for i := 1; i < len(times); i++ {
+		previous, current := nameTimestamp(times[i-1]), nameTimestamp(times[i])
+		if len(current) != timestampLength || previous >= current {
+			t.Errorf("Timestamp %q for %s doesn't sort after %q", current, times[i], previous)
+		}
+	}
+
+	names := map[string]bool{}
+	prefix := nameTimestamp(time.Now())
+	for i := 0; i < 100; i++ {
+		name := GenerateName()
+		if !strings.HasPrefix(name, prefix+"-") && !strings.HasPrefix(name, nameTimestamp(time.Now())+"-") {
+			t.Fatalf("Name %s doesn't start with the current timestamp", name)
+		}
+		if names[name] {
+			t.Errorf("Name %s was generated twice", name)
+		}
+		names[name] = true
+		if friendly, random := SplitName(name); len(strings.Split(friendly, "-")) != 2 || len(random) != 4 {
+			t.Errorf("Wrong split of %s: %q, %q", name, friendly, random)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package qbin
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// NotifyBefore defines how long before its expiration a document's notification URL receives a webhook. 0 disables notifications.
+var NotifyBefore time.Duration
+
+// ErrNotifyAddress is returned if a notification URL points to a private or reserved address.
+var ErrNotifyAddress = errors.New("notification URL must not point to a private or reserved address")
+
+// reservedNetworks are the address ranges webhooks are never sent to, in addition to the private, loopback, link-local,
+// multicast and unspecified addresses recognized by the net package.
+var reservedNetworks = parseNetworks(
+	"0.0.0.0/8",       // "this" network
+	"100.64.0.0/10",   // carrier-grade NAT
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"240.0.0.0/4",     // reserved, including broadcast
+	"64:ff9b::/96",    // NAT64, could reach any IPv4 address
+	"2001:db8::/32",   // documentation
+)
+
+// parseNetworks parses a list of CIDR ranges, which must be valid.
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, networks[i], _ = net.ParseCIDR(cidr)
+	}
+	return networks
+}
+
+// isPublicAddress checks if webhooks may be sent to an IP address.
+func isPublicAddress(ip net.IP) bool {
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// notifyDialer only connects to public addresses. The check runs after the host name has been resolved for every
+// connection (including redirects), so a host name can't be changed to point to an internal service after the URL was
+// validated (DNS rebinding).
+var notifyDialer = &net.Dialer{
+	Timeout: 5 * time.Second,
+	Control: func(network string, address string, conn syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !isPublicAddress(ip) {
+			return ErrNotifyAddress
+		}
+		return nil
+	},
+}
+
+// notifyClient sends the webhooks. It doesn't use a proxy from the environment, as the proxy would connect to the
+// address instead of notifyDialer.
+var notifyClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: &http.Transport{DialContext: notifyDialer.DialContext},
+}
+
+// ExpirationNotice is the JSON body posted to a document's notification URL.
+type ExpirationNotice struct {
+	Event string `json:"event"`
+	// Document is the database ID of the document (the hex-encoded SHA256 of its ID), as the ID itself is never stored
+	Document   string    `json:"document"`
+	Expiration time.Time `json:"expiration"`
+}
+
+// ValidateNotifyURL checks if a notification URL supplied by the user can be used for webhooks.
+func ValidateNotifyURL(notify string) error {
+	u, err := url.Parse(notify)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("notification URL must be an absolute http or https URL")
+	}
+	// Obvious internal targets are rejected right away; host names are checked again when the webhook is sent
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrNotifyAddress
+	}
+	if ip := net.ParseIP(host); ip != nil && !isPublicAddress(ip) {
+		return ErrNotifyAddress
+	}
+	return nil
+}
+
+// notifyExpiring posts a webhook for every document that expires within NotifyBefore and hasn't been notified yet.
+func notifyExpiring() {
+	eachShard(func(handle *sql.DB) error {
+		notifyExpiringIn(handle)
+		return nil
+	})
+}
+
+// notifyExpiringIn runs notifyExpiring() for the documents in one database.
+func notifyExpiringIn(handle *sql.DB) {
+	rows, err := handle.Query(
+		"SELECT id, notify, expiration FROM documents WHERE notify IS NOT NULL AND notified = 0 AND expiration > CURRENT_TIMESTAMP AND expiration < DATE_ADD(CURRENT_TIMESTAMP, INTERVAL ? SECOND)",
+		int64(NotifyBefore.Seconds()))
+	if err != nil {
+		Log.Errorf("Couldn't query documents to notify: %s", err)
+		return
+	}
+
+	type pending struct {
+		id, notify, expiration string
+	}
+	list := make([]pending, 0)
+	for rows.Next() {
+		p := pending{}
+		if err := rows.Scan(&p.id, &p.notify, &p.expiration); err != nil {
+			Log.Errorf("Couldn't read document to notify: %s", err)
+			continue
+		}
+		list = append(list, p)
+	}
+	rows.Close()
+
+	for _, p := range list {
+		// Claim the notification first, so it's never sent twice (even with multiple instances running the cleanup).
+		result, err := handle.Exec("UPDATE documents SET notified = 1 WHERE id = ? AND notified = 0", p.id)
+		if err != nil {
+			Log.Errorf("Couldn't mark document as notified: %s", err)
+			continue
+		}
+		if n, err := result.RowsAffected(); err != nil || n != 1 {
+			continue
+		}
+
+		expiration, _ := time.Parse("2006-01-02 15:04:05", p.expiration)
+		go func(notify string, id string) {
+			err := sendExpirationNotice(notify, id, expiration)
+			if err != nil {
+				Log.Warningf("Couldn't send expiration notice to %s: %s", notify, err)
+			}
+		}(p.notify, p.id)
+	}
+}
+
+// sendExpirationNotice posts an ExpirationNotice to a notification URL.
+func sendExpirationNotice(notify string, databaseID string, expiration time.Time) error {
+	body, err := json.Marshal(ExpirationNotice{
+		Event:      "expiring",
+		Document:   databaseID,
+		Expiration: expiration.UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := notifyClient.Post(notify, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return errors.New("webhook returned " + res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package qbin
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSendExpirationNotice(t *testing.T) {
+	defer func(client *http.Client) { notifyClient = client }(notifyClient)
+	notifyClient = &http.Client{Timeout: 10 * time.Second}
+	received := 0
+	var notice ExpirationNotice
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		received++
+		if err := json.NewDecoder(req.Body).Decode(&notice); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	expiration := time.Now().Add(time.Hour).Round(time.Second)
+	err := sendExpirationNotice(server.URL, "4f6c", expiration)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if received != 1 {
+		t.Errorf("Webhook received %d times (expected: 1)", received)
+	}
+	if notice.Event != "expiring" || notice.Document != "4f6c" || !notice.Expiration.Equal(expiration) {
+		t.Errorf("Wrong notice received: %+v", notice)
+	}
+}
+
+func TestValidateNotifyURL(t *testing.T) {
+	if err := ValidateNotifyURL("https://example.org/hooks/qbin?paste=1"); err != nil {
+		t.Errorf("Valid URL rejected: %s", err)
+	}
+	if err := ValidateNotifyURL("file:///etc/passwd"); err == nil {
+		t.Errorf("file:// URL should be rejected, but isn't.")
+	}
+	if err := ValidateNotifyURL("/relative"); err == nil {
+		t.Errorf("Relative URL should be rejected, but isn't.")
+	}
+	for _, internal := range []string{"http://localhost:8080/", "http://127.0.0.1/", "http://10.1.2.3/", "http://169.254.169.254/latest/meta-data/", "http://[::1]/", "http://[fd00::1]/", "http://100.64.0.1/"} {
+		if err := ValidateNotifyURL(internal); err != ErrNotifyAddress {
+			t.Errorf("Internal URL %s should be rejected, but isn't (error: %v).", internal, err)
+		}
+	}
+}
+
+func TestNotifyDialer(t *testing.T) {
+	received := false
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		received = true
+	}))
+	defer server.Close()
+
+	// A host name resolving to an internal address when the webhook is sent (e.g. after DNS rebinding) is rejected
+	for _, url := range []string{server.URL, strings.Replace(server.URL, "127.0.0.1", "localhost", 1)} {
+		if err := sendExpirationNotice(url, "4f6c", time.Now()); err == nil || !strings.Contains(err.Error(), ErrNotifyAddress.Error()) || received {
+			t.Errorf("Webhook was sent to %s (error: %v)", url, err)
+		}
+	}
+	for ip, public := range map[string]bool{"93.184.216.34": true, "2606:4700::1111": true, "192.168.1.1": false, "fe80::1": false, "198.18.0.1": false, "::ffff:127.0.0.1": false} {
+		if err := notifyDialer.Control("tcp", net.JoinHostPort(ip, "443"), nil); (err == nil) != public {
+			t.Errorf("Address %s should be allowed: %t (error: %v)", ip, public, err)
+		}
+	}
+}
+
+// notifyDB simulates the notification columns of the documents table.
+type notifyRow struct {
+	expiration time.Time
+	notified   bool
+}
+
+func notifyDB(name string, documents map[string]*notifyRow, notify string) *sync.Mutex {
+	var mutex sync.Mutex
+	useFakeDB(name, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if strings.HasPrefix(query, "SELECT id, notify, expiration FROM documents WHERE notify IS NOT NULL AND notified = 0") {
+			window := time.Duration(args[0].Value.(int64)) * time.Second
+			result := &fakeRows{columns: []string{"id", "notify", "expiration"}}
+			for id, doc := range documents {
+				if !doc.notified && doc.expiration.After(time.Now()) && doc.expiration.Before(time.Now().Add(window)) {
+					result.values = append(result.values, []driver.Value{id, notify, doc.expiration.UTC().Format("2006-01-02 15:04:05")})
+				}
+			}
+			return result, nil
+		} else if strings.HasPrefix(query, "UPDATE documents SET notified = 1 WHERE id = ? AND notified = 0") {
+			doc, ok := documents[args[0].Value.(string)]
+			if !ok || doc.notified {
+				return &fakeRows{}, nil
+			}
+			doc.notified = true
+			return &fakeRows{affected: 1}, nil
+		}
+		return nil, nil
+	})
+	return &mutex
+}
+
+func TestNotifyExpiring(t *testing.T) {
+	defer func(client *http.Client, before time.Duration) { notifyClient, NotifyBefore = client, before }(notifyClient, NotifyBefore)
+	notifyClient = &http.Client{Timeout: 10 * time.Second}
+	NotifyBefore = time.Hour
+
+	received := make(chan ExpirationNotice, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		notice := ExpirationNotice{}
+		json.NewDecoder(req.Body).Decode(&notice)
+		received <- notice
+	}))
+	defer server.Close()
+
+	soon := time.Now().Add(30 * time.Minute).Truncate(time.Second)
+	documents := map[string]*notifyRow{
+		"soon":     {expiration: soon},
+		"later":    {expiration: time.Now().Add(2 * time.Hour)},
+		"expired":  {expiration: time.Now().Add(-time.Minute)},
+		"notified": {expiration: time.Now().Add(10 * time.Minute), notified: true},
+	}
+	mutex := notifyDB("notify-expiring", documents, server.URL)
+
+	// Only the document within the window is notified, and only once
+	notifyExpiring()
+	notifyExpiring()
+	select {
+	case notice := <-received:
+		if !notice.Expiration.Equal(soon) || notice.Document != "soon" {
+			t.Errorf("Notice has the wrong document or expiration: %s %s (expected: soon %s)", notice.Document, notice.Expiration, soon)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Document expiring within the window wasn't notified")
+	}
+	mutex.Lock()
+	if !documents["soon"].notified || documents["later"].notified || documents["expired"].notified {
+		t.Errorf("Wrong documents were marked as notified: %+v %+v %+v", documents["soon"], documents["later"], documents["expired"])
+	}
+	mutex.Unlock()
+
+	// Once the window is reached, the next run notifies the other document
+	mutex.Lock()
+	documents["later"].expiration = time.Now().Add(59 * time.Minute)
+	mutex.Unlock()
+	notifyExpiring()
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Document entering the window wasn't notified")
+	}
+	if len(received) != 0 {
+		t.Errorf("%d notices were sent twice", len(received))
+	}
+}
@@ -0,0 +1,92 @@
+package qbin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// MaxPDFSize is the maximum size (in bytes of highlighted content) of documents that can be rendered by PDF().
+var MaxPDFSize = 256 * 1024
+
+// PDFCacheSize limits the memory (in bytes of PDF data) used to cache documents rendered by PDF(). 0 disables the cache.
+var PDFCacheSize = 32 * 1024 * 1024
+
+// ErrPDFTooLarge is returned by PDF() for documents exceeding MaxPDFSize.
+var ErrPDFTooLarge = errors.New("the document is too large to be rendered as PDF")
+
+var pdfCache = &documentCache{}
+
+// pdfColors maps the ANSI SGR color codes used by ANSI() to colors that are readable on white paper.
+var pdfColors = map[string][3]int{
+	"90": {128, 128, 128},
+	"35": {152, 0, 152},
+	"32": {0, 128, 0},
+	"33": {168, 104, 0},
+	"34": {0, 72, 192},
+	"36": {0, 120, 136},
+	"31": {184, 24, 24},
+}
+
+// PDF renders a document returned by Request() with highlighted content as paginated A4 PDF, using a monospace font
+// and a header with the ID and syntax on every page. Characters outside of Windows-1252 are replaced by dots.
+func PDF(doc *Document) ([]byte, error) {
+	hash := sha256.Sum256([]byte(doc.ID))
+	databaseID := hex.EncodeToString(hash[:])
+	if cached, ok := pdfCache.get(databaseID); ok {
+		return []byte(cached), nil
+	}
+	if len(doc.Content) > MaxPDFSize {
+		return nil, ErrPDFTooLarge
+	}
+
+	pdf := fpdf.New("P", "mm", "A4", "")
+	translate := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.SetTitle(doc.ID, true)
+	pdf.SetCreator("qbin", true)
+	title := doc.ID
+	if doc.Syntax != "" {
+		title += " (" + doc.Syntax + ")"
+	}
+	color := [3]int{}
+	pdf.SetHeaderFunc(func() {
+		pdf.SetFont("Courier", "B", 10)
+		pdf.SetTextColor(0, 0, 0)
+		pdf.CellFormat(0, 6, translate(title), "B", 1, "L", false, 0, "")
+		pdf.Ln(3)
+		// Continue the content in the color it had on the previous page
+		pdf.SetFont("Courier", "", 9)
+		pdf.SetTextColor(color[0], color[1], color[2])
+	})
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-12)
+		pdf.SetFont("Courier", "", 8)
+		pdf.SetTextColor(128, 128, 128)
+		pdf.CellFormat(0, 6, strconv.Itoa(pdf.PageNo()), "", 0, "R", false, 0, "")
+	})
+	pdf.AddPage()
+
+	for i, part := range strings.Split(ANSI(doc.Content), "\x1b[") {
+		if i > 0 {
+			// Every part except the first one starts with a color code, and unknown codes reset the color
+			if end := strings.IndexByte(part, 'm'); end >= 0 {
+				color = pdfColors[part[:end]]
+				part = part[end+1:]
+			}
+		}
+		pdf.SetTextColor(color[0], color[1], color[2])
+		pdf.Write(4, translate(strings.Replace(stripANSI(part), "\t", "    ", -1)))
+	}
+
+	data := bytes.Buffer{}
+	if err := pdf.Output(&data); err != nil {
+		return nil, err
+	}
+	pdfCache.put(databaseID, data.String(), doc.Expiration, PDFCacheSize)
+	return data.Bytes(), nil
+}
@@ -0,0 +1,41 @@
+package qbin
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPDF(t *testing.T) {
+	defer pdfCache.clear()
+	doc := &Document{ID: "cornflake-peddling-bp0q", Syntax: "go", Content: strings.Repeat(`<span class="token keyword">func</span> main() {	fmt.Println(&quot;Grüße&quot;) }`+"\n", 200)}
+	data, err := PDF(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-")) || !bytes.Contains(data, []byte("%%EOF")) {
+		t.Fatalf("Result isn't a PDF: %q", data[:16])
+	}
+	if bytes.Count(data, []byte("/Type /Page\n")) < 2 {
+		t.Errorf("Long document wasn't split into pages")
+	}
+
+	// Rendered documents are cached
+	doc.Content = "changed"
+	if cached, err := PDF(doc); err != nil || !bytes.Equal(cached, data) {
+		t.Errorf("PDF wasn't served from the cache: %v", err)
+	}
+	pdfCache.clear()
+	if rendered, err := PDF(doc); err != nil || bytes.Equal(rendered, data) {
+		t.Errorf("Changed document wasn't rendered again: %v", err)
+	}
+}
+
+func TestPDFTooLarge(t *testing.T) {
+	defer func() { MaxPDFSize = 256 * 1024 }()
+	defer pdfCache.clear()
+	MaxPDFSize = 16
+	if _, err := PDF(&Document{ID: "cornflake-peddling-bp0q", Content: strings.Repeat("x", 17)}); err != ErrPDFTooLarge {
+		t.Errorf("Too large document was rendered: %v", err)
+	}
+}
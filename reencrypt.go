@@ -0,0 +1,159 @@
+package qbin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// LazyReencryption re-encrypts documents in the background when they are requested, if they were encrypted with an outdated
+// strategy or scrypt parameters. As only hashes of the IDs are stored, documents can't be re-encrypted without being requested
+// or supplied to ReencryptAll.
+var LazyReencryption = false
+
+// outdatedEncryption checks if a document would be encrypted differently if it was stored now.
+// Unencrypted documents are never outdated, as they were stored without encryption on purpose.
+func outdatedEncryption(strategy int, version int) bool {
+	if strategy == EncryptionNone {
+		return false
+	}
+	currentStrategy, currentVersion := encryptionStrategy()
+	return strategy != currentStrategy || version != currentVersion
+}
+
+// Reencrypt encrypts a document again using the current strategy and scrypt parameters, and returns if it was outdated.
+func Reencrypt(id string) (bool, error) {
+	var content string
+	var raw, upload, integrity, aliasTarget, parent sql.NullString
+	var alias sql.NullInt64
+	var strategy, version int
+	databaseID := sha256.Sum256([]byte(id))
+	ctx, cancel := queryContext()
+	err := shardDB(hex.EncodeToString(databaseID[:])).QueryRowContext(ctx, "SELECT content, raw, upload, encryption, key_version, integrity, "+aliasColumn+", alias_target, parent FROM documents WHERE id = ?", hex.EncodeToString(databaseID[:])).
+		Scan(&content, &raw, &upload, &strategy, &version, &integrity, &alias, &aliasTarget, &parent)
+	cancel()
+	if err != nil {
+		return false, timeoutError(err)
+	}
+	if !outdatedEncryption(strategy, version) {
+		return false, nil
+	}
+
+	uploadTime, err := parseUpload(upload)
+	if err != nil {
+		return false, err
+	}
+	oldKey, err := documentKey(strategy, version, id, uploadTime)
+	if err != nil {
+		return false, err
+	}
+	newStrategy, newVersion := encryptionStrategy()
+	newKey, err := documentKey(newStrategy, newVersion, id, uploadTime)
+	if err != nil {
+		return false, err
+	}
+
+	// Documents stored with OriginalOnly have no highlighted content, and their integrity hash covers the original content
+	originalOnly := content == "" && raw.Valid
+	if originalOnly {
+		content = raw.String
+	}
+	plaintext, err := decrypt([]byte(content), oldKey)
+	if err != nil {
+		Log.Errorf("AES error: %s", err)
+		countDecryptionFailure()
+		return false, err
+	}
+	if integrity.Valid && !hmac.Equal([]byte(integrityHash(plaintext, oldKey)), []byte(integrity.String)) {
+		countDecryptionFailure()
+		return false, ErrCorrupted
+	}
+	data, err := encrypt(plaintext, newKey)
+	if err != nil {
+		return false, err
+	}
+	if integrity.Valid || IntegrityCheck {
+		integrity = sql.NullString{String: integrityHash(plaintext, newKey), Valid: true}
+	}
+
+	if originalOnly {
+		raw.String = string(data)
+		data = nil
+	} else if raw.Valid {
+		raw.String, err = reencryptValue(raw.String, oldKey, newKey)
+		if err != nil {
+			return false, err
+		}
+	}
+	if parent.Valid {
+		parent.String, err = reencryptValue(parent.String, oldKey, newKey)
+		if err != nil {
+			return false, err
+		}
+	}
+	if alias.Valid && aliasTarget.Valid {
+		// The alias target is encrypted with a key derived from the alias instead of the ID
+		aliasID := strconv.FormatInt(alias.Int64, 10)
+		oldAliasKey, err := documentKey(strategy, version, aliasID, uploadTime)
+		if err != nil {
+			return false, err
+		}
+		newAliasKey, err := documentKey(newStrategy, newVersion, aliasID, uploadTime)
+		if err != nil {
+			return false, err
+		}
+		aliasTarget.String, err = reencryptValue(aliasTarget.String, oldAliasKey, newAliasKey)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// Only update the document if nobody else re-encrypted it in the meantime
+	ctx, cancel = queryContext()
+	defer cancel()
+	result, err := updateDocument(ctx, shardDB(hex.EncodeToString(databaseID[:])), hex.EncodeToString(databaseID[:]),
+		"UPDATE documents SET content = ?, raw = ?, alias_target = ?, parent = ?, integrity = ?, encryption = ?, key_version = ? WHERE id = ? AND encryption = ? AND key_version = ?",
+		string(data), raw, aliasTarget, parent, integrity, newStrategy, newVersion, hex.EncodeToString(databaseID[:]), strategy, version)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return false, errors.New("the document was changed during re-encryption")
+	}
+	return true, nil
+}
+
+// reencryptValue decrypts a value with the old key and encrypts it with the new key.
+func reencryptValue(value string, oldKey []byte, newKey []byte) (string, error) {
+	plaintext, err := decrypt([]byte(value), oldKey)
+	if err != nil {
+		Log.Errorf("AES error: %s", err)
+		countDecryptionFailure()
+		return "", err
+	}
+	data, err := encrypt(plaintext, newKey)
+	return string(data), err
+}
+
+// ReencryptAll runs Reencrypt for multiple documents and returns the number of re-encrypted documents.
+// As only hashes of the IDs are stored, the IDs have to be supplied by the caller.
+func ReencryptAll(ids []string) int {
+	n := 0
+	start := time.Now()
+	for _, id := range ids {
+		reencrypted, err := Reencrypt(id)
+		if err != nil {
+			Log.Warningf("Couldn't re-encrypt document %s: %s", id, err)
+			continue
+		}
+		if reencrypted {
+			n++
+		}
+	}
+	Log.Infof("Re-encrypted %d of %d documents in %s", n, len(ids), time.Since(start))
+	return n
+}
@@ -0,0 +1,168 @@
+package qbin
+
+import (
+	"database/sql/driver"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// encryptedContent encrypts content like Store() does for the given ID and upload time.
+func encryptedContent(id string, upload string, content string) []byte {
+	uploadTime, _ := time.Parse("2006-01-02 15:04:05", upload)
+	key, _ := deriveKey(id, uploadTime, 0)
+	data, _ := encrypt([]byte(content), key)
+	return data
+}
+
+// documentColumns are the columns selected by Request().
+var documentColumns = []string{"content", "custom", "syntax", "upload", "expiration", "views", "raw", "pending", "highlight_skipped", "encryption", "integrity", "key_version", "content_hash"}
+
+// documentRow returns a row as selected by Request() for a public document without the original content.
+func documentRow(content []byte, custom string, syntax string, upload driver.Value, expiration driver.Value, views int64) *fakeRows {
+	return &fakeRows{columns: documentColumns, values: [][]driver.Value{
+		{content, custom, syntax, upload, expiration, views, nil, nil, int64(0), int64(EncryptionScrypt), nil, int64(0), nil},
+	}}
+}
+
+func TestVolatileConcurrency(t *testing.T) {
+	content := encryptedContent("cornflake-peddling-bp0q", "2018-10-25 16:41:27", "secret")
+
+	var mutex sync.Mutex
+	views := int64(0)
+	exists := true
+	useFakeDB("volatile", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if strings.HasPrefix(query, "SELECT content") {
+			if !exists {
+				return &fakeRows{columns: documentColumns}, nil
+			}
+			return documentRow(content, "", "", "2018-10-25 16:41:27", "1969-12-31 23:59:59", views), nil
+		} else if strings.HasPrefix(query, "UPDATE documents SET views = 1 WHERE id = ? AND views = 0") {
+			if exists && views == 0 {
+				views = 1
+				return &fakeRows{affected: 1}, nil
+			}
+		} else if strings.HasPrefix(query, "DELETE FROM documents WHERE id = ? AND views > 0") {
+			if exists && views > 0 {
+				exists = false
+				return &fakeRows{affected: 1}, nil
+			}
+		}
+		return &fakeRows{}, nil
+	})
+
+	// The uploader's view
+	if _, err := Request("cornflake-peddling-bp0q", false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var wg sync.WaitGroup
+	var successMutex sync.Mutex
+	successes := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doc, err := Request("cornflake-peddling-bp0q", false)
+			if err == nil && doc.Content == "secret" {
+				successMutex.Lock()
+				successes++
+				successMutex.Unlock()
+			} else if err != nil && err != ErrGone && err.Error() != "sql: no rows in result set" {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if successes != 1 {
+		t.Errorf("Volatile document was served %d times (expected: 1)", successes)
+	}
+}
+
+func TestReadOnlyRequest(t *testing.T) {
+	content := encryptedContent("cornflake-peddling-bp0q", "2018-10-25 16:41:27", "Hello World")
+	f := useFakeDB("read-only", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		if strings.HasPrefix(query, "SELECT content") {
+			return documentRow(content, "", "", "2018-10-25 16:41:27", nil, int64(5)), nil
+		}
+		return nil, nil
+	})
+	CountViews = false
+	defer func() { CountViews = true }()
+
+	doc, err := Request("cornflake-peddling-bp0q", false)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if doc.Views != 5 {
+		t.Errorf("Views mismatch, received: %d (expected: 5)", doc.Views)
+	}
+
+	time.Sleep(20 * time.Millisecond) // View counting would happen in the background
+	for _, query := range f.Queries() {
+		if !strings.HasPrefix(query, "SELECT") {
+			t.Errorf("Write query issued in read-only mode: %s", query)
+		}
+	}
+}
+
+func TestReplicaRequest(t *testing.T) {
+	content := encryptedContent("cornflake-peddling-bp0q", "2018-10-25 16:41:27", "Hello World")
+	handler := func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		if strings.HasPrefix(query, "SELECT content") {
+			return documentRow(content, "", "", "2018-10-25 16:41:27", nil, int64(0)), nil
+		}
+		return nil, nil
+	}
+	primary := useFakeDB("replica-primary", handler)
+	var r *fakeDB
+	replica, r = openFakeDB("replica", handler)
+	defer func() { replica = nil }()
+
+	_, err := Request("cornflake-peddling-bp0q", false)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(r.Queries()) != 1 {
+		t.Errorf("Replica received %d queries (expected: 1)", len(r.Queries()))
+	}
+	for _, query := range primary.Queries() {
+		if strings.HasPrefix(query, "SELECT") {
+			t.Errorf("Primary database received a read query: %s", query)
+		}
+	}
+
+	// Replication lag: the replica doesn't know the document yet
+	replica, r = openFakeDB("replica-lagging", nil)
+	ReplicaFallback = true
+	if _, err := Request("cornflake-peddling-bp0q", false); err != nil {
+		t.Errorf("Document wasn't requested from the primary database: %s", err)
+	}
+	ReplicaFallback = false
+	defer func() { ReplicaFallback = true }()
+	if _, err := Request("cornflake-peddling-bp0q", false); err == nil {
+		t.Errorf("Document was requested from the primary database without ReplicaFallback")
+	}
+}
+
+func TestNullUpload(t *testing.T) {
+	content := encryptedContent("cornflake-peddling-bp0q", "2018-10-25 16:41:27", "Hello World")
+	for _, upload := range []driver.Value{nil, "", "0000-00-00 00:00:00"} {
+		useFakeDB("null-upload", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+			if strings.HasPrefix(query, "SELECT content") {
+				return documentRow(content, "", "", upload, nil, int64(0)), nil
+			}
+			return nil, nil
+		})
+		if _, err := Request("cornflake-peddling-bp0q", false); err != ErrInvalidUpload {
+			t.Errorf("Request with upload time %v returned %v (expected: %s)", upload, err, ErrInvalidUpload)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package qbin
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// shards are the databases documents are distributed across by their database ID, in addition to the primary database
+// (which is always the first shard).
+var shards []*sql.DB
+
+// ErrShardingUnsupported is returned by ConnectShards() and ConnectReplica() if a feature requires all documents in one database.
+var ErrShardingUnsupported = errors.New("numeric aliases, collections, the hash chain and replicas can't be used with shards")
+
+// ConnectShards connects to additional MySQL/MariaDB databases, and distributes new documents across the primary database
+// and the shards by their hashed ID. It must be called before Connect(). The list of shards must not change once documents
+// have been stored, as documents would be looked up in the wrong database otherwise. The spam log and certificates are only
+// stored in the primary database.
+func ConnectShards(uris []string) error {
+	if NumericAliases || Collections || HashChain {
+		return ErrShardingUnsupported
+	}
+	connected := []*sql.DB{}
+	for _, uri := range uris {
+		Log.Noticef("Connecting to database shard %d", len(connected)+1)
+		result, err := try(func() (interface{}, error) {
+			s, err := sql.Open("mysql", uri)
+			if err != nil {
+				return nil, err
+			}
+			return s, s.Ping()
+		}, 10, time.Second) // Wait up to 10 seconds for the database
+		if err != nil {
+			return err
+		}
+		if err := setupDocumentsTable(result.(*sql.DB)); err != nil {
+			return err
+		}
+		connected = append(connected, result.(*sql.DB))
+	}
+	shards = connected
+	return nil
+}
+
+// shardDB returns the database which contains the document with the given database ID.
+func shardDB(databaseID string) *sql.DB {
+	if len(shards) == 0 || len(databaseID) < 8 {
+		return db
+	}
+	// The database ID is a hex-encoded SHA256 hash, so its beginning is evenly distributed
+	n, err := strconv.ParseUint(databaseID[:8], 16, 32)
+	if err != nil {
+		return db
+	}
+	if i := n % uint64(len(shards)+1); i > 0 {
+		return shards[i-1]
+	}
+	return db
+}
+
+// eachShard calls the function with every database that contains documents, until it returns an error.
+func eachShard(f func(*sql.DB) error) error {
+	if err := f(db); err != nil {
+		return err
+	}
+	for _, s := range shards {
+		if err := f(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eachReadShard is like eachShard(), but uses the replica if there is one (which is only possible without shards).
+func eachReadShard(f func(*sql.DB) error) error {
+	if len(shards) == 0 {
+		return f(readDB())
+	}
+	return eachShard(f)
+}
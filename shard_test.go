@@ -0,0 +1,64 @@
+package qbin
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"strconv"
+	"testing"
+)
+
+func TestShards(t *testing.T) {
+	defer func() { shards = nil }()
+	second := storedDocumentsDB("shard-1")
+	secondDB := db
+	primary := storedDocumentsDB("shard-0")
+	shards = []*sql.DB{secondDB}
+
+	ids := []string{}
+	for i := 0; i < 30; i++ {
+		doc := Document{Content: "document " + strconv.Itoa(i)}
+		if err := Store(&doc); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, doc.ID)
+	}
+	if len(primary) == 0 || len(second) == 0 || len(primary)+len(second) != len(ids) {
+		t.Fatalf("Documents weren't distributed across the shards: %d and %d", len(primary), len(second))
+	}
+
+	for i, id := range ids {
+		hash := sha256.Sum256([]byte(id))
+		databaseID := hex.EncodeToString(hash[:])
+		_, inPrimary := primary[databaseID]
+		_, inSecond := second[databaseID]
+		if inPrimary == inSecond || inSecond != (shardDB(databaseID) == secondDB) {
+			t.Errorf("Document %s is stored in the wrong shard", id)
+		}
+
+		doc, err := Request(id, true)
+		if err != nil || doc.Content != "document "+strconv.Itoa(i)+"\n" {
+			t.Errorf("Document %s couldn't be read from its shard: %q, %v", id, doc.Content, err)
+		}
+		if exists, err := Exists(id); err != nil || !exists {
+			t.Errorf("Document %s wasn't found in its shard: %v", id, err)
+		}
+	}
+
+	for _, id := range ids[:2] {
+		if err := Delete(id); err != nil {
+			t.Errorf("Document %s couldn't be deleted from its shard: %v", id, err)
+		}
+	}
+	if len(primary)+len(second) != len(ids)-2 {
+		t.Errorf("Deleted documents are still stored")
+	}
+}
+
+func TestShardsUnsupported(t *testing.T) {
+	defer func() { NumericAliases = false }()
+	NumericAliases = true
+	if err := ConnectShards([]string{"qbin:qbin@/shard"}); err != ErrShardingUnsupported {
+		t.Errorf("Shards were connected with numeric aliases: %v", err)
+	}
+}
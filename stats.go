@@ -0,0 +1,96 @@
+package qbin
+
+import (
+	"database/sql"
+	"time"
+)
+
+// StatsIncludeExpired defines if documents that have expired, but haven't been removed by the cleanup yet, are included in the syntax statistics.
+var StatsIncludeExpired = false
+
+// SQL predicates for the states of a document. Volatile documents have an expiration before the Unix epoch (see ParseExpiration).
+const (
+	volatilePredicate = "expiration < '1970-01-01 00:00:01'"
+	expiredPredicate  = "expiration >= '1970-01-01 00:00:01' AND expiration <= CURRENT_TIMESTAMP"
+	livePredicate     = "(expiration IS NULL OR expiration > CURRENT_TIMESTAMP)"
+)
+
+// Document states, see DocumentState().
+const (
+	StateLive     = "live"
+	StateExpired  = "expired"
+	StateVolatile = "volatile"
+)
+
+// DocumentCounts contains the number of public documents in each state.
+type DocumentCounts struct {
+	Live     int `json:"live"`
+	Expired  int `json:"expired"`
+	Volatile int `json:"volatile"`
+}
+
+// DocumentState returns the state of a document with the given expiration, matching the SQL predicates used for the statistics.
+func DocumentState(expiration time.Time) string {
+	if (expiration == time.Time{}) {
+		return StateLive
+	}
+	if expiration.Before(time.Unix(0, 1)) {
+		return StateVolatile
+	}
+	if !expiration.After(time.Now()) {
+		return StateExpired
+	}
+	return StateLive
+}
+
+// DocumentStats counts the public documents in each state. Expired documents are only counted until they are removed by the cleanup.
+func DocumentStats() (DocumentCounts, error) {
+	counts := DocumentCounts{}
+	query := "SELECT " +
+		"COALESCE(SUM(CASE WHEN " + livePredicate + " THEN 1 ELSE 0 END), 0), " +
+		"COALESCE(SUM(CASE WHEN " + expiredPredicate + " THEN 1 ELSE 0 END), 0), " +
+		"COALESCE(SUM(CASE WHEN " + volatilePredicate + " THEN 1 ELSE 0 END), 0) " +
+		"FROM documents WHERE pending IS NULL"
+	ctx, cancel := queryContext()
+	defer cancel()
+	err := eachReadShard(func(handle *sql.DB) error {
+		var live, expired, volatile int
+		err := handle.QueryRowContext(ctx, query).Scan(&live, &expired, &volatile)
+		counts.Live, counts.Expired, counts.Volatile = counts.Live+live, counts.Expired+expired, counts.Volatile+volatile
+		return err
+	})
+	return counts, timeoutError(err)
+}
+
+// SyntaxStats returns the number of public documents per syntax. Documents without a syntax are counted under an empty string.
+// Expired documents are only included with StatsIncludeExpired.
+func SyntaxStats() (map[string]int, error) {
+	query := "SELECT syntax, COUNT(id) FROM documents WHERE pending IS NULL"
+	if !StatsIncludeExpired {
+		query += " AND (" + livePredicate + " OR " + volatilePredicate + ")"
+	}
+	ctx, cancel := queryContext()
+	defer cancel()
+	stats := map[string]int{}
+	err := eachReadShard(func(handle *sql.DB) error {
+		rows, err := handle.QueryContext(ctx, query+" GROUP BY syntax")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var syntax string
+			var count int
+			if err := rows.Scan(&syntax, &count); err != nil {
+				return err
+			}
+			stats[syntax] += count
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, timeoutError(err)
+	}
+	return stats, nil
+}
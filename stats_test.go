@@ -0,0 +1,86 @@
+package qbin
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDocumentState(t *testing.T) {
+	volatile, _ := ParseExpiration("volatile")
+	forever, _ := ParseExpiration("0")
+	tests := map[time.Time]string{
+		volatile:                        StateVolatile,
+		forever:                         StateLive,
+		time.Now().Add(time.Hour):       StateLive,
+		time.Now().Add(-time.Hour):      StateExpired,
+		time.Unix(0, 1):                 StateExpired, // The earliest non-volatile expiration
+		time.Unix(0, 0).Add(-time.Hour): StateVolatile,
+	}
+	for expiration, expected := range tests {
+		if state := DocumentState(expiration); state != expected {
+			t.Errorf("Expiration %s has state %s (expected: %s)", expiration, state, expected)
+		}
+	}
+}
+
+func TestDocumentStates(t *testing.T) {
+	format := func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05") }
+	seeds := []struct {
+		expiration driver.Value
+		state      string
+	}{
+		{nil, StateLive},
+		{format(time.Now().Add(time.Hour)), StateLive},
+		{format(time.Now().Add(-time.Hour)), StateExpired},
+		{"1969-12-31 23:59:59", StateVolatile},
+	}
+	useFakeDB("document-states", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		if strings.HasPrefix(query, "SELECT id, alias, syntax, upload, expiration FROM documents WHERE fingerprint = ?") {
+			rows := &fakeRows{columns: []string{"id", "alias", "syntax", "upload", "expiration"}}
+			for i, seed := range seeds {
+				rows.values = append(rows.values, []driver.Value{string(rune('a' + i)), int64(i), "", "2018-10-25 16:41:27", seed.expiration})
+			}
+			return rows, nil
+		}
+		if strings.HasPrefix(query, "SELECT COALESCE(SUM(CASE WHEN") {
+			if !strings.Contains(query, livePredicate) || !strings.Contains(query, expiredPredicate) || !strings.Contains(query, volatilePredicate) {
+				t.Errorf("Statistics query doesn't use the state predicates: %s", query)
+			}
+			return &fakeRows{columns: []string{"live", "expired", "volatile"}, values: [][]driver.Value{{int64(2), int64(1), int64(1)}}}, nil
+		}
+		return nil, nil
+	})
+
+	documents, err := DocumentsByFingerprint("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, doc := range documents {
+		if doc.State != seeds[i].state {
+			t.Errorf("Document with expiration %v has state %s (expected: %s)", seeds[i].expiration, doc.State, seeds[i].state)
+		}
+	}
+
+	counts, err := DocumentStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts != (DocumentCounts{Live: 2, Expired: 1, Volatile: 1}) {
+		t.Errorf("Unexpected document counts: %+v", counts)
+	}
+}
+
+func TestSyntaxStatsExcludeExpired(t *testing.T) {
+	f := useFakeDB("syntax-stats-expired", nil)
+	SyntaxStats()
+	StatsIncludeExpired = true
+	defer func() { StatsIncludeExpired = false }()
+	SyntaxStats()
+
+	queries := f.Queries()
+	if !strings.Contains(queries[0], livePredicate) || strings.Contains(queries[1], livePredicate) {
+		t.Errorf("Expired documents weren't excluded from the syntax statistics:\n%s\n%s", queries[0], queries[1])
+	}
+}
@@ -0,0 +1,421 @@
+package qbin
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// storeSyntax stores a document using a fake database and returns the syntax written to the database.
+func storeSyntax(t *testing.T, syntax string) string {
+	stored := ""
+	useFakeDB("store-syntax", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		if strings.HasPrefix(query, "INSERT INTO documents") {
+			stored = args[3].Value.(string)
+			return &fakeRows{affected: 1}, nil
+		}
+		return nil, nil
+	})
+
+	doc := Document{Content: "package main", Syntax: syntax}
+	err := Store(&doc)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	return stored
+}
+
+func TestDefaultSyntax(t *testing.T) {
+	DefaultSyntax = "go"
+	defer func() { DefaultSyntax = "" }()
+
+	if syntax := storeSyntax(t, ""); syntax != "go" {
+		t.Errorf("Default syntax wasn't applied, stored: %s", syntax)
+	}
+	if syntax := storeSyntax(t, "javascript"); syntax != "javascript" {
+		t.Errorf("Explicit syntax was overridden, stored: %s", syntax)
+	}
+	if syntax := storeSyntax(t, "none"); syntax != "" {
+		t.Errorf("Explicitly no syntax was overridden, stored: %s", syntax)
+	}
+}
+
+func TestHighlightMaxLines(t *testing.T) {
+	HighlightMaxLines = 3
+	defer func() { HighlightMaxLines = 0 }()
+
+	doc := Document{Content: "# Title\n\n*1*\n\n*2*\n", Syntax: "markdown!"}
+	var mutex sync.Mutex
+	var content, raw driver.Value
+	skipped := false
+	useFakeDB("highlight-max-lines", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if strings.HasPrefix(query, "INSERT INTO documents") {
+			content, raw, skipped = args[1].Value, args[7].Value, args[11].Value.(bool)
+		} else if strings.HasPrefix(query, "SELECT highlight_skipped") {
+			return &fakeRows{columns: []string{"highlight_skipped"}, values: [][]driver.Value{{skipped}}}, nil
+		} else if strings.HasPrefix(query, "SELECT custom, syntax, upload, raw, encryption, key_version") {
+			return &fakeRows{columns: []string{"custom", "syntax", "upload", "raw", "encryption", "key_version"}, values: [][]driver.Value{
+				{"", "markdown!", doc.Upload.UTC().Format("2006-01-02 15:04:05"), raw, int64(EncryptionScrypt), int64(0)},
+			}}, nil
+		} else if strings.HasPrefix(query, "UPDATE documents SET content = ?, highlight_skipped = 0") {
+			content, skipped = args[0].Value, false
+		}
+		return nil, nil
+	})
+
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if !skipped || !doc.HighlightSkipped || raw == nil {
+		t.Fatalf("Highlighting wasn't skipped for a long document (skipped: %t, original stored: %t)", skipped, raw != nil)
+	}
+	if doc.Highlighted != EscapeHTML(doc.Content) {
+		t.Errorf("Unexpected content for a document without highlighting: %q", doc.Highlighted)
+	}
+
+	// Load the highlighting on demand
+	if err := HighlightSkipped(doc.ID); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := deriveKey(doc.ID, doc.Upload, 0)
+	highlighted, err := decrypt([]byte(content.(string)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped || !strings.Contains(string(highlighted), "<h1>Title</h1>") {
+		t.Errorf("Highlighting wasn't stored (skipped: %t): %s", skipped, highlighted)
+	}
+	if err := HighlightSkipped(doc.ID); err != ErrNotSkipped {
+		t.Errorf("Highlighting was loaded twice: %v", err)
+	}
+
+	// Short documents are highlighted immediately
+	doc = Document{Content: "# Title\n", Syntax: "markdown!"}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if skipped || doc.HighlightSkipped {
+		t.Errorf("Highlighting was skipped for a short document")
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	useFakeDB("content-hash", nil)
+
+	a := Document{Content: "Hello World\r\n", Syntax: "none"}
+	b := Document{Content: "Hello World\n\n", Syntax: "none"}
+	c := Document{Content: "Hello World!", Syntax: "none"}
+	for _, doc := range []*Document{&a, &b, &c} {
+		if err := Store(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.ContentHash == "" || a.ContentHash != b.ContentHash {
+		t.Errorf("Identical content has different hashes: %q != %q", a.ContentHash, b.ContentHash)
+	}
+	if a.ID == b.ID {
+		t.Errorf("Identical content has the same ID")
+	}
+	if a.ContentHash == c.ContentHash {
+		t.Errorf("Different content has the same hash: %q", a.ContentHash)
+	}
+
+	// Without the key, nobody can calculate the hash of guessed content
+	defer func() { ContentHashKey = nil }()
+	ContentHashKey = []byte("0123456789abcdef0123456789abcdef")
+	if hash, _ := ContentHash("Hello World", "none"); hash == a.ContentHash {
+		t.Errorf("Content hash doesn't depend on the key")
+	}
+
+	// ANSI escapes are kept in ANSI documents, so they must be part of the hash
+	defer func() { StripANSI = false }()
+	StripANSI = true
+	colored := Document{Content: "\x1b[31mHello World\x1b[0m", Syntax: "ansi"}
+	if err := Store(&colored); err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := ContentHash(colored.Content, "ansi"); hash != colored.ContentHash {
+		t.Errorf("Content hash of an ANSI document differs from the stored one: %q != %q", hash, colored.ContentHash)
+	}
+	if hash, _ := ContentHash("\x1b[31mHello World\x1b[0m", "none"); hash == colored.ContentHash {
+		t.Errorf("ANSI escapes aren't part of the content hash of an ANSI document")
+	}
+}
+
+func TestStoreOriginal(t *testing.T) {
+	defer func() {
+		StoreOriginal, StrictContent, NormalizeLineEndings, VisualizeTrailingWhitespace = false, false, true, false
+	}()
+	StoreOriginal, StrictContent, NormalizeLineEndings, VisualizeTrailingWhitespace = true, true, false, true
+	rows := storedDocumentsDB("store-original")
+
+	content := "\r\npackage main  \r\n\r\nfunc main() {\t\r\n\t// <tag> & \"quotes\"\r\n}\r\n\r\n  "
+	doc := Document{Content: content, Syntax: "go"}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	databaseID := sha256.Sum256([]byte(doc.ID))
+	if rows[hex.EncodeToString(databaseID[:])][6] == nil {
+		t.Fatalf("The original content wasn't stored")
+	}
+
+	requested, err := Request(doc.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requested.Content != content {
+		t.Errorf("Raw content isn't byte-exact: %q (expected: %q)", requested.Content, content)
+	}
+}
+
+func TestRehighlight(t *testing.T) {
+	defer func() { StoreOriginal = false }()
+	StoreOriginal = true
+	rows := storedDocumentsDB("rehighlight")
+
+	documents := []Document{
+		{Content: "# Title\n\n*Some text*\n", Syntax: "markdown!"},
+		{Content: "# Without original\n", Syntax: "markdown!"},
+	}
+	keys := []string{}
+	for i := range documents {
+		if err := Store(&documents[i]); err != nil {
+			t.Fatal(err)
+		}
+		databaseID := sha256.Sum256([]byte(documents[i].ID))
+		keys = append(keys, hex.EncodeToString(databaseID[:]))
+		// Replace the highlighted content, as if it was rendered by an older version
+		rows[keys[i]][0] = string(encryptedContent(documents[i].ID, rows[keys[i]][3].(string), "outdated"))
+	}
+	rows[keys[1]][6] = nil
+
+	if err := Rehighlight(documents[1].ID); err == nil {
+		t.Errorf("A document without the original content was highlighted again")
+	}
+	if n := RehighlightAll([]string{documents[0].ID, documents[1].ID, "missing-document-id"}); n != 1 {
+		t.Errorf("RehighlightAll updated %d documents (expected: 1)", n)
+	}
+	for i, expected := range []string{documents[0].Highlighted, "outdated"} {
+		doc, err := Request(documents[i].ID, false)
+		if err != nil {
+			t.Fatal(err)
+		} else if doc.Content != expected {
+			t.Errorf("Document %d has the highlighted content %q (expected: %q)", i, doc.Content, expected)
+		}
+	}
+}
+
+func TestPopularSyntaxes(t *testing.T) {
+	languages = map[string]bool{"go": true, "python": true, "rust": true, "": true}
+	PopularSyntaxes = []string{"python", "go", "cobol"}
+	defer func() {
+		languages = nil
+		PopularSyntaxes = nil
+	}()
+
+	if syntaxes := strings.Join(AdvertisedSyntaxes(), ","); syntaxes != "go,python" {
+		t.Errorf("Unexpected advertised syntaxes: %s", syntaxes)
+	}
+	if syntaxes := strings.Join(Syntaxes(), ","); syntaxes != "go,markdown!,python,rust" {
+		t.Errorf("Unexpected syntaxes: %s", syntaxes)
+	}
+
+	// Syntaxes that aren't advertised can still be used
+	if !SyntaxExists("rust") {
+		t.Errorf("Syntax that isn't advertised doesn't exist")
+	}
+	if syntax := storeSyntax(t, "rust"); syntax != "rust" {
+		t.Errorf("Syntax that isn't advertised wasn't stored, stored: %s", syntax)
+	}
+}
+
+func TestCustomValues(t *testing.T) {
+	var stored driver.Value
+	useFakeDB("custom-values", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		if strings.HasPrefix(query, "INSERT INTO documents") {
+			stored = args[2].Value
+		}
+		return nil, nil
+	})
+
+	doc := Document{Content: "U2FsdGVkX1+secret", Custom: "encrypted"}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if stored != "encrypted" {
+		t.Errorf("Allowed custom value wasn't stored: %v", stored)
+	}
+
+	stored = nil
+	doc = Document{Content: "Hello World", Custom: "<script>alert(1)</script>"}
+	if err := Store(&doc); err != ErrInvalidCustom {
+		t.Errorf("Unknown custom value returned %v (expected: %s)", err, ErrInvalidCustom)
+	}
+	if stored != nil {
+		t.Errorf("Document with an unknown custom value was stored")
+	}
+
+	CustomValues = append(CustomValues, "template")
+	defer func() { CustomValues = CustomValues[:1] }()
+	if err := Store(&Document{Content: "Hello World", Custom: "template"}); err != nil || stored != "template" {
+		t.Errorf("Configured custom value wasn't stored (error: %v)", err)
+	}
+}
+
+func TestStoreRejectsCheaply(t *testing.T) {
+	defer func(key func([]byte, []byte, int, int, int, int) ([]byte, error)) {
+		scryptKey = key
+		MaxNonPrintableRatio = 0
+		FilterEnable = map[string]bool{}
+		recentSpam.hashes = map[string]time.Time{}
+	}(scryptKey)
+	scryptCalls := 0
+	scryptKey = func(password, salt []byte, N, r, p, keyLen int) ([]byte, error) {
+		scryptCalls++
+		return make([]byte, keyLen), nil
+	}
+	MaxNonPrintableRatio = 0.1
+	FilterEnable = map[string]bool{"linkcount": true}
+
+	for name, doc := range map[string]Document{
+		"too large":      {Content: strings.Repeat("a", MaxFilesize+1), Syntax: "go"},
+		"binary":         {Content: "package main\x00", Syntax: "go"},
+		"non-printable":  {Content: "\x01\x02\x03\x04package main", Syntax: "go"},
+		"spam":           {Content: "http://a.example http://b.example http://c.example", Syntax: "go"},
+		"invalid custom": {Content: "package main", Syntax: "go", Custom: "unknown"},
+	} {
+		scryptCalls = 0
+		fake := useFakeDB("store-rejects-"+name, func(query string, args []driver.NamedValue) (*fakeRows, error) {
+			return &fakeRows{affected: 1}, nil
+		})
+		if err := Store(&doc); err == nil {
+			t.Errorf("%s document was stored", name)
+		}
+		spamWrites.Wait()
+		// Spam is stored in its own table
+		queries := []string{}
+		for _, query := range fake.Queries() {
+			if !strings.HasPrefix(query, "INSERT INTO spam") {
+				queries = append(queries, query)
+			}
+		}
+		if doc.Timing.Highlight != 0 || scryptCalls != 0 || len(queries) != 0 {
+			t.Errorf("%s document reached the expensive steps (highlighting: %s, key derivations: %d, queries: %v)", name, doc.Timing.Highlight, scryptCalls, queries)
+		}
+	}
+}
+
+func TestContentETags(t *testing.T) {
+	defer func() { ContentETags = false }()
+	storedDocumentsDB("content-etags")
+
+	plain := Document{Content: "Hello World", Syntax: "none"}
+	if err := Store(&plain); err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := Request(plain.ID, true); err != nil || doc.ContentHash != "" {
+		t.Errorf("Content hash was stored without ContentETags: %q, %v", doc.ContentHash, err)
+	}
+
+	ContentETags = true
+	content := "package main\r\n\r\nfunc main() {}\r\n"
+	doc := Document{Content: content, Syntax: "go"}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		requested, err := Request(doc.ID, i == 0)
+		if err != nil || requested.ContentHash != doc.ContentHash {
+			t.Errorf("Stored content hash %q differs from the one returned by Store(): %q (error: %v)", requested.ContentHash, doc.ContentHash, err)
+		}
+	}
+
+	// The hash for a conditional upload is the same for the original content
+	hash, err := ContentHash(content, "go")
+	if err != nil || hash != doc.ContentHash {
+		t.Errorf("Content hash for a conditional upload %q differs from the stored one: %q (error: %v)", hash, doc.ContentHash, err)
+	}
+	if exists, err := ContentExists(hash); err != nil || !exists {
+		t.Errorf("Stored content wasn't found (error: %v)", err)
+	}
+	if hash, _ := ContentHash("Hello World", "none"); hash != plain.ContentHash {
+		t.Errorf("Content hash of the same content differs: %q, %q", hash, plain.ContentHash)
+	} else if exists, err := ContentExists(hash); err != nil || exists {
+		t.Errorf("Document stored without ContentETags was found (error: %v)", err)
+	}
+}
+
+func TestRequestByContentHash(t *testing.T) {
+	defer func() { ContentETags, AllowUnencrypted = false, false }()
+	ContentETags, AllowUnencrypted = true, true
+	documents := storedDocumentsDB("content-hash")
+	f := fakeDrivers["content-hash"]
+	documentsHandler := f.handler
+	f.handler = func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		if strings.HasPrefix(query, "SELECT content, raw, expiration FROM documents WHERE content_hash = ? AND encryption = ?") {
+			result := &fakeRows{columns: []string{"content", "raw", "expiration"}}
+			for _, row := range documents {
+				if row[13] == args[0].Value && row[9] == args[1].Value && row[7] == nil {
+					result.values = append(result.values, []driver.Value{row[0], row[6], row[4]})
+				}
+			}
+			return result, nil
+		}
+		return documentsHandler(query, args)
+	}
+
+	public := Document{Content: "package main\n\nfunc main() {}", Syntax: "none", Unencrypted: true}
+	if err := Store(&public); err != nil {
+		t.Fatal(err)
+	}
+	if content, expiration, err := RequestByContentHash(public.ContentHash); err != nil || content != "package main\n\nfunc main() {}\n" || !expiration.IsZero() {
+		t.Errorf("Content hash didn't resolve: %q, %s, %v", content, expiration, err)
+	}
+
+	// Documents that expire can only be cached until then
+	expiring := Document{Content: "Hello World", Syntax: "none", Unencrypted: true, Expiration: time.Now().Add(time.Hour).Truncate(time.Second)}
+	if err := Store(&expiring); err != nil {
+		t.Fatal(err)
+	}
+	if _, expiration, err := RequestByContentHash(expiring.ContentHash); err != nil || !expiration.Equal(expiring.Expiration) {
+		t.Errorf("Expiration of the content hash is %s (expected: %s), %v", expiration, expiring.Expiration, err)
+	}
+
+	// Encrypted documents can't be served without their ID
+	encrypted := Document{Content: "secret", Syntax: "none"}
+	if err := Store(&encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := RequestByContentHash(encrypted.ContentHash); err != sql.ErrNoRows {
+		t.Errorf("Encrypted document was found by its content hash: %v", err)
+	}
+	if _, _, err := RequestByContentHash(strings.Repeat("0", 32)); err != sql.ErrNoRows {
+		t.Errorf("Unknown content hash returned %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	storedDocumentsDB("delete")
+
+	doc := Document{Content: "delete me"}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := Delete(doc.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Request(doc.ID, true); err != sql.ErrNoRows {
+		t.Errorf("Deleted document can still be requested: %v", err)
+	}
+	if err := Delete(doc.ID); err != sql.ErrNoRows {
+		t.Errorf("Deleting a missing document returned %v", err)
+	}
+}
@@ -100,11 +100,28 @@ func handleMsgProcessing(conn net.Conn, msg string, root string) {
 		Expiration: defaultExpiration,
 		Views:      1,
 	}
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		if qbin.CheckCountry(host) == qbin.ErrBlockedCountry {
+			conn.Write([]byte("Uploading documents isn't allowed from your country.\n"))
+			return
+		}
+		doc.Fingerprint = qbin.Fingerprint(host, "")
+	}
 
 	err := qbin.Store(&doc)
 	if err != nil {
-		if err.Error() == "file contains 0x00 bytes" {
+		if err == qbin.ErrTooLarge {
+			conn.Write([]byte("Maximum document size exceeded.\n"))
+		} else if err == qbin.ErrBinaryContent {
 			conn.Write([]byte("You are trying to upload a binary file, which is not supported.\n"))
+		} else if err == qbin.ErrNonPrintableContent {
+			conn.Write([]byte("Your file consists mostly of non-printable characters, which is not supported.\n"))
+		} else if err == qbin.ErrInsufficientStorage {
+			conn.Write([]byte("The server is out of storage, please try again later.\n"))
+		} else if err == qbin.ErrQuotaExceeded {
+			conn.Write([]byte("You've reached your storage quota, please try again when some of your documents have expired.\n"))
+		} else if err == qbin.ErrRepeatedSpam {
+			conn.Write([]byte("Slow down, you've already sent that document and it got caught in the spam filter.\n"))
 		} else if strings.HasPrefix(err.Error(), "spam: ") {
 			conn.Write([]byte("Your file got caught in the spam filter.\nReason: " + strings.TrimPrefix(err.Error(), "spam: ") + "\n"))
 		} else {
@@ -116,5 +133,8 @@ func handleMsgProcessing(conn net.Conn, msg string, root string) {
 
 	// Send URL back
 	reply := root + "/" + doc.ID + "\n"
+	if doc.ConfirmationToken != "" {
+		reply += "Confirmation token: " + doc.ConfirmationToken + "\n"
+	}
 	conn.Write([]byte(reply))
 }
@@ -0,0 +1,87 @@
+package qbin
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ViewFlushInterval defines how long view counts are collected in memory before they are written to the database.
+// This reduces the write load for popular documents, but the view count returned by Request() is only eventually correct.
+// 0 writes every view immediately.
+var ViewFlushInterval time.Duration
+
+// ViewFlushThreshold defines after how many collected views they are written to the database, even if ViewFlushInterval hasn't passed yet.
+var ViewFlushThreshold = 1000
+
+// MaxTrackedViews stops counting the views of a document once it has this many, which avoids pointless writes for viral
+// documents. FormatViews() shows the capped view count as e.g. "10000+". 0 counts all views.
+var MaxTrackedViews int
+
+var pendingViews = map[string]int{}
+var pendingViewsTotal int
+var pendingViewsMutex sync.Mutex
+
+// countView increments the view counter of a document (by its database ID), either immediately or batched. The new view
+// count (views is the count stored in the database) is published to SubscribeViews() subscribers.
+func countView(databaseID string, views int) {
+	if MaxTrackedViews > 0 && views >= MaxTrackedViews {
+		return
+	}
+	if ViewFlushInterval <= 0 {
+		go shardDB(databaseID).Exec("UPDATE documents SET views = views + 1 WHERE id = ?", databaseID)
+		publishViews(databaseID, views+1)
+		return
+	}
+
+	pendingViewsMutex.Lock()
+	if MaxTrackedViews > 0 && views+pendingViews[databaseID] >= MaxTrackedViews {
+		pendingViewsMutex.Unlock()
+		return
+	}
+	pendingViews[databaseID]++
+	pendingViewsTotal++
+	pending := pendingViews[databaseID]
+	full := pendingViewsTotal >= ViewFlushThreshold
+	pendingViewsMutex.Unlock()
+	publishViews(databaseID, views+pending)
+
+	if full {
+		go FlushViews()
+	}
+}
+
+// FormatViews formats a view count for display, as MaxTrackedViews with a "+" if the count has reached it.
+func FormatViews(views int) string {
+	if MaxTrackedViews > 0 && views >= MaxTrackedViews {
+		return strconv.Itoa(MaxTrackedViews) + "+"
+	}
+	return strconv.Itoa(views)
+}
+
+// FlushViews writes all collected views to the database. It must be called before shutting down to avoid losing views.
+func FlushViews() {
+	pendingViewsMutex.Lock()
+	views := pendingViews
+	pendingViews = map[string]int{}
+	pendingViewsTotal = 0
+	pendingViewsMutex.Unlock()
+
+	for id, n := range views {
+		_, err := shardDB(id).Exec("UPDATE documents SET views = views + ? WHERE id = ?", n, id)
+		if err != nil {
+			Log.Errorf("Couldn't write %d views: %s", n, err)
+		}
+	}
+	if len(views) > 0 {
+		Log.Debugf("Wrote views of %d documents.", len(views))
+	}
+}
+
+// flushViewsPeriodically calls FlushViews every ViewFlushInterval.
+func flushViewsPeriodically() {
+	for {
+		time.Sleep(ViewFlushInterval)
+		FlushViews()
+	}
+}
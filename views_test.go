@@ -0,0 +1,139 @@
+package qbin
+
+import (
+	"database/sql/driver"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatchedViews(t *testing.T) {
+	ViewFlushInterval = time.Hour
+	ViewFlushThreshold = 1000
+	defer func() { ViewFlushInterval = 0 }()
+
+	var mutex sync.Mutex
+	updates := 0
+	views := map[string]int64{}
+	useFakeDB("batched-views", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if strings.HasPrefix(query, "UPDATE documents SET views = views + ? WHERE id = ?") {
+			updates++
+			views[args[1].Value.(string)] += args[0].Value.(int64)
+			return &fakeRows{affected: 1}, nil
+		}
+		return nil, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() { defer wg.Done(); countView("a", 0) }()
+		go func() { defer wg.Done(); countView("b", 0) }()
+	}
+	wg.Wait()
+	countView("c", 0)
+
+	mutex.Lock()
+	if updates != 0 {
+		t.Errorf("Views were written before the flush")
+	}
+	mutex.Unlock()
+
+	FlushViews()
+	if views["a"] != 50 || views["b"] != 50 || views["c"] != 1 {
+		t.Errorf("Unexpected view counts after flush: %v", views)
+	}
+	if updates != 3 {
+		t.Errorf("Flush used %d updates (expected: 3)", updates)
+	}
+
+	// Nothing must be written twice
+	FlushViews()
+	if updates != 3 || views["a"] != 50 {
+		t.Errorf("Views were written again by the second flush: %v", views)
+	}
+}
+
+func TestViewFlushThreshold(t *testing.T) {
+	ViewFlushInterval = time.Hour
+	ViewFlushThreshold = 10
+	defer func() {
+		ViewFlushInterval = 0
+		ViewFlushThreshold = 1000
+	}()
+
+	flushed := make(chan int64, 1)
+	useFakeDB("view-threshold", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		if strings.HasPrefix(query, "UPDATE documents SET views = views + ?") {
+			flushed <- args[0].Value.(int64)
+		}
+		return nil, nil
+	})
+
+	for i := 0; i < 10; i++ {
+		countView("a", 0)
+	}
+	select {
+	case n := <-flushed:
+		if n != 10 {
+			t.Errorf("Flushed %d views (expected: 10)", n)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Views weren't flushed after reaching the threshold")
+	}
+}
+
+func TestMaxTrackedViews(t *testing.T) {
+	MaxTrackedViews = 10000
+	defer func() {
+		MaxTrackedViews = 0
+		ViewFlushInterval = 0
+	}()
+
+	var mutex sync.Mutex
+	views := map[string]int64{}
+	useFakeDB("max-tracked-views", func(query string, args []driver.NamedValue) (*fakeRows, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if strings.HasPrefix(query, "UPDATE documents SET views = views + 1 WHERE id = ?") {
+			views[args[0].Value.(string)]++
+		} else if strings.HasPrefix(query, "UPDATE documents SET views = views + ? WHERE id = ?") {
+			views[args[1].Value.(string)] += args[0].Value.(int64)
+		}
+		return &fakeRows{affected: 1}, nil
+	})
+
+	// Counting stops at the cap
+	countView("a", 9999)
+	countView("b", 10000)
+	countView("c", 12345)
+	time.Sleep(100 * time.Millisecond)
+	mutex.Lock()
+	if views["a"] != 1 || views["b"] != 0 || views["c"] != 0 {
+		t.Errorf("Unexpected views with MaxTrackedViews: %v", views)
+	}
+	mutex.Unlock()
+
+	// Batched views stop at the cap, too
+	ViewFlushInterval = time.Hour
+	for i := 0; i < 5; i++ {
+		countView("d", 9997)
+	}
+	FlushViews()
+	if views["d"] != 3 {
+		t.Errorf("Batched views exceeded the cap: %d (expected: 3)", views["d"])
+	}
+
+	for views, expected := range map[int]string{0: "0", 9999: "9999", 10000: "10000+", 10003: "10000+"} {
+		if formatted := FormatViews(views); formatted != expected {
+			t.Errorf("Formatted %d views as %q (expected: %q)", views, formatted, expected)
+		}
+	}
+	MaxTrackedViews = 0
+	if formatted := FormatViews(10003); formatted != "10003" {
+		t.Errorf("Formatted views as %q without a cap", formatted)
+	}
+}
@@ -0,0 +1,29 @@
+package qbin
+
+import (
+	"regexp"
+	"strings"
+)
+
+// VisualizeTrailingWhitespace makes Highlight() replace trailing spaces and tabs with visible markers in a
+// <span class="trailing-whitespace">, so whitespace problems can be spotted in the browser. The original content of those
+// documents is stored next to the highlighted one, so the raw document still contains the exact whitespace.
+var VisualizeTrailingWhitespace = false
+
+// trailingWhitespace matches the whitespace at the end of a highlighted line, followed by the tags closed on that line.
+var trailingWhitespace = regexp.MustCompile(`[ \t]+((?:</span>)*)$`)
+
+// visualizeTrailingWhitespace marks the trailing whitespace of every line in highlighted HTML, and returns the HTML unchanged
+// if there is none.
+func visualizeTrailingWhitespace(highlighted string) string {
+	lines := strings.Split(highlighted, "\n")
+	for i, line := range lines {
+		match := trailingWhitespace.FindStringSubmatchIndex(line)
+		if match == nil {
+			continue
+		}
+		marker := strings.NewReplacer(" ", "·", "\t", "→").Replace(line[match[0]:match[2]])
+		lines[i] = line[:match[0]] + `<span class="trailing-whitespace">` + marker + "</span>" + line[match[2]:]
+	}
+	return strings.Join(lines, "\n")
+}
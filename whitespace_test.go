@@ -0,0 +1,90 @@
+package qbin
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakePrism starts a prism-server replacement that escapes the content without highlighting it, and returns a function to stop it.
+func fakePrism(t *testing.T) func() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := PrismServer
+	PrismServer = listener.Addr().String()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			request, _ := bufio.NewReader(conn).ReadString(0)
+			content := strings.SplitN(strings.TrimSuffix(request, "\x00"), "\n", 2)[1]
+			conn.Write([]byte(`<span class="token">` + strings.Replace(EscapeHTML(content), "\n", "</span>\n", -1) + "\x00"))
+			conn.Close()
+		}
+	}()
+	return func() {
+		listener.Close()
+		PrismServer = previous
+	}
+}
+
+func TestVisualizeTrailingWhitespace(t *testing.T) {
+	tests := map[string]string{
+		"func main() {  ":                         `func main() {<span class="trailing-whitespace">··</span>`,
+		"x := 1\t </span></span>":                 `x := 1<span class="trailing-whitespace">→·</span></span></span>`,
+		"  indented":                              "  indented",
+		"a  b</span>":                             "a  b</span>",
+		"first \nsecond\n   \n":                   "first<span class=\"trailing-whitespace\">·</span>\nsecond\n<span class=\"trailing-whitespace\">···</span>\n",
+		`<span class="line-number"></span>end   `: `<span class="line-number"></span>end<span class="trailing-whitespace">···</span>`,
+	}
+	for highlighted, expected := range tests {
+		if result := visualizeTrailingWhitespace(highlighted); result != expected {
+			t.Errorf("Visualized %q as %q (expected: %q)", highlighted, result, expected)
+		}
+	}
+}
+
+func TestTrailingWhitespaceRaw(t *testing.T) {
+	defer fakePrism(t)()
+	defer func() { VisualizeTrailingWhitespace = false }()
+	VisualizeTrailingWhitespace = true
+	storedDocumentsDB("trailing-whitespace")
+
+	doc := Document{Content: "package main  \n\nfunc main() {}\t\n", Syntax: "go"}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := Request(doc.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.Content != "package main  \n\nfunc main() {}\t\n" {
+		t.Errorf("Raw content doesn't preserve the trailing whitespace: %q", raw.Content)
+	}
+	highlighted, err := Request(doc.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(highlighted.Content, `package main<span class="trailing-whitespace">··</span></span>`) ||
+		!strings.Contains(highlighted.Content, `func main() {}<span class="trailing-whitespace">→</span></span>`) {
+		t.Errorf("Highlighted content doesn't visualize the trailing whitespace: %q", highlighted.Content)
+	}
+
+	// Documents without trailing whitespace don't need the original content
+	documents := storedDocumentsDB("no-trailing-whitespace")
+	doc = Document{Content: "package main\n", Syntax: "go"}
+	if err := Store(&doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range documents {
+		if row[6] != nil {
+			t.Errorf("Original content was stored without trailing whitespace")
+		}
+	}
+}